@@ -0,0 +1,5 @@
+-- spatial index used by QueryPostersInBounds.
+-- innodb will only use a spatial index on a NOT NULL geometry column with a fixed SRID,
+-- posters are inserted with point(lng, lat) which has SRID 0
+alter table fyp_schema.posters modify location point not null srid 0;
+create spatial index posters_location_idx on fyp_schema.posters (location);
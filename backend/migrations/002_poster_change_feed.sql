@@ -0,0 +1,15 @@
+-- per party change sequence used by the RetrieveUpdates cursor and WatchPosters.
+-- resyncSeq is raised when posters leave a party, cursors older than it can't be followed any more
+alter table fyp_schema.parties
+    add column changeSeq bigint not null default 0,
+    add column resyncSeq bigint not null default 0;
+alter table fyp_schema.posters add column changeSeq bigint not null default 0;
+create index posters_change_idx on fyp_schema.posters (partyId, changeSeq, posterId);
+
+-- number existing posters in the order they were last updated
+update fyp_schema.posters as p
+    join (select posterId, row_number() over (partition by partyId order by updated, posterId) as seq from fyp_schema.posters) as s
+    on p.posterId = s.posterId
+set p.changeSeq = s.seq;
+update fyp_schema.parties as p
+set p.changeSeq = (select coalesce(max(changeSeq), 0) from fyp_schema.posters where partyId = p.partyID);
@@ -0,0 +1,11 @@
+-- history of posters moved with MovePoster
+create table fyp_schema.posterMoves (
+    id          int auto_increment primary key,
+    posterId    int not null,
+    movedBy     int not null,
+    moved       timestamp not null default current_timestamp,
+    oldLocation point not null,
+    newLocation point not null,
+    distance    double not null,
+    index posterMoves_poster_idx (posterId)
+);
@@ -0,0 +1,24 @@
+-- areas where posters must not be placed. zones without a partyId apply to every party
+create table fyp_schema.exclusionZones (
+    zoneId      int auto_increment primary key,
+    partyId     int null,
+    name        varchar(255) not null,
+    -- ZoneEnforcement value from messages.proto
+    enforcement tinyint not null default 0,
+    area        geometry not null srid 0,
+    created     timestamp not null default current_timestamp,
+    createdBy   int null,
+    spatial index exclusionZones_area_idx (area),
+    index exclusionZones_party_idx (partyId)
+);
+
+-- problems found with a poster when it was placed, e.g. being inside a flagged exclusion zone
+create table fyp_schema.posterViolations (
+    id       int auto_increment primary key,
+    posterId int not null,
+    source   varchar(32) not null,
+    sourceId int null,
+    detail   varchar(255) not null,
+    created  timestamp not null default current_timestamp,
+    index posterViolations_poster_idx (posterId)
+);
@@ -0,0 +1,16 @@
+-- local authority boundaries and the poster rules that apply inside them. rules that are null do not apply
+create table fyp_schema.jurisdictions (
+    jurisdictionId      int auto_increment primary key,
+    name                varchar(255) not null,
+    area                geometry not null srid 0,
+    placementDaysBefore int null,
+    removalDaysAfter    int null,
+    maxHeightCm         int null,
+    permitRequired      boolean not null default false,
+    spatial index jurisdictions_area_idx (area)
+);
+
+alter table fyp_schema.posters
+    add column jurisdictionId int null,
+    add column heightCm int not null default 0,
+    add column permitNumber varchar(64) not null default '';
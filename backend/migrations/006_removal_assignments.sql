@@ -0,0 +1,18 @@
+-- outstanding posters split up between members for removal. progress comes from posters.removed
+create table fyp_schema.removalAssignments (
+    assignmentId int auto_increment primary key,
+    partyId      int not null,
+    name         varchar(255) not null,
+    -- null when the assignment is not given to a member
+    assigneeId   int null,
+    created      timestamp not null default current_timestamp,
+    createdBy    int not null,
+    index removalAssignments_assignee_idx (partyId, assigneeId)
+);
+
+-- a poster can only be in one assignment
+create table fyp_schema.removalAssignmentPosters (
+    assignmentId int not null,
+    posterId     int not null primary key,
+    index removalAssignmentPosters_assignment_idx (assignmentId)
+);
@@ -0,0 +1,20 @@
+-- locations where a party plans to put up posters before an election
+create table fyp_schema.plannedSites (
+    siteId    int auto_increment primary key,
+    partyId   int not null,
+    location  point not null srid 0,
+    quantity  int not null default 1,
+    candidate varchar(255) not null default '',
+    -- the volunteer who has said they will put up the posters
+    claimedBy int null,
+    claimed   timestamp null,
+    created   timestamp not null default current_timestamp,
+    createdBy int not null,
+    spatial index plannedSites_location_idx (location),
+    index plannedSites_party_idx (partyId, claimedBy)
+);
+
+-- set by PlacePoster when a poster is placed close to a site the volunteer claimed
+alter table fyp_schema.posters
+    add column plannedSiteId int null,
+    add index posters_plannedSite_idx (plannedSiteId);
@@ -0,0 +1,29 @@
+create table fyp_schema.posterDesigns (
+    designId          int auto_increment primary key,
+    partyId           int not null,
+    name              varchar(255) not null,
+    lowStockThreshold int not null default 0,
+    created           timestamp not null default current_timestamp,
+    index posterDesigns_party_idx (partyId)
+);
+
+-- every movement of posters in or out of a partys stock. stock levels are sums over the ledger
+create table fyp_schema.inventoryLedger (
+    entryId   int auto_increment primary key,
+    partyId   int not null,
+    designId  int not null,
+    -- InventoryKind value from messages.proto
+    kind      tinyint not null,
+    quantity  int not null,
+    -- the volunteer whose stock the entry is for, null for the partys own stock
+    userId    int null,
+    -- set for entries recorded by PlacePoster
+    posterId  int null,
+    created   timestamp not null default current_timestamp,
+    createdBy int not null,
+    index inventoryLedger_design_idx (partyId, designId),
+    index inventoryLedger_user_idx (partyId, userId)
+);
+
+alter table fyp_schema.posters
+    add column designId int null;
@@ -0,0 +1,10 @@
+-- local authority enforcement officers. regulators are not members of a party, they can read the posters of
+-- every party inside their jurisdiction but nothing about the members who placed them
+create table fyp_schema.regulators (
+    regulatorId    int auto_increment primary key,
+    username       varchar(255) not null unique,
+    pwhash         varchar(255) not null,
+    jurisdictionId int not null,
+    created        timestamp not null default current_timestamp,
+    foreign key (jurisdictionId) references fyp_schema.jurisdictions (jurisdictionId)
+);
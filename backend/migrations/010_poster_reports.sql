@@ -0,0 +1,20 @@
+-- reports from members of the public about posters. a report is matched to the nearest poster that is still up,
+-- it is resolved when that poster is removed or a party admin dismisses it.
+-- reporters get a status token, only its sha256 is stored
+create table fyp_schema.posterReports (
+    reportId        int auto_increment primary key,
+    statusTokenHash char(64) not null unique,
+    location        point not null srid 0,
+    description     text not null,
+    photo           mediumblob null,
+    photoType       varchar(32) not null default '',
+    -- null if no poster was close enough to the report
+    posterId        int null,
+    partyId         int null,
+    distance        double null,
+    reported        timestamp not null default current_timestamp,
+    dismissed       timestamp null,
+    dismissedBy     int null,
+    dismissReason   varchar(255) not null default '',
+    index posterReports_party_idx (partyId, dismissed)
+);
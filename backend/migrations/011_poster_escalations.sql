@@ -0,0 +1,17 @@
+-- steps taken by the escalation scheduler as posters approach and pass their removal deadline.
+-- step is the EscalationStep enum, level counts repeated escalations to admins
+create table fyp_schema.posterEscalations (
+    escalationId int auto_increment primary key,
+    posterId     int not null,
+    partyId      int not null,
+    step         tinyint not null,
+    level        int not null default 0,
+    recipientId  int not null,
+    deadline     timestamp not null,
+    created      timestamp not null default current_timestamp,
+    unique posterEscalations_step_idx (posterId, step, level),
+    index posterEscalations_party_idx (partyId, recipientId)
+);
+
+-- the last step the placer was told about, null if the poster is not close to its deadline
+alter table fyp_schema.posters add column escalationStatus tinyint null;
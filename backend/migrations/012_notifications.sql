@@ -0,0 +1,30 @@
+-- where users want to be notified. channel is the NotificationChannel enum and address is an email address,
+-- webhook url or push device token depending on the channel
+create table fyp_schema.notificationChannels (
+    userId  int not null,
+    channel tinyint not null,
+    address varchar(4096) not null,
+    primary key (userId, channel)
+);
+
+-- NotificationEvent values a user does not want to be notified about on any channel
+create table fyp_schema.notificationMutes (
+    userId int not null,
+    event  tinyint not null,
+    primary key (userId, event)
+);
+
+-- every attempt to deliver a notification, error is empty when it was delivered
+create table fyp_schema.notificationLog (
+    notificationId bigint auto_increment primary key,
+    userId         int not null,
+    event          tinyint not null,
+    channel        tinyint not null,
+    address        varchar(4096) not null,
+    subject        varchar(255) not null,
+    body           text not null,
+    delivered      bool not null,
+    error          varchar(1024) not null default '',
+    created        timestamp not null default current_timestamp,
+    index notificationLog_user_idx (userId, created)
+);
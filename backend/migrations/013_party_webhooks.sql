@@ -0,0 +1,44 @@
+-- urls party admins registered to be told about party events. secret is used to sign every payload
+create table fyp_schema.partyWebhooks (
+    webhookId int auto_increment primary key,
+    partyId   int not null,
+    url       varchar(2048) not null,
+    secret    char(64) not null,
+    createdBy int not null,
+    created   timestamp not null default current_timestamp,
+    index partyWebhooks_party_idx (partyId)
+);
+
+-- WebhookEvent values each webhook is sent
+create table fyp_schema.partyWebhookEvents (
+    webhookId int not null,
+    event     tinyint not null,
+    primary key (webhookId, event)
+);
+
+-- an event to deliver to a webhook. nextAttempt is null once it was delivered or retries ran out
+create table fyp_schema.webhookDeliveries (
+    deliveryId  bigint auto_increment primary key,
+    webhookId   int not null,
+    partyId     int not null,
+    event       tinyint not null,
+    payload     mediumtext not null,
+    created     timestamp not null default current_timestamp,
+    retries     int not null default 0,
+    nextAttempt timestamp null,
+    delivered   timestamp null,
+    lastError   varchar(1024) not null default '',
+    index webhookDeliveries_due_idx (nextAttempt),
+    index webhookDeliveries_party_idx (partyId, webhookId)
+);
+
+-- every attempt to deliver an event. statusCode is 0 if no response was received
+create table fyp_schema.webhookAttempts (
+    attemptId  bigint auto_increment primary key,
+    deliveryId bigint not null,
+    attempted  timestamp not null default current_timestamp,
+    statusCode int not null,
+    error      varchar(1024) not null default '',
+    durationMs int not null,
+    index webhookAttempts_delivery_idx (deliveryId)
+);
@@ -0,0 +1,13 @@
+-- domain events written in the same transaction as the change that caused them.
+-- the dispatcher publishes them in eventId order and sets dispatched once every subscriber has handled them
+create table fyp_schema.outboxEvents (
+    eventId    bigint auto_increment primary key,
+    kind       varchar(32) not null,
+    partyId    int not null,
+    payload    mediumtext not null,
+    created    timestamp not null default current_timestamp,
+    attempts   int not null default 0,
+    lastError  varchar(1024) not null default '',
+    dispatched timestamp null,
+    index outboxEvents_pending_idx (dispatched, eventId)
+);
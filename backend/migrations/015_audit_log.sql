@@ -0,0 +1,15 @@
+-- administrative actions, written in the same transaction as the action.
+-- beforeValue and afterValue are json encoded values and null when there was no value
+create table fyp_schema.auditLog (
+    auditId     bigint auto_increment primary key,
+    action      tinyint not null,
+    partyId     int not null,
+    actorId     int not null,
+    targetId    int not null default 0,
+    ip          varchar(64) not null default '',
+    beforeValue text null,
+    afterValue  text null,
+    created     timestamp not null default current_timestamp,
+    index auditLog_party_idx (partyId, auditId),
+    index auditLog_actor_idx (partyId, actorId, auditId)
+);
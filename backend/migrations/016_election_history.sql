@@ -0,0 +1,26 @@
+-- elections were keyed by partyId so replace into only ever kept one per party. every election is kept now and
+-- closed once its posters are dealt with. openPartyId makes sure a party has at most one open election
+alter table fyp_schema.elections
+    drop primary key,
+    add column electionId int auto_increment primary key first,
+    add column name varchar(255) not null default '',
+    add column created timestamp not null default current_timestamp,
+    add column closed timestamp null,
+    add column closedBy int null,
+    add column openPartyId int as (if(closed is null, partyId, null)) stored,
+    add unique index elections_open_idx (openPartyId),
+    add index elections_party_idx (partyId, electionId);
+
+-- the final state of every poster that was up during an election, copied when the election is closed
+create table fyp_schema.electionPosters (
+    electionId      int not null,
+    posterId        int not null,
+    userId          int not null,
+    location        point not null,
+    jurisdictionId  int null,
+    created         timestamp not null,
+    removed         timestamp null,
+    removedBy       int null,
+    removalDeadline timestamp null,
+    primary key (electionId, posterId)
+);
@@ -0,0 +1,18 @@
+-- removal grace period of each ElectionType, the number of days after polling day posters must be removed by.
+-- change removalDaysAfter here to change the grace period of elections created afterwards
+create table fyp_schema.electionTypes (
+    electionType     tinyint primary key,
+    name             varchar(64) not null,
+    removalDaysAfter int not null
+);
+insert into fyp_schema.electionTypes (electionType, name, removalDaysAfter) values
+    (0, 'general', 7),
+    (1, 'local', 7),
+    (2, 'european', 7),
+    (3, 'referendum', 7),
+    (4, 'by-election', 7);
+
+-- elections keep the grace period they were created with so changing a type doesn't move existing deadlines
+alter table fyp_schema.elections
+    add column electionType tinyint not null default 0,
+    add column removalDaysAfter int not null default 7;
@@ -0,0 +1,4 @@
+-- bit i is set once the dispatcher's i-th subscriber has handled the event, so a failing subscriber is retried
+-- on its own instead of every subscriber seeing the event again
+alter table fyp_schema.outboxEvents
+    add column handled bigint not null default 0;
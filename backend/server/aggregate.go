@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	maxZoom = 22
+	// posters have to be removed by the deadline of their jurisdiction, or by the grace period of the election type if
+	// their jurisdiction has no rule. null if the party has no open election. l1 is posters, l2 jurisdictions and l3 elections
+	posterDeadlineExpression = "date_add(l3.endDate, interval coalesce(l2.removalDaysAfter, l3.removalDaysAfter) day)"
+	posterOverdueCondition   = "l1.removed is null and now() > " + posterDeadlineExpression
+	// sum() is null for cells with no matching posters
+	aggregatePostersQuery = fmt.Sprintf(`select ST_GeoHash(l1.location, ?) as cell, count(*),
+							coalesce(sum(l1.removed is not null), 0),
+							coalesce(sum(%s), 0),
+							avg(st_y(l1.location)), avg(st_x(l1.location))
+							from fyp_schema.posters as l1
+							left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							left join fyp_schema.elections as l3 on l1.partyId = l3.partyId and l3.closed is null
+							where l1.partyId = ? and MBRContains(ST_MakeEnvelope(point(?,?), point(?,?)), l1.location)
+							group by cell
+							order by cell`, posterOverdueCondition)
+)
+
+// AggregatePosters counts the posters in each geohash cell of a bounding box so zoomed out maps can draw
+// clusters instead of thousands of markers.
+func (s *server) AggregatePosters(ctx context.Context, in *pb.AggregateRequest) (*pb.AggregateResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetBounds() == nil {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("bounding box not set")
+	}
+	if err := validBoundingBox(in.GetBounds()); err != nil {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	if in.GetZoom() < 0 || int(in.GetZoom()) > maxZoom {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("zoom must be between 0 and %d", maxZoom)
+	}
+
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	precision := geoService.GeohashPrecision(int(in.GetZoom()))
+	sw, ne := in.GetBounds().GetSouthWest(), in.GetBounds().GetNorthEast()
+	rows, err := s.DB.Query(aggregatePostersQuery, precision, in.GetPartyId(), sw.GetLng(), sw.GetLat(), ne.GetLng(), ne.GetLat())
+	if err != nil {
+		return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to aggregate posters: %v", err)
+	}
+	defer rows.Close()
+
+	var cells []*pb.PosterCell
+	for rows.Next() {
+		var geohash string
+		var total, removed, overdue int32
+		var centroid pb.Location
+		err = rows.Scan(&geohash, &total, &removed, &overdue, &centroid.Lat, &centroid.Lng)
+		if err != nil {
+			return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read poster cells from sql result: %v", err)
+		}
+		cellSW, cellNE, err := geoService.DecodeGeohash(geohash)
+		if err != nil {
+			return &pb.AggregateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read poster cells from sql result: %v", err)
+		}
+		cells = append(cells, &pb.PosterCell{
+			Geohash: geohash,
+			Bounds: &pb.BoundingBox{
+				SouthWest: &pb.Location{Lat: cellSW.Lat, Lng: cellSW.Lng},
+				NorthEast: &pb.Location{Lat: cellNE.Lat, Lng: cellNE.Lng},
+			},
+			Centroid: &pb.Location{Lat: centroid.Lat, Lng: centroid.Lng},
+			Up:       total - removed - overdue,
+			Removed:  removed,
+			Overdue:  overdue,
+		})
+	}
+	return &pb.AggregateResponse{Code: pb.ResponseCode_OK, Cells: cells, Precision: int32(precision)}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestAggregatePosters(t *testing.T) {
+	bounds := &pb.BoundingBox{SouthWest: &pb.Location{Lat: 53.3, Lng: -6.3}, NorthEast: &pb.Location{Lat: 53.4, Lng: -6.2}}
+	columns := []string{"cell", "total", "removed", "overdue", "latitude", "longitude"}
+	tests := []struct {
+		name          string
+		userId        int32
+		partyId       int32
+		bounds        *pb.BoundingBox
+		zoom          int32
+		wantPrecision int
+		cellRows      *sqlmock.Rows
+		wantErr       bool
+		wantCode      pb.ResponseCode
+		wantCells     []*pb.PosterCell
+	}{
+		{
+			name:     "bounds not set",
+			userId:   1,
+			partyId:  1,
+			zoom:     12,
+			cellRows: sqlmock.NewRows(columns),
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "zoom too high",
+			userId:   1,
+			partyId:  1,
+			bounds:   bounds,
+			zoom:     23,
+			cellRows: sqlmock.NewRows(columns),
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:          "invalid geohash from database",
+			userId:        1,
+			partyId:       1,
+			bounds:        bounds,
+			zoom:          12,
+			wantPrecision: 5,
+			cellRows:      sqlmock.NewRows(columns).AddRow("gc7a9", 3, 0, 0, 53.35, -6.26),
+			wantErr:       true,
+			wantCode:      pb.ResponseCode_FAILED,
+		},
+		{
+			name:          "success",
+			userId:        1,
+			partyId:       1,
+			bounds:        bounds,
+			zoom:          12,
+			wantPrecision: 5,
+			cellRows: sqlmock.NewRows(columns).
+				AddRow("gc7x3", 2, 2, 0, 53.31, -6.29).
+				AddRow("gc7x9", 10, 3, 4, 53.36, -6.26),
+			wantCode: pb.ResponseCode_OK,
+			wantCells: []*pb.PosterCell{
+				{Geohash: "gc7x3", Removed: 2, Centroid: &pb.Location{Lat: 53.31, Lng: -6.29}},
+				{Geohash: "gc7x9", Up: 3, Removed: 3, Overdue: 4, Centroid: &pb.Location{Lat: 53.36, Lng: -6.26}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select ST_GeoHash").WithArgs(tc.wantPrecision, tc.partyId, -6.3, 53.3, -6.2, 53.4).WillReturnRows(tc.cellRows)
+
+			res, err := server.AggregatePosters(ctx, &pb.AggregateRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: testAuthKey(t, tc.userId, tc.partyId),
+				Bounds: tc.bounds, Zoom: tc.zoom})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Cells) != len(tc.wantCells) {
+				t.Fatalf("got cells %v want %v", res.Cells, tc.wantCells)
+			}
+			for i, want := range tc.wantCells {
+				got := res.Cells[i]
+				if got.Geohash != want.Geohash || got.Up != want.Up || got.Removed != want.Removed || got.Overdue != want.Overdue ||
+					got.Centroid.Lat != want.Centroid.Lat || got.Centroid.Lng != want.Centroid.Lng {
+					t.Fatalf("got cell %v want %v", got, want)
+				}
+			}
+			if tc.wantCells != nil && res.Precision != int32(tc.wantPrecision) {
+				t.Fatalf("got precision %d want %d", res.Precision, tc.wantPrecision)
+			}
+			// the cell bounds are the geohash cell the posters are in, not the extent of the posters
+			if tc.wantCells != nil && (res.Cells[1].Bounds.SouthWest.Lat != 53.349609375 || res.Cells[1].Bounds.NorthEast.Lng != -6.240234375) {
+				t.Fatalf("got cell bounds %v", res.Cells[1].Bounds)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	maxAssignmentClusters = 100
+	// outstanding posters of a party that are not in an assignment yet
+	unassignedPostersQuery = `select posterID, partyId, userID, st_y(location) as latitude, st_x(location) as longitude
+							from fyp_schema.posters
+							where partyId = ? and removed is null
+							and not exists (select 1 from fyp_schema.removalAssignmentPosters as a where a.posterId = posters.posterID)%s
+							order by posterID`
+	partyMemberQuery            = "select userID from fyp_schema.users where userID = ? and partyID = ?"
+	insertAssignmentQuery       = "insert into fyp_schema.removalAssignments (partyId, name, assigneeId, createdBy) values (?,?,?,?)"
+	insertAssignmentPosterQuery = "insert into fyp_schema.removalAssignmentPosters (assignmentId, posterId) values (?,?)"
+	// posters removed after they were assigned show up as removed, so progress is always up to date
+	memberAssignmentsQuery = `select l1.assignmentId, l1.name, l1.assigneeId, l3.posterID, l3.partyId, l3.userID, st_y(l3.location), st_x(l3.location), l3.removed is not null
+								from fyp_schema.removalAssignments as l1
+								join fyp_schema.removalAssignmentPosters as l2 on l1.assignmentId = l2.assignmentId
+								join fyp_schema.posters as l3 on l2.posterId = l3.posterID
+								where l1.partyId = ? and l1.assigneeId = ?
+								order by l1.assignmentId, l3.posterID`
+	reassignRemovalQuery    = "update fyp_schema.removalAssignments set assigneeId = ? where assignmentId = ? and partyId = ?"
+	assignmentAssigneeQuery = "select assigneeId from fyp_schema.removalAssignments where assignmentId = ? and partyId = ? for update"
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// partyMemberArg checks that a member being given an assignment or stock is in the party. An assigneeId of 0 means no member.
+func partyMemberArg(q querier, assigneeId, partyId int32) (sql.NullInt32, error) {
+	if assigneeId == 0 {
+		return sql.NullInt32{}, nil
+	}
+	rows, err := q.Query(partyMemberQuery, assigneeId, partyId)
+	if err != nil {
+		return sql.NullInt32{}, fmt.Errorf("failed to check member: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return sql.NullInt32{}, fmt.Errorf("user %d is not a member of the party", assigneeId)
+	}
+	return sql.NullInt32{Int32: assigneeId, Valid: true}, nil
+}
+
+// CreateRemovalAssignments allows a party admin to split the outstanding posters between members,
+// either by listing the posters for each assignment or by splitting them into areas.
+func (s *server) CreateRemovalAssignments(ctx context.Context, in *pb.CreateAssignmentsRequest) (*pb.CreateAssignmentsResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if len(in.GetAssignments()) == 0 && in.GetClusters() == 0 {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("assignments or clusters must be set")
+	}
+	if len(in.GetAssignments()) > 0 && in.GetClusters() != 0 {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only one of assignments or clusters can be set")
+	}
+	if in.GetClusters() < 0 || int(in.GetClusters()) > maxAssignmentClusters {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("clusters must be between 1 and %d", maxAssignmentClusters)
+	}
+	// assigneeIds only apply to clustered areas, manual assignments name their own assignee
+	if in.GetClusters() > 0 && len(in.GetAssigneeIds()) > int(in.GetClusters()) {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("more assignees than clusters")
+	}
+	for i, draft := range in.GetAssignments() {
+		if len(draft.GetPosterIds()) == 0 {
+			return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("assignment %d has no posters", i)
+		}
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can create removal assignments")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	var requested []int32
+	for _, draft := range in.GetAssignments() {
+		requested = append(requested, draft.GetPosterIds()...)
+	}
+	clause, idArgs := posterIdsClause(requested)
+	rows, err = tx.Query(fmt.Sprintf(unassignedPostersQuery, clause), append([]interface{}{in.GetPartyId()}, idArgs...)...)
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query outstanding posters: %v", err)
+	}
+	var posters []*pb.Poster
+	byId := make(map[int32]*pb.Poster)
+	for rows.Next() {
+		poster := &pb.Poster{Location: &pb.Location{}}
+		err = rows.Scan(&poster.Posterid, &poster.Party, &poster.PlacedBy, &poster.Location.Lat, &poster.Location.Lng)
+		if err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read posters from sql result: %v", err)
+		}
+		posters = append(posters, poster)
+		byId[poster.Posterid] = poster
+	}
+	_ = rows.Close()
+
+	// work out which posters go in each assignment
+	drafts := in.GetAssignments()
+	var unassigned []int32
+	if in.GetClusters() > 0 {
+		if len(posters) == 0 {
+			_ = tx.Rollback()
+			return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("there are no outstanding posters to assign")
+		}
+		points := make([]geoService.Point, len(posters))
+		for i, poster := range posters {
+			points[i] = geoService.Point{Lat: poster.Location.Lat, Lng: poster.Location.Lng}
+		}
+		labels := geoService.Cluster(points, int(in.GetClusters()))
+		// k-means can leave an area with no posters, only areas with posters become drafts
+		drafts = nil
+		areas := make(map[int]*pb.AssignmentDraft)
+		for i, poster := range posters {
+			draft, ok := areas[labels[i]]
+			if !ok {
+				draft = &pb.AssignmentDraft{Name: fmt.Sprintf("area %d", len(drafts)+1)}
+				if len(drafts) < len(in.GetAssigneeIds()) {
+					draft.AssigneeId = in.GetAssigneeIds()[len(drafts)]
+				}
+				areas[labels[i]] = draft
+				drafts = append(drafts, draft)
+			}
+			draft.PosterIds = append(draft.PosterIds, poster.Posterid)
+		}
+		if len(drafts) < len(in.GetAssigneeIds()) {
+			unassigned = in.GetAssigneeIds()[len(drafts):]
+		}
+	}
+
+	var assignments []*pb.RemovalAssignment
+	var created []assignmentAudit
+	seen := make(map[int32]bool)
+	for i, draft := range drafts {
+		assignee, err := partyMemberArg(tx, draft.GetAssigneeId(), in.GetPartyId())
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+		name := draft.GetName()
+		if name == "" {
+			name = fmt.Sprintf("assignment %d", i+1)
+		}
+		res, err := tx.Exec(insertAssignmentQuery, in.GetPartyId(), name, assignee, in.GetUserId())
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create assignment: %v", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to get assignmentId from query: %v", err)
+		}
+		assignment := &pb.RemovalAssignment{AssignmentId: int32(id), Name: name, AssigneeId: draft.GetAssigneeId()}
+		for _, posterId := range draft.GetPosterIds() {
+			poster, ok := byId[posterId]
+			if !ok || seen[posterId] {
+				_ = tx.Rollback()
+				return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("poster %d is not outstanding or is already assigned", posterId)
+			}
+			seen[posterId] = true
+			if _, err = tx.Exec(insertAssignmentPosterQuery, id, posterId); err != nil {
+				_ = tx.Rollback()
+				return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to add poster to assignment: %v", err)
+			}
+			assignment.Posters = append(assignment.Posters, poster)
+		}
+		assignment.Total = int32(len(assignment.Posters))
+		assignments = append(assignments, assignment)
+		created = append(created, assignmentAudit{AssignmentId: assignment.AssignmentId, AssigneeId: assignment.AssigneeId})
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_ASSIGNMENTS_CREATED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   created,
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record assignments: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit assignments: %v", err)
+	}
+	return &pb.CreateAssignmentsResponse{Code: pb.ResponseCode_OK, Assignments: assignments, UnassignedIds: unassigned}, nil
+}
+
+// MyAssignments returns the removal assignments given to the user and how far along they are.
+func (s *server) MyAssignments(ctx context.Context, in *pb.MyAssignmentsRequest) (*pb.MyAssignmentsResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	rows, err := s.DB.Query(memberAssignmentsQuery, in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query assignments: %v", err)
+	}
+	defer rows.Close()
+	var assignments []*pb.RemovalAssignment
+	for rows.Next() {
+		var assignment pb.RemovalAssignment
+		poster := &pb.Poster{Location: &pb.Location{}}
+		err = rows.Scan(&assignment.AssignmentId, &assignment.Name, &assignment.AssigneeId,
+			&poster.Posterid, &poster.Party, &poster.PlacedBy, &poster.Location.Lat, &poster.Location.Lng, &poster.Removed)
+		if err != nil {
+			return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read assignments from sql result: %v", err)
+		}
+		// rows are ordered by assignment so a new assignmentId starts the next assignment
+		if len(assignments) == 0 || assignments[len(assignments)-1].AssignmentId != assignment.AssignmentId {
+			assignments = append(assignments, &assignment)
+		}
+		current := assignments[len(assignments)-1]
+		current.Posters = append(current.Posters, poster)
+		current.Total++
+		if poster.Removed {
+			current.Removed++
+		}
+	}
+	return &pb.MyAssignmentsResponse{Code: pb.ResponseCode_OK, Assignments: assignments}, nil
+}
+
+// setAssignee gives an assignment to a member, or to nobody if assigneeId is 0. Only the party admin can do this.
+func (s *server) setAssignee(ctx context.Context, authKey string, userId, partyId, assignmentId, assigneeId int32) error {
+	if authKey == "" {
+		return fmt.Errorf("authKey not set")
+	}
+	if userId == 0 {
+		return fmt.Errorf("userId not set")
+	}
+	if partyId == 0 {
+		return fmt.Errorf("partyId not set")
+	}
+	if assignmentId == 0 {
+		return fmt.Errorf("assignmentId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(authKey)
+	if userClaims == nil || userClaims.Valid() != nil {
+		return fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, userId, partyId) {
+		return fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", partyId, userId)
+	if err != nil {
+		return fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return fmt.Errorf("only party admin can change removal assignments")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	assignee, err := partyMemberArg(tx, assigneeId, partyId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	var previous sql.NullInt32
+	if err = tx.QueryRow(assignmentAssigneeQuery, assignmentId, partyId).Scan(&previous); err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("assignment does not exist")
+		}
+		return fmt.Errorf("failed to query assignment: %v", err)
+	}
+	if _, err = tx.Exec(reassignRemovalQuery, assignee, assignmentId, partyId); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update assignment: %v", err)
+	}
+	entry := auditEntry{
+		action:   pb.AuditAction_AUDIT_REMOVAL_REASSIGNED,
+		partyId:  partyId,
+		actorId:  userId,
+		targetId: assigneeId,
+		before:   assignmentAudit{AssignmentId: assignmentId, AssigneeId: previous.Int32},
+		after:    assignmentAudit{AssignmentId: assignmentId, AssigneeId: assigneeId},
+	}
+	if assigneeId == 0 {
+		entry.action = pb.AuditAction_AUDIT_REMOVAL_UNASSIGNED
+		entry.targetId = previous.Int32
+	}
+	if err = writeAudit(ctx, tx, entry); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to record assignment change: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update assignment: %v", err)
+	}
+	return nil
+}
+
+// ReassignRemoval gives a removal assignment to a different member.
+func (s *server) ReassignRemoval(ctx context.Context, in *pb.ReassignRemovalRequest) (*pb.ReassignRemovalResponse, error) {
+	if in.GetAssigneeId() == 0 {
+		return &pb.ReassignRemovalResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("assigneeId not set")
+	}
+	if err := s.setAssignee(ctx, in.GetAuthKey(), in.GetUserId(), in.GetPartyId(), in.GetAssignmentId(), in.GetAssigneeId()); err != nil {
+		return &pb.ReassignRemovalResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	return &pb.ReassignRemovalResponse{Code: pb.ResponseCode_OK}, nil
+}
+
+// UnassignRemoval takes a removal assignment back from its member so it can be given to someone else later.
+func (s *server) UnassignRemoval(ctx context.Context, in *pb.UnassignRemovalRequest) (*pb.UnassignRemovalResponse, error) {
+	if err := s.setAssignee(ctx, in.GetAuthKey(), in.GetUserId(), in.GetPartyId(), in.GetAssignmentId(), 0); err != nil {
+		return &pb.UnassignRemovalResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	return &pb.UnassignRemovalResponse{Code: pb.ResponseCode_OK}, nil
+}
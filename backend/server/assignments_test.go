@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func testAuthKey(t *testing.T, userId, partyId int32) string {
+	userClaims := tokenService.UserClaims{
+		UserID:   userId,
+		Username: "test",
+		PartyId:  partyId,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+		},
+	}
+	authKey, err := tokenService.NewAccessToken(userClaims)
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	return authKey
+}
+
+func TestCreateRemovalAssignments(t *testing.T) {
+	columns := []string{"posterID", "partyId", "userID", "latitude", "longitude"}
+	// two posters in the city centre and two about 10km away
+	posterRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow(1, 1, 1, 53.349, -6.260).
+			AddRow(2, 1, 1, 53.288, -6.365).
+			AddRow(3, 1, 2, 53.350, -6.261).
+			AddRow(4, 1, 2, 53.289, -6.364)
+	}
+	tests := []struct {
+		name           string
+		userId         int32
+		partyId        int32
+		assignments    []*pb.AssignmentDraft
+		clusters       int32
+		assigneeIds    []int32
+		adminRows      *sqlmock.Rows
+		posterRows     *sqlmock.Rows
+		wantPosterArgs []driver.Value
+		wantAssignees  []int32
+		wantErr        bool
+		wantCode       pb.ResponseCode
+		wantPosters    [][]int32
+		wantUnassigned []int32
+	}{
+		{
+			name:       "nothing to assign",
+			userId:     1,
+			partyId:    1,
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			posterRows: posterRows(),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "too many assignees",
+			userId:      1,
+			partyId:     1,
+			clusters:    1,
+			assigneeIds: []int32{2, 3},
+			adminRows:   sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			posterRows:  posterRows(),
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "user is not admin of party",
+			userId:     1,
+			partyId:    1,
+			clusters:   2,
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			posterRows: posterRows(),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:           "poster already assigned",
+			userId:         1,
+			partyId:        1,
+			assignments:    []*pb.AssignmentDraft{{Name: "centre", PosterIds: []int32{1, 5}}},
+			adminRows:      sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			posterRows:     sqlmock.NewRows(columns).AddRow(1, 1, 1, 53.349, -6.260),
+			wantPosterArgs: []driver.Value{int32(1), int32(1), int32(5)},
+			wantErr:        true,
+			wantCode:       pb.ResponseCode_FAILED,
+		},
+		{
+			name:           "manual assignment",
+			userId:         1,
+			partyId:        1,
+			assignments:    []*pb.AssignmentDraft{{Name: "centre", AssigneeId: 2, PosterIds: []int32{1, 3}}},
+			adminRows:      sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			posterRows:     sqlmock.NewRows(columns).AddRow(1, 1, 1, 53.349, -6.260).AddRow(3, 1, 2, 53.350, -6.261),
+			wantPosterArgs: []driver.Value{int32(1), int32(1), int32(3)},
+			wantAssignees:  []int32{2},
+			wantCode:       pb.ResponseCode_OK,
+			wantPosters:    [][]int32{{1, 3}},
+		},
+		{
+			name:           "manual assignment ignores assigneeIds",
+			userId:         1,
+			partyId:        1,
+			assignments:    []*pb.AssignmentDraft{{Name: "centre", AssigneeId: 2, PosterIds: []int32{1, 3}}},
+			assigneeIds:    []int32{3},
+			adminRows:      sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			posterRows:     sqlmock.NewRows(columns).AddRow(1, 1, 1, 53.349, -6.260).AddRow(3, 1, 2, 53.350, -6.261),
+			wantPosterArgs: []driver.Value{int32(1), int32(1), int32(3)},
+			wantAssignees:  []int32{2},
+			wantCode:       pb.ResponseCode_OK,
+			wantPosters:    [][]int32{{1, 3}},
+		},
+		{
+			name:           "clustered into areas",
+			userId:         1,
+			partyId:        1,
+			clusters:       2,
+			assigneeIds:    []int32{2},
+			adminRows:      sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			posterRows:     posterRows(),
+			wantPosterArgs: []driver.Value{int32(1)},
+			wantAssignees:  []int32{2, 0},
+			wantCode:       pb.ResponseCode_OK,
+			wantPosters:    [][]int32{{1, 3}, {2, 4}},
+		},
+		{
+			name:        "area left empty",
+			userId:      1,
+			partyId:     1,
+			clusters:    2,
+			assigneeIds: []int32{2, 3},
+			adminRows:   sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			// posters in the same place can only make one area
+			posterRows:     sqlmock.NewRows(columns).AddRow(1, 1, 1, 53.349, -6.260).AddRow(3, 1, 2, 53.349, -6.260),
+			wantPosterArgs: []driver.Value{int32(1)},
+			wantAssignees:  []int32{2},
+			wantCode:       pb.ResponseCode_OK,
+			wantPosters:    [][]int32{{1, 3}},
+			wantUnassigned: []int32{3},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			mock.ExpectBegin()
+			mock.ExpectQuery("select posterID").WithArgs(tc.wantPosterArgs...).WillReturnRows(tc.posterRows)
+			var created []string
+			for i, posters := range tc.wantPosters {
+				created = append(created, fmt.Sprintf(`{"assignmentId":%d,"assigneeId":%d}`, 10+i, tc.wantAssignees[i]))
+				if tc.wantAssignees[i] != 0 {
+					mock.ExpectQuery("select userID").WithArgs(tc.wantAssignees[i], tc.partyId).
+						WillReturnRows(sqlmock.NewRows([]string{"userID"}).AddRow(tc.wantAssignees[i]))
+				}
+				mock.ExpectExec("insert into fyp_schema.removalAssignments").WillReturnResult(sqlmock.NewResult(int64(10+i), 1))
+				for _, posterId := range posters {
+					mock.ExpectExec("insert into fyp_schema.removalAssignmentPosters").WithArgs(int64(10+i), posterId).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			if !tc.wantErr {
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_ASSIGNMENTS_CREATED), tc.partyId, tc.userId, int32(0), "", nil, "["+strings.Join(created, ",")+"]").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectCommit()
+
+			res, err := server.CreateRemovalAssignments(ctx, &pb.CreateAssignmentsRequest{UserId: tc.userId, PartyId: tc.partyId,
+				AuthKey: testAuthKey(t, tc.userId, tc.partyId), Assignments: tc.assignments, Clusters: tc.clusters, AssigneeIds: tc.assigneeIds})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			var posters [][]int32
+			for i, assignment := range res.Assignments {
+				var ids []int32
+				for _, poster := range assignment.Posters {
+					ids = append(ids, poster.Posterid)
+				}
+				posters = append(posters, ids)
+				if assignment.AssigneeId != tc.wantAssignees[i] || assignment.Total != int32(len(ids)) {
+					t.Fatalf("got assignment %v", assignment)
+				}
+			}
+			if !reflect.DeepEqual(posters, tc.wantPosters) {
+				t.Fatalf("got posters %v want posters %v", posters, tc.wantPosters)
+			}
+			if !reflect.DeepEqual(res.UnassignedIds, tc.wantUnassigned) {
+				t.Fatalf("got unassigned %v want unassigned %v", res.UnassignedIds, tc.wantUnassigned)
+			}
+			if !tc.wantErr {
+				if err = mock.ExpectationsWereMet(); err != nil {
+					t.Fatalf("unfulfilled expectations: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMyAssignments(t *testing.T) {
+	columns := []string{"assignmentId", "name", "assigneeId", "posterID", "partyId", "userID", "latitude", "longitude", "removed"}
+	tests := []struct {
+		name           string
+		userId         int32
+		partyId        int32
+		returnRows     *sqlmock.Rows
+		wantErr        bool
+		wantCode       pb.ResponseCode
+		wantTotals     []int32
+		wantRemoved    []int32
+		wantAssignment []int32
+	}{
+		{
+			name:       "partyId not set",
+			userId:     2,
+			returnRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "success",
+			userId:  2,
+			partyId: 1,
+			returnRows: sqlmock.NewRows(columns).
+				AddRow(10, "area 1", 2, 1, 1, 1, 53.349, -6.260, true).
+				AddRow(10, "area 1", 2, 3, 1, 2, 53.350, -6.261, false).
+				AddRow(12, "area 3", 2, 7, 1, 2, 53.3, -6.3, true),
+			wantCode:       pb.ResponseCode_OK,
+			wantAssignment: []int32{10, 12},
+			wantTotals:     []int32{2, 1},
+			wantRemoved:    []int32{1, 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.returnRows)
+
+			res, err := server.MyAssignments(ctx, &pb.MyAssignmentsRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: testAuthKey(t, tc.userId, tc.partyId)})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Assignments) != len(tc.wantAssignment) {
+				t.Fatalf("got assignments %v want %v", res.Assignments, tc.wantAssignment)
+			}
+			for i, assignment := range res.Assignments {
+				if assignment.AssignmentId != tc.wantAssignment[i] || assignment.Total != tc.wantTotals[i] || assignment.Removed != tc.wantRemoved[i] {
+					t.Fatalf("got assignment %v", assignment)
+				}
+			}
+		})
+	}
+}
+
+func TestReassignRemoval(t *testing.T) {
+	tests := []struct {
+		name         string
+		userId       int32
+		partyId      int32
+		assignmentId int32
+		assigneeId   int32
+		unassign     bool
+		adminRows    *sqlmock.Rows
+		memberRows   *sqlmock.Rows
+		assigneeRows *sqlmock.Rows
+		wantErr      bool
+		wantCode     pb.ResponseCode
+		wantAudit    []driver.Value
+	}{
+		{
+			name:         "assigneeId not set",
+			userId:       1,
+			partyId:      1,
+			assignmentId: 10,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "user is not admin of party",
+			userId:       1,
+			partyId:      1,
+			assignmentId: 10,
+			assigneeId:   3,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "assignee not in party",
+			userId:       1,
+			partyId:      1,
+			assignmentId: 10,
+			assigneeId:   3,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			memberRows:   sqlmock.NewRows([]string{"userID"}),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "assignment does not exist",
+			userId:       1,
+			partyId:      1,
+			assignmentId: 10,
+			assigneeId:   3,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			memberRows:   sqlmock.NewRows([]string{"userID"}).AddRow(3),
+			assigneeRows: sqlmock.NewRows([]string{"assigneeId"}),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "reassign",
+			userId:       1,
+			partyId:      1,
+			assignmentId: 10,
+			assigneeId:   3,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			memberRows:   sqlmock.NewRows([]string{"userID"}).AddRow(3),
+			assigneeRows: sqlmock.NewRows([]string{"assigneeId"}).AddRow(2),
+			wantCode:     pb.ResponseCode_OK,
+			wantAudit: []driver.Value{int32(pb.AuditAction_AUDIT_REMOVAL_REASSIGNED), int32(1), int32(1), int32(3), "",
+				`{"assignmentId":10,"assigneeId":2}`, `{"assignmentId":10,"assigneeId":3}`},
+		},
+		{
+			name:         "unassign",
+			userId:       1,
+			partyId:      1,
+			assignmentId: 10,
+			unassign:     true,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			assigneeRows: sqlmock.NewRows([]string{"assigneeId"}).AddRow(2),
+			wantCode:     pb.ResponseCode_OK,
+			wantAudit: []driver.Value{int32(pb.AuditAction_AUDIT_REMOVAL_UNASSIGNED), int32(1), int32(1), int32(2), "",
+				`{"assignmentId":10,"assigneeId":2}`, `{"assignmentId":10,"assigneeId":0}`},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			if tc.memberRows != nil || tc.assigneeRows != nil {
+				mock.ExpectBegin()
+			}
+			if tc.memberRows != nil {
+				mock.ExpectQuery("select userID").WithArgs(tc.assigneeId, tc.partyId).WillReturnRows(tc.memberRows)
+			}
+			if tc.assigneeRows != nil {
+				mock.ExpectQuery("select assigneeId").WithArgs(tc.assignmentId, tc.partyId).WillReturnRows(tc.assigneeRows)
+			}
+			if tc.wantAudit != nil {
+				mock.ExpectExec("update fyp_schema.removalAssignments").WithArgs(sqlmock.AnyArg(), tc.assignmentId, tc.partyId).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").WithArgs(tc.wantAudit...).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			} else if tc.memberRows != nil || tc.assigneeRows != nil {
+				mock.ExpectRollback()
+			}
+
+			authKey := testAuthKey(t, tc.userId, tc.partyId)
+			var code pb.ResponseCode
+			if tc.unassign {
+				var res *pb.UnassignRemovalResponse
+				res, err = server.UnassignRemoval(ctx, &pb.UnassignRemovalRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey, AssignmentId: tc.assignmentId})
+				code = res.Code
+			} else {
+				var res *pb.ReassignRemovalResponse
+				res, err = server.ReassignRemoval(ctx, &pb.ReassignRemovalRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey,
+					AssignmentId: tc.assignmentId, AssigneeId: tc.assigneeId})
+				code = res.Code
+			}
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", code, tc.wantCode)
+			}
+			if tc.wantErr {
+				return
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	defaultAuditPageSize = int32(50)
+	maxAuditPageSize     = int32(500)
+	insertAuditQuery     = "insert into fyp_schema.auditLog (action, partyId, actorId, targetId, ip, beforeValue, afterValue) values (?,?,?,?,?,?,?)"
+	previousPartyQuery   = "select partyId from fyp_schema.users where userId = ?"
+	// filters are added where %s is
+	auditLogQuery = `select l1.auditId, l1.action, l1.actorId, coalesce(l2.username, ''), l1.targetId, l1.ip, coalesce(l1.beforeValue, ''),
+						coalesce(l1.afterValue, ''), unix_timestamp(l1.created)
+						from fyp_schema.auditLog as l1 left join fyp_schema.users as l2 on l1.actorId = l2.userID
+						where l1.partyId = ?%s order by l1.auditId desc limit ?`
+)
+
+// auditEntry is an administrative action. before and after are encoded as json, nil if there was no value.
+type auditEntry struct {
+	action  pb.AuditAction
+	partyId int32
+	actorId int32
+	// the user the action was applied to
+	targetId int32
+	before   interface{}
+	after    interface{}
+}
+
+// electionAudit is the value NewElection and CloseElection change.
+type electionAudit struct {
+	ElectionId       int32           `json:"electionId"`
+	Name             string          `json:"name"`
+	ElectionType     pb.ElectionType `json:"electionType"`
+	StartDate        time.Time       `json:"startDate"`
+	EndDate          time.Time       `json:"endDate"`
+	RemovalDaysAfter int32           `json:"removalDaysAfter"`
+	Closed           *time.Time      `json:"closed,omitempty"`
+}
+
+// membershipAudit is the value join requests and their review change.
+type membershipAudit struct {
+	PartyId     int32  `json:"partyId,omitempty"`
+	JoinRequest string `json:"joinRequest,omitempty"`
+}
+
+// partyAudit is the value RegisterParty creates.
+type partyAudit struct {
+	PartyName string `json:"partyName"`
+	Admin     int32  `json:"admin"`
+}
+
+// posterImportAudit is the value ImportPosters creates.
+type posterImportAudit struct {
+	Format   pb.ImportFormat `json:"format"`
+	Imported int32           `json:"imported"`
+}
+
+// zoneImportAudit is the value ImportExclusionZones creates.
+type zoneImportAudit struct {
+	Enforcement pb.ZoneEnforcement `json:"enforcement"`
+	Imported    int32              `json:"imported"`
+}
+
+// webhookAudit is the value RegisterWebhook creates and DeleteWebhook removes.
+type webhookAudit struct {
+	WebhookId int32             `json:"webhookId"`
+	Url       string            `json:"url,omitempty"`
+	Events    []pb.WebhookEvent `json:"events,omitempty"`
+}
+
+// deliveryAudit is the value RedeliverWebhook queues again.
+type deliveryAudit struct {
+	DeliveryId int64 `json:"deliveryId"`
+}
+
+// reportAudit is the value DismissReport changes.
+type reportAudit struct {
+	ReportId      int32  `json:"reportId"`
+	DismissReason string `json:"dismissReason,omitempty"`
+}
+
+// assignmentAudit is the value CreateRemovalAssignments creates and ReassignRemoval and UnassignRemoval change.
+// AssigneeId is 0 if nobody has the assignment.
+type assignmentAudit struct {
+	AssignmentId int32 `json:"assignmentId"`
+	AssigneeId   int32 `json:"assigneeId"`
+}
+
+// posterAudit is the value of a poster an admin moved or placed outside the rules members have to follow.
+type posterAudit struct {
+	PosterId       int32        `json:"posterId"`
+	Location       *pb.Location `json:"location,omitempty"`
+	OverrideReason string       `json:"overrideReason,omitempty"`
+}
+
+// designAudit is the value CreatePosterDesign creates.
+type designAudit struct {
+	DesignId          int32  `json:"designId"`
+	Name              string `json:"name"`
+	LowStockThreshold int32  `json:"lowStockThreshold"`
+}
+
+// sitesAudit is the value CreatePlannedSites creates.
+type sitesAudit struct {
+	SiteIds []int32 `json:"siteIds"`
+}
+
+// inventoryAudit is the value RecordInventory adds to the ledger.
+type inventoryAudit struct {
+	DesignId int32            `json:"designId"`
+	Kind     pb.InventoryKind `json:"kind"`
+	Quantity int32            `json:"quantity"`
+}
+
+func auditValue(value interface{}) (sql.NullString, error) {
+	if value == nil {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+// writeAudit records the action as part of tx along with the address the request came from.
+func writeAudit(ctx context.Context, tx *sql.Tx, entry auditEntry) error {
+	before, err := auditValue(entry.before)
+	if err != nil {
+		return err
+	}
+	after, err := auditValue(entry.after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertAuditQuery, int32(entry.action), entry.partyId, entry.actorId, entry.targetId, clientAddress(ctx), before, after)
+	return err
+}
+
+func parseAuditPageToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	auditId, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || auditId <= 0 {
+		return 0, fmt.Errorf("invalid page token")
+	}
+	return auditId, nil
+}
+
+// QueryAuditLog returns a party's administrative actions, newest first.
+func (s *server) QueryAuditLog(ctx context.Context, in *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	beforeId, err := parseAuditPageToken(in.GetPageToken())
+	if err != nil {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	if in.GetSince() != nil && in.GetUntil() != nil && !in.GetSince().AsTime().Before(in.GetUntil().AsTime()) {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("since must be before until")
+	}
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can view the audit log")
+	}
+	_ = rows.Close()
+
+	pageSize := in.GetPageSize()
+	if pageSize <= 0 {
+		pageSize = defaultAuditPageSize
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+	filters := ""
+	args := []interface{}{in.GetPartyId()}
+	if len(in.GetActions()) > 0 {
+		placeholders := make([]string, len(in.GetActions()))
+		for i, action := range in.GetActions() {
+			placeholders[i] = "?"
+			args = append(args, int32(action))
+		}
+		filters += fmt.Sprintf(" and l1.action in (%s)", strings.Join(placeholders, ","))
+	}
+	if in.GetActorId() != 0 {
+		filters += " and l1.actorId = ?"
+		args = append(args, in.GetActorId())
+	}
+	if in.GetTargetId() != 0 {
+		filters += " and l1.targetId = ?"
+		args = append(args, in.GetTargetId())
+	}
+	if in.GetSince() != nil {
+		filters += " and l1.created >= from_unixtime(?)"
+		args = append(args, in.GetSince().AsTime().Unix())
+	}
+	if in.GetUntil() != nil {
+		filters += " and l1.created < from_unixtime(?)"
+		args = append(args, in.GetUntil().AsTime().Unix())
+	}
+	if beforeId != 0 {
+		filters += " and l1.auditId < ?"
+		args = append(args, beforeId)
+	}
+	// one extra row tells us if there is another page
+	args = append(args, pageSize+1)
+	rows, err = s.DB.Query(fmt.Sprintf(auditLogQuery, filters), args...)
+	if err != nil {
+		return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query audit log: %v", err)
+	}
+	defer rows.Close()
+	var entries []*pb.AuditEntry
+	for rows.Next() {
+		var entry pb.AuditEntry
+		var action int32
+		var created int64
+		err = rows.Scan(&entry.AuditId, &action, &entry.ActorId, &entry.ActorName, &entry.TargetId, &entry.Ip, &entry.Before, &entry.After, &created)
+		if err != nil {
+			return &pb.QueryAuditLogResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read audit log: %v", err)
+		}
+		entry.Action = pb.AuditAction(action)
+		entry.Created = timestamppb.New(time.Unix(created, 0))
+		entries = append(entries, &entry)
+	}
+	res := &pb.QueryAuditLogResponse{Code: pb.ResponseCode_OK}
+	if int32(len(entries)) > pageSize {
+		entries = entries[:pageSize]
+		res.NextPageToken = strconv.FormatInt(entries[pageSize-1].GetAuditId(), 10)
+	}
+	res.Entries = entries
+	return res, nil
+}
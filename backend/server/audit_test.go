@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestWriteAudit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 51234}})
+	mock.ExpectBegin()
+	mock.ExpectExec("insert into fyp_schema.auditLog").
+		WithArgs(int32(pb.AuditAction_AUDIT_ELECTION_SET), int32(1), int32(2), int32(0), "10.0.0.7", nil,
+			`{"electionId":3,"name":"general","electionType":0,"startDate":"2024-06-01T00:00:00Z","endDate":"2024-06-08T00:00:00Z","removalDaysAfter":0}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_ELECTION_SET,
+		partyId: 1,
+		actorId: 2,
+		after: electionAudit{
+			ElectionId: 3,
+			Name:       "general",
+			StartDate:  time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+			EndDate:    time.Date(2024, 6, 8, 0, 0, 0, 0, time.UTC),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestQueryAuditLog(t *testing.T) {
+	columns := []string{"auditId", "action", "actorId", "username", "targetId", "ip", "beforeValue", "afterValue", "created"}
+	since := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 6, 8, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		userId        int32
+		partyId       int32
+		req           *pb.QueryAuditLogRequest
+		adminRows     *sqlmock.Rows
+		wantArgs      []driver.Value
+		rows          *sqlmock.Rows
+		wantErr       bool
+		wantIds       []int64
+		wantPageToken string
+	}{
+		{
+			name:      "user is not admin of party",
+			userId:    2,
+			partyId:   1,
+			req:       &pb.QueryAuditLogRequest{},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+		},
+		{
+			name:    "invalid page token",
+			userId:  1,
+			partyId: 1,
+			req:     &pb.QueryAuditLogRequest{PageToken: "abc"},
+			wantErr: true,
+		},
+		{
+			name:    "since after until",
+			userId:  1,
+			partyId: 1,
+			req:     &pb.QueryAuditLogRequest{Since: timestamppb.New(until), Until: timestamppb.New(since)},
+			wantErr: true,
+		},
+		{
+			name:      "first page",
+			userId:    1,
+			partyId:   1,
+			req:       &pb.QueryAuditLogRequest{PageSize: 2},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantArgs:  []driver.Value{int32(1), int32(3)},
+			rows: sqlmock.NewRows(columns).
+				AddRow(9, int32(pb.AuditAction_AUDIT_MEMBER_APPROVED), 1, "admin", 4, "10.0.0.7", `{"partyId":1,"joinRequest":"pending"}`, `{"partyId":1,"joinRequest":"approved"}`, 1717500000).
+				AddRow(8, int32(pb.AuditAction_AUDIT_JOIN_REQUESTED), 4, "member", 4, "10.0.0.8", "", `{"joinRequest":"pending"}`, 1717400000).
+				AddRow(5, int32(pb.AuditAction_AUDIT_ELECTION_SET), 1, "admin", 0, "10.0.0.7", "", `{"startDate":"2024-06-01T00:00:00Z","endDate":"2024-06-08T00:00:00Z"}`, 1717300000),
+			wantIds:       []int64{9, 8},
+			wantPageToken: "8",
+		},
+		{
+			name:    "filtered last page",
+			userId:  1,
+			partyId: 1,
+			req: &pb.QueryAuditLogRequest{
+				Actions:   []pb.AuditAction{pb.AuditAction_AUDIT_MEMBER_APPROVED, pb.AuditAction_AUDIT_MEMBER_DENIED},
+				ActorId:   1,
+				TargetId:  4,
+				Since:     timestamppb.New(since),
+				Until:     timestamppb.New(until),
+				PageToken: "8",
+			},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantArgs: []driver.Value{int32(1), int32(pb.AuditAction_AUDIT_MEMBER_APPROVED), int32(pb.AuditAction_AUDIT_MEMBER_DENIED),
+				int32(1), int32(4), since.Unix(), until.Unix(), int64(8), defaultAuditPageSize + 1},
+			rows: sqlmock.NewRows(columns).
+				AddRow(6, int32(pb.AuditAction_AUDIT_MEMBER_DENIED), 1, "admin", 4, "10.0.0.7", `{"joinRequest":"pending"}`, `{"joinRequest":"denied"}`, 1717350000),
+			wantIds: []int64{6},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db}
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			}
+			if tc.rows != nil {
+				mock.ExpectQuery("select l1.auditId").WithArgs(tc.wantArgs...).WillReturnRows(tc.rows)
+			}
+			tc.req.AuthKey = testAuthKey(t, tc.userId, tc.partyId)
+			tc.req.UserId = tc.userId
+			tc.req.PartyId = tc.partyId
+
+			res, err := server.QueryAuditLog(context.Background(), tc.req)
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+			if tc.wantErr {
+				return
+			}
+			var ids []int64
+			for _, entry := range res.GetEntries() {
+				ids = append(ids, entry.GetAuditId())
+			}
+			if len(ids) != len(tc.wantIds) {
+				t.Fatalf("got entries %v want %v", ids, tc.wantIds)
+			}
+			for i := range ids {
+				if ids[i] != tc.wantIds[i] {
+					t.Fatalf("got entries %v want %v", ids, tc.wantIds)
+				}
+			}
+			if res.GetNextPageToken() != tc.wantPageToken {
+				t.Fatalf("got page token %q want %q", res.GetNextPageToken(), tc.wantPageToken)
+			}
+			if first := res.GetEntries()[0]; first.GetActorName() != "admin" || first.GetIp() != "10.0.0.7" || first.GetAfter() == "" {
+				t.Fatalf("got entry %v", first)
+			}
+		})
+	}
+}
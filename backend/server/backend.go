@@ -7,6 +7,9 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"log"
 	"net"
+	"net/http"
+	"net/smtp"
+	"os"
 	"time"
 
 	"database/sql"
@@ -23,15 +26,32 @@ import (
 var (
 	removePosterMaxDistance = 30
 	port                    = flag.Int("port", 50051, "The server port")
-	placePosterQuery        = "insert into fyp_schema.posters (partyId, userId, created,updated,location) values (?,?,NOW(),NOW(),point(?,?))"
+	tilePort                = flag.Int("tile-port", 8080, "The port vector tiles of posters are served on over HTTP")
+	importZonesFile         = flag.String("import-zones", "", "GeoJSON file of exclusion zones that apply to every party. the zones are imported and the server exits")
+	flagZones               = flag.Bool("flag-zones", false, "flag placements inside imported zones instead of rejecting them")
+	escalationInterval      = flag.Duration("escalation-interval", 15*time.Minute, "how often posters close to their removal deadline are checked for escalation")
+	escalationDueSoon       = flag.Duration("escalation-due-soon", 48*time.Hour, "how long before the removal deadline placers are warned and posters are reported as due soon")
+	escalationAdminAfter    = flag.Duration("escalation-admin-after", 24*time.Hour, "how long after the removal deadline party admins are told about posters still up")
+	escalationAdminEvery    = flag.Duration("escalation-admin-every", 72*time.Hour, "how often party admins are told again about posters still up")
+	smtpAddr                = flag.String("smtp-addr", "", "host:port of the SMTP server email notifications are sent through, email is disabled if not set. credentials are read from the SMTP_USERNAME and SMTP_PASSWORD environment variables")
+	smtpFrom                = flag.String("smtp-from", "posters@localhost", "address email notifications are sent from")
+	pushEndpoint            = flag.String("push-endpoint", "https://fcm.googleapis.com/fcm/send", "FCM compatible endpoint push notifications are sent to, the server key is read from the PUSH_SERVER_KEY environment variable and push is disabled if it is not set")
+	createRegulatorName     = flag.String("create-regulator", "", "username of a local authority regulator account to create, the password is read from the REGULATOR_PASSWORD environment variable. the account is created and the server exits")
+	regulatorJurisdiction   = flag.Int("regulator-jurisdiction", 0, "jurisdictionId the regulator created with -create-regulator can see posters in")
+	importJurisdictionsFile = flag.String("import-jurisdictions", "", "GeoJSON file of local authority boundaries with their poster rules. the jurisdictions are imported and the server exits")
+	placePosterQuery        = "insert into fyp_schema.posters (partyId, userId, created,updated,location,changeSeq,jurisdictionId,heightCm,permitNumber,plannedSiteId,designId) values (?,?,NOW(),NOW(),point(?,?),?,?,?,?,?,?)"
 	checkPosterQuery        = "select partyId, posterId from fyp_schema.posters where posterId = ?"
-	outstandingPosterQuery  = `	select unix_timestamp(l2.created), l2.posterId, l2.userId, l4.username,l3.firstName, l3.lastName
+	outstandingPosterQuery  = `	select unix_timestamp(l2.created), l2.posterId, l2.userId, l4.username,l3.firstName, l3.lastName, l5.name, l5.removalDaysAfter, l2.created < l1.startDate
 								from fyp_schema.elections as l1
 								join fyp_schema.posters as l2 on l1.partyId = l2.partyID
 								join fyp_schema.userinfo as l3 on l2.userID = l3.userID
 								join fyp_schema.users as l4 on l2.userId = l4.userId
-								where l1.partyId = ? and l2.removed is null and l2.created > l1.startDate;`
-	removePosterQuery    = "update fyp_schema.posters set removed = now(), updated = now(), removedBy = ? where posterID = ? and partyID = ?;"
+								left join fyp_schema.jurisdictions as l5 on l2.jurisdictionId = l5.jurisdictionId
+								where l1.partyId = ? and l1.closed is null and l2.removed is null;`
+	outstandingViolationsQuery = `select l1.posterId, l1.detail from fyp_schema.posterViolations as l1
+								join fyp_schema.posters as l2 on l1.posterId = l2.posterID
+								where l2.partyId = ? and l2.removed is null order by l1.id`
+	removePosterQuery    = "update fyp_schema.posters set removed = now(), updated = now(), removedBy = ?, changeSeq = ? where posterID = ? and partyID = ?;"
 	registerAccountQuery = "insert into fyp_schema.users (partyId, username, pwhash) values (1,?,?)"
 	accountExistsQuery   = "select username, userId from fyp_schema.users where username = ?"
 	addUserinfoQuery     = "insert into fyp_schema.userinfo (userID, firstName, lastName,location) values (?,?,?,null)"
@@ -42,7 +62,16 @@ var (
 
 type server struct {
 	pb.UnimplementedPosterAppServer
-	DB *sql.DB
+	DB  *sql.DB
+	hub *posterHub
+	// limits ReportPoster, which can be called without an account
+	reportLimiter *rateLimiter
+	// nil if party webhooks are not sent
+	webhooks *webhookDispatcher
+	// publishes events written to the outbox, nil if they are only recorded
+	outbox *outboxDispatcher
+	// posters this close to their removal deadline are reported as due soon
+	removalDueSoon time.Duration
 }
 type Account struct {
 	Username  string
@@ -64,12 +93,15 @@ type PosterUpdate struct {
 	location pb.Location
 }
 type OutstandingPoster struct {
-	created   int64
-	posterId  int32
-	userID    int32
-	username  string
-	firstName string
-	lastName  string
+	created      int64
+	posterId     int32
+	userID       int32
+	username     string
+	firstName    string
+	lastName     string
+	jurisdiction sql.NullString
+	rules        ruleSet
+	preElection  bool
 }
 
 func hash(password string) (string, error) {
@@ -109,23 +141,32 @@ func (s *server) OutstandingPosters(ctx context.Context, in *pb.PosterTimeReques
 		return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query outsatanding posters: %v", err)
 	}
 
-	var posters []*pb.PosterUser
+	var posters, preElectionPosters []*pb.PosterUser
+	rules := make(map[*pb.PosterUser]ruleSet)
 	for rows.Next() {
 		var poster OutstandingPoster
-		err = rows.Scan(&poster.created, &poster.posterId, &poster.userID, &poster.username, &poster.firstName, &poster.lastName)
+		err = rows.Scan(&poster.created, &poster.posterId, &poster.userID, &poster.username, &poster.firstName, &poster.lastName, &poster.jurisdiction, &poster.rules.removalDaysAfter, &poster.preElection)
 		if err != nil {
 			return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read from from sql result: %v", err)
 		}
-		posters = append(posters, &pb.PosterUser{
-			Poster:    &pb.Poster{Posterid: poster.posterId, PlacedBy: poster.userID},
-			Created:   timestamppb.New(time.Unix(poster.created, 0)),
-			Username:  poster.username,
-			FirstName: poster.firstName,
-			LastName:  poster.lastName,
-		})
+		posterUser := &pb.PosterUser{
+			Poster:       &pb.Poster{Posterid: poster.posterId, PlacedBy: poster.userID},
+			Created:      timestamppb.New(time.Unix(poster.created, 0)),
+			Username:     poster.username,
+			FirstName:    poster.firstName,
+			LastName:     poster.lastName,
+			Jurisdiction: poster.jurisdiction.String,
+		}
+		// posters placed before the election still have to come down, so they are reported on their own
+		if poster.preElection {
+			preElectionPosters = append(preElectionPosters, posterUser)
+		} else {
+			posters = append(posters, posterUser)
+		}
+		rules[posterUser] = poster.rules
 	}
 	rows.Close()
-	rows, err = s.DB.Query("select unix_timestamp(endDate) from fyp_schema.elections where partyId = ?", in.GetPartyId())
+	rows, err = s.DB.Query("select unix_timestamp(endDate), removalDaysAfter from fyp_schema.elections where partyId = ? and closed is null", in.GetPartyId())
 	if err != nil {
 		return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query election end date: %v", err)
 	}
@@ -133,15 +174,47 @@ func (s *server) OutstandingPosters(ctx context.Context, in *pb.PosterTimeReques
 		return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("party admin must create an election first")
 	}
 	var electionDate int64
-	err = rows.Scan(&electionDate)
+	var graceDays int32
+	err = rows.Scan(&electionDate, &graceDays)
 	if err != nil {
 		return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read election date from query: %v", err)
 	}
 	rows.Close()
-	return &pb.PosterTimeResponse{Code: pb.ResponseCode_OK, Posters: posters, RemovalDate: timestamppb.New(time.Unix(electionDate, 0))}, nil
+	// posters in a jurisdiction have to be removed by the date its rules give, the rest within the grace period of the election type
+	removalDate := time.Unix(electionDate, 0).Add(days(graceDays))
+	now := time.Now()
+	byId := make(map[int32]*pb.PosterUser)
+	for poster, posterRules := range rules {
+		deadline, ok := posterRules.removalDeadline(time.Unix(electionDate, 0))
+		if !ok {
+			deadline = removalDate
+		}
+		status, remaining := removalStatus(deadline, now, s.removalDueSoon)
+		poster.RemovalDeadline = timestamppb.New(deadline)
+		poster.RemovalStatus = status
+		poster.SecondsRemaining = int64(remaining / time.Second)
+		byId[poster.GetPoster().GetPosterid()] = poster
+	}
+
+	rows, err = s.DB.Query(outstandingViolationsQuery, in.GetPartyId())
+	if err != nil {
+		return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query poster violations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var posterId int32
+		var detail string
+		if err = rows.Scan(&posterId, &detail); err != nil {
+			return &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read poster violations: %v", err)
+		}
+		if poster, ok := byId[posterId]; ok {
+			poster.Violations = append(poster.Violations, detail)
+		}
+	}
+	return &pb.PosterTimeResponse{Code: pb.ResponseCode_OK, Posters: posters, PreElectionPosters: preElectionPosters, RemovalDate: timestamppb.New(removalDate)}, nil
 }
 
-// NewElection updates the current election dates for a party
+// NewElection starts a new election for a party. The party's open election is closed and its posters archived.
 func (s *server) NewElection(ctx context.Context, in *pb.CreateElectionRequest) (*pb.CreateElectionResponse, error) {
 	if in.GetAuthKey() == "" {
 		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey not set")
@@ -176,15 +249,68 @@ func (s *server) NewElection(ctx context.Context, in *pb.CreateElectionRequest)
 	if in.GetStartDate().GetSeconds() >= in.GetElectionDate().GetSeconds() {
 		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("election date must come after the start date")
 	}
+	if _, ok := pb.ElectionType_name[int32(in.GetElectionType())]; !ok {
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("unknown election type %d", in.GetElectionType())
+	}
 
-	// add election to database, replacing the old election if it exists
-	_, err = s.DB.Exec("replace into fyp_schema.elections (partyId, startDate, endDate) values (?,from_unixtime(?),from_unixtime(?))", in.GetPartyId(), in.GetStartDate().AsTime().Unix(), in.GetElectionDate().AsTime().Unix())
-
+	_ = rows.Close()
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
-		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update election %v", err)
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction %v", err)
+	}
+	previous, err := openElection(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query election %v", err)
+	}
+	if previous != nil {
+		if err = closeElection(ctx, tx, previous, in.GetPartyId(), in.GetUserId(), time.Now()); err != nil {
+			_ = tx.Rollback()
+			return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+	}
+	var graceDays int32
+	if err = tx.QueryRow(electionTypeQuery, int32(in.GetElectionType())).Scan(&graceDays); err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query election type %v", err)
+	}
+	name := electionName(in.GetName(), in.GetElectionDate().AsTime())
+	res, err := tx.Exec(insertElectionQuery, in.GetPartyId(), name, int32(in.GetElectionType()),
+		in.GetStartDate().AsTime().Unix(), in.GetElectionDate().AsTime().Unix(), graceDays)
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create election %v", err)
+	}
+	electionId, err := res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create election %v", err)
+	}
+	entry := auditEntry{
+		action:  pb.AuditAction_AUDIT_ELECTION_SET,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after: electionAudit{
+			ElectionId:       int32(electionId),
+			Name:             name,
+			ElectionType:     in.GetElectionType(),
+			StartDate:        time.Unix(in.GetStartDate().AsTime().Unix(), 0).UTC(),
+			EndDate:          time.Unix(in.GetElectionDate().AsTime().Unix(), 0).UTC(),
+			RemovalDaysAfter: graceDays,
+		},
+	}
+	if previous != nil {
+		entry.before = previous
+	}
+	if err = writeAudit(ctx, tx, entry); err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record election change %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.CreateElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create election %v", err)
 	}
 
-	return &pb.CreateElectionResponse{Code: pb.ResponseCode_OK}, nil
+	return &pb.CreateElectionResponse{Code: pb.ResponseCode_OK, ElectionId: int32(electionId)}, nil
 }
 
 // RetrieveProfileStats retrieves information about a given user.
@@ -281,14 +407,30 @@ func (s *server) ApproveMembers(ctx context.Context, in *pb.ApproveMemberRequest
 			if err != nil {
 				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to close rows: %v", err)
 			}
+			// the users posters are leaving their old party, clients following its changes have to resync
+			_, err = tx.Exec(resyncPartyQuery, member.GetUserId())
+			if err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update change sequence: %v", err)
+			}
+			var previousParty int32
+			if err = tx.QueryRow(previousPartyQuery, member.GetUserId()).Scan(&previousParty); err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query users party: %v", err)
+			}
 			// update users party
 			_, err = tx.Exec("update fyp_schema.users set partyId = ? where userId = ?", in.GetPartyId(), member.GetUserId())
 			if err != nil {
 				_ = tx.Rollback()
 				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update user: %v", err)
 			}
+			seq, err := nextChangeSeq(tx, in.GetPartyId())
+			if err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update change sequence: %v", err)
+			}
 			// update users posters to belong to new party
-			_, err = tx.Exec("update fyp_schema.posters set partyId = ? where userId = ? and posterId > 0", in.GetPartyId(), member.GetUserId())
+			_, err = tx.Exec("update fyp_schema.posters set partyId = ?, changeSeq = ? where userId = ? and posterId > 0", in.GetPartyId(), seq, member.GetUserId())
 			if err != nil {
 				_ = tx.Rollback()
 				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update users posters: %v", err)
@@ -299,6 +441,22 @@ func (s *server) ApproveMembers(ctx context.Context, in *pb.ApproveMemberRequest
 				_ = tx.Rollback()
 				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update join request: %v", err)
 			}
+			if err = writeOutbox(tx, memberEvent(eventMemberApproved, in.GetPartyId(), member)); err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record member approval: %v", err)
+			}
+			err = writeAudit(ctx, tx, auditEntry{
+				action:   pb.AuditAction_AUDIT_MEMBER_APPROVED,
+				partyId:  in.GetPartyId(),
+				actorId:  in.GetUserId(),
+				targetId: member.GetUserId(),
+				before:   membershipAudit{PartyId: previousParty, JoinRequest: "pending"},
+				after:    membershipAudit{PartyId: in.GetPartyId(), JoinRequest: "approved"},
+			})
+			if err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record member approval: %v", err)
+			}
 		}
 	}
 
@@ -310,9 +468,28 @@ func (s *server) ApproveMembers(ctx context.Context, in *pb.ApproveMemberRequest
 				_ = tx.Rollback()
 				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update join request: %v", err)
 			}
+			if err = writeOutbox(tx, memberEvent(eventMemberDenied, in.GetPartyId(), member)); err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record member denial: %v", err)
+			}
+			err = writeAudit(ctx, tx, auditEntry{
+				action:   pb.AuditAction_AUDIT_MEMBER_DENIED,
+				partyId:  in.GetPartyId(),
+				actorId:  in.GetUserId(),
+				targetId: member.GetUserId(),
+				before:   membershipAudit{JoinRequest: "pending"},
+				after:    membershipAudit{JoinRequest: "denied"},
+			})
+			if err != nil {
+				_ = tx.Rollback()
+				return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record member denial: %v", err)
+			}
 		}
 	}
-	_ = tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return &pb.ApproveMemberResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit member review: %v", err)
+	}
+	s.outbox.poke()
 	return &pb.ApproveMemberResponse{Code: pb.ResponseCode_OK}, nil
 }
 
@@ -423,7 +600,26 @@ func (s *server) JoinParty(ctx context.Context, in *pb.JoinPartyRequest) (*pb.Jo
 		_ = tx.Rollback()
 		return &pb.JoinPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create join request")
 	}
-	_ = tx.Commit()
+	err = writeOutbox(tx, domainEvent{Kind: eventJoinRequested, PartyId: in.GetPartyId(), Member: &webhookMember{UserId: in.GetUserId()}})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.JoinPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record join request: %v", err)
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:   pb.AuditAction_AUDIT_JOIN_REQUESTED,
+		partyId:  in.GetPartyId(),
+		actorId:  in.GetUserId(),
+		targetId: in.GetUserId(),
+		after:    membershipAudit{JoinRequest: "pending"},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.JoinPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record join request: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.JoinPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit join request: %v", err)
+	}
+	s.outbox.poke()
 	return &pb.JoinPartyResponse{Code: pb.ResponseCode_OK}, nil
 }
 
@@ -496,13 +692,26 @@ func (s *server) RegisterParty(ctx context.Context, in *pb.RegisterPartyRequest)
 		_ = tx.Rollback()
 		return &pb.RegisterPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update users party")
 	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:   pb.AuditAction_AUDIT_PARTY_REGISTERED,
+		partyId:  int32(partyId),
+		actorId:  in.GetUserId(),
+		targetId: in.GetUserId(),
+		after:    partyAudit{PartyName: in.GetPartyName(), Admin: in.GetUserId()},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RegisterPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record new party %v", err)
+	}
 	userClaims.PartyId = int32(partyId)
 	authKey, err := tokenService.NewAccessToken(*userClaims)
 	if err != nil {
 		_ = tx.Rollback()
 		return &pb.RegisterPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create new authKey %v", err)
 	}
-	_ = tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return &pb.RegisterPartyResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit new party: %v", err)
+	}
 	return &pb.RegisterPartyResponse{Code: pb.ResponseCode_OK, PartyId: int32(partyId), AuthKey: authKey}, nil
 }
 
@@ -529,15 +738,138 @@ func (s *server) PlacePoster(ctx context.Context, in *pb.PlacementRequest) (*pb.
 	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
 		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
 	}
-	res, err := s.DB.Exec(placePosterQuery, in.GetPartyId(), in.GetUserId(), in.GetLocation().Lng, in.GetLocation().Lat)
+	// posters can only be placed during the election unless an admin overrides it
+	startDate, pollingDay, hasElection, err := s.electionDates(in.GetPartyId())
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query election dates: %v", err)
+	}
+	var violations []posterViolation
+	// set if an admin placed the poster outside the election window
+	overridden := false
+	if code, err := electionWindow(time.Now(), startDate, pollingDay, hasElection); err != nil {
+		if in.GetOverrideReason() == "" {
+			return &pb.PlacementResponse{Code: code}, err
+		}
+		rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+		if err != nil {
+			return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+		}
+		if !rows.Next() {
+			_ = rows.Close()
+			return &pb.PlacementResponse{Code: code}, fmt.Errorf("only party admin can place posters outside the election window")
+		}
+		_ = rows.Close()
+		overridden = true
+		violations = append(violations, posterViolation{source: "election_window", sourceId: in.GetUserId(), detail: "placed outside the election window: " + in.GetOverrideReason()})
+	}
+	// check that the poster is not inside an exclusion zone
+	zones, err := s.zonesAt(in.GetPartyId(), in.GetLocation())
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check exclusion zones: %v", err)
+	}
+	for _, zone := range zones {
+		if zone.enforcement == pb.ZoneEnforcement_REJECT_PLACEMENT {
+			return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("posters can not be placed inside exclusion zone: %s", zone.name)
+		}
+		violations = append(violations, posterViolation{source: "exclusion_zone", sourceId: zone.zoneId, detail: fmt.Sprintf("poster is inside exclusion zone: %s", zone.name)})
+	}
+	// check the placement against the poster law where it is being placed
+	rules, err := s.jurisdictionAt(in.GetLocation())
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to look up jurisdiction: %v", err)
+	}
+	var jurisdictionId sql.NullInt32
+	if rules != nil {
+		jurisdictionId = sql.NullInt32{Int32: rules.jurisdictionId, Valid: true}
+		violations = append(violations, rules.check(placement{placed: time.Now(), heightCm: in.GetHeightCm(), permitNumber: in.GetPermitNumber()}, pollingDay)...)
+	}
+	// count the poster towards a planned site the user claimed
+	siteId, err := s.claimedSiteNear(in.GetPartyId(), in.GetUserId(), in.GetLocation())
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to look up planned sites: %v", err)
+	}
+	// take the poster out of the users stock if the party is tracking inventory
+	stock, err := s.volunteerStock(in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query poster stock: %v", err)
+	}
+	var designs []posterDesign
+	if in.GetDesignId() != 0 {
+		designs, err = posterDesigns(s.DB, in.GetPartyId())
+		if err != nil {
+			return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query poster designs: %v", err)
+		}
+	}
+	var designId sql.NullInt32
+	var stockWarning string
+	designId.Int32, stockWarning, designId.Valid, err = placementDesign(in.GetDesignId(), stock, designs)
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	seq, err := nextChangeSeq(tx, in.GetPartyId())
 	if err != nil {
+		_ = tx.Rollback()
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update change sequence: %v", err)
+	}
+	res, err := tx.Exec(placePosterQuery, in.GetPartyId(), in.GetUserId(), in.GetLocation().Lng, in.GetLocation().Lat, seq,
+		jurisdictionId, in.GetHeightCm(), in.GetPermitNumber(), siteId, designId)
+	if err != nil {
+		_ = tx.Rollback()
 		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to insert poster to database: %v", err)
 	}
 	id, err := res.LastInsertId()
 	if err != nil {
+		_ = tx.Rollback()
 		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to get posterId from query: %v", err)
 	}
-	return &pb.PlacementResponse{Code: pb.ResponseCode_OK, PosterId: int32(id)}, nil
+	if err = recordViolations(tx, id, violations); err != nil {
+		_ = tx.Rollback()
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster violations: %v", err)
+	}
+	if overridden {
+		err = writeAudit(ctx, tx, auditEntry{
+			action:  pb.AuditAction_AUDIT_ELECTION_WINDOW_OVERRIDDEN,
+			partyId: in.GetPartyId(),
+			actorId: in.GetUserId(),
+			after:   posterAudit{PosterId: int32(id), Location: in.GetLocation(), OverrideReason: in.GetOverrideReason()},
+		})
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record election window override: %v", err)
+		}
+	}
+	if designId.Valid {
+		_, err = tx.Exec(insertInventoryQuery, in.GetPartyId(), designId, int32(pb.InventoryKind_STOCK_PLACED), 1, in.GetUserId(), id, in.GetUserId())
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update poster stock: %v", err)
+		}
+	}
+	event, err := posterChangedEvent(pb.PosterChangeType_POSTER_PLACED,
+		&pb.Poster{PlacedBy: in.GetUserId(), Party: in.GetPartyId(), Posterid: int32(id), Location: in.GetLocation()}, seq)
+	if err == nil {
+		err = writeOutbox(tx, event)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster placement: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.PlacementResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit poster: %v", err)
+	}
+	s.outbox.poke()
+	var warnings []string
+	for _, violation := range violations {
+		warnings = append(warnings, violation.detail)
+	}
+	if stockWarning != "" {
+		warnings = append(warnings, stockWarning)
+	}
+	return &pb.PlacementResponse{Code: pb.ResponseCode_OK, PosterId: int32(id), Warnings: warnings, PlannedSiteId: siteId.Int32}, nil
 }
 
 // RemovePoster will attempt to remove a poster from the database at a specific location.
@@ -583,10 +915,32 @@ func (s *server) RemovePoster(ctx context.Context, in *pb.RemovePosterRequest) (
 		return &pb.RemovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to scan sql result: %v", err)
 	}
 
-	_, err = s.DB.Exec(removePosterQuery, in.GetUserId(), poster.posterId, in.GetPartyId())
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.RemovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	seq, err := nextChangeSeq(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RemovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update change sequence: %v", err)
+	}
+	_, err = tx.Exec(removePosterQuery, in.GetUserId(), seq, poster.posterId, in.GetPartyId())
 	if err != nil {
+		_ = tx.Rollback()
 		return &pb.RemovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to remove poster: %v", err)
 	}
+	event, err := posterChangedEvent(pb.PosterChangeType_POSTER_REMOVED, &pb.Poster{Party: in.GetPartyId(), Posterid: poster.posterId, Removed: true}, seq)
+	if err == nil {
+		err = writeOutbox(tx, event)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RemovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster removal: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.RemovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit poster removal: %v", err)
+	}
+	s.outbox.poke()
 	return &pb.RemovePosterResponse{Code: pb.ResponseCode_OK, Posterid: poster.posterId}, nil
 }
 
@@ -690,8 +1044,9 @@ func (s *server) LoginAccount(ctx context.Context, in *pb.LoginRequest) (*pb.Log
 	return &pb.LoginResponse{AuthKey: accessToken, Code: pb.ResponseCode_OK, Party: result.PartyName, UserId: int32(result.UserId), PartyId: int32(result.PartyId)}, nil
 }
 
-// RetrieveUpdates will request all changes to the poster database that have been made since
-// the time specified in the lastupdated field in the request
+// RetrieveUpdates will request changes to the poster database made after the position given in the cursor field.
+// Clients without a cursor can use the lastupdated field to request changes made since a time instead.
+// Changes are returned one page at a time along with the cursor to use for the next request.
 func (s *server) RetrieveUpdates(ctx context.Context, in *pb.UpdateRequest) (*pb.UpdateResponse, error) {
 	if in.GetAuthKey() == "" {
 		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("no authkey provided")
@@ -702,8 +1057,15 @@ func (s *server) RetrieveUpdates(ctx context.Context, in *pb.UpdateRequest) (*pb
 	if in.GetPartyid() == 0 {
 		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("no partyId provided")
 	}
-	if in.GetLastUpdated() == nil {
-		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("no lastUpdated provided")
+	if in.GetLastUpdated() == nil && in.GetCursor() == "" {
+		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("no lastUpdated or cursor provided")
+	}
+	pageSize := int(in.GetPageSize())
+	if pageSize < 0 || pageSize > maxUpdatesPageSize {
+		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("page size must be between 1 and %d", maxUpdatesPageSize)
+	}
+	if pageSize == 0 {
+		pageSize = defaultUpdatesPageSize
 	}
 
 	// verify authkey
@@ -715,26 +1077,43 @@ func (s *server) RetrieveUpdates(ctx context.Context, in *pb.UpdateRequest) (*pb
 		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
 	}
 
-	rows, err := s.DB.Query("select posterID, partyId, userID, removed, st_y(location) as latitude, st_x(location) as longitude from fyp_schema.posters where partyId = ? and updated > from_unixtime(?)", in.Partyid, in.LastUpdated.AsTime().Unix())
-	if err != nil {
-		return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query database for posters %v", err)
-	}
-	defer rows.Close()
 	var posters []*pb.Poster
-	for rows.Next() {
-		var poster PosterUpdate
-		removed := []uint8{}
-		t := false
-		err = rows.Scan(&poster.PosterId, &poster.PartyId, &poster.UserID, &removed, &poster.location.Lat, &poster.location.Lng)
+	var positions []changeCursor
+	if in.GetCursor() != "" {
+		cursor, err := parseChangeCursor(in.GetCursor())
+		if err != nil {
+			return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+		resync, err := s.needsResync(cursor, in.GetPartyid())
 		if err != nil {
-			return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to get updates %v", err)
+			return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check cursor: %v", err)
 		}
-		if removed != nil {
-			t = true
+		// the client has to throw away its posters and start again using lastUpdated
+		if resync {
+			return &pb.UpdateResponse{Code: pb.ResponseCode_OK, ResyncRequired: true}, nil
 		}
-		posters = append(posters, &pb.Poster{PlacedBy: poster.UserID, Party: poster.PartyId, Posterid: poster.PosterId, Location: &poster.location, Removed: t})
+		// ask for one more poster than the page size so we know if there are more pages
+		posters, positions, err = s.postersChangedSince(cursor, pageSize+1)
+		if err != nil {
+			return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+	} else {
+		var err error
+		posters, positions, err = s.postersUpdatedSince(in.GetPartyid(), in.GetLastUpdated().AsTime().Unix(), pageSize+1)
+		if err != nil {
+			return &pb.UpdateResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+	}
+
+	hasMore := len(posters) > pageSize
+	if hasMore {
+		posters, positions = posters[:pageSize], positions[:pageSize]
+	}
+	cursor := in.GetCursor()
+	if len(positions) > 0 {
+		cursor = positions[len(positions)-1].String()
 	}
-	return &pb.UpdateResponse{Posters: posters, Code: pb.ResponseCode_OK}, nil
+	return &pb.UpdateResponse{Posters: posters, Code: pb.ResponseCode_OK, Cursor: cursor, HasMore: hasMore}, nil
 }
 
 // RetrieveParties will return a list of all parties available for a user to join
@@ -767,19 +1146,92 @@ func (s *server) RetrieveParties(ctx context.Context, in *pb.RetrievePartiesRequ
 
 func main() {
 	flag.Parse()
-	lis, err := net.Listen("tcp", fmt.Sprintf("192.168.0.194:%d", *port))
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
-	}
-
 	db, err := sql.Open("mysql", "root:root@tcp(127.0.0.1:3306)/fyp_schema")
 	defer db.Close()
 
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *importZonesFile != "" {
+		enforcement := pb.ZoneEnforcement_REJECT_PLACEMENT
+		if *flagZones {
+			enforcement = pb.ZoneEnforcement_FLAG_PLACEMENT
+		}
+		n, err := importSiteZones(db, *importZonesFile, enforcement)
+		if err != nil {
+			log.Fatalf("failed to import exclusion zones: %v", err)
+		}
+		log.Printf("imported %d exclusion zones", n)
+		return
+	}
+	if *importJurisdictionsFile != "" {
+		n, err := importJurisdictions(db, *importJurisdictionsFile)
+		if err != nil {
+			log.Fatalf("failed to import jurisdictions: %v", err)
+		}
+		log.Printf("imported %d jurisdictions", n)
+		return
+	}
+
+	if *createRegulatorName != "" {
+		if err := createRegulator(db, *createRegulatorName, os.Getenv("REGULATOR_PASSWORD"), *regulatorJurisdiction); err != nil {
+			log.Fatalf("failed to create regulator: %v", err)
+		}
+		log.Printf("created regulator %s", *createRegulatorName)
+		return
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("192.168.0.194:%d", *port))
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	notifications := &notificationService{
+		db:       db,
+		channels: map[pb.NotificationChannel]notifier{pb.NotificationChannel_NOTIFICATION_WEBHOOK: &webhookNotifier{client: newWebhookClient(10 * time.Second)}},
+	}
+	if *smtpAddr != "" {
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			host, _, _ := net.SplitHostPort(*smtpAddr)
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		notifications.channels[pb.NotificationChannel_NOTIFICATION_EMAIL] = &smtpNotifier{addr: *smtpAddr, from: *smtpFrom, auth: auth}
+	}
+	if key := os.Getenv("PUSH_SERVER_KEY"); key != "" {
+		notifications.channels[pb.NotificationChannel_NOTIFICATION_PUSH] = &pushNotifier{endpoint: *pushEndpoint, serverKey: key, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	webhooks := newWebhookDispatcher(db, newWebhookClient(webhookTimeout))
+	go webhooks.run(context.Background())
+	hub := newPosterHub()
+	// streams come first so slow notification channels don't hold up watchers
+	outbox := newOutboxDispatcher(db, hub.handleEvent, notifications.handleEvent, webhooks.handleEvent)
+	go outbox.run(context.Background())
+	app := &server{
+		DB:             db,
+		hub:            hub,
+		reportLimiter:  newRateLimiter(reportsPerWindow, reportWindow),
+		webhooks:       webhooks,
+		outbox:         outbox,
+		removalDueSoon: *escalationDueSoon,
+	}
+	escalations := &escalationScheduler{
+		db:            db,
+		notifications: notifications,
+		interval:      *escalationInterval,
+		policy:        escalationPolicy{dueSoon: *escalationDueSoon, adminAfter: *escalationAdminAfter, adminEvery: *escalationAdminEvery},
+	}
+	go escalations.run(context.Background())
+	go func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/tiles/", app.serveTile)
+		addr := fmt.Sprintf("192.168.0.194:%d", *tilePort)
+		log.Printf("serving vector tiles at %v", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("failed to serve vector tiles: %v", err)
+		}
+	}()
 	s := grpc.NewServer()
-	pb.RegisterPosterAppServer(s, &server{DB: db})
+	pb.RegisterPosterAppServer(s, app)
 	log.Printf("server listening at %v", lis.Addr())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"database/sql/driver"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"log"
+	"math"
 	"testing"
 	"time"
 
@@ -18,6 +20,10 @@ import (
 )
 
 func TestOutstandingPosters(t *testing.T) {
+	electionDate := time.Now().Truncate(time.Second)
+	// posters outside a jurisdiction with a removal rule have to come down within the grace period of the election type
+	graceDays := int32(3)
+	removalDate := electionDate.Add(days(graceDays))
 
 	tests := []struct {
 		name         string
@@ -31,26 +37,26 @@ func TestOutstandingPosters(t *testing.T) {
 		{
 			name:    "userId not set",
 			partyId: 1,
-			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName"}).
-				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1").
-				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2").
-				AddRow(time.Now().Unix(), 3, 3, "michael1236", "Michael", "test3").
-				AddRow(time.Now().Unix(), 4, 4, "michael1237", "Michael", "test4"),
+			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName", "jurisdiction", "removalDaysAfter", "preElection"}).
+				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1", nil, nil, false).
+				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2", nil, nil, false).
+				AddRow(time.Now().Unix(), 3, 3, "michael1236", "Michael", "test3", nil, nil, false).
+				AddRow(time.Now().Unix(), 4, 4, "michael1237", "Michael", "test4", nil, nil, false),
 
-			electionDate: time.Now(),
+			electionDate: electionDate,
 			wantErr:      true,
 			wantRes:      &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED},
 		},
 		{
 			name:   "partyId not set",
 			userId: 1,
-			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName"}).
-				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1").
-				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2").
-				AddRow(time.Now().Unix(), 3, 3, "michael1236", "Michael", "test3").
-				AddRow(time.Now().Unix(), 4, 4, "michael1237", "Michael", "test4"),
+			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName", "jurisdiction", "removalDaysAfter", "preElection"}).
+				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1", nil, nil, false).
+				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2", nil, nil, false).
+				AddRow(time.Now().Unix(), 3, 3, "michael1236", "Michael", "test3", nil, nil, false).
+				AddRow(time.Now().Unix(), 4, 4, "michael1237", "Michael", "test4", nil, nil, false),
 
-			electionDate: time.Now(),
+			electionDate: electionDate,
 			wantErr:      true,
 			wantRes:      &pb.PosterTimeResponse{Code: pb.ResponseCode_FAILED},
 		},
@@ -58,23 +64,54 @@ func TestOutstandingPosters(t *testing.T) {
 			name:    "success",
 			partyId: 1,
 			userId:  1,
-			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName"}).
-				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1").
-				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2").
-				AddRow(time.Now().Unix(), 3, 3, "michael1236", "Michael", "test3").
-				AddRow(time.Now().Unix(), 4, 4, "michael1237", "Michael", "test4"),
+			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName", "jurisdiction", "removalDaysAfter", "preElection"}).
+				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1", "dublin city", 7, false).
+				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2", nil, nil, false).
+				AddRow(time.Now().Unix(), 3, 3, "michael1236", "Michael", "test3", nil, nil, false).
+				AddRow(time.Now().Unix(), 4, 4, "michael1237", "Michael", "test4", nil, nil, false).
+				AddRow(time.Now().Unix(), 5, 5, "michael1238", "Michael", "test5", nil, nil, true),
+
+			electionDate: electionDate,
+			wantErr:      false,
+			wantRes: &pb.PosterTimeResponse{
+				Code: pb.ResponseCode_OK,
+				Posters: []*pb.PosterUser{
+					{Poster: &pb.Poster{PlacedBy: 1, Posterid: 1}, Username: "michael1234", FirstName: "Michael", LastName: "test1", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(electionDate.Add(7 * 24 * time.Hour)), RemovalStatus: pb.RemovalStatus_REMOVAL_OK},
+					{Poster: &pb.Poster{PlacedBy: 2, Posterid: 2}, Username: "michael1235", FirstName: "Michael", LastName: "test2", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(removalDate), RemovalStatus: pb.RemovalStatus_REMOVAL_DUE_SOON, Violations: []string{"dublin city: a permit is required to place posters"}},
+					{Poster: &pb.Poster{PlacedBy: 3, Posterid: 3}, Username: "michael1236", FirstName: "Michael", LastName: "test3", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(removalDate), RemovalStatus: pb.RemovalStatus_REMOVAL_DUE_SOON},
+					{Poster: &pb.Poster{PlacedBy: 4, Posterid: 4}, Username: "michael1237", FirstName: "Michael", LastName: "test4", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(removalDate), RemovalStatus: pb.RemovalStatus_REMOVAL_DUE_SOON},
+				},
+				PreElectionPosters: []*pb.PosterUser{
+					{Poster: &pb.Poster{PlacedBy: 5, Posterid: 5}, Username: "michael1238", FirstName: "Michael", LastName: "test5", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(removalDate), RemovalStatus: pb.RemovalStatus_REMOVAL_DUE_SOON},
+				},
+				RemovalDate: timestamppb.New(removalDate),
+			},
+		},
+		{
+			name:    "overdue",
+			partyId: 1,
+			userId:  1,
+			posterRows: sqlmock.NewRows([]string{"created", "posterId", "userID", "username", "firstName", "lastName", "jurisdiction", "removalDaysAfter", "preElection"}).
+				AddRow(time.Now().Unix(), 1, 1, "michael1234", "Michael", "test1", "dublin city", 7, false).
+				AddRow(time.Now().Unix(), 2, 2, "michael1235", "Michael", "test2", nil, nil, false),
 
-			electionDate: time.Now(),
+			electionDate: electionDate.Add(-5 * 24 * time.Hour),
 			wantErr:      false,
 			wantRes: &pb.PosterTimeResponse{
 				Code: pb.ResponseCode_OK,
 				Posters: []*pb.PosterUser{
-					{Poster: &pb.Poster{PlacedBy: 1, Posterid: 1}, Username: "michael1234", FirstName: "Michael", LastName: "test1", Created: timestamppb.Now()},
-					{Poster: &pb.Poster{PlacedBy: 2, Posterid: 2}, Username: "michael1235", FirstName: "Michael", LastName: "test2", Created: timestamppb.Now()},
-					{Poster: &pb.Poster{PlacedBy: 3, Posterid: 3}, Username: "michael1236", FirstName: "Michael", LastName: "test3", Created: timestamppb.Now()},
-					{Poster: &pb.Poster{PlacedBy: 4, Posterid: 4}, Username: "michael1237", FirstName: "Michael", LastName: "test4", Created: timestamppb.Now()},
+					{Poster: &pb.Poster{PlacedBy: 1, Posterid: 1}, Username: "michael1234", FirstName: "Michael", LastName: "test1", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(electionDate.Add(2 * 24 * time.Hour)), RemovalStatus: pb.RemovalStatus_REMOVAL_DUE_SOON},
+					{Poster: &pb.Poster{PlacedBy: 2, Posterid: 2}, Username: "michael1235", FirstName: "Michael", LastName: "test2", Created: timestamppb.Now(),
+						RemovalDeadline: timestamppb.New(electionDate.Add(-2 * 24 * time.Hour)), RemovalStatus: pb.RemovalStatus_REMOVAL_OVERDUE,
+						Violations: []string{"dublin city: a permit is required to place posters"}},
 				},
-				RemovalDate: timestamppb.Now(),
+				RemovalDate: timestamppb.New(electionDate.Add(-2 * 24 * time.Hour)),
 			},
 		},
 	}
@@ -88,11 +125,13 @@ func TestOutstandingPosters(t *testing.T) {
 				t.Fatalf("an error occured while creating fake sql database %v", err)
 
 			}
-			server := &server{DB: db}
+			server := &server{DB: db, removalDueSoon: 4 * 24 * time.Hour}
 
 			mock.ExpectQuery("select").WithArgs(tc.partyId).WillReturnRows(tc.posterRows)
-			electionRows := sqlmock.NewRows([]string{"electionDate"}).AddRow(tc.electionDate.Unix())
+			electionRows := sqlmock.NewRows([]string{"electionDate", "removalDaysAfter"}).AddRow(tc.electionDate.Unix(), graceDays)
 			mock.ExpectQuery("select").WithArgs(tc.partyId).WillReturnRows(electionRows)
+			violationRows := sqlmock.NewRows([]string{"posterId", "detail"}).AddRow(2, "dublin city: a permit is required to place posters")
+			mock.ExpectQuery("select").WithArgs(tc.partyId).WillReturnRows(violationRows)
 			userClaims := tokenService.UserClaims{
 				UserID:   tc.userId,
 				Username: "test",
@@ -119,6 +158,18 @@ func TestOutstandingPosters(t *testing.T) {
 			if len(res.GetPosters()) != len(tc.wantRes.GetPosters()) {
 				t.Fatalf("expected posters of length %v got posters of length %v", len(tc.wantRes.GetPosters()), len(res.GetPosters()))
 			}
+			if len(res.GetPreElectionPosters()) != len(tc.wantRes.GetPreElectionPosters()) {
+				t.Fatalf("expected pre election posters of length %v got %v", len(tc.wantRes.GetPreElectionPosters()), len(res.GetPreElectionPosters()))
+			}
+			if res.GetRemovalDate().GetSeconds() != tc.wantRes.GetRemovalDate().GetSeconds() {
+				t.Fatalf("expected removal date %v got %v", tc.wantRes.GetRemovalDate().AsTime(), res.GetRemovalDate().AsTime())
+			}
+			for i, val := range res.GetPreElectionPosters() {
+				if tc.wantRes.PreElectionPosters[i].Username != val.Username || tc.wantRes.PreElectionPosters[i].RemovalDeadline.GetSeconds() != val.RemovalDeadline.GetSeconds() ||
+					tc.wantRes.PreElectionPosters[i].RemovalStatus != val.RemovalStatus {
+					t.Fatalf("expected pre election poster %v got poster %v", tc.wantRes.PreElectionPosters[i], val)
+				}
+			}
 
 			for i, val := range res.GetPosters() {
 				if tc.wantRes.Posters[i].FirstName != val.FirstName {
@@ -130,6 +181,19 @@ func TestOutstandingPosters(t *testing.T) {
 				if tc.wantRes.Posters[i].LastName != val.LastName {
 					t.Fatalf("expected poster %v got poster %v", tc.wantRes.Posters[i], res.Posters[i])
 				}
+				if len(tc.wantRes.Posters[i].Violations) != len(val.Violations) {
+					t.Fatalf("expected violations %v got violations %v", tc.wantRes.Posters[i].Violations, val.Violations)
+				}
+				if tc.wantRes.Posters[i].RemovalDeadline.GetSeconds() != val.RemovalDeadline.GetSeconds() {
+					t.Fatalf("expected removal deadline %v got %v", tc.wantRes.Posters[i].RemovalDeadline.AsTime(), val.RemovalDeadline.AsTime())
+				}
+				if tc.wantRes.Posters[i].RemovalStatus != val.RemovalStatus {
+					t.Fatalf("expected removal status %v got %v", tc.wantRes.Posters[i].RemovalStatus, val.RemovalStatus)
+				}
+				// allow for the time the test takes
+				if remaining := time.Until(val.RemovalDeadline.AsTime()).Seconds(); math.Abs(remaining-float64(val.SecondsRemaining)) > 5 {
+					t.Fatalf("expected %v seconds remaining got %v", remaining, val.SecondsRemaining)
+				}
 			}
 
 		})
@@ -210,7 +274,7 @@ func TestNewElection(t *testing.T) {
 			wantErr:      false,
 			startDate:    timestamppb.New(time.Now().Add(time.Hour)),
 			electionDate: timestamppb.New(time.Now().Add(time.Hour + time.Hour*24*7)),
-			wantRes:      &pb.CreateElectionResponse{Code: pb.ResponseCode_OK},
+			wantRes:      &pb.CreateElectionResponse{Code: pb.ResponseCode_OK, ElectionId: 1},
 		},
 	}
 
@@ -226,7 +290,25 @@ func TestNewElection(t *testing.T) {
 			server := &server{DB: db}
 
 			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.queryRows)
-			mock.ExpectExec("replace").WithArgs(tc.partyId, tc.startDate.AsTime().Unix(), tc.electionDate.AsTime().Unix()).WillReturnResult(tc.execRes)
+			mock.ExpectBegin()
+			// the open election is closed and archived before the new one is created
+			previous := `{"electionId":3,"name":"Election 2024-06-08","electionType":0,"startDate":"2024-06-01T00:00:00Z","endDate":"2024-06-08T00:00:00Z","removalDaysAfter":7}`
+			mock.ExpectQuery("select electionId").WithArgs(tc.partyId).
+				WillReturnRows(sqlmock.NewRows([]string{"electionId", "name", "electionType", "startDate", "endDate", "removalDaysAfter"}).AddRow(3, "Election 2024-06-08", 0, 1717200000, 1717804800, 7))
+			mock.ExpectExec("insert into fyp_schema.electionPosters").WithArgs(int32(3)).WillReturnResult(sqlmock.NewResult(0, 12))
+			mock.ExpectExec("update fyp_schema.elections set closed").WithArgs(sqlmock.AnyArg(), tc.userId, int32(3)).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("insert into fyp_schema.auditLog").
+				WithArgs(int32(pb.AuditAction_AUDIT_ELECTION_CLOSED), tc.partyId, tc.userId, int32(0), "", previous, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectQuery("select removalDaysAfter").WithArgs(int32(pb.ElectionType_LOCAL_ELECTION)).WillReturnRows(sqlmock.NewRows([]string{"removalDaysAfter"}).AddRow(5))
+			name := "Election " + tc.electionDate.AsTime().Format("2006-01-02")
+			mock.ExpectExec("insert into fyp_schema.elections").
+				WithArgs(tc.partyId, name, int32(pb.ElectionType_LOCAL_ELECTION), tc.startDate.AsTime().Unix(), tc.electionDate.AsTime().Unix(), int32(5)).WillReturnResult(tc.execRes)
+			mock.ExpectExec("insert into fyp_schema.auditLog").
+				WithArgs(int32(pb.AuditAction_AUDIT_ELECTION_SET), tc.partyId, tc.userId, int32(0), "", previous,
+					fmt.Sprintf(`{"electionId":1,"name":%q,"electionType":1,"startDate":%q,"endDate":%q,"removalDaysAfter":5}`, name, tc.startDate.AsTime().Truncate(time.Second).Format(time.RFC3339), tc.electionDate.AsTime().Truncate(time.Second).Format(time.RFC3339))).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 			userClaims := tokenService.UserClaims{
 				UserID:   tc.userId,
 				Username: "test",
@@ -246,6 +328,7 @@ func TestNewElection(t *testing.T) {
 				PartyId:      tc.partyId,
 				StartDate:    tc.startDate,
 				ElectionDate: tc.electionDate,
+				ElectionType: pb.ElectionType_LOCAL_ELECTION,
 			})
 
 			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
@@ -458,13 +541,28 @@ func TestApproveMembers(t *testing.T) {
 						WillReturnRows(sqlmock.NewRows([]string{"id"}))
 
 				}
+				mock.ExpectExec("update fyp_schema.parties").WithArgs(member.GetUserId()).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("select partyId from fyp_schema.users").WithArgs(member.GetUserId()).WillReturnRows(sqlmock.NewRows([]string{"partyId"}).AddRow(1))
 				mock.ExpectExec("update fyp_schema.users").WithArgs(tc.partyId, member.GetUserId()).WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("update fyp_schema.posters").WithArgs(tc.partyId, member.GetUserId()).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("update fyp_schema.parties").WithArgs(tc.partyId).WillReturnResult(sqlmock.NewResult(5, 1))
+				mock.ExpectExec("update fyp_schema.posters").WithArgs(tc.partyId, 5, member.GetUserId()).WillReturnResult(sqlmock.NewResult(1, 1))
 				mock.ExpectExec("update fyp_schema.joinRequests").WithArgs(member.GetUserId(), tc.partyId).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into fyp_schema.outboxEvents").WithArgs(eventMemberApproved, tc.partyId, outboxEventArg{kind: eventMemberApproved, userId: member.GetUserId()}).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_MEMBER_APPROVED), tc.partyId, tc.userId, member.GetUserId(), "",
+						`{"partyId":1,"joinRequest":"pending"}`, fmt.Sprintf(`{"partyId":%d,"joinRequest":"approved"}`, tc.partyId)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
 			}
 
 			for _, member := range tc.deniedMembers {
 				mock.ExpectExec("update").WithArgs(member.GetUserId(), tc.partyId).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into fyp_schema.outboxEvents").WithArgs(eventMemberDenied, tc.partyId, outboxEventArg{kind: eventMemberDenied, userId: member.GetUserId()}).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_MEMBER_DENIED), tc.partyId, tc.userId, member.GetUserId(), "",
+						`{"joinRequest":"pending"}`, `{"joinRequest":"denied"}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
 			}
 			mock.ExpectCommit()
 			userClaims := tokenService.UserClaims{
@@ -618,6 +716,7 @@ func TestJoinParty(t *testing.T) {
 		joinRequestExistsRows *sqlmock.Rows
 		partyExistsRows       *sqlmock.Rows
 		joinRequestResult     driver.Result
+		commitErr             error
 		wantErr               bool
 
 		wantCode pb.ResponseCode
@@ -688,6 +787,18 @@ func TestJoinParty(t *testing.T) {
 			wantErr:               false,
 			wantCode:              pb.ResponseCode_OK,
 		},
+		{
+			name:                  "commit fails",
+			userId:                2,
+			partyId:               1,
+			userMemberRows:        sqlmock.NewRows([]string{"userID", "partyID"}),
+			partyExistsRows:       sqlmock.NewRows([]string{"partyID ", "partyName", "admin"}).AddRow(1, "fake_party", 23),
+			joinRequestExistsRows: sqlmock.NewRows([]string{"userID", "partyID", "reviewed"}),
+			joinRequestResult:     sqlmock.NewResult(2, 1),
+			commitErr:             fmt.Errorf("serialization failure"),
+			wantErr:               true,
+			wantCode:              pb.ResponseCode_FAILED,
+		},
 	}
 
 	for _, tc := range tests {
@@ -708,7 +819,12 @@ func TestJoinParty(t *testing.T) {
 			mock.ExpectBegin()
 			mock.ExpectExec("update").WithArgs(tc.userId).WillReturnResult(driver.ResultNoRows)
 			mock.ExpectExec("insert").WithArgs(tc.userId, tc.partyId).WillReturnResult(tc.joinRequestResult)
-			mock.ExpectCommit()
+			mock.ExpectExec("insert into fyp_schema.outboxEvents").WithArgs(eventJoinRequested, tc.partyId, outboxEventArg{kind: eventJoinRequested, userId: tc.userId}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("insert into fyp_schema.auditLog").
+				WithArgs(int32(pb.AuditAction_AUDIT_JOIN_REQUESTED), tc.partyId, tc.userId, tc.userId, "", nil, `{"joinRequest":"pending"}`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit().WillReturnError(tc.commitErr)
 
 			userClaims := tokenService.UserClaims{
 				UserID:   tc.userId,
@@ -836,6 +952,10 @@ func TestRegisterParty(t *testing.T) {
 			mock.ExpectQuery("select").WithArgs(tc.partyName).WillReturnRows(tc.partyExistsRows)
 			mock.ExpectExec("insert").WithArgs(tc.partyName, tc.userId).WillReturnResult(tc.createPartyResult)
 			mock.ExpectExec("update").WithArgs(tc.newPartyId, tc.userId).WillReturnResult(tc.updateUserResult)
+			mock.ExpectExec("insert into fyp_schema.auditLog").
+				WithArgs(int32(pb.AuditAction_AUDIT_PARTY_REGISTERED), tc.newPartyId, tc.userId, tc.userId, "", nil,
+					fmt.Sprintf(`{"partyName":%q,"admin":%d}`, tc.partyName, tc.userId)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
 
 			mock.ExpectCommit()
 			userClaims := tokenService.UserClaims{
@@ -950,7 +1070,13 @@ func TestRemovePoster(t *testing.T) {
 			}
 			server := &server{DB: db}
 			mock.ExpectQuery("select").WithArgs(tc.location.GetLat(), tc.location.GetLng(), tc.partyId, removePosterMaxDistance).WillReturnRows(tc.returnRows)
-			mock.ExpectExec("update").WithArgs(tc.userId, tc.posterId, tc.partyId).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectBegin()
+			mock.ExpectExec("update fyp_schema.parties").WithArgs(tc.partyId).WillReturnResult(sqlmock.NewResult(5, 1))
+			mock.ExpectExec("update fyp_schema.posters").WithArgs(tc.userId, 5, tc.posterId, tc.partyId).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("insert into fyp_schema.outboxEvents").
+				WithArgs(eventPosterChanged, tc.partyId, outboxEventArg{kind: eventPosterChanged, change: pb.PosterChangeType_POSTER_REMOVED, posterId: tc.posterId}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 
 			userClaims := tokenService.UserClaims{
 				UserID:   tc.userId,
@@ -983,13 +1109,25 @@ func TestRemovePoster(t *testing.T) {
 
 func TestPlacePoster(t *testing.T) {
 	tests := []struct {
-		name         string
-		userId       int32
-		partyId      int32
-		location     *pb.Location
-		wantErr      bool
-		returnResult driver.Result
-		wantCode     pb.ResponseCode
+		name           string
+		userId         int32
+		partyId        int32
+		location       *pb.Location
+		wantErr        bool
+		returnResult   driver.Result
+		zoneRows       *sqlmock.Rows
+		rulesRows      *sqlmock.Rows
+		siteRows       *sqlmock.Rows
+		wantSiteId     int32
+		stockRows      *sqlmock.Rows
+		designId       int32
+		designRows     *sqlmock.Rows
+		wantDesign     int32
+		electionRows   *sqlmock.Rows
+		overrideReason string
+		adminRows      *sqlmock.Rows
+		wantCode       pb.ResponseCode
+		wantWarnings   int
 	}{
 		{
 			name:         "userId not set",
@@ -1015,6 +1153,117 @@ func TestPlacePoster(t *testing.T) {
 			wantErr:      true,
 			wantCode:     pb.ResponseCode_FAILED,
 		},
+		{
+			name:         "inside exclusion zone",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			zoneRows:     sqlmock.NewRows([]string{"zoneId", "name", "enforcement"}).AddRow(1, "school", pb.ZoneEnforcement_REJECT_PLACEMENT),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "inside flagged zone",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			zoneRows:     sqlmock.NewRows([]string{"zoneId", "name", "enforcement"}).AddRow(1, "junction", pb.ZoneEnforcement_FLAG_PLACEMENT),
+			wantErr:      false,
+			wantCode:     pb.ResponseCode_OK,
+			wantWarnings: 1,
+		},
+		{
+			name:         "no election",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			electionRows: sqlmock.NewRows([]string{"startDate", "endDate"}),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_NO_ELECTION,
+		},
+		{
+			name:         "before election starts",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			electionRows: sqlmock.NewRows([]string{"startDate", "endDate"}).AddRow(time.Now().Add(24*time.Hour).Unix(), time.Now().Add(60*24*time.Hour).Unix()),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_OUTSIDE_ELECTION_WINDOW,
+		},
+		{
+			name:           "override by member",
+			userId:         1,
+			partyId:        1,
+			location:       &pb.Location{Lat: 1, Lng: 2},
+			returnResult:   sqlmock.NewResult(1, 2),
+			electionRows:   sqlmock.NewRows([]string{"startDate", "endDate"}).AddRow(time.Now().Add(-60*24*time.Hour).Unix(), time.Now().Add(-24*time.Hour).Unix()),
+			overrideReason: "by-election",
+			adminRows:      sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:        true,
+			wantCode:       pb.ResponseCode_OUTSIDE_ELECTION_WINDOW,
+		},
+		{
+			name:           "override by admin",
+			userId:         1,
+			partyId:        1,
+			location:       &pb.Location{Lat: 1, Lng: 2},
+			returnResult:   sqlmock.NewResult(1, 2),
+			electionRows:   sqlmock.NewRows([]string{"startDate", "endDate"}).AddRow(time.Now().Add(-60*24*time.Hour).Unix(), time.Now().Add(-24*time.Hour).Unix()),
+			overrideReason: "by-election",
+			adminRows:      sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:        false,
+			wantCode:       pb.ResponseCode_OK,
+			wantWarnings:   1,
+		},
+		{
+			name:         "near claimed site",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			siteRows:     sqlmock.NewRows([]string{"siteId", "distance"}).AddRow(4, 12.5),
+			wantSiteId:   4,
+			wantErr:      false,
+			wantCode:     pb.ResponseCode_OK,
+		},
+		{
+			name:         "taken from stock",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			stockRows:    sqlmock.NewRows([]string{"designId", "holding"}).AddRow(3, 10).AddRow(2, 4),
+			wantDesign:   3,
+			wantErr:      false,
+			wantCode:     pb.ResponseCode_OK,
+		},
+		{
+			name:         "design of another party",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			designId:     7,
+			designRows:   sqlmock.NewRows([]string{"designId", "name", "lowStockThreshold"}).AddRow(3, "candidate a", 10),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "breaks jurisdiction rules",
+			userId:       1,
+			partyId:      1,
+			location:     &pb.Location{Lat: 1, Lng: 2},
+			returnResult: sqlmock.NewResult(1, 2),
+			rulesRows: sqlmock.NewRows([]string{"jurisdictionId", "name", "placementDaysBefore", "removalDaysAfter", "maxHeightCm", "permitRequired"}).
+				AddRow(1, "dublin city", 30, 7, 230, true),
+			wantErr:      false,
+			wantCode:     pb.ResponseCode_OK,
+			wantWarnings: 2,
+		},
 		{
 			name:         "success",
 			userId:       1,
@@ -1036,7 +1285,53 @@ func TestPlacePoster(t *testing.T) {
 
 			}
 			server := &server{DB: db}
-			mock.ExpectExec("insert").WithArgs(tc.partyId, tc.userId, tc.location.GetLng(), tc.location.GetLat()).WillReturnResult(tc.returnResult)
+			if tc.zoneRows == nil {
+				tc.zoneRows = sqlmock.NewRows([]string{"zoneId", "name", "enforcement"})
+			}
+			if tc.electionRows == nil {
+				// polling day is 60 days away so placing today is too early for jurisdictions with a 30 day rule
+				tc.electionRows = sqlmock.NewRows([]string{"startDate", "endDate"}).AddRow(time.Now().Add(-24*time.Hour).Unix(), time.Now().Add(60*24*time.Hour).Unix())
+			}
+			mock.ExpectQuery("select unix_timestamp").WithArgs(tc.partyId).WillReturnRows(tc.electionRows)
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.location.GetLng(), tc.location.GetLat()).WillReturnRows(tc.zoneRows)
+			if tc.rulesRows == nil {
+				tc.rulesRows = sqlmock.NewRows([]string{"jurisdictionId", "name", "placementDaysBefore", "removalDaysAfter", "maxHeightCm", "permitRequired"})
+			}
+			mock.ExpectQuery("select jurisdictionId").WithArgs(tc.location.GetLng(), tc.location.GetLat()).WillReturnRows(tc.rulesRows)
+			if tc.siteRows == nil {
+				tc.siteRows = sqlmock.NewRows([]string{"siteId", "distance"})
+			}
+			mock.ExpectQuery("select siteId").WithArgs(tc.location.GetLng(), tc.location.GetLat(), tc.partyId, tc.userId, plannedSiteLinkDistance).WillReturnRows(tc.siteRows)
+			if tc.stockRows == nil {
+				tc.stockRows = sqlmock.NewRows([]string{"designId", "holding"})
+			}
+			mock.ExpectQuery("select designId").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.stockRows)
+			if tc.designRows != nil {
+				mock.ExpectQuery("select designId, name").WithArgs(tc.partyId).WillReturnRows(tc.designRows)
+			}
+			mock.ExpectBegin()
+			mock.ExpectExec("update fyp_schema.parties").WithArgs(tc.partyId).WillReturnResult(sqlmock.NewResult(5, 1))
+			mock.ExpectExec("insert").WithArgs(tc.partyId, tc.userId, tc.location.GetLng(), tc.location.GetLat(), 5, sqlmock.AnyArg(), int32(180), "", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(tc.returnResult)
+			for i := 0; i < tc.wantWarnings; i++ {
+				mock.ExpectExec("insert into fyp_schema.posterViolations").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			if tc.overrideReason != "" {
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_ELECTION_WINDOW_OVERRIDDEN), tc.partyId, tc.userId, int32(0), "", nil,
+						`{"posterId":1,"location":{"lat":1,"lng":2},"overrideReason":"by-election"}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			if tc.wantDesign != 0 {
+				mock.ExpectExec("insert into fyp_schema.inventoryLedger").WithArgs(tc.partyId, sqlmock.AnyArg(), int32(pb.InventoryKind_STOCK_PLACED), 1, tc.userId, sqlmock.AnyArg(), tc.userId).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectExec("insert into fyp_schema.outboxEvents").
+				WithArgs(eventPosterChanged, tc.partyId, outboxEventArg{kind: eventPosterChanged, change: pb.PosterChangeType_POSTER_PLACED}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
 
 			userClaims := tokenService.UserClaims{
 				UserID:   tc.userId,
@@ -1052,7 +1347,7 @@ func TestPlacePoster(t *testing.T) {
 				t.Fatalf("failed to create jwt: %v", err)
 			}
 
-			res, err := server.PlacePoster(ctx, &pb.PlacementRequest{UserId: tc.userId, PartyId: tc.partyId, Location: tc.location, AuthKey: authKey})
+			res, err := server.PlacePoster(ctx, &pb.PlacementRequest{UserId: tc.userId, PartyId: tc.partyId, Location: tc.location, AuthKey: authKey, HeightCm: 180, OverrideReason: tc.overrideReason, DesignId: tc.designId})
 
 			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
 				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
@@ -1061,6 +1356,12 @@ func TestPlacePoster(t *testing.T) {
 			if res.Code != tc.wantCode {
 				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
 			}
+			if len(res.Warnings) != tc.wantWarnings {
+				t.Fatalf("got warnings %v want %d warnings", res.Warnings, tc.wantWarnings)
+			}
+			if res.PlannedSiteId != tc.wantSiteId {
+				t.Fatalf("got planned site %d want %d", res.PlannedSiteId, tc.wantSiteId)
+			}
 		})
 	}
 }
@@ -1265,13 +1566,16 @@ func TestLoginAccount(t *testing.T) {
 }
 
 func TestRetrieveUpdates(t *testing.T) {
-
+	columns := []string{"posterID", "partyId", "userID", "removed", "latitude", "longitude", "changeSeq"}
 	tests := []struct {
 		name         string
 		userId       int32
 		partyId      int32
 		lastUpdated  *timestamp.Timestamp
+		cursor       string
+		pageSize     int32
 		wantErr      bool
+		seqRows      *sqlmock.Rows
 		returnRows   *sqlmock.Rows
 		wantCode     pb.ResponseCode
 		wantResponse *pb.UpdateResponse
@@ -1279,7 +1583,7 @@ func TestRetrieveUpdates(t *testing.T) {
 		{
 			name:         "userId not set",
 			partyId:      1,
-			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			returnRows:   sqlmock.NewRows(columns),
 			lastUpdated:  timestamppb.New(time.Date(2000, 1, 1, 1, 1, 1, 1, time.UTC)),
 			wantErr:      true,
 			wantCode:     pb.ResponseCode_FAILED,
@@ -1288,17 +1592,27 @@ func TestRetrieveUpdates(t *testing.T) {
 		{
 			name:         "partyId not set",
 			userId:       1,
-			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			returnRows:   sqlmock.NewRows(columns),
 			lastUpdated:  timestamppb.New(time.Date(2000, 1, 1, 1, 1, 1, 1, time.UTC)),
 			wantErr:      true,
 			wantCode:     pb.ResponseCode_FAILED,
 			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_FAILED},
 		},
 		{
-			name:         "lastUpdated  not set",
+			name:         "lastUpdated and cursor not set",
 			userId:       1,
 			partyId:      1,
-			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			returnRows:   sqlmock.NewRows(columns),
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_FAILED},
+		},
+		{
+			name:         "invalid cursor",
+			userId:       1,
+			partyId:      1,
+			cursor:       "not a cursor",
+			returnRows:   sqlmock.NewRows(columns),
 			wantErr:      true,
 			wantCode:     pb.ResponseCode_FAILED,
 			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_FAILED},
@@ -1307,15 +1621,15 @@ func TestRetrieveUpdates(t *testing.T) {
 			name:    "success",
 			userId:  1,
 			partyId: 1,
-			returnRows: sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}).
-				AddRow(1, 1, 1, nil, 1, 1).
-				AddRow(2, 1, 1, nil, 2, 1),
+			returnRows: sqlmock.NewRows(columns).
+				AddRow(1, 1, 1, nil, 1, 1, 1).
+				AddRow(2, 1, 1, nil, 2, 1, 2),
 
 			lastUpdated: timestamppb.New(time.Date(2000, 1, 1, 1, 1, 1, 1, time.UTC)),
 			wantErr:     false,
 
 			wantCode: pb.ResponseCode_OK,
-			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_OK, Posters: []*pb.Poster{
+			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_OK, Cursor: changeCursor{partyId: 1, seq: 2, posterId: 2}.String(), Posters: []*pb.Poster{
 				{
 					PlacedBy: 1,
 					Party:    1,
@@ -1330,6 +1644,56 @@ func TestRetrieveUpdates(t *testing.T) {
 				},
 			}},
 		},
+		{
+			name:     "cursor with more pages",
+			userId:   1,
+			partyId:  1,
+			cursor:   changeCursor{partyId: 1, seq: 4, posterId: 7}.String(),
+			pageSize: 1,
+			seqRows:  sqlmock.NewRows([]string{"changeSeq", "resyncSeq"}).AddRow(10, 0),
+			returnRows: sqlmock.NewRows(columns).
+				AddRow(8, 1, 1, []uint8("2024-01-01 00:00:00"), 1, 1, 4).
+				AddRow(3, 1, 1, nil, 2, 1, 5),
+			wantCode: pb.ResponseCode_OK,
+			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_OK, HasMore: true, Cursor: changeCursor{partyId: 1, seq: 4, posterId: 8}.String(), Posters: []*pb.Poster{
+				{
+					PlacedBy: 1,
+					Party:    1,
+					Posterid: 8,
+					Location: &pb.Location{Lat: 1, Lng: 1},
+					Removed:  true,
+				},
+			}},
+		},
+		{
+			name:         "cursor with no changes",
+			userId:       1,
+			partyId:      1,
+			cursor:       changeCursor{partyId: 1, seq: 10, posterId: 7}.String(),
+			seqRows:      sqlmock.NewRows([]string{"changeSeq", "resyncSeq"}).AddRow(10, 0),
+			returnRows:   sqlmock.NewRows(columns),
+			wantCode:     pb.ResponseCode_OK,
+			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_OK, Cursor: changeCursor{partyId: 1, seq: 10, posterId: 7}.String()},
+		},
+		{
+			name:         "cursor from another party",
+			userId:       1,
+			partyId:      1,
+			cursor:       changeCursor{partyId: 2, seq: 4, posterId: 7}.String(),
+			returnRows:   sqlmock.NewRows(columns),
+			wantCode:     pb.ResponseCode_OK,
+			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_OK, ResyncRequired: true},
+		},
+		{
+			name:         "cursor older than resync point",
+			userId:       1,
+			partyId:      1,
+			cursor:       changeCursor{partyId: 1, seq: 4, posterId: 7}.String(),
+			seqRows:      sqlmock.NewRows([]string{"changeSeq", "resyncSeq"}).AddRow(10, 6),
+			returnRows:   sqlmock.NewRows(columns),
+			wantCode:     pb.ResponseCode_OK,
+			wantResponse: &pb.UpdateResponse{Code: pb.ResponseCode_OK, ResyncRequired: true},
+		},
 	}
 
 	for _, tc := range tests {
@@ -1343,7 +1707,18 @@ func TestRetrieveUpdates(t *testing.T) {
 			}
 			server := &server{DB: db}
 
-			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.lastUpdated.AsTime().Unix()).WillReturnRows(tc.returnRows)
+			pageSize := int(tc.pageSize)
+			if pageSize == 0 {
+				pageSize = defaultUpdatesPageSize
+			}
+			if tc.cursor == "" {
+				mock.ExpectQuery("select").WithArgs(tc.partyId, tc.lastUpdated.AsTime().Unix(), pageSize+1).WillReturnRows(tc.returnRows)
+			} else if cursor, err := parseChangeCursor(tc.cursor); err == nil {
+				if tc.seqRows != nil {
+					mock.ExpectQuery("select changeSeq").WithArgs(tc.partyId).WillReturnRows(tc.seqRows)
+				}
+				mock.ExpectQuery("select posterID").WithArgs(tc.partyId, cursor.seq, cursor.seq, cursor.posterId, pageSize+1).WillReturnRows(tc.returnRows)
+			}
 
 			userClaims := tokenService.UserClaims{
 				UserID:   tc.userId,
@@ -1359,7 +1734,7 @@ func TestRetrieveUpdates(t *testing.T) {
 				t.Fatalf("failed to create jwt: %v", err)
 			}
 
-			res, err := server.RetrieveUpdates(ctx, &pb.UpdateRequest{Partyid: tc.partyId, UserId: tc.userId, AuthKey: authKey, LastUpdated: tc.lastUpdated})
+			res, err := server.RetrieveUpdates(ctx, &pb.UpdateRequest{Partyid: tc.partyId, UserId: tc.userId, AuthKey: authKey, LastUpdated: tc.lastUpdated, Cursor: tc.cursor, PageSize: tc.pageSize})
 
 			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
 				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
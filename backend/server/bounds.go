@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	defaultBoundsLimit = 500
+	maxBoundsLimit     = 5000
+	// MBRContains can use the spatial index on posters.location, see migrations/001_posters_spatial_index.sql
+	postersInBoundsQuery = `select posterID, partyId, userID, removed, st_y(location) as latitude, st_x(location) as longitude
+							from fyp_schema.posters
+							where partyId = ? and MBRContains(ST_MakeEnvelope(point(?,?), point(?,?)), location)%s
+							limit ?`
+)
+
+// posterStatusClause returns the extra condition needed to filter posters by their removal state.
+func posterStatusClause(status pb.PosterStatusFilter) string {
+	switch status {
+	case pb.PosterStatusFilter_ACTIVE_POSTERS:
+		return " and removed is null"
+	case pb.PosterStatusFilter_REMOVED_POSTERS:
+		return " and removed is not null"
+	}
+	return ""
+}
+
+// validBoundingBox checks that the corners of a bounding box are valid coordinates and in the right order.
+func validBoundingBox(bounds *pb.BoundingBox) error {
+	sw, ne := bounds.GetSouthWest(), bounds.GetNorthEast()
+	if sw == nil || ne == nil {
+		return fmt.Errorf("bounding box corners not set")
+	}
+	for _, corner := range []*pb.Location{sw, ne} {
+		if corner.GetLat() < -90 || corner.GetLat() > 90 || corner.GetLng() < -180 || corner.GetLng() > 180 {
+			return fmt.Errorf("bounding box corner is not a valid coordinate")
+		}
+	}
+	if sw.GetLat() > ne.GetLat() {
+		return fmt.Errorf("south west corner must be south of the north east corner")
+	}
+	// boxes crossing the antimeridian would need to be split in two, no party needs this
+	if sw.GetLng() > ne.GetLng() {
+		return fmt.Errorf("south west corner must be west of the north east corner")
+	}
+	return nil
+}
+
+// QueryPostersInBounds returns the posters of a party that are inside a bounding box, i.e the area shown on the users map.
+func (s *server) QueryPostersInBounds(ctx context.Context, in *pb.BoundsRequest) (*pb.BoundsResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetBounds() == nil {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("bounding box not set")
+	}
+	if err := validBoundingBox(in.GetBounds()); err != nil {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	limit := int(in.GetLimit())
+	if limit < 0 || limit > maxBoundsLimit {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("limit must be between 1 and %d", maxBoundsLimit)
+	}
+	if limit == 0 {
+		limit = defaultBoundsLimit
+	}
+
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	sw, ne := in.GetBounds().GetSouthWest(), in.GetBounds().GetNorthEast()
+	// ask for one more poster than the limit so we know if the result was truncated
+	rows, err := s.DB.Query(fmt.Sprintf(postersInBoundsQuery, posterStatusClause(in.GetStatus())),
+		in.GetPartyId(), sw.GetLng(), sw.GetLat(), ne.GetLng(), ne.GetLat(), limit+1)
+	if err != nil {
+		return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query posters in bounding box: %v", err)
+	}
+	defer rows.Close()
+
+	var posters []*pb.Poster
+	truncated := false
+	for rows.Next() {
+		if len(posters) == limit {
+			truncated = true
+			break
+		}
+		var poster PosterUpdate
+		removed := []uint8{}
+		err = rows.Scan(&poster.PosterId, &poster.PartyId, &poster.UserID, &removed, &poster.location.Lat, &poster.location.Lng)
+		if err != nil {
+			return &pb.BoundsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read posters from sql result: %v", err)
+		}
+		posters = append(posters, &pb.Poster{
+			PlacedBy: poster.UserID,
+			Party:    poster.PartyId,
+			Posterid: poster.PosterId,
+			Location: &pb.Location{Lat: poster.location.Lat, Lng: poster.location.Lng},
+			Removed:  removed != nil,
+		})
+	}
+	return &pb.BoundsResponse{Code: pb.ResponseCode_OK, Posters: posters, Truncated: truncated}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/golang/protobuf/proto"
+	"github.com/michaelc445/fyp/tokenService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestQueryPostersInBounds(t *testing.T) {
+	bounds := &pb.BoundingBox{SouthWest: &pb.Location{Lat: 53.3, Lng: -6.3}, NorthEast: &pb.Location{Lat: 53.4, Lng: -6.2}}
+	tests := []struct {
+		name         string
+		userId       int32
+		partyId      int32
+		bounds       *pb.BoundingBox
+		limit        int32
+		returnRows   *sqlmock.Rows
+		wantLimit    int
+		wantErr      bool
+		wantResponse *pb.BoundsResponse
+	}{
+		{
+			name:         "userId not set",
+			partyId:      1,
+			bounds:       bounds,
+			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			wantErr:      true,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_FAILED},
+		},
+		{
+			name:         "partyId not set",
+			userId:       1,
+			bounds:       bounds,
+			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			wantErr:      true,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_FAILED},
+		},
+		{
+			name:         "bounds not set",
+			userId:       1,
+			partyId:      1,
+			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			wantErr:      true,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_FAILED},
+		},
+		{
+			name:         "corners swapped",
+			userId:       1,
+			partyId:      1,
+			bounds:       &pb.BoundingBox{SouthWest: bounds.NorthEast, NorthEast: bounds.SouthWest},
+			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			wantErr:      true,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_FAILED},
+		},
+		{
+			name:         "limit too large",
+			userId:       1,
+			partyId:      1,
+			bounds:       bounds,
+			limit:        int32(maxBoundsLimit + 1),
+			returnRows:   sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}),
+			wantErr:      true,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_FAILED},
+		},
+		{
+			name:    "success",
+			userId:  1,
+			partyId: 1,
+			bounds:  bounds,
+			returnRows: sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}).
+				AddRow(1, 1, 1, nil, 53.35, -6.25).
+				AddRow(2, 1, 2, []uint8("2024-01-01 00:00:00"), 53.36, -6.26),
+			wantLimit: defaultBoundsLimit + 1,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_OK, Posters: []*pb.Poster{
+				{PlacedBy: 1, Party: 1, Posterid: 1, Location: &pb.Location{Lat: 53.35, Lng: -6.25}},
+				{PlacedBy: 2, Party: 1, Posterid: 2, Location: &pb.Location{Lat: 53.36, Lng: -6.26}, Removed: true},
+			}},
+		},
+		{
+			name:    "truncated",
+			userId:  1,
+			partyId: 1,
+			bounds:  bounds,
+			limit:   1,
+			returnRows: sqlmock.NewRows([]string{"posterID", "partyId", "userID", "removed", "latitude", "longitude"}).
+				AddRow(1, 1, 1, nil, 53.35, -6.25).
+				AddRow(2, 1, 2, nil, 53.36, -6.26),
+			wantLimit: 2,
+			wantResponse: &pb.BoundsResponse{Code: pb.ResponseCode_OK, Truncated: true, Posters: []*pb.Poster{
+				{PlacedBy: 1, Party: 1, Posterid: 1, Location: &pb.Location{Lat: 53.35, Lng: -6.25}},
+			}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			sw, ne := tc.bounds.GetSouthWest(), tc.bounds.GetNorthEast()
+			mock.ExpectQuery("select").WithArgs(tc.partyId, sw.GetLng(), sw.GetLat(), ne.GetLng(), ne.GetLat(), tc.wantLimit).WillReturnRows(tc.returnRows)
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.partyId,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			res, err := server.QueryPostersInBounds(ctx, &pb.BoundsRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey, Bounds: tc.bounds, Limit: tc.limit})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if !proto.Equal(res, tc.wantResponse) {
+				t.Fatalf("got response %v want response %v", res, tc.wantResponse)
+			}
+		})
+	}
+}
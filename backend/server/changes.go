@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/michaelc445/proto"
+)
+
+// Every change to a poster is given the next value of its party's change sequence, see
+// migrations/002_poster_change_feed.sql. Bumping the sequence locks the party row until the transaction
+// commits, so a party's changes always become visible in sequence order and a client that has seen
+// everything up to a sequence number can never miss a change below it.
+var (
+	defaultUpdatesPageSize = 500
+	maxUpdatesPageSize     = 5000
+	// last_insert_id(expr) makes the new sequence number available through LastInsertId
+	nextChangeSeqQuery = "update fyp_schema.parties set changeSeq = last_insert_id(changeSeq + 1) where partyID = ?"
+	// used when posters leave a party, clients of that party can't be told about this incrementally
+	resyncPartyQuery    = "update fyp_schema.parties set changeSeq = changeSeq + 1, resyncSeq = changeSeq where partyID = (select partyId from fyp_schema.users where userId = ?)"
+	changeSeqQuery      = "select changeSeq, resyncSeq from fyp_schema.parties where partyID = ?"
+	postersChangedQuery = `select posterID, partyId, userID, removed, st_y(location) as latitude, st_x(location) as longitude, changeSeq
+							from fyp_schema.posters
+							where partyId = ? and (changeSeq > ? or (changeSeq = ? and posterID > ?))
+							order by changeSeq, posterID
+							limit ?`
+	// clients that have not been given a cursor yet still ask for changes since a time
+	postersUpdatedQuery = `select posterID, partyId, userID, removed, st_y(location) as latitude, st_x(location) as longitude, changeSeq
+							from fyp_schema.posters
+							where partyId = ? and updated > from_unixtime(?)
+							order by changeSeq, posterID
+							limit ?`
+)
+
+// changeCursor is the position of a client in its party's change feed. Several posters can share a
+// sequence number when they change in the same transaction so the posterId is used to break ties.
+type changeCursor struct {
+	partyId  int32
+	seq      int64
+	posterId int32
+}
+
+func (c changeCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d.%d", c.partyId, c.seq, c.posterId)))
+}
+
+func parseChangeCursor(cursor string) (changeCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return changeCursor{}, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 3 {
+		return changeCursor{}, fmt.Errorf("invalid cursor")
+	}
+	partyId, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return changeCursor{}, fmt.Errorf("invalid cursor")
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return changeCursor{}, fmt.Errorf("invalid cursor")
+	}
+	posterId, err := strconv.ParseInt(parts[2], 10, 32)
+	if err != nil {
+		return changeCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return changeCursor{partyId: int32(partyId), seq: seq, posterId: int32(posterId)}, nil
+}
+
+// after reports whether the change at c comes after other in the feed.
+func (c changeCursor) after(other changeCursor) bool {
+	return c.seq > other.seq || (c.seq == other.seq && c.posterId > other.posterId)
+}
+
+// nextChangeSeq bumps the change sequence of a party inside tx and returns the new value.
+func nextChangeSeq(tx *sql.Tx, partyId int32) (int64, error) {
+	res, err := tx.Exec(nextChangeSeqQuery, partyId)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// needsResync reports whether a cursor can no longer be used to follow the change feed of a party.
+func (s *server) needsResync(cursor changeCursor, partyId int32) (bool, error) {
+	// the user has moved to a different party since the cursor was created
+	if cursor.partyId != partyId {
+		return true, nil
+	}
+	rows, err := s.DB.Query(changeSeqQuery, partyId)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, fmt.Errorf("party does not exist")
+	}
+	var changeSeq, resyncSeq int64
+	if err = rows.Scan(&changeSeq, &resyncSeq); err != nil {
+		return false, err
+	}
+	return cursor.seq > changeSeq || cursor.seq < resyncSeq, nil
+}
+
+// postersChangedSince returns up to limit posters changed after the cursor, in the order they changed,
+// along with the position of each of them in the feed.
+func (s *server) postersChangedSince(cursor changeCursor, limit int) ([]*pb.Poster, []changeCursor, error) {
+	rows, err := s.DB.Query(postersChangedQuery, cursor.partyId, cursor.seq, cursor.seq, cursor.posterId, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query database for posters %v", err)
+	}
+	defer rows.Close()
+	return readPosterChanges(rows)
+}
+
+// postersUpdatedSince is the same as postersChangedSince for clients that only have the time of their last update.
+func (s *server) postersUpdatedSince(partyId int32, lastUpdated int64, limit int) ([]*pb.Poster, []changeCursor, error) {
+	rows, err := s.DB.Query(postersUpdatedQuery, partyId, lastUpdated, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query database for posters %v", err)
+	}
+	defer rows.Close()
+	return readPosterChanges(rows)
+}
+
+func readPosterChanges(rows *sql.Rows) ([]*pb.Poster, []changeCursor, error) {
+	var posters []*pb.Poster
+	var positions []changeCursor
+	for rows.Next() {
+		var poster PosterUpdate
+		var seq int64
+		removed := []uint8{}
+		err := rows.Scan(&poster.PosterId, &poster.PartyId, &poster.UserID, &removed, &poster.location.Lat, &poster.location.Lng, &seq)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get updates %v", err)
+		}
+		posters = append(posters, &pb.Poster{
+			PlacedBy: poster.UserID,
+			Party:    poster.PartyId,
+			Posterid: poster.PosterId,
+			Location: &pb.Location{Lat: poster.location.Lat, Lng: poster.location.Lng},
+			Removed:  removed != nil,
+		})
+		positions = append(positions, changeCursor{partyId: poster.PartyId, seq: seq, posterId: poster.PosterId})
+	}
+	return posters, positions, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestChangeCursor(t *testing.T) {
+	cursor := changeCursor{partyId: 3, seq: 120, posterId: 42}
+	parsed, err := parseChangeCursor(cursor.String())
+	if err != nil {
+		t.Fatalf("failed to parse cursor: %v", err)
+	}
+	if parsed != cursor {
+		t.Fatalf("got cursor %v want %v", parsed, cursor)
+	}
+	if !(changeCursor{seq: 120, posterId: 43}).after(cursor) || (changeCursor{seq: 119, posterId: 50}).after(cursor) {
+		t.Fatalf("cursors compared in the wrong order")
+	}
+	for _, invalid := range []string{"", "bm90IGEgY3Vyc29y", "!!"} {
+		if _, err := parseChangeCursor(invalid); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// a party has at most one election that isn't closed
+	openElectionQuery = `select electionId, name, electionType, unix_timestamp(startDate), unix_timestamp(endDate), removalDaysAfter
+							from fyp_schema.elections where partyId = ? and closed is null for update`
+	insertElectionQuery = `insert into fyp_schema.elections (partyId, name, electionType, startDate, endDate, removalDaysAfter)
+							values (?,?,?,from_unixtime(?),from_unixtime(?),?)`
+	electionTypeQuery = "select removalDaysAfter from fyp_schema.electionTypes where electionType = ?"
+	// copies every poster that was up during the election along with the deadline it had to be removed by
+	archiveElectionQuery = fmt.Sprintf(`insert into fyp_schema.electionPosters (electionId, posterId, userId, location, jurisdictionId, created, removed, removedBy, removalDeadline)
+							select l3.electionId, l1.posterID, l1.userID, l1.location, l1.jurisdictionId, l1.created, l1.removed, l1.removedBy, %s
+							from fyp_schema.posters as l1
+							join fyp_schema.elections as l3 on l1.partyId = l3.partyId
+							left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							where l3.electionId = ? and (l1.removed is null or l1.removed >= l3.startDate)`, posterDeadlineExpression)
+	closeElectionQuery = "update fyp_schema.elections set closed = from_unixtime(?), closedBy = ? where electionId = ? and closed is null"
+	// stats of closed elections come from their archived posters
+	listElectionsQuery = `select l1.electionId, l1.name, l1.electionType, l1.removalDaysAfter, unix_timestamp(l1.startDate), unix_timestamp(l1.endDate), unix_timestamp(l1.closed),
+							count(l2.posterId), coalesce(sum(l2.removed is not null), 0), coalesce(sum(l2.removed > l2.removalDeadline), 0)
+							from fyp_schema.elections as l1
+							left join fyp_schema.electionPosters as l2 on l1.electionId = l2.electionId
+							where l1.partyId = ?
+							group by l1.electionId
+							order by l1.electionId desc`
+	// stats of the open election come from the posters table, counting the same posters closing it would archive
+	openElectionStatsQuery = fmt.Sprintf(`select count(*), coalesce(sum(l1.removed is not null), 0), coalesce(sum(l1.removed > %s), 0)
+							from fyp_schema.posters as l1
+							join fyp_schema.elections as l3 on l1.partyId = l3.partyId and l3.closed is null
+							left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							where l1.partyId = ? and (l1.removed is null or l1.removed >= l3.startDate)`, posterDeadlineExpression)
+)
+
+// electionStatus is upcoming until posters can be placed and active until the election is closed.
+func electionStatus(startDate time.Time, closed bool, now time.Time) pb.ElectionStatus {
+	if closed {
+		return pb.ElectionStatus_ELECTION_CLOSED
+	}
+	if now.Before(startDate) {
+		return pb.ElectionStatus_ELECTION_UPCOMING
+	}
+	return pb.ElectionStatus_ELECTION_ACTIVE
+}
+
+// removalStatus tells how close a poster is to its removal deadline. Posters within dueSoon of it are due soon.
+func removalStatus(deadline time.Time, now time.Time, dueSoon time.Duration) (status pb.RemovalStatus, remaining time.Duration) {
+	remaining = deadline.Sub(now)
+	switch {
+	case remaining < 0:
+		return pb.RemovalStatus_REMOVAL_OVERDUE, remaining
+	case remaining <= dueSoon:
+		return pb.RemovalStatus_REMOVAL_DUE_SOON, remaining
+	}
+	return pb.RemovalStatus_REMOVAL_OK, remaining
+}
+
+// electionName names elections that weren't given a name after their election date.
+func electionName(name string, electionDate time.Time) string {
+	if name != "" {
+		return name
+	}
+	return "Election " + electionDate.UTC().Format("2006-01-02")
+}
+
+// openElection returns the party's open election, nil if it has none. The election is locked until tx ends.
+func openElection(tx *sql.Tx, partyId int32) (*electionAudit, error) {
+	rows, err := tx.Query(openElectionQuery, partyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	var election electionAudit
+	var start, end int64
+	if err = rows.Scan(&election.ElectionId, &election.Name, &election.ElectionType, &start, &end, &election.RemovalDaysAfter); err != nil {
+		return nil, err
+	}
+	election.StartDate = time.Unix(start, 0).UTC()
+	election.EndDate = time.Unix(end, 0).UTC()
+	return &election, nil
+}
+
+// closeElection archives the posters of an open election and closes it as part of tx.
+func closeElection(ctx context.Context, tx *sql.Tx, election *electionAudit, partyId, userId int32, now time.Time) error {
+	if _, err := tx.Exec(archiveElectionQuery, election.ElectionId); err != nil {
+		return fmt.Errorf("failed to archive posters: %v", err)
+	}
+	res, err := tx.Exec(closeElectionQuery, now.Unix(), userId, election.ElectionId)
+	if err != nil {
+		return fmt.Errorf("failed to close election: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return fmt.Errorf("election %d is already closed", election.ElectionId)
+	}
+	closed := *election
+	closedAt := time.Unix(now.Unix(), 0).UTC()
+	closed.Closed = &closedAt
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_ELECTION_CLOSED,
+		partyId: partyId,
+		actorId: userId,
+		before:  election,
+		after:   closed,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record closing election: %v", err)
+	}
+	return nil
+}
+
+// CloseElection closes a party's open election, archiving the final state of its posters.
+func (s *server) CloseElection(ctx context.Context, in *pb.CloseElectionRequest) (*pb.CloseElectionResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetElectionId() == 0 {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("electionId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can close an election")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	election, err := openElection(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query election: %v", err)
+	}
+	if election == nil || election.ElectionId != in.GetElectionId() {
+		_ = tx.Rollback()
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("election %d is not open", in.GetElectionId())
+	}
+	if err = closeElection(ctx, tx, election, in.GetPartyId(), in.GetUserId(), time.Now()); err != nil {
+		_ = tx.Rollback()
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.CloseElectionResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to close election: %v", err)
+	}
+	return &pb.CloseElectionResponse{Code: pb.ResponseCode_OK}, nil
+}
+
+// ListElections returns every election of a party with how its posters were dealt with.
+func (s *server) ListElections(ctx context.Context, in *pb.ListElectionsRequest) (*pb.ListElectionsResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	rows, err := s.DB.Query(listElectionsQuery, in.GetPartyId())
+	if err != nil {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query elections: %v", err)
+	}
+	now := time.Now()
+	var elections []*pb.Election
+	var open *pb.Election
+	for rows.Next() {
+		var election pb.Election
+		var start, end int64
+		var closed sql.NullInt64
+		err = rows.Scan(&election.ElectionId, &election.Name, &election.ElectionType, &election.RemovalDaysAfter, &start, &end, &closed,
+			&election.Posters, &election.Removed, &election.RemovedLate)
+		if err != nil {
+			_ = rows.Close()
+			return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read elections: %v", err)
+		}
+		election.StartDate = timestamppb.New(time.Unix(start, 0))
+		election.ElectionDate = timestamppb.New(time.Unix(end, 0))
+		election.Status = electionStatus(time.Unix(start, 0), closed.Valid, now)
+		if closed.Valid {
+			election.Closed = timestamppb.New(time.Unix(closed.Int64, 0))
+		} else {
+			open = &election
+		}
+		elections = append(elections, &election)
+	}
+	_ = rows.Close()
+	if open == nil {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_OK, Elections: elections}, nil
+	}
+	err = s.DB.QueryRow(openElectionStatsQuery, in.GetPartyId()).Scan(&open.Posters, &open.Removed, &open.RemovedLate)
+	if err != nil {
+		return &pb.ListElectionsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to count election posters: %v", err)
+	}
+	return &pb.ListElectionsResponse{Code: pb.ResponseCode_OK, Elections: elections}, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestElectionStatus(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		now    time.Time
+		closed bool
+		want   pb.ElectionStatus
+	}{
+		{name: "before posters can be placed", now: start.Add(-time.Hour), want: pb.ElectionStatus_ELECTION_UPCOMING},
+		{name: "posters can be placed", now: start, want: pb.ElectionStatus_ELECTION_ACTIVE},
+		{name: "active after polling day until closed", now: start.Add(time.Hour * 24 * 30), want: pb.ElectionStatus_ELECTION_ACTIVE},
+		{name: "closed", now: start.Add(time.Hour * 24 * 30), closed: true, want: pb.ElectionStatus_ELECTION_CLOSED},
+		{name: "closed before it started", now: start.Add(-time.Hour), closed: true, want: pb.ElectionStatus_ELECTION_CLOSED},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := electionStatus(start, tc.closed, tc.now); got != tc.want {
+				t.Fatalf("got status %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRemovalStatus(t *testing.T) {
+	deadline := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	dueSoon := 48 * time.Hour
+	tests := []struct {
+		name          string
+		now           time.Time
+		wantStatus    pb.RemovalStatus
+		wantRemaining time.Duration
+	}{
+		{name: "well before the deadline", now: deadline.Add(-72 * time.Hour), wantStatus: pb.RemovalStatus_REMOVAL_OK, wantRemaining: 72 * time.Hour},
+		{name: "within the due soon window", now: deadline.Add(-dueSoon), wantStatus: pb.RemovalStatus_REMOVAL_DUE_SOON, wantRemaining: dueSoon},
+		{name: "at the deadline", now: deadline, wantStatus: pb.RemovalStatus_REMOVAL_DUE_SOON},
+		{name: "past the deadline", now: deadline.Add(time.Hour), wantStatus: pb.RemovalStatus_REMOVAL_OVERDUE, wantRemaining: -time.Hour},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, remaining := removalStatus(deadline, tc.now, dueSoon)
+			if status != tc.wantStatus || remaining != tc.wantRemaining {
+				t.Fatalf("got %v with %v remaining want %v with %v remaining", status, remaining, tc.wantStatus, tc.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestCloseElection(t *testing.T) {
+	electionColumns := []string{"electionId", "name", "electionType", "startDate", "endDate", "removalDaysAfter"}
+	tests := []struct {
+		name       string
+		electionId int32
+		adminRows  *sqlmock.Rows
+		expect     func(mock sqlmock.Sqlmock)
+		wantErr    bool
+		wantCode   pb.ResponseCode
+	}{
+		{
+			name:       "user is not admin of party",
+			electionId: 3,
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			expect:     func(mock sqlmock.Sqlmock) {},
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "election is not open",
+			electionId: 2,
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("select electionId").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows(electionColumns).AddRow(3, "general", 0, 1717200000, 1717804800, 7))
+				mock.ExpectRollback()
+			},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "posters are archived",
+			electionId: 3,
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("select electionId").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows(electionColumns).AddRow(3, "general", 0, 1717200000, 1717804800, 7))
+				mock.ExpectExec("insert into fyp_schema.electionPosters").WithArgs(int32(3)).WillReturnResult(sqlmock.NewResult(0, 12))
+				mock.ExpectExec("update fyp_schema.elections set closed").WithArgs(sqlmock.AnyArg(), int32(1), int32(3)).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_ELECTION_CLOSED), int32(1), int32(1), int32(0), "",
+						`{"electionId":3,"name":"general","electionType":0,"startDate":"2024-06-01T00:00:00Z","endDate":"2024-06-08T00:00:00Z","removalDaysAfter":7}`, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantCode: pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(int32(1), int32(1)).WillReturnRows(tc.adminRows)
+			tc.expect(mock)
+
+			res, err := server.CloseElection(context.Background(), &pb.CloseElectionRequest{
+				AuthKey:    testAuthKey(t, 1, 1),
+				UserId:     1,
+				PartyId:    1,
+				ElectionId: tc.electionId,
+			})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.GetCode() != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.GetCode(), tc.wantCode)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestListElections(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	now := time.Now()
+	columns := []string{"electionId", "name", "electionType", "removalDaysAfter", "startDate", "endDate", "closed", "posters", "removed", "removedLate"}
+	mock.ExpectQuery("select l1.electionId").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(4, "local", int32(pb.ElectionType_LOCAL_ELECTION), 5, now.Add(-time.Hour*24).Unix(), now.Add(time.Hour*24*6).Unix(), nil, 0, 0, 0).
+		AddRow(3, "general", int32(pb.ElectionType_GENERAL_ELECTION), 7, 1717200000, 1717804800, 1718409600, 12, 11, 2))
+	mock.ExpectQuery("select count").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows([]string{"posters", "removed", "removedLate"}).AddRow(5, 1, 0))
+
+	res, err := server.ListElections(context.Background(), &pb.ListElectionsRequest{AuthKey: testAuthKey(t, 2, 1), UserId: 2, PartyId: 1})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+	elections := res.GetElections()
+	if len(elections) != 2 {
+		t.Fatalf("got %d elections want 2", len(elections))
+	}
+	open, closed := elections[0], elections[1]
+	if open.GetStatus() != pb.ElectionStatus_ELECTION_ACTIVE || open.GetClosed() != nil || open.GetPosters() != 5 || open.GetRemoved() != 1 ||
+		open.GetElectionType() != pb.ElectionType_LOCAL_ELECTION || open.GetRemovalDaysAfter() != 5 {
+		t.Fatalf("got open election %v", open)
+	}
+	if closed.GetStatus() != pb.ElectionStatus_ELECTION_CLOSED || closed.GetClosed().GetSeconds() != 1718409600 ||
+		closed.GetPosters() != 12 || closed.GetRemoved() != 11 || closed.GetRemovedLate() != 2 {
+		t.Fatalf("got closed election %v", closed)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// admins are escalated to at most this many times for a poster
+	maxAdminEscalations = 3
+	// posters that are still up and close to or past their deadline. parties without an election have no deadline
+	escalationCandidatesQuery = fmt.Sprintf(`select l1.posterID, l1.partyId, l1.userID, l1.escalationStatus, unix_timestamp(%[1]s), l4.admin
+							from fyp_schema.posters as l1
+							join fyp_schema.elections as l3 on l1.partyId = l3.partyId and l3.closed is null
+							join fyp_schema.parties as l4 on l1.partyId = l4.partyID
+							left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							where l1.removed is null and %[1]s <= from_unixtime(?)`, posterDeadlineExpression)
+	// posters whose deadline moved back out of the window, e.g. because the election date changed
+	clearEscalationStatusQuery = fmt.Sprintf(`update fyp_schema.posters as l1
+							join fyp_schema.elections as l3 on l1.partyId = l3.partyId and l3.closed is null
+							left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							set l1.escalationStatus = null
+							where l1.removed is null and l1.escalationStatus is not null and %s > from_unixtime(?)`, posterDeadlineExpression)
+	// steps that were already taken are ignored by the unique key, so running twice is safe
+	insertEscalationQuery     = "insert ignore into fyp_schema.posterEscalations (posterId, partyId, step, level, recipientId, deadline) values (?,?,?,?,?,from_unixtime(?))"
+	setEscalationStatusQuery  = "update fyp_schema.posters set escalationStatus = ? where posterID = ?"
+	partyEscalationsQuery     = "select posterId, step, level, recipientId, unix_timestamp(deadline), unix_timestamp(created) from fyp_schema.posterEscalations where partyId = ?%s order by created desc, escalationId desc"
+	escalationRecipientClause = " and recipientId = ?"
+	escalationPosterClause    = " and posterId = ?"
+)
+
+// escalationPolicy decides when posters are escalated relative to their removal deadline.
+type escalationPolicy struct {
+	// how long before the deadline the placer is warned
+	dueSoon time.Duration
+	// how long after the deadline the party admin is told
+	adminAfter time.Duration
+	// how often the party admin is told again while the poster is still up
+	adminEvery time.Duration
+}
+
+type escalationStep struct {
+	step  pb.EscalationStep
+	level int32
+}
+
+// steps returns the escalations a poster should have had by now. Only the latest step for the placer and the
+// highest admin level are returned, so a poster found well past its deadline doesn't get every step at once.
+func (p escalationPolicy) steps(deadline, now time.Time) []escalationStep {
+	if now.Before(deadline.Add(-p.dueSoon)) {
+		return nil
+	}
+	if now.Before(deadline) {
+		return []escalationStep{{step: pb.EscalationStep_ESCALATION_DUE_SOON}}
+	}
+	steps := []escalationStep{{step: pb.EscalationStep_ESCALATION_OVERDUE}}
+	firstAdmin := deadline.Add(p.adminAfter)
+	if now.Before(firstAdmin) {
+		return steps
+	}
+	level := 1
+	if p.adminEvery > 0 {
+		level += int(now.Sub(firstAdmin) / p.adminEvery)
+	}
+	if level > maxAdminEscalations {
+		level = maxAdminEscalations
+	}
+	return append(steps, escalationStep{step: pb.EscalationStep_ESCALATION_ADMIN, level: int32(level)})
+}
+
+// posterEscalation is an escalation step taken for a poster.
+type posterEscalation struct {
+	posterId    int32
+	partyId     int32
+	step        pb.EscalationStep
+	level       int32
+	recipientId int32
+	deadline    time.Time
+}
+
+// escalationScheduler periodically escalates posters that are still up close to or after their removal deadline.
+type escalationScheduler struct {
+	db       *sql.DB
+	policy   escalationPolicy
+	interval time.Duration
+	// nil if escalations are only recorded
+	notifications *notificationService
+}
+
+// escalationEvents are the notifications sent for each escalation step.
+var escalationEvents = map[pb.EscalationStep]pb.NotificationEvent{
+	pb.EscalationStep_ESCALATION_DUE_SOON: pb.NotificationEvent_NOTIFY_POSTER_DUE_SOON,
+	pb.EscalationStep_ESCALATION_OVERDUE:  pb.NotificationEvent_NOTIFY_POSTER_OVERDUE,
+	pb.EscalationStep_ESCALATION_ADMIN:    pb.NotificationEvent_NOTIFY_POSTER_ESCALATED,
+}
+
+func (e *escalationScheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		if escalations, err := e.runOnce(time.Now()); err != nil {
+			log.Printf("failed to escalate posters: %v", err)
+		} else if len(escalations) > 0 {
+			log.Printf("escalated %d posters", len(escalations))
+			e.notify(ctx, escalations)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notify tells the recipient of each escalation about it.
+func (e *escalationScheduler) notify(ctx context.Context, escalations []posterEscalation) {
+	if e.notifications == nil {
+		return
+	}
+	for _, escalation := range escalations {
+		err := e.notifications.notify(ctx, notification{
+			event:    escalationEvents[escalation.step],
+			userId:   escalation.recipientId,
+			partyId:  escalation.partyId,
+			posterId: escalation.posterId,
+			deadline: escalation.deadline,
+			level:    escalation.level,
+		})
+		if err != nil {
+			log.Printf("failed to notify user %d about poster %d: %v", escalation.recipientId, escalation.posterId, err)
+		}
+	}
+}
+
+// runOnce takes every escalation step that is due and returns the ones that had not been taken before.
+func (e *escalationScheduler) runOnce(now time.Time) ([]posterEscalation, error) {
+	if _, err := e.db.Exec(clearEscalationStatusQuery, now.Add(e.policy.dueSoon).Unix()); err != nil {
+		return nil, fmt.Errorf("failed to clear escalation status: %v", err)
+	}
+	rows, err := e.db.Query(escalationCandidatesQuery, now.Add(e.policy.dueSoon).Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query posters to escalate: %v", err)
+	}
+	type candidate struct {
+		posterId, partyId, placerId, adminId int32
+		status                               sql.NullInt32
+		deadline                             int64
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err = rows.Scan(&c.posterId, &c.partyId, &c.placerId, &c.status, &c.deadline, &c.adminId); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to read posters to escalate: %v", err)
+		}
+		candidates = append(candidates, c)
+	}
+	_ = rows.Close()
+
+	var escalations []posterEscalation
+	for _, c := range candidates {
+		deadline := time.Unix(c.deadline, 0)
+		for _, step := range e.policy.steps(deadline, now) {
+			recipient := c.placerId
+			if step.step == pb.EscalationStep_ESCALATION_ADMIN {
+				recipient = c.adminId
+			} else if !c.status.Valid || c.status.Int32 != int32(step.step) {
+				if _, err = e.db.Exec(setEscalationStatusQuery, int32(step.step), c.posterId); err != nil {
+					return escalations, fmt.Errorf("failed to mark poster %d: %v", c.posterId, err)
+				}
+			}
+			res, err := e.db.Exec(insertEscalationQuery, c.posterId, c.partyId, int32(step.step), step.level, recipient, c.deadline)
+			if err != nil {
+				return escalations, fmt.Errorf("failed to record escalation of poster %d: %v", c.posterId, err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				escalations = append(escalations, posterEscalation{
+					posterId:    c.posterId,
+					partyId:     c.partyId,
+					step:        step.step,
+					level:       step.level,
+					recipientId: recipient,
+					deadline:    deadline,
+				})
+			}
+		}
+	}
+	return escalations, nil
+}
+
+// PosterEscalations returns the escalation steps taken for a party's posters so they can be shown in the app.
+func (s *server) PosterEscalations(ctx context.Context, in *pb.EscalationsRequest) (*pb.EscalationsResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+	// admins see every escalation, members only their own
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	admin := rows.Next()
+	_ = rows.Close()
+
+	filters := ""
+	args := []interface{}{in.GetPartyId()}
+	if !admin {
+		filters += escalationRecipientClause
+		args = append(args, in.GetUserId())
+	}
+	if in.GetPosterId() != 0 {
+		filters += escalationPosterClause
+		args = append(args, in.GetPosterId())
+	}
+	rows, err = s.DB.Query(fmt.Sprintf(partyEscalationsQuery, filters), args...)
+	if err != nil {
+		return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query escalations: %v", err)
+	}
+	defer rows.Close()
+	var escalations []*pb.PosterEscalation
+	for rows.Next() {
+		var escalation pb.PosterEscalation
+		var step int32
+		var deadline, created int64
+		if err = rows.Scan(&escalation.PosterId, &step, &escalation.Level, &escalation.RecipientId, &deadline, &created); err != nil {
+			return &pb.EscalationsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read escalations: %v", err)
+		}
+		escalation.Step = pb.EscalationStep(step)
+		escalation.Deadline = timestamppb.New(time.Unix(deadline, 0))
+		escalation.Created = timestamppb.New(time.Unix(created, 0))
+		escalations = append(escalations, &escalation)
+	}
+	return &pb.EscalationsResponse{Code: pb.ResponseCode_OK, Escalations: escalations}, nil
+}
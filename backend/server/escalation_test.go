@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestEscalationSteps(t *testing.T) {
+	policy := escalationPolicy{dueSoon: 48 * time.Hour, adminAfter: 24 * time.Hour, adminEvery: 72 * time.Hour}
+	deadline := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		now  time.Time
+		want []escalationStep
+	}{
+		{
+			name: "well before deadline",
+			now:  deadline.Add(-72 * time.Hour),
+		},
+		{
+			name: "due soon",
+			now:  deadline.Add(-time.Hour),
+			want: []escalationStep{{step: pb.EscalationStep_ESCALATION_DUE_SOON}},
+		},
+		{
+			name: "overdue",
+			now:  deadline.Add(time.Hour),
+			want: []escalationStep{{step: pb.EscalationStep_ESCALATION_OVERDUE}},
+		},
+		{
+			name: "first admin escalation",
+			now:  deadline.Add(25 * time.Hour),
+			want: []escalationStep{{step: pb.EscalationStep_ESCALATION_OVERDUE}, {step: pb.EscalationStep_ESCALATION_ADMIN, level: 1}},
+		},
+		{
+			name: "repeated admin escalation",
+			now:  deadline.Add(24*time.Hour + 73*time.Hour),
+			want: []escalationStep{{step: pb.EscalationStep_ESCALATION_OVERDUE}, {step: pb.EscalationStep_ESCALATION_ADMIN, level: 2}},
+		},
+		{
+			name: "admin escalations are capped",
+			now:  deadline.Add(365 * 24 * time.Hour),
+			want: []escalationStep{{step: pb.EscalationStep_ESCALATION_OVERDUE}, {step: pb.EscalationStep_ESCALATION_ADMIN, level: int32(maxAdminEscalations)}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := policy.steps(deadline, tc.now)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got steps %v want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got steps %v want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEscalationRunOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	defer db.Close()
+	now := time.Date(2024, 6, 12, 0, 0, 0, 0, time.UTC)
+	scheduler := &escalationScheduler{db: db, policy: escalationPolicy{dueSoon: 48 * time.Hour, adminAfter: 24 * time.Hour, adminEvery: 72 * time.Hour}}
+	columns := []string{"posterID", "partyId", "userID", "escalationStatus", "deadline", "admin"}
+	mock.ExpectExec("update fyp_schema.posters as l1").WithArgs(now.Add(48 * time.Hour).Unix()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select l1.posterID, l1.partyId").WithArgs(now.Add(48 * time.Hour).Unix()).WillReturnRows(sqlmock.NewRows(columns).
+		// due tomorrow and not marked yet
+		AddRow(1, 1, 2, nil, now.Add(24*time.Hour).Unix(), 5).
+		// two days overdue and already marked overdue, admin already told
+		AddRow(2, 1, 3, 1, now.Add(-48*time.Hour).Unix(), 5))
+	mock.ExpectExec("update fyp_schema.posters set escalationStatus").WithArgs(0, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert ignore into fyp_schema.posterEscalations").WithArgs(1, 1, 0, 0, 2, now.Add(24*time.Hour).Unix()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("insert ignore into fyp_schema.posterEscalations").WithArgs(2, 1, 1, 0, 3, now.Add(-48*time.Hour).Unix()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert ignore into fyp_schema.posterEscalations").WithArgs(2, 1, 2, 1, 5, now.Add(-48*time.Hour).Unix()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	escalations, err := scheduler.runOnce(now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(escalations) != 1 || escalations[0].posterId != 1 || escalations[0].step != pb.EscalationStep_ESCALATION_DUE_SOON || escalations[0].recipientId != 2 {
+		t.Fatalf("got escalations %v", escalations)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestPosterEscalations(t *testing.T) {
+	columns := []string{"posterId", "step", "level", "recipientId", "deadline", "created"}
+	tests := []struct {
+		name            string
+		authKey         string
+		userId          int32
+		partyId         int32
+		posterId        int32
+		adminRows       *sqlmock.Rows
+		wantArgs        []driver.Value
+		escalationRows  *sqlmock.Rows
+		wantErr         bool
+		wantCode        pb.ResponseCode
+		wantEscalations int
+	}{
+		{
+			name:     "partyId not set",
+			authKey:  testAuthKey(t, 1, 1),
+			userId:   1,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "token for another party",
+			authKey:  testAuthKey(t, 1, 2),
+			userId:   1,
+			partyId:  1,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:            "admin sees every escalation",
+			authKey:         testAuthKey(t, 1, 1),
+			userId:          1,
+			partyId:         1,
+			adminRows:       sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantArgs:        []driver.Value{int32(1)},
+			escalationRows:  sqlmock.NewRows(columns).AddRow(4, 2, 1, 1, 1718000000, 1718100000).AddRow(4, 1, 0, 2, 1718000000, 1718000000),
+			wantCode:        pb.ResponseCode_OK,
+			wantEscalations: 2,
+		},
+		{
+			name:            "member sees their own escalations for a poster",
+			authKey:         testAuthKey(t, 2, 1),
+			userId:          2,
+			partyId:         1,
+			posterId:        4,
+			adminRows:       sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantArgs:        []driver.Value{int32(1), int32(2), int32(4)},
+			escalationRows:  sqlmock.NewRows(columns).AddRow(4, 1, 0, 2, 1718000000, 1718000000),
+			wantCode:        pb.ResponseCode_OK,
+			wantEscalations: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db}
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select \\* from fyp_schema.parties").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			}
+			if tc.escalationRows != nil {
+				mock.ExpectQuery("select posterId, step, level").WithArgs(tc.wantArgs...).WillReturnRows(tc.escalationRows)
+			}
+
+			res, err := server.PosterEscalations(ctx, &pb.EscalationsRequest{AuthKey: tc.authKey, UserId: tc.userId, PartyId: tc.partyId, PosterId: tc.posterId})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Escalations) != tc.wantEscalations {
+				t.Fatalf("got %d escalations want %d", len(res.Escalations), tc.wantEscalations)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
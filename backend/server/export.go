@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	// size of the chunks an export is streamed in
+	exportChunkSize    = 64 * 1024
+	exportPostersQuery = `select l1.posterID, l1.userID, l2.username, unix_timestamp(l1.created), unix_timestamp(l1.removed),
+							st_y(l1.location), st_x(l1.location)
+							from fyp_schema.posters as l1
+							join fyp_schema.users as l2 on l1.userID = l2.userID
+							where l1.partyId = ?%s
+							order by l1.posterID`
+)
+
+// exportedPoster is a row of an export. Locations are stored as WGS84 so no conversion is needed.
+type exportedPoster struct {
+	posterId int32
+	userId   int32
+	username string
+	placed   time.Time
+	// zero if the poster is still up
+	removed time.Time
+	lat     float64
+	lng     float64
+}
+
+func (p exportedPoster) name() string {
+	return fmt.Sprintf("poster %d", p.posterId)
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatCoordinate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// posterExporter writes posters in one file format. start and end write whatever comes before and after the posters.
+type posterExporter interface {
+	contentType() string
+	extension() string
+	start(w io.Writer) error
+	write(w io.Writer, poster exportedPoster) error
+	end(w io.Writer) error
+}
+
+func newPosterExporter(format pb.ExportFormat) (posterExporter, error) {
+	switch format {
+	case pb.ExportFormat_EXPORT_GEOJSON:
+		return &geoJSONExporter{}, nil
+	case pb.ExportFormat_EXPORT_KML:
+		return kmlExporter{}, nil
+	case pb.ExportFormat_EXPORT_GPX:
+		return gpxExporter{}, nil
+	case pb.ExportFormat_EXPORT_CSV:
+		return &csvExporter{}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %v", format)
+}
+
+type geoJSONExporter struct {
+	written int
+}
+
+func (e *geoJSONExporter) contentType() string { return "application/geo+json" }
+func (e *geoJSONExporter) extension() string   { return "geojson" }
+
+func (e *geoJSONExporter) start(w io.Writer) error {
+	_, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (e *geoJSONExporter) write(w io.Writer, poster exportedPoster) error {
+	properties := map[string]interface{}{
+		"posterId": poster.posterId,
+		"userId":   poster.userId,
+		"username": poster.username,
+		"placed":   formatExportTime(poster.placed),
+		"removed":  nil,
+	}
+	if !poster.removed.IsZero() {
+		properties["removed"] = formatExportTime(poster.removed)
+	}
+	feature, err := json.Marshal(map[string]interface{}{
+		"type":       "Feature",
+		"geometry":   map[string]interface{}{"type": "Point", "coordinates": []float64{poster.lng, poster.lat}},
+		"properties": properties,
+	})
+	if err != nil {
+		return err
+	}
+	if e.written > 0 {
+		if _, err = io.WriteString(w, ","); err != nil {
+			return err
+		}
+	}
+	e.written++
+	_, err = w.Write(feature)
+	return err
+}
+
+func (e *geoJSONExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+type kmlExporter struct{}
+
+func (kmlExporter) contentType() string { return "application/vnd.google-earth.kml+xml" }
+func (kmlExporter) extension() string   { return "kml" }
+
+func (kmlExporter) start(w io.Writer) error {
+	_, err := io.WriteString(w, xml.Header+`<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>posters</name>`)
+	return err
+}
+
+func (kmlExporter) write(w io.Writer, poster exportedPoster) error {
+	// councils mostly want to know who to contact about a poster and whether it is still up
+	description := fmt.Sprintf("placed by %s on %s", poster.username, formatExportTime(poster.placed))
+	if !poster.removed.IsZero() {
+		description += ", removed on " + formatExportTime(poster.removed)
+	}
+	_, err := fmt.Fprintf(w, "<Placemark><name>%s</name><description>%s</description><TimeStamp><when>%s</when></TimeStamp><Point><coordinates>%s,%s</coordinates></Point></Placemark>",
+		escapeXML(poster.name()), escapeXML(description), formatExportTime(poster.placed), formatCoordinate(poster.lng), formatCoordinate(poster.lat))
+	return err
+}
+
+func (kmlExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "</Document></kml>")
+	return err
+}
+
+type gpxExporter struct{}
+
+func (gpxExporter) contentType() string { return "application/gpx+xml" }
+func (gpxExporter) extension() string   { return "gpx" }
+
+func (gpxExporter) start(w io.Writer) error {
+	_, err := io.WriteString(w, xml.Header+`<gpx xmlns="http://www.topografix.com/GPX/1/1" version="1.1" creator="fyp">`)
+	return err
+}
+
+func (gpxExporter) write(w io.Writer, poster exportedPoster) error {
+	_, err := fmt.Fprintf(w, `<wpt lat="%s" lon="%s"><time>%s</time><name>%s</name><desc>%s</desc></wpt>`,
+		formatCoordinate(poster.lat), formatCoordinate(poster.lng), formatExportTime(poster.placed), escapeXML(poster.name()), escapeXML("placed by "+poster.username))
+	return err
+}
+
+func (gpxExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "</gpx>")
+	return err
+}
+
+type csvExporter struct {
+	csv *csv.Writer
+}
+
+func (e *csvExporter) contentType() string { return "text/csv" }
+func (e *csvExporter) extension() string   { return "csv" }
+
+func (e *csvExporter) start(w io.Writer) error {
+	e.csv = csv.NewWriter(w)
+	return e.csv.Write([]string{"posterId", "userId", "username", "placed", "removed", "latitude", "longitude"})
+}
+
+func (e *csvExporter) write(w io.Writer, poster exportedPoster) error {
+	return e.csv.Write([]string{
+		strconv.Itoa(int(poster.posterId)),
+		strconv.Itoa(int(poster.userId)),
+		poster.username,
+		formatExportTime(poster.placed),
+		formatExportTime(poster.removed),
+		formatCoordinate(poster.lat),
+		formatCoordinate(poster.lng),
+	})
+}
+
+func (e *csvExporter) end(w io.Writer) error {
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// chunkWriter sends everything written to it as ExportChunks once enough has been buffered.
+type chunkWriter struct {
+	stream      pb.PosterApp_ExportPostersServer
+	buf         bytes.Buffer
+	contentType string
+	filename    string
+	sent        bool
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	n, _ := c.buf.Write(p)
+	for c.buf.Len() >= exportChunkSize {
+		if err := c.send(c.buf.Next(exportChunkSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (c *chunkWriter) send(data []byte) error {
+	chunk := &pb.ExportChunk{Data: append([]byte(nil), data...)}
+	if !c.sent {
+		chunk.ContentType = c.contentType
+		chunk.Filename = c.filename
+		c.sent = true
+	}
+	return c.stream.Send(chunk)
+}
+
+// flush sends whatever is left in the buffer.
+func (c *chunkWriter) flush() error {
+	if c.buf.Len() == 0 && c.sent {
+		return nil
+	}
+	return c.send(c.buf.Next(c.buf.Len()))
+}
+
+// ExportPosters streams a partys posters as a GeoJSON, KML, GPX or CSV file.
+func (s *server) ExportPosters(in *pb.ExportRequest, stream pb.PosterApp_ExportPostersServer) error {
+	if in.GetAuthKey() == "" {
+		return fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return fmt.Errorf("partyId not set")
+	}
+	exporter, err := newPosterExporter(in.GetFormat())
+	if err != nil {
+		return err
+	}
+	if in.GetPlacedAfter() != nil && in.GetPlacedBefore() != nil && !in.GetPlacedAfter().AsTime().Before(in.GetPlacedBefore().AsTime()) {
+		return fmt.Errorf("placedAfter must be before placedBefore")
+	}
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return fmt.Errorf("authkey does not match supplied data")
+	}
+
+	filters := posterStatusClause(in.GetStatus())
+	args := []interface{}{in.GetPartyId()}
+	if in.GetCurrentElection() {
+		startDate, _, ok, err := s.electionDates(in.GetPartyId())
+		if err != nil {
+			return fmt.Errorf("failed to query election dates: %v", err)
+		}
+		if !ok {
+			return fmt.Errorf("party admin must create an election first")
+		}
+		filters += " and l1.created >= from_unixtime(?)"
+		args = append(args, startDate.Unix())
+	}
+	if in.GetPlacedAfter() != nil {
+		filters += " and l1.created >= from_unixtime(?)"
+		args = append(args, in.GetPlacedAfter().AsTime().Unix())
+	}
+	if in.GetPlacedBefore() != nil {
+		filters += " and l1.created < from_unixtime(?)"
+		args = append(args, in.GetPlacedBefore().AsTime().Unix())
+	}
+	if in.GetVolunteerId() != 0 {
+		filters += " and l1.userID = ?"
+		args = append(args, in.GetVolunteerId())
+	}
+	rows, err := s.DB.Query(fmt.Sprintf(exportPostersQuery, filters), args...)
+	if err != nil {
+		return fmt.Errorf("failed to query posters: %v", err)
+	}
+	defer rows.Close()
+
+	w := &chunkWriter{
+		stream:      stream,
+		contentType: exporter.contentType(),
+		filename:    fmt.Sprintf("posters-%s.%s", time.Now().UTC().Format("2006-01-02"), exporter.extension()),
+	}
+	if err = exporter.start(w); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var poster exportedPoster
+		var placed int64
+		var removed sql.NullInt64
+		err = rows.Scan(&poster.posterId, &poster.userId, &poster.username, &placed, &removed, &poster.lat, &poster.lng)
+		if err != nil {
+			return fmt.Errorf("failed to read posters from sql result: %v", err)
+		}
+		poster.placed = time.Unix(placed, 0)
+		if removed.Valid {
+			poster.removed = time.Unix(removed.Int64, 0)
+		}
+		if err = exporter.write(w, poster); err != nil {
+			return err
+		}
+	}
+	if err = exporter.end(w); err != nil {
+		return err
+	}
+	return w.flush()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/michaelc445/proto"
+)
+
+type fakeExportStream struct {
+	grpc.ServerStream
+	chunks []*pb.ExportChunk
+}
+
+func (f *fakeExportStream) Context() context.Context {
+	return context.Background()
+}
+
+func (f *fakeExportStream) Send(chunk *pb.ExportChunk) error {
+	f.chunks = append(f.chunks, chunk)
+	return nil
+}
+
+func (f *fakeExportStream) file() string {
+	var b bytes.Buffer
+	for _, chunk := range f.chunks {
+		b.Write(chunk.Data)
+	}
+	return b.String()
+}
+
+func TestExportPosters(t *testing.T) {
+	columns := []string{"posterID", "userID", "username", "created", "removed", "latitude", "longitude"}
+	exportRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow(1, 1, "michael1234", 1700000000, nil, 53.35, -6.26).
+			AddRow(2, 2, "o'brien & co", 1700003600, 1700090000, 53.36, -6.25)
+	}
+	tests := []struct {
+		name            string
+		request         *pb.ExportRequest
+		electionRows    *sqlmock.Rows
+		wantArgs        []interface{}
+		exportRows      *sqlmock.Rows
+		wantErr         bool
+		wantContentType string
+		wantContains    []string
+	}{
+		{
+			name:    "unknown format",
+			request: &pb.ExportRequest{Format: pb.ExportFormat(10)},
+			wantErr: true,
+		},
+		{
+			name:    "placedAfter after placedBefore",
+			request: &pb.ExportRequest{PlacedAfter: timestamppb.New(time.Unix(1700003600, 0)), PlacedBefore: timestamppb.New(time.Unix(1700000000, 0))},
+			wantErr: true,
+		},
+		{
+			name:         "party has no election",
+			request:      &pb.ExportRequest{CurrentElection: true},
+			electionRows: sqlmock.NewRows([]string{"startDate", "endDate"}),
+			wantErr:      true,
+		},
+		{
+			name:            "geojson",
+			request:         &pb.ExportRequest{Format: pb.ExportFormat_EXPORT_GEOJSON},
+			wantArgs:        []interface{}{int32(1)},
+			exportRows:      exportRows(),
+			wantContentType: "application/geo+json",
+			wantContains:    []string{`"coordinates":[-6.26,53.35]`, `"removed":"2023-11-15T23:13:20Z"`},
+		},
+		{
+			name:            "kml",
+			request:         &pb.ExportRequest{Format: pb.ExportFormat_EXPORT_KML, Status: pb.PosterStatusFilter_REMOVED_POSTERS},
+			wantArgs:        []interface{}{int32(1)},
+			exportRows:      exportRows(),
+			wantContentType: "application/vnd.google-earth.kml+xml",
+			wantContains:    []string{"<coordinates>-6.25,53.36</coordinates>", "placed by o&#39;brien &amp; co"},
+		},
+		{
+			name:            "gpx",
+			request:         &pb.ExportRequest{Format: pb.ExportFormat_EXPORT_GPX, VolunteerId: 2},
+			wantArgs:        []interface{}{int32(1), int32(2)},
+			exportRows:      exportRows(),
+			wantContentType: "application/gpx+xml",
+			wantContains:    []string{`<wpt lat="53.35" lon="-6.26">`, "</gpx>"},
+		},
+		{
+			name: "csv",
+			request: &pb.ExportRequest{Format: pb.ExportFormat_EXPORT_CSV, CurrentElection: true,
+				PlacedAfter: timestamppb.New(time.Unix(1600000000, 0)), PlacedBefore: timestamppb.New(time.Unix(1800000000, 0))},
+			electionRows:    sqlmock.NewRows([]string{"startDate", "endDate"}).AddRow(1690000000, 1710000000),
+			wantArgs:        []interface{}{int32(1), int64(1690000000), int64(1600000000), int64(1800000000)},
+			exportRows:      exportRows(),
+			wantContentType: "text/csv",
+			wantContains: []string{
+				"posterId,userId,username,placed,removed,latitude,longitude\n",
+				"1,1,michael1234,2023-11-14T22:13:20Z,,53.35,-6.26\n",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.electionRows != nil {
+				mock.ExpectQuery("select unix_timestamp").WithArgs(int32(1)).WillReturnRows(tc.electionRows)
+			}
+			if tc.exportRows != nil {
+				args := make([]driver.Value, len(tc.wantArgs))
+				for i, arg := range tc.wantArgs {
+					args[i] = arg
+				}
+				mock.ExpectQuery("select l1.posterID").WithArgs(args...).WillReturnRows(tc.exportRows)
+			}
+
+			tc.request.UserId, tc.request.PartyId, tc.request.AuthKey = 1, 1, testAuthKey(t, 1, 1)
+			stream := &fakeExportStream{}
+			err = server.ExportPosters(tc.request, stream)
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if len(stream.chunks) == 0 || stream.chunks[0].ContentType != tc.wantContentType || !strings.HasPrefix(stream.chunks[0].Filename, "posters-") {
+				t.Fatalf("got chunks %v", stream.chunks)
+			}
+			file := stream.file()
+			for _, want := range tc.wantContains {
+				if !strings.Contains(file, want) {
+					t.Fatalf("export does not contain %q:\n%s", want, file)
+				}
+			}
+			if tc.request.Format == pb.ExportFormat_EXPORT_GEOJSON {
+				var collection struct {
+					Features []json.RawMessage `json:"features"`
+				}
+				if err = json.Unmarshal([]byte(file), &collection); err != nil || len(collection.Features) != 2 {
+					t.Fatalf("export is not valid geojson: %v\n%s", err, file)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkWriter(t *testing.T) {
+	defer func(size int) { exportChunkSize = size }(exportChunkSize)
+	exportChunkSize = 4
+
+	stream := &fakeExportStream{}
+	w := &chunkWriter{stream: stream, contentType: "text/csv", filename: "posters.csv"}
+	_, _ = w.Write([]byte("abcdefghij"))
+	if err := w.flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if len(stream.chunks) != 3 || stream.file() != "abcdefghij" {
+		t.Fatalf("got chunks %v", stream.chunks)
+	}
+	if stream.chunks[0].ContentType != "text/csv" || stream.chunks[1].ContentType != "" {
+		t.Fatalf("content type should only be on the first chunk: %v", stream.chunks)
+	}
+
+	// an empty export still tells the client what the file is
+	stream = &fakeExportStream{}
+	w = &chunkWriter{stream: stream, contentType: "text/csv", filename: "posters.csv"}
+	if err := w.flush(); err != nil || len(stream.chunks) != 1 || stream.chunks[0].Filename != "posters.csv" {
+		t.Fatalf("got chunks %v err %v", stream.chunks, err)
+	}
+}
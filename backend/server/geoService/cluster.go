@@ -0,0 +1,70 @@
+package geoService
+
+import "math"
+
+// maxClusterIterations is plenty for the few hundred posters a party has outstanding.
+const maxClusterIterations = 100
+
+// Cluster splits points into k geographic groups with k-means and returns the group of each point.
+// The first centre is the first point and each next one is the point furthest from the centres so far,
+// so the same points always give the same groups.
+func Cluster(points []Point, k int) []int {
+	labels := make([]int, len(points))
+	if k <= 1 || len(points) == 0 {
+		return labels
+	}
+	if k > len(points) {
+		k = len(points)
+	}
+
+	centres := []Point{points[0]}
+	nearest := make([]float64, len(points))
+	for i, p := range points {
+		nearest[i] = Distance(p, centres[0])
+	}
+	for len(centres) < k {
+		furthest := 0
+		for i := range points {
+			if nearest[i] > nearest[furthest] {
+				furthest = i
+			}
+		}
+		centres = append(centres, points[furthest])
+		for i, p := range points {
+			nearest[i] = math.Min(nearest[i], Distance(p, points[furthest]))
+		}
+	}
+
+	for iteration := 0; iteration < maxClusterIterations; iteration++ {
+		changed := iteration == 0
+		for i, p := range points {
+			best := 0
+			for c := range centres {
+				if Distance(p, centres[c]) < Distance(p, centres[best]) {
+					best = c
+				}
+			}
+			if labels[i] != best {
+				labels[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		// move each centre to the middle of its group, groups are small enough to average coordinates
+		sums := make([]Point, k)
+		counts := make([]int, k)
+		for i, p := range points {
+			sums[labels[i]].Lat += p.Lat
+			sums[labels[i]].Lng += p.Lng
+			counts[labels[i]]++
+		}
+		for c := range centres {
+			if counts[c] > 0 {
+				centres[c] = Point{Lat: sums[c].Lat / float64(counts[c]), Lng: sums[c].Lng / float64(counts[c])}
+			}
+		}
+	}
+	return labels
+}
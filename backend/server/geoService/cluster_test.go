@@ -0,0 +1,56 @@
+package geoService
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCluster(t *testing.T) {
+	// two groups of posters, one in the city centre and one about 10km away
+	points := []Point{
+		{Lat: 53.349, Lng: -6.260},
+		{Lat: 53.288, Lng: -6.365},
+		{Lat: 53.350, Lng: -6.261},
+		{Lat: 53.289, Lng: -6.364},
+		{Lat: 53.348, Lng: -6.259},
+	}
+	tests := []struct {
+		name       string
+		points     []Point
+		k          int
+		wantLabels []int
+	}{
+		{
+			name:       "two groups",
+			points:     points,
+			k:          2,
+			wantLabels: []int{0, 1, 0, 1, 0},
+		},
+		{
+			name:       "one group",
+			points:     points,
+			k:          1,
+			wantLabels: []int{0, 0, 0, 0, 0},
+		},
+		{
+			name:       "more groups than points",
+			points:     points[:2],
+			k:          5,
+			wantLabels: []int{0, 1},
+		},
+		{
+			name:       "no points",
+			k:          3,
+			wantLabels: []int{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			labels := Cluster(tc.points, tc.k)
+			if !reflect.DeepEqual(labels, tc.wantLabels) {
+				t.Fatalf("got labels %v want %v", labels, tc.wantLabels)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package geoService
+
+import "math"
+
+// EarthRadius is the radius in metres used by MySQL's ST_Distance_Sphere, so distances worked out here
+// match the ones the database gives.
+const EarthRadius = 6370986.0
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+// Distance returns the great circle distance between two points in metres using the haversine formula.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat, dLng := lat2-lat1, radians(b.Lng-a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Bearing returns the initial compass bearing in degrees, 0 to 360, to travel from a to b.
+func Bearing(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLng := radians(b.Lng - a.Lng)
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(degrees(math.Atan2(y, x))+360, 360)
+}
+
+// Envelope returns the south west and north east corners of a box that contains every point within
+// metres of p. The box is clamped to valid coordinates rather than wrapping around the antimeridian.
+func Envelope(p Point, metres float64) (sw, ne Point) {
+	dLat := degrees(metres / EarthRadius)
+	// a degree of longitude gets shorter towards the poles
+	dLng := 180.0
+	if cos := math.Cos(radians(p.Lat)); cos > 1e-9 {
+		dLng = math.Min(180, dLat/cos)
+	}
+	sw = Point{Lat: math.Max(-90, p.Lat-dLat), Lng: math.Max(-180, p.Lng-dLng)}
+	ne = Point{Lat: math.Min(90, p.Lat+dLat), Lng: math.Min(180, p.Lng+dLng)}
+	return sw, ne
+}
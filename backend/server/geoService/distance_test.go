@@ -0,0 +1,64 @@
+package geoService
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{name: "same point", a: Point{Lat: 53.34, Lng: -6.26}, b: Point{Lat: 53.34, Lng: -6.26}, want: 0},
+		{name: "one degree of latitude", a: Point{Lat: 0, Lng: 0}, b: Point{Lat: 1, Lng: 0}, want: 111195},
+		{name: "dublin to cork", a: Point{Lat: 53.3498, Lng: -6.2603}, b: Point{Lat: 51.8985, Lng: -8.4756}, want: 219920},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Distance(tc.a, tc.b)
+			// within 0.1% of the expected distance
+			if math.Abs(got-tc.want) > tc.want*0.001+1 {
+				t.Fatalf("got distance %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBearing(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Point
+		want float64
+	}{
+		{name: "north", a: Point{Lat: 0, Lng: 0}, b: Point{Lat: 1, Lng: 0}, want: 0},
+		{name: "east", a: Point{Lat: 0, Lng: 0}, b: Point{Lat: 0, Lng: 1}, want: 90},
+		{name: "south", a: Point{Lat: 1, Lng: 0}, b: Point{Lat: 0, Lng: 0}, want: 180},
+		{name: "west", a: Point{Lat: 0, Lng: 1}, b: Point{Lat: 0, Lng: 0}, want: 270},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Bearing(tc.a, tc.b)
+			if math.Abs(got-tc.want) > 0.01 {
+				t.Fatalf("got bearing %v want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	p := Point{Lat: 53.34, Lng: -6.26}
+	sw, ne := Envelope(p, 1000)
+	for _, corner := range []Point{{Lat: sw.Lat, Lng: p.Lng}, {Lat: ne.Lat, Lng: p.Lng}, {Lat: p.Lat, Lng: sw.Lng}, {Lat: p.Lat, Lng: ne.Lng}} {
+		if d := Distance(p, corner); math.Abs(d-1000) > 1 {
+			t.Fatalf("got envelope edge %v metres away want 1000", d)
+		}
+	}
+	sw, ne = Envelope(Point{Lat: 89.99, Lng: 179.99}, 10000)
+	if !sw.Valid() || !ne.Valid() {
+		t.Fatalf("got invalid envelope %v %v", sw, ne)
+	}
+}
@@ -0,0 +1,56 @@
+package geoService
+
+import (
+	"fmt"
+	"strings"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// MaxGeohashPrecision is the longest geohash MySQL's ST_GeoHash is asked for, cells are around 40m across.
+const MaxGeohashPrecision = 8
+
+// GeohashPrecision returns the geohash length whose cells are roughly the size of a map tile at a web map zoom level,
+// so a screen full of map shows a few dozen cells at most.
+func GeohashPrecision(zoom int) int {
+	// each extra character splits a cell into 32, about two and a half zoom levels
+	precision := (zoom*2)/5 + 1
+	if precision < 1 {
+		return 1
+	}
+	if precision > MaxGeohashPrecision {
+		return MaxGeohashPrecision
+	}
+	return precision
+}
+
+// DecodeGeohash returns the south west and north east corners of a geohash cell.
+func DecodeGeohash(hash string) (sw, ne Point, err error) {
+	if hash == "" {
+		return Point{}, Point{}, fmt.Errorf("geohash is empty")
+	}
+	lat := [2]float64{-90, 90}
+	lng := [2]float64{-180, 180}
+	// bits alternate between longitude and latitude, starting with longitude
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		value := strings.IndexRune(geohashAlphabet, c)
+		if value < 0 {
+			return Point{}, Point{}, fmt.Errorf("%q is not a valid geohash", hash)
+		}
+		for bit := 4; bit >= 0; bit-- {
+			interval := &lat
+			if even {
+				interval = &lng
+			}
+			mid := (interval[0] + interval[1]) / 2
+			if value&(1<<bit) != 0 {
+				interval[0] = mid
+			} else {
+				interval[1] = mid
+			}
+			even = !even
+		}
+	}
+	return Point{Lat: lat[0], Lng: lng[0]}, Point{Lat: lat[1], Lng: lng[1]}, nil
+}
@@ -0,0 +1,58 @@
+package geoService
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGeohashPrecision(t *testing.T) {
+	tests := []struct {
+		zoom int
+		want int
+	}{
+		{zoom: 0, want: 1},
+		{zoom: 5, want: 3},
+		{zoom: 12, want: 5},
+		{zoom: 15, want: 7},
+		{zoom: 22, want: MaxGeohashPrecision},
+	}
+
+	for _, tc := range tests {
+		if got := GeohashPrecision(tc.zoom); got != tc.want {
+			t.Fatalf("zoom %d got precision %d want %d", tc.zoom, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeGeohash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		wantSW  Point
+		wantNE  Point
+		wantErr bool
+	}{
+		{name: "whole cell", hash: "g", wantSW: Point{Lat: 45, Lng: -45}, wantNE: Point{Lat: 90, Lng: 0}},
+		{name: "dublin", hash: "gc7x9", wantSW: Point{Lat: 53.349609375, Lng: -6.2841796875}, wantNE: Point{Lat: 53.3935546875, Lng: -6.240234375}},
+		{name: "upper case", hash: "GC7X9", wantSW: Point{Lat: 53.349609375, Lng: -6.2841796875}, wantNE: Point{Lat: 53.3935546875, Lng: -6.240234375}},
+		{name: "empty", wantErr: true},
+		{name: "invalid character", hash: "gc7a", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sw, ne, err := DecodeGeohash(tc.hash)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			for _, c := range [][2]float64{{sw.Lat, tc.wantSW.Lat}, {sw.Lng, tc.wantSW.Lng}, {ne.Lat, tc.wantNE.Lat}, {ne.Lng, tc.wantNE.Lng}} {
+				if math.Abs(c[0]-c[1]) > 1e-9 {
+					t.Fatalf("got cell %v %v want %v %v", sw, ne, tc.wantSW, tc.wantNE)
+				}
+			}
+		})
+	}
+}
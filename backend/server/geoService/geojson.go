@@ -0,0 +1,217 @@
+package geoService
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Point is a WGS84 coordinate.
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Polygon is a list of closed rings, the first ring is the outer boundary and any others are holes.
+type Polygon [][]Point
+
+// PointFeature is a location read from a GeoJSON file.
+type PointFeature struct {
+	Point
+	Properties map[string]interface{}
+}
+
+// Feature is a named area read from a GeoJSON file.
+type Feature struct {
+	Name       string
+	Polygons   []Polygon
+	Properties map[string]interface{}
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONObject struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+	geoJSONFeature
+}
+
+func parseFeatures(data []byte) ([]geoJSONFeature, error) {
+	var object geoJSONObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("invalid geojson: %v", err)
+	}
+	switch object.Type {
+	case "FeatureCollection":
+		return object.Features, nil
+	case "Feature":
+		return []geoJSONFeature{object.geoJSONFeature}, nil
+	}
+	return nil, fmt.Errorf("geojson must be a FeatureCollection or Feature, got %q", object.Type)
+}
+
+// PointRow is a feature read by ParsePointRows. Err is set if the feature is not a valid Point.
+type PointRow struct {
+	PointFeature
+	Err error
+}
+
+// ParsePointRows reads every feature of a GeoJSON FeatureCollection or Feature, so callers can report all of
+// the invalid features at once. An error is only returned if the data is not GeoJSON.
+func ParsePointRows(data []byte) ([]PointRow, error) {
+	features, err := parseFeatures(data)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]PointRow, len(features))
+	for i, feature := range features {
+		rows[i].Properties = feature.Properties
+		if feature.Geometry == nil || feature.Geometry.Type != "Point" {
+			rows[i].Err = fmt.Errorf("must be a Point")
+			continue
+		}
+		var position []float64
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &position); err != nil || len(position) < 2 {
+			rows[i].Err = fmt.Errorf("has invalid coordinates")
+			continue
+		}
+		rows[i].Point = Point{Lng: position[0], Lat: position[1]}
+		if !rows[i].Point.Valid() {
+			rows[i].Err = fmt.Errorf("position %v is not a valid coordinate", position)
+		}
+	}
+	return rows, nil
+}
+
+// ParsePoints reads the Point features from a GeoJSON FeatureCollection or Feature.
+func ParsePoints(data []byte) ([]PointFeature, error) {
+	rows, err := ParsePointRows(data)
+	if err != nil {
+		return nil, err
+	}
+	var points []PointFeature
+	for i, row := range rows {
+		if row.Err != nil {
+			return nil, fmt.Errorf("feature %d %v", i, row.Err)
+		}
+		points = append(points, row.PointFeature)
+	}
+	return points, nil
+}
+
+// ParseAreas reads the Polygon and MultiPolygon features from a GeoJSON FeatureCollection or Feature.
+// Every feature must have a name property.
+func ParseAreas(data []byte) ([]Feature, error) {
+	features, err := parseFeatures(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var areas []Feature
+	for i, feature := range features {
+		name, _ := feature.Properties["name"].(string)
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("feature %d has no name property", i)
+		}
+		if feature.Geometry == nil {
+			return nil, fmt.Errorf("feature %q has no geometry", name)
+		}
+		var polygons []Polygon
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var coordinates [][][]float64
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &coordinates); err != nil {
+				return nil, fmt.Errorf("feature %q has invalid coordinates: %v", name, err)
+			}
+			polygon, err := toPolygon(coordinates)
+			if err != nil {
+				return nil, fmt.Errorf("feature %q: %v", name, err)
+			}
+			polygons = append(polygons, polygon)
+		case "MultiPolygon":
+			var coordinates [][][][]float64
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &coordinates); err != nil {
+				return nil, fmt.Errorf("feature %q has invalid coordinates: %v", name, err)
+			}
+			for _, c := range coordinates {
+				polygon, err := toPolygon(c)
+				if err != nil {
+					return nil, fmt.Errorf("feature %q: %v", name, err)
+				}
+				polygons = append(polygons, polygon)
+			}
+		default:
+			return nil, fmt.Errorf("feature %q must be a Polygon or MultiPolygon, got %q", name, feature.Geometry.Type)
+		}
+		areas = append(areas, Feature{Name: name, Polygons: polygons, Properties: feature.Properties})
+	}
+	return areas, nil
+}
+
+func toPolygon(rings [][][]float64) (Polygon, error) {
+	if len(rings) == 0 {
+		return nil, fmt.Errorf("polygon has no rings")
+	}
+	var polygon Polygon
+	for _, ring := range rings {
+		if len(ring) < 4 {
+			return nil, fmt.Errorf("polygon ring must have at least 4 positions")
+		}
+		var points []Point
+		for _, position := range ring {
+			// geojson positions are longitude first
+			if len(position) < 2 {
+				return nil, fmt.Errorf("position must have a longitude and latitude")
+			}
+			point := Point{Lng: position[0], Lat: position[1]}
+			if !point.Valid() {
+				return nil, fmt.Errorf("position %v is not a valid coordinate", position)
+			}
+			points = append(points, point)
+		}
+		if points[0] != points[len(points)-1] {
+			return nil, fmt.Errorf("polygon ring is not closed")
+		}
+		polygon = append(polygon, points)
+	}
+	return polygon, nil
+}
+
+// Valid reports whether p is a valid WGS84 coordinate.
+func (p Point) Valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// WKT returns the areas polygons as well known text, with x as longitude to match point(lng, lat) in the database.
+func (f Feature) WKT() string {
+	var polygons []string
+	for _, polygon := range f.Polygons {
+		var rings []string
+		for _, ring := range polygon {
+			var positions []string
+			for _, point := range ring {
+				positions = append(positions, formatFloat(point.Lng)+" "+formatFloat(point.Lat))
+			}
+			rings = append(rings, "("+strings.Join(positions, ", ")+")")
+		}
+		polygons = append(polygons, "("+strings.Join(rings, ", ")+")")
+	}
+	if len(polygons) == 1 {
+		return "POLYGON" + polygons[0]
+	}
+	return "MULTIPOLYGON(" + strings.Join(polygons, ", ") + ")"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,141 @@
+package geoService
+
+import "testing"
+
+func TestParseAreas(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+		wantWKT []string
+	}{
+		{
+			name: "feature collection",
+			data: `{"type":"FeatureCollection","features":[
+				{"type":"Feature","properties":{"name":"school"},"geometry":{"type":"Polygon","coordinates":[[[-6.25,53.3],[-6.24,53.3],[-6.24,53.31],[-6.25,53.3]]]}},
+				{"type":"Feature","properties":{"name":"junctions"},"geometry":{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[2,2],[3,2],[3,3],[2,2]]]]}}
+			]}`,
+			wantWKT: []string{
+				"POLYGON((-6.25 53.3, -6.24 53.3, -6.24 53.31, -6.25 53.3))",
+				"MULTIPOLYGON(((0 0, 1 0, 1 1, 0 0)), ((2 2, 3 2, 3 3, 2 2)))",
+			},
+		},
+		{
+			name:    "single feature",
+			data:    `{"type":"Feature","properties":{"name":"school"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}`,
+			wantWKT: []string{"POLYGON((0 0, 1 0, 1 1, 0 0))"},
+		},
+		{
+			name:    "missing name",
+			data:    `{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "ring not closed",
+			data:    `{"type":"Feature","properties":{"name":"a"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid coordinate",
+			data:    `{"type":"Feature","properties":{"name":"a"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,95],[1,1],[0,0]]]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "point geometry",
+			data:    `{"type":"Feature","properties":{"name":"a"},"geometry":{"type":"Point","coordinates":[0,0]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not geojson",
+			data:    `not json`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			areas, err := ParseAreas([]byte(tc.data))
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if len(areas) != len(tc.wantWKT) {
+				t.Fatalf("got %d areas want %d", len(areas), len(tc.wantWKT))
+			}
+			for i, area := range areas {
+				if area.WKT() != tc.wantWKT[i] {
+					t.Fatalf("got wkt %v want %v", area.WKT(), tc.wantWKT[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantErr    bool
+		wantPoints []Point
+	}{
+		{
+			name: "feature collection",
+			data: `{"type":"FeatureCollection","features":[
+				{"type":"Feature","properties":{"quantity":2},"geometry":{"type":"Point","coordinates":[-6.25,53.3]}},
+				{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[-6.24,53.31]}}
+			]}`,
+			wantPoints: []Point{{Lat: 53.3, Lng: -6.25}, {Lat: 53.31, Lng: -6.24}},
+		},
+		{
+			name:    "polygon geometry",
+			data:    `{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid coordinate",
+			data:    `{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[0,95]}}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			points, err := ParsePoints([]byte(tc.data))
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if len(points) != len(tc.wantPoints) {
+				t.Fatalf("got %d points want %d", len(points), len(tc.wantPoints))
+			}
+			for i, point := range points {
+				if point.Point != tc.wantPoints[i] {
+					t.Fatalf("got point %v want %v", point.Point, tc.wantPoints[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePointRows(t *testing.T) {
+	rows, err := ParsePointRows([]byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"username":"a"},"geometry":{"type":"Point","coordinates":[-6.25,53.3]}},
+		{"type":"Feature","properties":{"username":"b"},"geometry":null},
+		{"type":"Feature","properties":{"username":"c"},"geometry":{"type":"Point","coordinates":[0,95]}}
+	]}`))
+	if err != nil {
+		t.Fatalf("failed to parse rows: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows want 3", len(rows))
+	}
+	if rows[0].Err != nil || rows[0].Point != (Point{Lat: 53.3, Lng: -6.25}) || rows[0].Properties["username"] != "a" {
+		t.Fatalf("got row %v", rows[0])
+	}
+	// invalid features are still returned with their properties so they can be reported
+	if rows[1].Err == nil || rows[2].Err == nil || rows[2].Properties["username"] != "c" {
+		t.Fatalf("got rows %v", rows)
+	}
+
+	if _, err = ParsePointRows([]byte(`not geojson`)); err == nil {
+		t.Fatalf("expected error for invalid geojson")
+	}
+}
@@ -0,0 +1,54 @@
+package geoService
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// Waypoint is a named point on a GPX route.
+type Waypoint struct {
+	Point
+	Name string
+}
+
+type gpxPoint struct {
+	Lat  string `xml:"lat,attr"`
+	Lon  string `xml:"lon,attr"`
+	Name string `xml:"name,omitempty"`
+}
+
+type gpxFile struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	Xmlns     string     `xml:"xmlns,attr"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Route     struct {
+		Name   string     `xml:"name"`
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+func toGPXPoint(w Waypoint) gpxPoint {
+	return gpxPoint{
+		Lat:  strconv.FormatFloat(w.Lat, 'f', -1, 64),
+		Lon:  strconv.FormatFloat(w.Lng, 'f', -1, 64),
+		Name: w.Name,
+	}
+}
+
+// GPX returns a GPX 1.1 document with a route through the waypoints in order, which can be opened in
+// most navigation apps. Every waypoint is also added as a wpt so it shows up as a marker.
+func GPX(name string, waypoints []Waypoint) ([]byte, error) {
+	file := gpxFile{Xmlns: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "fyp"}
+	file.Route.Name = name
+	for _, w := range waypoints {
+		file.Waypoints = append(file.Waypoints, toGPXPoint(w))
+		file.Route.Points = append(file.Route.Points, toGPXPoint(w))
+	}
+	out, err := xml.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
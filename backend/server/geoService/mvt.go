@@ -0,0 +1,188 @@
+package geoService
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TileExtent is the size of a vector tile in tile coordinates.
+const TileExtent = 4096
+
+// TileFeature is a point drawn on a vector tile with the attributes clients can style it by.
+// Attribute values can be strings, bools, ints or float64s.
+type TileFeature struct {
+	Id         uint64
+	Point      Point
+	Attributes map[string]interface{}
+}
+
+// ValidTile checks that x and y are in range for the zoom level.
+func ValidTile(z, x, y int) error {
+	if z < 0 || z > 30 {
+		return fmt.Errorf("zoom must be between 0 and 30")
+	}
+	n := 1 << z
+	if x < 0 || x >= n || y < 0 || y >= n {
+		return fmt.Errorf("tile %d/%d/%d does not exist", z, x, y)
+	}
+	return nil
+}
+
+// tilePosition returns where a point is in web mercator tile units at zoom z, tile x/y is the square x to x+1, y to y+1.
+func tilePosition(p Point, z int) (x, y float64) {
+	n := float64(int(1) << z)
+	// web mercator can't show the poles
+	lat := math.Max(-85.0511287798, math.Min(85.0511287798, p.Lat))
+	x = (p.Lng + 180) / 360 * n
+	y = (1 - math.Log(math.Tan(radians(lat))+1/math.Cos(radians(lat)))/math.Pi) / 2 * n
+	return x, y
+}
+
+// TileBounds returns the south west and north east corners of a web mercator tile.
+func TileBounds(z, x, y int) (sw, ne Point) {
+	n := float64(int(1) << z)
+	lat := func(y float64) float64 {
+		return degrees(math.Atan(math.Sinh(math.Pi * (1 - 2*y/n))))
+	}
+	sw = Point{Lat: lat(float64(y + 1)), Lng: float64(x)/n*360 - 180}
+	ne = Point{Lat: lat(float64(y)), Lng: float64(x+1)/n*360 - 180}
+	return sw, ne
+}
+
+// field numbers from the Mapbox vector tile spec, version 2
+const (
+	mvtTileLayers = 3
+
+	mvtLayerVersion  = 15
+	mvtLayerName     = 1
+	mvtLayerFeatures = 2
+	mvtLayerKeys     = 3
+	mvtLayerValues   = 4
+	mvtLayerExtent   = 5
+
+	mvtFeatureId       = 1
+	mvtFeatureTags     = 2
+	mvtFeatureType     = 3
+	mvtFeatureGeometry = 4
+	mvtPoint           = 1
+	mvtMoveTo          = 1
+
+	mvtValueString = 1
+	mvtValueDouble = 3
+	mvtValueSint   = 6
+	mvtValueBool   = 7
+)
+
+func zigzag(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+func mvtValue(value interface{}) ([]byte, error) {
+	var b []byte
+	switch v := value.(type) {
+	case string:
+		b = protowire.AppendTag(b, mvtValueString, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case float64:
+		b = protowire.AppendTag(b, mvtValueDouble, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case int:
+		b = protowire.AppendTag(b, mvtValueSint, protowire.VarintType)
+		b = protowire.AppendVarint(b, zigzag(int64(v)))
+	case int32:
+		b = protowire.AppendTag(b, mvtValueSint, protowire.VarintType)
+		b = protowire.AppendVarint(b, zigzag(int64(v)))
+	case int64:
+		b = protowire.AppendTag(b, mvtValueSint, protowire.VarintType)
+		b = protowire.AppendVarint(b, zigzag(v))
+	case bool:
+		b = protowire.AppendTag(b, mvtValueBool, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	default:
+		return nil, fmt.Errorf("vector tiles can't have attributes of type %T", value)
+	}
+	return b, nil
+}
+
+// MVT encodes point features as a single layer Mapbox vector tile for tile z/x/y.
+// Features outside the tile are still encoded, clients clip them.
+func MVT(layerName string, z, x, y int, features []TileFeature) ([]byte, error) {
+	var layer []byte
+	layer = protowire.AppendTag(layer, mvtLayerVersion, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, 2)
+	layer = protowire.AppendTag(layer, mvtLayerName, protowire.BytesType)
+	layer = protowire.AppendString(layer, layerName)
+
+	// keys and values are stored once per layer and referenced by index from each feature
+	keyIndex := make(map[string]uint64)
+	valueIndex := make(map[string]uint64)
+	var keys []string
+	var values [][]byte
+	for _, feature := range features {
+		names := make([]string, 0, len(feature.Attributes))
+		for name := range feature.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var tags []byte
+		for _, name := range names {
+			value, err := mvtValue(feature.Attributes[name])
+			if err != nil {
+				return nil, err
+			}
+			k, ok := keyIndex[name]
+			if !ok {
+				k = uint64(len(keys))
+				keyIndex[name] = k
+				keys = append(keys, name)
+			}
+			v, ok := valueIndex[string(value)]
+			if !ok {
+				v = uint64(len(values))
+				valueIndex[string(value)] = v
+				values = append(values, value)
+			}
+			tags = protowire.AppendVarint(tags, k)
+			tags = protowire.AppendVarint(tags, v)
+		}
+
+		px, py := tilePosition(feature.Point, z)
+		var geometry []byte
+		geometry = protowire.AppendVarint(geometry, mvtMoveTo|1<<3)
+		geometry = protowire.AppendVarint(geometry, zigzag(int64(math.Round((px-float64(x))*TileExtent))))
+		geometry = protowire.AppendVarint(geometry, zigzag(int64(math.Round((py-float64(y))*TileExtent))))
+
+		var f []byte
+		f = protowire.AppendTag(f, mvtFeatureId, protowire.VarintType)
+		f = protowire.AppendVarint(f, feature.Id)
+		if len(tags) > 0 {
+			f = protowire.AppendTag(f, mvtFeatureTags, protowire.BytesType)
+			f = protowire.AppendBytes(f, tags)
+		}
+		f = protowire.AppendTag(f, mvtFeatureType, protowire.VarintType)
+		f = protowire.AppendVarint(f, mvtPoint)
+		f = protowire.AppendTag(f, mvtFeatureGeometry, protowire.BytesType)
+		f = protowire.AppendBytes(f, geometry)
+
+		layer = protowire.AppendTag(layer, mvtLayerFeatures, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, f)
+	}
+	for _, key := range keys {
+		layer = protowire.AppendTag(layer, mvtLayerKeys, protowire.BytesType)
+		layer = protowire.AppendString(layer, key)
+	}
+	for _, value := range values {
+		layer = protowire.AppendTag(layer, mvtLayerValues, protowire.BytesType)
+		layer = protowire.AppendBytes(layer, value)
+	}
+	layer = protowire.AppendTag(layer, mvtLayerExtent, protowire.VarintType)
+	layer = protowire.AppendVarint(layer, TileExtent)
+
+	var tile []byte
+	tile = protowire.AppendTag(tile, mvtTileLayers, protowire.BytesType)
+	tile = protowire.AppendBytes(tile, layer)
+	return tile, nil
+}
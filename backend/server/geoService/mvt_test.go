@@ -0,0 +1,154 @@
+package geoService
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields splits a protobuf message into its length delimited and varint fields.
+func decodeFields(t *testing.T, b []byte) (bytesFields map[protowire.Number][][]byte, varints map[protowire.Number][]uint64) {
+	bytesFields = make(map[protowire.Number][][]byte)
+	varints = make(map[protowire.Number][]uint64)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			bytesFields[num] = append(bytesFields[num], v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			varints[num] = append(varints[num], v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return bytesFields, varints
+}
+
+func packedVarints(t *testing.T, b []byte) []uint64 {
+	var values []uint64
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			t.Fatalf("invalid packed varint: %v", protowire.ParseError(n))
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values
+}
+
+func TestMVT(t *testing.T) {
+	features := []TileFeature{
+		{Id: 1, Point: Point{Lat: 0, Lng: 0}, Attributes: map[string]interface{}{"status": "up", "ageDays": 3}},
+		{Id: 2, Point: Point{Lat: 0, Lng: -90}, Attributes: map[string]interface{}{"status": "up", "ageDays": int64(-1)}},
+	}
+	tile, err := MVT("posters", 0, 0, 0, features)
+	if err != nil {
+		t.Fatalf("failed to encode tile: %v", err)
+	}
+	tileFields, _ := decodeFields(t, tile)
+	if len(tileFields[mvtTileLayers]) != 1 {
+		t.Fatalf("got %d layers want 1", len(tileFields[mvtTileLayers]))
+	}
+	layer, layerVarints := decodeFields(t, tileFields[mvtTileLayers][0])
+	if string(layer[mvtLayerName][0]) != "posters" || layerVarints[mvtLayerVersion][0] != 2 || layerVarints[mvtLayerExtent][0] != TileExtent {
+		t.Fatalf("got layer %v %v", layer, layerVarints)
+	}
+	// keys are sorted and the shared "up" value is only stored once
+	if len(layer[mvtLayerKeys]) != 2 || string(layer[mvtLayerKeys][0]) != "ageDays" || len(layer[mvtLayerValues]) != 3 {
+		t.Fatalf("got keys %q and %d values", layer[mvtLayerKeys], len(layer[mvtLayerValues]))
+	}
+	if len(layer[mvtLayerFeatures]) != 2 {
+		t.Fatalf("got %d features want 2", len(layer[mvtLayerFeatures]))
+	}
+
+	wantGeometry := [][]uint64{
+		// the middle of the tile
+		{mvtMoveTo | 1<<3, zigzag(2048), zigzag(2048)},
+		{mvtMoveTo | 1<<3, zigzag(1024), zigzag(2048)},
+	}
+	wantTags := [][]uint64{{0, 0, 1, 1}, {0, 2, 1, 1}}
+	for i, raw := range layer[mvtLayerFeatures] {
+		feature, featureVarints := decodeFields(t, raw)
+		if featureVarints[mvtFeatureId][0] != features[i].Id || featureVarints[mvtFeatureType][0] != mvtPoint {
+			t.Fatalf("got feature %v", featureVarints)
+		}
+		geometry := packedVarints(t, feature[mvtFeatureGeometry][0])
+		tags := packedVarints(t, feature[mvtFeatureTags][0])
+		for j := range wantGeometry[i] {
+			if len(geometry) != len(wantGeometry[i]) || geometry[j] != wantGeometry[i][j] {
+				t.Fatalf("feature %d got geometry %v want %v", i, geometry, wantGeometry[i])
+			}
+		}
+		for j := range wantTags[i] {
+			if len(tags) != len(wantTags[i]) || tags[j] != wantTags[i][j] {
+				t.Fatalf("feature %d got tags %v want %v", i, tags, wantTags[i])
+			}
+		}
+	}
+
+	if _, err = MVT("posters", 0, 0, 0, []TileFeature{{Attributes: map[string]interface{}{"bad": []int{1}}}}); err == nil {
+		t.Fatalf("expected error for unsupported attribute type")
+	}
+}
+
+func TestTileBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		z, x, y int
+		wantSW  Point
+		wantNE  Point
+	}{
+		{name: "whole world", wantSW: Point{Lat: -85.0511287798, Lng: -180}, wantNE: Point{Lat: 85.0511287798, Lng: 180}},
+		{name: "north east quarter", z: 1, x: 1, y: 0, wantSW: Point{Lat: 0, Lng: 0}, wantNE: Point{Lat: 85.0511287798, Lng: 180}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sw, ne := TileBounds(tc.z, tc.x, tc.y)
+			for _, c := range [][2]float64{{sw.Lat, tc.wantSW.Lat}, {sw.Lng, tc.wantSW.Lng}, {ne.Lat, tc.wantNE.Lat}, {ne.Lng, tc.wantNE.Lng}} {
+				if math.Abs(c[0]-c[1]) > 1e-6 {
+					t.Fatalf("got tile %v %v want %v %v", sw, ne, tc.wantSW, tc.wantNE)
+				}
+			}
+		})
+	}
+}
+
+func TestValidTile(t *testing.T) {
+	tests := []struct {
+		z, x, y int
+		wantErr bool
+	}{
+		{z: 0, x: 0, y: 0},
+		{z: 2, x: 3, y: 3},
+		{z: 2, x: 4, y: 0, wantErr: true},
+		{z: 2, x: 0, y: -1, wantErr: true},
+		{z: 31, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		if err := ValidTile(tc.z, tc.x, tc.y); (err != nil) != tc.wantErr {
+			t.Fatalf("tile %d/%d/%d expected error: %v but got err: %v", tc.z, tc.x, tc.y, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package geoService
+
+// maxTwoOptPasses stops 2-opt early on large routes, most of the improvement comes from the first few passes.
+const maxTwoOptPasses = 50
+
+// Route returns the order to visit stops in when starting from start. The route is found with the nearest
+// neighbour heuristic and then improved with 2-opt, it is not guaranteed to be the shortest route.
+// The route ends at the last stop rather than returning to start.
+func Route(start Point, stops []Point) []int {
+	n := len(stops)
+	if n == 0 {
+		return nil
+	}
+	// node 0 is the start, node i+1 is stops[i]
+	nodes := append([]Point{start}, stops...)
+	dist := make([][]float64, n+1)
+	for i := range nodes {
+		dist[i] = make([]float64, n+1)
+		for j := range nodes {
+			if j < i {
+				dist[i][j] = dist[j][i]
+			} else if j > i {
+				dist[i][j] = Distance(nodes[i], nodes[j])
+			}
+		}
+	}
+
+	path := make([]int, 0, n+1)
+	path = append(path, 0)
+	visited := make([]bool, n+1)
+	visited[0] = true
+	for len(path) <= n {
+		current, next := path[len(path)-1], -1
+		for j := 1; j <= n; j++ {
+			if !visited[j] && (next == -1 || dist[current][j] < dist[current][next]) {
+				next = j
+			}
+		}
+		visited[next] = true
+		path = append(path, next)
+	}
+
+	// reversing path[i:j+1] swaps edges (i-1, i) and (j, j+1) for (i-1, j) and (i, j+1). The start never moves.
+	for pass := 0; pass < maxTwoOptPasses; pass++ {
+		improved := false
+		for i := 1; i < n; i++ {
+			for j := i + 1; j <= n; j++ {
+				delta := dist[path[i-1]][path[j]] - dist[path[i-1]][path[i]]
+				if j < n {
+					delta += dist[path[i]][path[j+1]] - dist[path[j]][path[j+1]]
+				}
+				if delta < -1e-9 {
+					for a, b := i, j; a < b; a, b = a+1, b-1 {
+						path[a], path[b] = path[b], path[a]
+					}
+					improved = true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+
+	order := make([]int, n)
+	for i, node := range path[1:] {
+		order[i] = node - 1
+	}
+	return order
+}
@@ -0,0 +1,59 @@
+package geoService
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	start := Point{Lat: 0, Lng: 0}
+	tests := []struct {
+		name      string
+		stops     []Point
+		wantOrder []int
+	}{
+		{
+			name: "no stops",
+		},
+		{
+			name:      "points along a line",
+			stops:     []Point{{Lat: 0, Lng: 0.03}, {Lat: 0, Lng: 0.01}, {Lat: 0, Lng: 0.02}},
+			wantOrder: []int{1, 2, 0},
+		},
+		{
+			// nearest neighbour goes to the closest point on the right first and has to double back,
+			// 2-opt finds it is shorter to do the left side first
+			name:      "nearest neighbour improved by 2-opt",
+			stops:     []Point{{Lat: 0, Lng: 0.010}, {Lat: 0, Lng: -0.011}, {Lat: 0, Lng: 0.1}, {Lat: 0, Lng: -0.012}},
+			wantOrder: []int{3, 1, 0, 2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			order := Route(start, tc.stops)
+			if !reflect.DeepEqual(order, tc.wantOrder) {
+				t.Fatalf("got order %v want %v", order, tc.wantOrder)
+			}
+		})
+	}
+}
+
+func TestGPX(t *testing.T) {
+	out, err := GPX("removal route", []Waypoint{{Point: Point{Lat: 53.35, Lng: -6.25}, Name: "start"}, {Point: Point{Lat: 53.36, Lng: -6.26}, Name: "poster 1"}})
+	if err != nil {
+		t.Fatalf("failed to create gpx: %v", err)
+	}
+	var file gpxFile
+	if err = xml.Unmarshal(out, &file); err != nil {
+		t.Fatalf("gpx is not valid xml: %v", err)
+	}
+	if len(file.Waypoints) != 2 || len(file.Route.Points) != 2 || file.Route.Points[1].Lat != "53.36" || file.Route.Points[1].Lon != "-6.26" {
+		t.Fatalf("got gpx %s", out)
+	}
+	if !strings.Contains(string(out), `xmlns="http://www.topografix.com/GPX/1/1"`) {
+		t.Fatalf("gpx is missing namespace: %s", out)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	maxImportRows      = 5000
+	importMembersQuery = "select userID, username from fyp_schema.users where partyID = ?"
+	// the jurisdiction is looked up in the insert rather than once per row before it
+	importPosterQuery = `insert into fyp_schema.posters (partyId, userId, created, updated, location, changeSeq, jurisdictionId, heightCm, permitNumber, removed, removedBy)
+						values (?,?,from_unixtime(?),now(),point(?,?),?,
+						(select jurisdictionId from fyp_schema.jurisdictions where ST_Contains(area, point(?,?)) order by ST_Area(area) limit 1),
+						?,?,from_unixtime(?),?)`
+	importTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+)
+
+// importRow is a poster read from an import file before it has been checked.
+type importRow struct {
+	row      int32
+	location geoService.Point
+	// set if the row could not be read at all
+	err    error
+	fields map[string]string
+}
+
+// importedPoster is a row that passed validation.
+type importedPoster struct {
+	userId       int32
+	location     geoService.Point
+	placed       time.Time
+	removed      sql.NullInt64
+	heightCm     int32
+	permitNumber string
+}
+
+func parseImportTime(value string) (time.Time, error) {
+	for _, layout := range importTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a valid time", value)
+}
+
+// readImportCSV reads posters from a CSV file with a header row. Rows are numbered by line.
+func readImportCSV(data []byte) ([]importRow, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"latitude", "longitude", "username", "placed"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv is missing the %s column", required)
+		}
+	}
+	var rows []importRow
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the reader has no field position for a row it could not parse
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, fmt.Errorf("failed to read csv: %v", err)
+			}
+			rows = append(rows, importRow{row: int32(parseErr.Line), err: parseErr.Err, fields: make(map[string]string)})
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		row := importRow{row: int32(line), fields: make(map[string]string)}
+		// short rows are treated as having empty values in the missing columns
+		for name, i := range columns {
+			if i < len(record) {
+				row.fields[name] = strings.TrimSpace(record[i])
+			}
+		}
+		lat, latErr := strconv.ParseFloat(row.fields["latitude"], 64)
+		lng, lngErr := strconv.ParseFloat(row.fields["longitude"], 64)
+		row.location = geoService.Point{Lat: lat, Lng: lng}
+		if latErr != nil || lngErr != nil {
+			row.err = fmt.Errorf("latitude and longitude must be numbers")
+		} else if !row.location.Valid() {
+			row.err = fmt.Errorf("%v,%v is not a valid coordinate", lat, lng)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// readImportGeoJSON reads posters from the Point features of a GeoJSON file. Rows are numbered by feature starting from 1.
+func readImportGeoJSON(data []byte) ([]importRow, error) {
+	features, err := geoService.ParsePointRows(data)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]importRow, len(features))
+	for i, feature := range features {
+		rows[i] = importRow{row: int32(i + 1), location: feature.Point, err: feature.Err, fields: make(map[string]string)}
+		for key, value := range feature.Properties {
+			switch v := value.(type) {
+			case string:
+				rows[i].fields[strings.ToLower(key)] = v
+			case float64:
+				rows[i].fields[strings.ToLower(key)] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// validateImportRow checks a row against the party's members. now is the time of the import, posters can't be placed after it.
+func validateImportRow(row importRow, members map[string]int32, now time.Time) (importedPoster, error) {
+	if row.err != nil {
+		return importedPoster{}, row.err
+	}
+	poster := importedPoster{location: row.location, permitNumber: row.fields["permitnumber"]}
+	username := row.fields["username"]
+	if username == "" {
+		return importedPoster{}, fmt.Errorf("username not set")
+	}
+	userId, ok := members[username]
+	if !ok {
+		return importedPoster{}, fmt.Errorf("%s is not a member of the party", username)
+	}
+	poster.userId = userId
+	if row.fields["placed"] == "" {
+		return importedPoster{}, fmt.Errorf("placed not set")
+	}
+	placed, err := parseImportTime(row.fields["placed"])
+	if err != nil {
+		return importedPoster{}, fmt.Errorf("placed: %v", err)
+	}
+	if placed.After(now) {
+		return importedPoster{}, fmt.Errorf("placed is in the future")
+	}
+	poster.placed = placed
+	if value := row.fields["removed"]; value != "" {
+		removed, err := parseImportTime(value)
+		if err != nil {
+			return importedPoster{}, fmt.Errorf("removed: %v", err)
+		}
+		if removed.Before(placed) || removed.After(now) {
+			return importedPoster{}, fmt.Errorf("removed must be between when the poster was placed and now")
+		}
+		poster.removed = sql.NullInt64{Int64: removed.Unix(), Valid: true}
+	}
+	if value := row.fields["heightcm"]; value != "" {
+		height, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || height < 0 {
+			return importedPoster{}, fmt.Errorf("heightCm must be a whole number of centimetres")
+		}
+		poster.heightCm = int32(height)
+	}
+	if len(poster.permitNumber) > 64 {
+		return importedPoster{}, fmt.Errorf("permitNumber can not be longer than 64 characters")
+	}
+	return poster, nil
+}
+
+// ImportPosters adds posters placed before a party started using the app from a CSV or GeoJSON file.
+// Every row is checked first and the file is only imported if all of them are valid.
+func (s *server) ImportPosters(ctx context.Context, in *pb.ImportPostersRequest) (*pb.ImportPostersResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if len(in.GetData()) == 0 {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("data not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can import posters")
+	}
+	_ = rows.Close()
+
+	var importRows []importRow
+	switch in.GetFormat() {
+	case pb.ImportFormat_IMPORT_CSV:
+		importRows, err = readImportCSV(in.GetData())
+	case pb.ImportFormat_IMPORT_GEOJSON:
+		importRows, err = readImportGeoJSON(in.GetData())
+	default:
+		err = fmt.Errorf("unknown import format %v", in.GetFormat())
+	}
+	if err != nil {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	if len(importRows) == 0 {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("file has no posters")
+	}
+	if len(importRows) > maxImportRows {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("at most %d posters can be imported at once", maxImportRows)
+	}
+
+	rows, err = s.DB.Query(importMembersQuery, in.GetPartyId())
+	if err != nil {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query party members: %v", err)
+	}
+	members := make(map[string]int32)
+	for rows.Next() {
+		var userId int32
+		var username string
+		if err = rows.Scan(&userId, &username); err != nil {
+			_ = rows.Close()
+			return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read party members: %v", err)
+		}
+		members[username] = userId
+	}
+	_ = rows.Close()
+
+	now := time.Now()
+	var posters []importedPoster
+	var importErrors []*pb.ImportError
+	for _, row := range importRows {
+		poster, err := validateImportRow(row, members, now)
+		if err != nil {
+			importErrors = append(importErrors, &pb.ImportError{Row: row.row, Message: err.Error()})
+			continue
+		}
+		posters = append(posters, poster)
+	}
+	// the row errors are returned in the response rather than as an error so the client can show them
+	if len(importErrors) > 0 {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED, Errors: importErrors}, nil
+	}
+	if in.GetDryRun() {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_OK, Imported: int32(len(posters))}, nil
+	}
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	// the whole file is one change in the party's change feed
+	seq, err := nextChangeSeq(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update change sequence: %v", err)
+	}
+	for i, poster := range posters {
+		var removedBy sql.NullInt32
+		if poster.removed.Valid {
+			removedBy = sql.NullInt32{Int32: in.GetUserId(), Valid: true}
+		}
+		res, err := tx.Exec(importPosterQuery, in.GetPartyId(), poster.userId, poster.placed.Unix(), poster.location.Lng, poster.location.Lat, seq,
+			poster.location.Lng, poster.location.Lat, poster.heightCm, poster.permitNumber, poster.removed, removedBy)
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to import row %d: %v", importRows[i].row, err)
+		}
+		posterId, err := res.LastInsertId()
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to get poster id: %v", err)
+		}
+		changeType := pb.PosterChangeType_POSTER_PLACED
+		if poster.removed.Valid {
+			changeType = pb.PosterChangeType_POSTER_REMOVED
+		}
+		event, err := posterChangedEvent(changeType, &pb.Poster{
+			PlacedBy: poster.userId,
+			Party:    in.GetPartyId(),
+			Posterid: int32(posterId),
+			Location: &pb.Location{Lat: poster.location.Lat, Lng: poster.location.Lng},
+			Removed:  poster.removed.Valid,
+		}, seq)
+		if err == nil {
+			err = writeOutbox(tx, event)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record row %d: %v", importRows[i].row, err)
+		}
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_POSTERS_IMPORTED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   posterImportAudit{Format: in.GetFormat(), Imported: int32(len(posters))},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record import: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.ImportPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to import posters: %v", err)
+	}
+	s.outbox.poke()
+	return &pb.ImportPostersResponse{Code: pb.ResponseCode_OK, Imported: int32(len(posters))}, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/michaelc445/fyp/geoService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestReadImportCSV(t *testing.T) {
+	rows, err := readImportCSV([]byte("Latitude,Longitude,Username,Placed,HeightCm\n" +
+		"53.35,-6.26,michael1234,2024-01-10,250\n" +
+		"not a number,-6.26,michael1234,2024-01-10\n" +
+		"95,-6.26,michael1234,2024-01-10\n" +
+		"53.3,x\"y,michael1234,2024-01-10\n" +
+		"53.36,-6.27,michael1234,2024-01-11\n"))
+	if err != nil {
+		t.Fatalf("failed to read csv: %v", err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("got %d rows want 5", len(rows))
+	}
+	if rows[0].row != 2 || rows[0].err != nil || rows[0].location != (geoService.Point{Lat: 53.35, Lng: -6.26}) || rows[0].fields["heightcm"] != "250" {
+		t.Fatalf("got row %v", rows[0])
+	}
+	if rows[1].row != 3 || rows[1].err == nil || rows[2].row != 4 || rows[2].err == nil {
+		t.Fatalf("got rows %v", rows)
+	}
+	// a malformed row is reported without stopping the rows after it from being read
+	if rows[3].row != 5 || rows[3].err == nil || rows[4].row != 6 || rows[4].err != nil {
+		t.Fatalf("got rows %v", rows[3:])
+	}
+
+	if _, err = readImportCSV([]byte("latitude,longitude,placed\n53.35,-6.26,2024-01-10\n")); err == nil {
+		t.Fatalf("expected error for missing username column")
+	}
+}
+
+func TestValidateImportRow(t *testing.T) {
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	members := map[string]int32{"michael1234": 5}
+	location := geoService.Point{Lat: 53.35, Lng: -6.26}
+	tests := []struct {
+		name        string
+		fields      map[string]string
+		wantErr     bool
+		wantPlaced  time.Time
+		wantRemoved sql.NullInt64
+		wantHeight  int32
+	}{
+		{
+			name:       "date only",
+			fields:     map[string]string{"username": "michael1234", "placed": "2024-01-10"},
+			wantPlaced: time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:        "all fields",
+			fields:      map[string]string{"username": "michael1234", "placed": "2024-01-10T09:30:00Z", "removed": "2024-01-20 18:00:00", "heightcm": "250", "permitnumber": "P-1"},
+			wantPlaced:  time.Date(2024, 1, 10, 9, 30, 0, 0, time.UTC),
+			wantRemoved: sql.NullInt64{Int64: time.Date(2024, 1, 20, 18, 0, 0, 0, time.UTC).Unix(), Valid: true},
+			wantHeight:  250,
+		},
+		{
+			name:    "username not in party",
+			fields:  map[string]string{"username": "someone", "placed": "2024-01-10"},
+			wantErr: true,
+		},
+		{
+			name:    "placed not set",
+			fields:  map[string]string{"username": "michael1234"},
+			wantErr: true,
+		},
+		{
+			name:    "placed in the future",
+			fields:  map[string]string{"username": "michael1234", "placed": "2024-03-01"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid placed time",
+			fields:  map[string]string{"username": "michael1234", "placed": "10/01/2024"},
+			wantErr: true,
+		},
+		{
+			name:    "removed before placed",
+			fields:  map[string]string{"username": "michael1234", "placed": "2024-01-10", "removed": "2024-01-09"},
+			wantErr: true,
+		},
+		{
+			name:    "negative height",
+			fields:  map[string]string{"username": "michael1234", "placed": "2024-01-10", "heightcm": "-1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			poster, err := validateImportRow(importRow{row: 2, location: location, fields: tc.fields}, members, now)
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if poster.userId != 5 || !poster.placed.Equal(tc.wantPlaced) || poster.removed != tc.wantRemoved || poster.heightCm != tc.wantHeight {
+				t.Fatalf("got poster %v", poster)
+			}
+		})
+	}
+}
+
+func TestImportPosters(t *testing.T) {
+	validCSV := "latitude,longitude,username,placed,removed\n53.35,-6.26,michael1234,2024-01-10,\n53.36,-6.25,michael1234,2024-01-10,2024-01-20\n"
+	tests := []struct {
+		name         string
+		format       pb.ImportFormat
+		data         string
+		dryRun       bool
+		adminRows    *sqlmock.Rows
+		wantInserts  int
+		wantErr      bool
+		wantCode     pb.ResponseCode
+		wantImported int32
+		wantErrors   []*pb.ImportError
+	}{
+		{
+			name:      "data not set",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "user is not admin of party",
+			data:      validCSV,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "not geojson",
+			format:    pb.ImportFormat_IMPORT_GEOJSON,
+			data:      validCSV,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "invalid rows",
+			format:    pb.ImportFormat_IMPORT_GEOJSON,
+			data:      `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{"username":"michael1234","placed":"2024-01-10"},"geometry":{"type":"Point","coordinates":[-6.26,53.35]}},{"type":"Feature","properties":{"username":"someone","placed":"2024-01-10"},"geometry":{"type":"Point","coordinates":[-6.26,53.35]}},{"type":"Feature","properties":{"username":"michael1234"},"geometry":null}]}`,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantCode:  pb.ResponseCode_FAILED,
+			wantErrors: []*pb.ImportError{
+				{Row: 2, Message: "someone is not a member of the party"},
+				{Row: 3, Message: "must be a Point"},
+			},
+		},
+		{
+			name:         "dry run",
+			data:         validCSV,
+			dryRun:       true,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantCode:     pb.ResponseCode_OK,
+			wantImported: 2,
+		},
+		{
+			name:         "success",
+			data:         validCSV,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantInserts:  2,
+			wantCode:     pb.ResponseCode_OK,
+			wantImported: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(int32(1), int32(1)).WillReturnRows(tc.adminRows)
+			mock.ExpectQuery("select userID, username").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows([]string{"userID", "username"}).AddRow(5, "michael1234"))
+			if tc.wantInserts > 0 {
+				mock.ExpectBegin()
+				mock.ExpectExec("update fyp_schema.parties set changeSeq").WithArgs(int32(1)).WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec("insert into fyp_schema.posters").
+					WithArgs(int32(1), int32(5), time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC).Unix(), -6.26, 53.35, int64(7), -6.26, 53.35, int32(0), "", nil, nil).
+					WillReturnResult(sqlmock.NewResult(11, 1))
+				mock.ExpectExec("insert into fyp_schema.outboxEvents").
+					WithArgs(eventPosterChanged, int32(1), outboxEventArg{kind: eventPosterChanged, change: pb.PosterChangeType_POSTER_PLACED, posterId: 11}).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into fyp_schema.posters").
+					WithArgs(int32(1), int32(5), time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC).Unix(), -6.25, 53.36, int64(7), -6.25, 53.36, int32(0), "",
+						time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC).Unix(), int32(1)).
+					WillReturnResult(sqlmock.NewResult(12, 1))
+				// the second poster was already taken down
+				mock.ExpectExec("insert into fyp_schema.outboxEvents").
+					WithArgs(eventPosterChanged, int32(1), outboxEventArg{kind: eventPosterChanged, change: pb.PosterChangeType_POSTER_REMOVED, posterId: 12}).
+					WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_POSTERS_IMPORTED), int32(1), int32(1), int32(0), "", nil, fmt.Sprintf(`{"format":%d,"imported":2}`, tc.format)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			res, err := server.ImportPosters(ctx, &pb.ImportPostersRequest{UserId: 1, PartyId: 1, AuthKey: testAuthKey(t, 1, 1),
+				Format: tc.format, Data: []byte(tc.data), DryRun: tc.dryRun})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if res.Imported != tc.wantImported {
+				t.Fatalf("got %d imported want %d", res.Imported, tc.wantImported)
+			}
+			if len(res.Errors) != len(tc.wantErrors) {
+				t.Fatalf("got errors %v want %v", res.Errors, tc.wantErrors)
+			}
+			for i, want := range tc.wantErrors {
+				if res.Errors[i].Row != want.Row || res.Errors[i].Message != want.Message {
+					t.Fatalf("got error %v want %v", res.Errors[i], want)
+				}
+			}
+			if tc.wantInserts > 0 {
+				if err = mock.ExpectationsWereMet(); err != nil {
+					t.Fatalf("import did not run the expected queries: %v", err)
+				}
+			}
+		})
+	}
+}
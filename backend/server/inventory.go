@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	insertDesignQuery    = "insert into fyp_schema.posterDesigns (partyId, name, lowStockThreshold) values (?,?,?)"
+	designQuery          = "select designId, name, lowStockThreshold from fyp_schema.posterDesigns where partyId = ? order by designId"
+	insertInventoryQuery = "insert into fyp_schema.inventoryLedger (partyId, designId, kind, quantity, userId, posterId, createdBy) values (?,?,?,?,?,?,?)"
+	// the posters a volunteer has been given and not placed or damaged yet
+	volunteerStockQuery = fmt.Sprintf(`select designId, sum(case kind when %d then quantity else -quantity end) as holding
+							from fyp_schema.inventoryLedger
+							where partyId = ? and userId = ? and kind in (%d,%d,%d)
+							group by designId
+							order by holding desc, designId`,
+		pb.InventoryKind_STOCK_ISSUED, pb.InventoryKind_STOCK_ISSUED, pb.InventoryKind_STOCK_PLACED, pb.InventoryKind_STOCK_DAMAGED)
+	inventoryTotalsQuery = `select l1.designId, l1.kind, l1.userId, l2.username, sum(l1.quantity)
+							from fyp_schema.inventoryLedger as l1
+							left join fyp_schema.users as l2 on l1.userId = l2.userID
+							where l1.partyId = ?
+							group by l1.designId, l1.kind, l1.userId, l2.username`
+)
+
+// inventoryTotal is the sum of the ledger entries of one kind for a design and volunteer.
+type inventoryTotal struct {
+	designId  int32
+	kind      pb.InventoryKind
+	volunteer sql.NullInt32
+	username  sql.NullString
+	quantity  int32
+}
+
+type posterDesign struct {
+	designId          int32
+	name              string
+	lowStockThreshold int32
+}
+
+func posterDesigns(q querier, partyId int32) ([]posterDesign, error) {
+	rows, err := q.Query(designQuery, partyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var designs []posterDesign
+	for rows.Next() {
+		var design posterDesign
+		if err = rows.Scan(&design.designId, &design.name, &design.lowStockThreshold); err != nil {
+			return nil, err
+		}
+		designs = append(designs, design)
+	}
+	return designs, nil
+}
+
+func inventoryTotals(q querier, partyId int32) ([]inventoryTotal, error) {
+	rows, err := q.Query(inventoryTotalsQuery, partyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var totals []inventoryTotal
+	for rows.Next() {
+		var total inventoryTotal
+		if err = rows.Scan(&total.designId, &total.kind, &total.volunteer, &total.username, &total.quantity); err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, nil
+}
+
+type heldStock struct {
+	designId int32
+	holding  int32
+}
+
+// volunteerStock returns how many posters of each design a volunteer is holding, most held first.
+func (s *server) volunteerStock(partyId, userId int32) ([]heldStock, error) {
+	rows, err := s.DB.Query(volunteerStockQuery, partyId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stock []heldStock
+	for rows.Next() {
+		var held heldStock
+		if err = rows.Scan(&held.designId, &held.holding); err != nil {
+			return nil, err
+		}
+		stock = append(stock, held)
+	}
+	return stock, nil
+}
+
+// placementDesign picks the design a placed poster is taken from. ok is false if the user has no stock
+// and did not say which design they placed, i.e. the party is not tracking inventory. A requested design must be one of designs.
+func placementDesign(requested int32, stock []heldStock, designs []posterDesign) (designId int32, warning string, ok bool, err error) {
+	if requested != 0 {
+		known := false
+		for _, design := range designs {
+			known = known || design.designId == requested
+		}
+		if !known {
+			return 0, "", false, fmt.Errorf("poster design does not exist")
+		}
+		for _, held := range stock {
+			if held.designId == requested && held.holding > 0 {
+				return requested, "", true, nil
+			}
+		}
+		return requested, "you have no posters of this design left, ask your party admin for more", true, nil
+	}
+	if len(stock) > 0 && stock[0].holding > 0 {
+		return stock[0].designId, "", true, nil
+	}
+	return 0, "", false, nil
+}
+
+// summariseInventory works out the stock levels of each design and volunteer from the ledger totals.
+func summariseInventory(designs []posterDesign, totals []inventoryTotal) ([]*pb.DesignStock, []*pb.VolunteerStock, []string) {
+	byDesign := make(map[int32]*pb.DesignStock)
+	var designStock []*pb.DesignStock
+	for _, design := range designs {
+		stock := &pb.DesignStock{DesignId: design.designId, Name: design.name}
+		byDesign[design.designId] = stock
+		designStock = append(designStock, stock)
+	}
+
+	type volunteerDesign struct{ userId, designId int32 }
+	byVolunteer := make(map[volunteerDesign]*pb.VolunteerStock)
+	var volunteerStock []*pb.VolunteerStock
+	for _, total := range totals {
+		design, ok := byDesign[total.designId]
+		if !ok {
+			continue
+		}
+		var volunteer *pb.VolunteerStock
+		if total.volunteer.Valid {
+			key := volunteerDesign{total.volunteer.Int32, total.designId}
+			if volunteer, ok = byVolunteer[key]; !ok {
+				volunteer = &pb.VolunteerStock{UserId: key.userId, Username: total.username.String, DesignId: key.designId}
+				byVolunteer[key] = volunteer
+				volunteerStock = append(volunteerStock, volunteer)
+			}
+		}
+		switch total.kind {
+		case pb.InventoryKind_STOCK_PRINTED:
+			design.Printed += total.quantity
+			design.InStock += total.quantity
+		case pb.InventoryKind_STOCK_ISSUED:
+			design.Issued += total.quantity
+			design.InStock -= total.quantity
+			design.WithVolunteers += total.quantity
+			if volunteer != nil {
+				volunteer.Issued += total.quantity
+				volunteer.Holding += total.quantity
+			}
+		case pb.InventoryKind_STOCK_PLACED:
+			design.Placed += total.quantity
+			design.WithVolunteers -= total.quantity
+			if volunteer != nil {
+				volunteer.Placed += total.quantity
+				volunteer.Holding -= total.quantity
+			}
+		case pb.InventoryKind_STOCK_DAMAGED:
+			design.Damaged += total.quantity
+			if volunteer != nil {
+				volunteer.Damaged += total.quantity
+				volunteer.Holding -= total.quantity
+				design.WithVolunteers -= total.quantity
+			} else {
+				design.InStock -= total.quantity
+			}
+		case pb.InventoryKind_STOCK_RECOVERED:
+			design.Recovered += total.quantity
+			design.InStock += total.quantity
+			if volunteer != nil {
+				volunteer.Recovered += total.quantity
+			}
+		}
+	}
+
+	var warnings []string
+	for i, design := range designs {
+		stock := designStock[i]
+		stock.LowStock = stock.InStock <= design.lowStockThreshold
+		if stock.LowStock {
+			warnings = append(warnings, fmt.Sprintf("%s is low on stock, %d left", design.name, stock.InStock))
+		}
+	}
+	sort.Slice(volunteerStock, func(i, j int) bool {
+		if volunteerStock[i].UserId != volunteerStock[j].UserId {
+			return volunteerStock[i].UserId < volunteerStock[j].UserId
+		}
+		return volunteerStock[i].DesignId < volunteerStock[j].DesignId
+	})
+	return designStock, volunteerStock, warnings
+}
+
+// CreatePosterDesign allows a party admin to add a poster design to track the stock of.
+func (s *server) CreatePosterDesign(ctx context.Context, in *pb.CreateDesignRequest) (*pb.CreateDesignResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetName() == "" {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("name not set")
+	}
+	if in.GetLowStockThreshold() < 0 {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("lowStockThreshold can not be negative")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can add poster designs")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	res, err := tx.Exec(insertDesignQuery, in.GetPartyId(), in.GetName(), in.GetLowStockThreshold())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to add poster design: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to get designId from query: %v", err)
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_DESIGN_CREATED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   designAudit{DesignId: int32(id), Name: in.GetName(), LowStockThreshold: in.GetLowStockThreshold()},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster design: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.CreateDesignResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to add poster design: %v", err)
+	}
+	return &pb.CreateDesignResponse{Code: pb.ResponseCode_OK, DesignId: int32(id)}, nil
+}
+
+// RecordInventory adds posters to or takes them out of a partys stock. Only the party admin can do this,
+// except for volunteers recording posters they damaged themselves.
+func (s *server) RecordInventory(ctx context.Context, in *pb.InventoryRequest) (*pb.InventoryResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetDesignId() == 0 {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("designId not set")
+	}
+	if in.GetQuantity() <= 0 {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("quantity must be more than 0")
+	}
+	if _, ok := pb.InventoryKind_name[int32(in.GetKind())]; !ok {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("unknown inventory kind %v", in.GetKind())
+	}
+	switch in.GetKind() {
+	case pb.InventoryKind_STOCK_PLACED:
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("placed posters are recorded when they are placed")
+	case pb.InventoryKind_STOCK_ISSUED:
+		if in.GetVolunteerId() == 0 {
+			return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("volunteerId not set")
+		}
+	case pb.InventoryKind_STOCK_PRINTED:
+		if in.GetVolunteerId() != 0 {
+			return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("printed posters go to the partys stock, volunteerId can not be set")
+		}
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	ownDamage := in.GetKind() == pb.InventoryKind_STOCK_DAMAGED && in.GetVolunteerId() == in.GetUserId()
+	if !ownDamage {
+		// check the user is admin
+		rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+		if err != nil {
+			return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+		}
+		if !rows.Next() {
+			_ = rows.Close()
+			return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can record inventory")
+		}
+		_ = rows.Close()
+	}
+	// the stock is checked and changed in one transaction so two entries can't both take the last posters
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	volunteer, err := partyMemberArg(tx, in.GetVolunteerId(), in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+
+	designs, err := posterDesigns(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query poster designs: %v", err)
+	}
+	totals, err := inventoryTotals(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query inventory: %v", err)
+	}
+	// apply the new entry to the current totals to check it is possible and find any warnings
+	totals = append(totals, inventoryTotal{designId: in.GetDesignId(), kind: in.GetKind(), volunteer: volunteer, quantity: in.GetQuantity()})
+	designStock, volunteerStock, warnings := summariseInventory(designs, totals)
+	var stock *pb.DesignStock
+	for _, design := range designStock {
+		if design.DesignId == in.GetDesignId() {
+			stock = design
+		}
+	}
+	if stock == nil {
+		_ = tx.Rollback()
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("poster design does not exist")
+	}
+	if stock.InStock < 0 {
+		_ = tx.Rollback()
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only %d posters of %s are in stock", stock.InStock+in.GetQuantity(), stock.Name)
+	}
+	for _, held := range volunteerStock {
+		if held.UserId == in.GetVolunteerId() && held.DesignId == in.GetDesignId() && held.Holding < 0 && in.GetKind() == pb.InventoryKind_STOCK_DAMAGED {
+			warnings = append(warnings, fmt.Sprintf("volunteer has damaged more posters of %s than they were given", stock.Name))
+		}
+	}
+
+	_, err = tx.Exec(insertInventoryQuery, in.GetPartyId(), in.GetDesignId(), int32(in.GetKind()), in.GetQuantity(), volunteer, nil, in.GetUserId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record inventory: %v", err)
+	}
+	// volunteers recording their own damaged posters is not an administrative action
+	if !ownDamage {
+		err = writeAudit(ctx, tx, auditEntry{
+			action:   pb.AuditAction_AUDIT_INVENTORY_RECORDED,
+			partyId:  in.GetPartyId(),
+			actorId:  in.GetUserId(),
+			targetId: in.GetVolunteerId(),
+			after:    inventoryAudit{DesignId: in.GetDesignId(), Kind: in.GetKind(), Quantity: in.GetQuantity()},
+		})
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record inventory: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.InventoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record inventory: %v", err)
+	}
+	return &pb.InventoryResponse{Code: pb.ResponseCode_OK, Warnings: warnings}, nil
+}
+
+// InventoryReport returns the stock of each poster design and reconciles what each volunteer was given against what they placed.
+func (s *server) InventoryReport(ctx context.Context, in *pb.InventoryReportRequest) (*pb.InventoryReportResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can view the inventory")
+	}
+	_ = rows.Close()
+
+	designs, err := posterDesigns(s.DB, in.GetPartyId())
+	if err != nil {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query poster designs: %v", err)
+	}
+	totals, err := inventoryTotals(s.DB, in.GetPartyId())
+	if err != nil {
+		return &pb.InventoryReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query inventory: %v", err)
+	}
+	designStock, volunteerStock, warnings := summariseInventory(designs, totals)
+	return &pb.InventoryReportResponse{Code: pb.ResponseCode_OK, Designs: designStock, Volunteers: volunteerStock, Warnings: warnings}, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestSummariseInventory(t *testing.T) {
+	designs := []posterDesign{{designId: 1, name: "candidate a", lowStockThreshold: 10}, {designId: 2, name: "candidate b"}}
+	volunteer := sql.NullInt32{Int32: 5, Valid: true}
+	username := sql.NullString{String: "michael1234", Valid: true}
+	totals := []inventoryTotal{
+		{designId: 1, kind: pb.InventoryKind_STOCK_PRINTED, quantity: 100},
+		{designId: 1, kind: pb.InventoryKind_STOCK_ISSUED, volunteer: volunteer, username: username, quantity: 95},
+		{designId: 1, kind: pb.InventoryKind_STOCK_PLACED, volunteer: volunteer, username: username, quantity: 80},
+		{designId: 1, kind: pb.InventoryKind_STOCK_DAMAGED, volunteer: volunteer, username: username, quantity: 5},
+		{designId: 1, kind: pb.InventoryKind_STOCK_RECOVERED, volunteer: volunteer, username: username, quantity: 3},
+		{designId: 2, kind: pb.InventoryKind_STOCK_PRINTED, quantity: 50},
+		{designId: 2, kind: pb.InventoryKind_STOCK_DAMAGED, quantity: 2},
+		// entries for designs that no longer exist are left out
+		{designId: 9, kind: pb.InventoryKind_STOCK_PRINTED, quantity: 10},
+	}
+
+	designStock, volunteerStock, warnings := summariseInventory(designs, totals)
+
+	if len(designStock) != 2 {
+		t.Fatalf("got designs %v", designStock)
+	}
+	a, b := designStock[0], designStock[1]
+	if a.InStock != 8 || a.WithVolunteers != 10 || a.Placed != 80 || !a.LowStock {
+		t.Fatalf("got design stock %v", a)
+	}
+	if b.InStock != 48 || b.WithVolunteers != 0 || b.LowStock {
+		t.Fatalf("got design stock %v", b)
+	}
+	if len(volunteerStock) != 1 || volunteerStock[0].Holding != 10 || volunteerStock[0].Recovered != 3 || volunteerStock[0].Username != "michael1234" {
+		t.Fatalf("got volunteer stock %v", volunteerStock)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("got warnings %v want 1 warning", warnings)
+	}
+}
+
+func TestPlacementDesign(t *testing.T) {
+	stock := []heldStock{{designId: 3, holding: 10}, {designId: 2, holding: 0}}
+	designs := []posterDesign{{designId: 2, name: "candidate b"}, {designId: 3, name: "candidate c"}}
+	tests := []struct {
+		name        string
+		requested   int32
+		stock       []heldStock
+		wantDesign  int32
+		wantWarning bool
+		wantOk      bool
+		wantErr     bool
+	}{
+		{name: "not tracking inventory"},
+		{name: "most held design", stock: stock, wantDesign: 3, wantOk: true},
+		{name: "requested design", requested: 3, stock: stock, wantDesign: 3, wantOk: true},
+		{name: "requested design with no stock", requested: 2, stock: stock, wantDesign: 2, wantWarning: true, wantOk: true},
+		{name: "requested design of another party", requested: 7, stock: stock, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			designId, warning, ok, err := placementDesign(tc.requested, tc.stock, designs)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if designId != tc.wantDesign || (warning != "") != tc.wantWarning || ok != tc.wantOk {
+				t.Fatalf("got design %d warning %q ok %v", designId, warning, ok)
+			}
+		})
+	}
+}
+
+func TestCreatePosterDesign(t *testing.T) {
+	tests := []struct {
+		name      string
+		design    string
+		adminRows *sqlmock.Rows
+		expect    func(mock sqlmock.Sqlmock)
+		wantErr   bool
+		wantCode  pb.ResponseCode
+	}{
+		{
+			name:     "name not set",
+			expect:   func(mock sqlmock.Sqlmock) {},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "user is not admin of party",
+			design:    "candidate a",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			expect:    func(mock sqlmock.Sqlmock) {},
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "success",
+			design:    "candidate a",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec("insert into fyp_schema.posterDesigns").WithArgs(int32(1), "candidate a", int32(20)).WillReturnResult(sqlmock.NewResult(4, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_DESIGN_CREATED), int32(1), int32(1), int32(0), "", nil, `{"designId":4,"name":"candidate a","lowStockThreshold":20}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantCode: pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db}
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select").WithArgs(int32(1), int32(1)).WillReturnRows(tc.adminRows)
+			}
+			tc.expect(mock)
+
+			res, err := server.CreatePosterDesign(context.Background(), &pb.CreateDesignRequest{AuthKey: testAuthKey(t, 1, 1), UserId: 1, PartyId: 1,
+				Name: tc.design, LowStockThreshold: 20})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.GetCode() != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.GetCode(), tc.wantCode)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecordInventory(t *testing.T) {
+	designRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"designId", "name", "lowStockThreshold"}).AddRow(1, "candidate a", 10)
+	}
+	totalsColumns := []string{"designId", "kind", "userId", "username", "quantity"}
+	tests := []struct {
+		name         string
+		userId       int32
+		partyId      int32
+		designId     int32
+		kind         pb.InventoryKind
+		quantity     int32
+		volunteerId  int32
+		adminRows    *sqlmock.Rows
+		totalRows    *sqlmock.Rows
+		wantErr      bool
+		wantCode     pb.ResponseCode
+		wantWarnings int
+	}{
+		{
+			name:     "quantity not set",
+			userId:   1,
+			partyId:  1,
+			designId: 1,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "placed posters",
+			userId:   1,
+			partyId:  1,
+			designId: 1,
+			kind:     pb.InventoryKind_STOCK_PLACED,
+			quantity: 5,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "unknown kind",
+			userId:   1,
+			partyId:  1,
+			designId: 1,
+			kind:     pb.InventoryKind(9),
+			quantity: 5,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "user is not admin of party",
+			userId:    1,
+			partyId:   1,
+			designId:  1,
+			quantity:  100,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "issue more than in stock",
+			userId:      1,
+			partyId:     1,
+			designId:    1,
+			kind:        pb.InventoryKind_STOCK_ISSUED,
+			quantity:    60,
+			volunteerId: 5,
+			adminRows:   sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			totalRows:   sqlmock.NewRows(totalsColumns).AddRow(1, 0, nil, nil, 50),
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "issue leaves stock low",
+			userId:       1,
+			partyId:      1,
+			designId:     1,
+			kind:         pb.InventoryKind_STOCK_ISSUED,
+			quantity:     45,
+			volunteerId:  5,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			totalRows:    sqlmock.NewRows(totalsColumns).AddRow(1, 0, nil, nil, 50),
+			wantCode:     pb.ResponseCode_OK,
+			wantWarnings: 1,
+		},
+		{
+			name:      "print",
+			userId:    1,
+			partyId:   1,
+			designId:  1,
+			kind:      pb.InventoryKind_STOCK_PRINTED,
+			quantity:  100,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			totalRows: sqlmock.NewRows(totalsColumns),
+			wantCode:  pb.ResponseCode_OK,
+		},
+		{
+			name:        "volunteer damaged their own posters",
+			userId:      5,
+			partyId:     1,
+			designId:    1,
+			kind:        pb.InventoryKind_STOCK_DAMAGED,
+			quantity:    2,
+			volunteerId: 5,
+			totalRows:   sqlmock.NewRows(totalsColumns).AddRow(1, 0, nil, nil, 50).AddRow(1, 1, 5, "michael1234", 20),
+			wantCode:    pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			}
+			if tc.totalRows != nil {
+				mock.ExpectBegin()
+				if tc.volunteerId != 0 {
+					mock.ExpectQuery("select userID").WithArgs(tc.volunteerId, tc.partyId).WillReturnRows(sqlmock.NewRows([]string{"userID"}).AddRow(tc.volunteerId))
+				}
+				mock.ExpectQuery("select designId").WithArgs(tc.partyId).WillReturnRows(designRows())
+				mock.ExpectQuery("select l1.designId").WithArgs(tc.partyId).WillReturnRows(tc.totalRows)
+				if tc.wantErr {
+					mock.ExpectRollback()
+				} else {
+					mock.ExpectExec("insert into fyp_schema.inventoryLedger").WithArgs(tc.partyId, tc.designId, int32(tc.kind), tc.quantity, sqlmock.AnyArg(), nil, tc.userId).
+						WillReturnResult(sqlmock.NewResult(1, 1))
+					// volunteers recording their own damage are not audited
+					if tc.adminRows != nil {
+						mock.ExpectExec("insert into fyp_schema.auditLog").
+							WithArgs(int32(pb.AuditAction_AUDIT_INVENTORY_RECORDED), tc.partyId, tc.userId, tc.volunteerId, "", nil,
+								fmt.Sprintf(`{"designId":%d,"kind":%d,"quantity":%d}`, tc.designId, tc.kind, tc.quantity)).
+							WillReturnResult(sqlmock.NewResult(1, 1))
+					}
+					mock.ExpectCommit()
+				}
+			}
+
+			res, err := server.RecordInventory(ctx, &pb.InventoryRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: testAuthKey(t, tc.userId, tc.partyId),
+				DesignId: tc.designId, Kind: tc.kind, Quantity: tc.quantity, VolunteerId: tc.volunteerId})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Warnings) != tc.wantWarnings {
+				t.Fatalf("got warnings %v want %d warnings", res.Warnings, tc.wantWarnings)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestInventoryReport(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	mock.ExpectQuery("select").WithArgs(int32(1), int32(1)).WillReturnRows(sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1))
+	mock.ExpectQuery("select designId").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows([]string{"designId", "name", "lowStockThreshold"}).AddRow(1, "candidate a", 10))
+	mock.ExpectQuery("select l1.designId").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows([]string{"designId", "kind", "userId", "username", "quantity"}).
+		AddRow(1, 0, nil, nil, 100).
+		AddRow(1, 1, 5, "michael1234", 20).
+		AddRow(1, 2, 5, "michael1234", 22))
+
+	res, err := server.InventoryReport(ctx, &pb.InventoryReportRequest{UserId: 1, PartyId: 1, AuthKey: testAuthKey(t, 1, 1)})
+	if err != nil {
+		t.Fatalf("failed to get inventory report: %v", err)
+	}
+	if len(res.Designs) != 1 || res.Designs[0].InStock != 80 || res.Designs[0].LowStock {
+		t.Fatalf("got designs %v", res.Designs)
+	}
+	// the volunteer placed two more posters than they were given
+	if len(res.Volunteers) != 1 || res.Volunteers[0].Holding != -2 {
+		t.Fatalf("got volunteers %v", res.Volunteers)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	// members other than the party admin can only make small corrections to a posters location
+	movePosterMaxDistance = 50
+	movePosterLookupQuery = `select userId, removed, st_y(location) as latitude, st_x(location) as longitude, ST_Distance_Sphere(location, point(?,?)) as distance,
+							unix_timestamp(created), heightCm, permitNumber
+							from fyp_schema.posters where posterID = ? and partyID = ? for update`
+	movePosterQuery       = "update fyp_schema.posters set location = point(?,?), jurisdictionId = ?, updated = now(), changeSeq = ? where posterID = ? and partyID = ?"
+	recordPosterMoveQuery = "insert into fyp_schema.posterMoves (posterId, movedBy, oldLocation, newLocation, distance) values (?,?,point(?,?),point(?,?),?)"
+	// violations that depend on where the poster is are checked again at the new location
+	clearLocationViolationsQuery = "delete from fyp_schema.posterViolations where posterId = ? and source in ('exclusion_zone', 'jurisdiction')"
+)
+
+// MovePoster corrects the location of a poster that was placed in the wrong position.
+func (s *server) MovePoster(ctx context.Context, in *pb.MovePosterRequest) (*pb.MovePosterResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetPosterId() == 0 {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("posterId not set")
+	}
+	if in.GetLocation() == nil {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("location of poster not set")
+	}
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+	// the new location is checked against exclusion zones the same way a placement is
+	zones, err := s.zonesAt(in.GetPartyId(), in.GetLocation())
+	if err != nil {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check exclusion zones: %v", err)
+	}
+	var violations []posterViolation
+	for _, zone := range zones {
+		if zone.enforcement == pb.ZoneEnforcement_REJECT_PLACEMENT {
+			return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("posters can not be moved inside exclusion zone: %s", zone.name)
+		}
+		violations = append(violations, posterViolation{source: "exclusion_zone", sourceId: zone.zoneId, detail: fmt.Sprintf("poster is inside exclusion zone: %s", zone.name)})
+	}
+	// the poster falls under the poster law of where it is moved to
+	rules, err := s.jurisdictionAt(in.GetLocation())
+	if err != nil {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to look up jurisdiction: %v", err)
+	}
+	var jurisdictionId sql.NullInt32
+	var pollingDay time.Time
+	if rules != nil {
+		jurisdictionId = sql.NullInt32{Int32: rules.jurisdictionId, Valid: true}
+		_, pollingDay, _, err = s.electionDates(in.GetPartyId())
+		if err != nil {
+			return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query election dates: %v", err)
+		}
+	}
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	location := in.GetLocation()
+	rows, err := tx.Query(movePosterLookupQuery, location.GetLng(), location.GetLat(), in.GetPosterId(), in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query poster: %v", err)
+	}
+	if !rows.Next() {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("poster does not exist")
+	}
+	var placedBy int32
+	var old pb.Location
+	var distance float64
+	var placed int64
+	var current placement
+	removed := []uint8{}
+	err = rows.Scan(&placedBy, &removed, &old.Lat, &old.Lng, &distance, &placed, &current.heightCm, &current.permitNumber)
+	_ = rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to scan sql result: %v", err)
+	}
+	if removed != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("can not move a poster that has been removed")
+	}
+	current.placed = time.Unix(placed, 0)
+	violations = append(violations, rules.check(current, pollingDay)...)
+
+	movedByAdmin := distance > float64(movePosterMaxDistance)
+	if movedByAdmin {
+		// only the party admin can move posters further
+		rows, err = tx.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+		}
+		isAdmin := rows.Next()
+		_ = rows.Close()
+		if !isAdmin {
+			_ = tx.Rollback()
+			return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("posters can only be moved up to %d meters. ask your party admin to move it further", movePosterMaxDistance)
+		}
+	}
+
+	seq, err := nextChangeSeq(tx, in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update change sequence: %v", err)
+	}
+	_, err = tx.Exec(movePosterQuery, location.GetLng(), location.GetLat(), jurisdictionId, seq, in.GetPosterId(), in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to move poster: %v", err)
+	}
+	_, err = tx.Exec(recordPosterMoveQuery, in.GetPosterId(), in.GetUserId(), old.GetLng(), old.GetLat(), location.GetLng(), location.GetLat(), distance)
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster move: %v", err)
+	}
+	if movedByAdmin {
+		err = writeAudit(ctx, tx, auditEntry{
+			action:   pb.AuditAction_AUDIT_POSTER_MOVED,
+			partyId:  in.GetPartyId(),
+			actorId:  in.GetUserId(),
+			targetId: placedBy,
+			before:   posterAudit{PosterId: in.GetPosterId(), Location: &old},
+			after:    posterAudit{PosterId: in.GetPosterId(), Location: location},
+		})
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster move: %v", err)
+		}
+	}
+	_, err = tx.Exec(clearLocationViolationsQuery, in.GetPosterId())
+	if err == nil {
+		err = recordViolations(tx, int64(in.GetPosterId()), violations)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster violations: %v", err)
+	}
+	event, err := posterChangedEvent(pb.PosterChangeType_POSTER_MOVED,
+		&pb.Poster{PlacedBy: placedBy, Party: in.GetPartyId(), Posterid: in.GetPosterId(), Location: location}, seq)
+	if err == nil {
+		err = writeOutbox(tx, event)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record poster move: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.MovePosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit poster move: %v", err)
+	}
+	s.outbox.poke()
+	var warnings []string
+	for _, violation := range violations {
+		warnings = append(warnings, violation.detail)
+	}
+	return &pb.MovePosterResponse{Code: pb.ResponseCode_OK, Warnings: warnings}, nil
+}
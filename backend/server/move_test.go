@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestMovePoster(t *testing.T) {
+	columns := []string{"userId", "removed", "latitude", "longitude", "distance", "created", "heightCm", "permitNumber"}
+	zoneColumns := []string{"zoneId", "name", "enforcement"}
+	rulesColumns := []string{"jurisdictionId", "name", "placementDaysBefore", "removalDaysAfter", "maxHeightCm", "permitRequired"}
+	placed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	tests := []struct {
+		name         string
+		userId       int32
+		partyId      int32
+		posterId     int32
+		location     *pb.Location
+		zoneRows     *sqlmock.Rows
+		rulesRows    *sqlmock.Rows
+		electionRows *sqlmock.Rows
+		posterRows   *sqlmock.Rows
+		adminRows    *sqlmock.Rows
+		wantErr      bool
+		wantCode     pb.ResponseCode
+		wantWarnings int
+	}{
+		{
+			name:     "userId not set",
+			partyId:  1,
+			posterId: 1,
+			location: &pb.Location{Lat: 1, Lng: 1},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "posterId not set",
+			userId:   1,
+			partyId:  1,
+			location: &pb.Location{Lat: 1, Lng: 1},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "location not set",
+			userId:   1,
+			partyId:  1,
+			posterId: 1,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "poster does not exist",
+			userId:     1,
+			partyId:    1,
+			posterId:   1,
+			location:   &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:   sqlmock.NewRows(zoneColumns),
+			posterRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "poster removed",
+			userId:     1,
+			partyId:    1,
+			posterId:   1,
+			location:   &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:   sqlmock.NewRows(zoneColumns),
+			posterRows: sqlmock.NewRows(columns).AddRow(2, []uint8("2024-01-01 00:00:00"), 1, 1, 10, placed, 250, ""),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "too far for member",
+			userId:     1,
+			partyId:    1,
+			posterId:   1,
+			location:   &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:   sqlmock.NewRows(zoneColumns),
+			posterRows: sqlmock.NewRows(columns).AddRow(2, nil, 1, 1, movePosterMaxDistance+1, placed, 250, ""),
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "admin can move further",
+			userId:     1,
+			partyId:    1,
+			posterId:   1,
+			location:   &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:   sqlmock.NewRows(zoneColumns),
+			posterRows: sqlmock.NewRows(columns).AddRow(2, nil, 1, 1, movePosterMaxDistance+1, placed, 250, ""),
+			adminRows:  sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantCode:   pb.ResponseCode_OK,
+		},
+		{
+			name:     "inside rejecting exclusion zone",
+			userId:   1,
+			partyId:  1,
+			posterId: 1,
+			location: &pb.Location{Lat: 1, Lng: 1},
+			zoneRows: sqlmock.NewRows(zoneColumns).AddRow(3, "school", int32(pb.ZoneEnforcement_REJECT_PLACEMENT)),
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "inside flagged exclusion zone",
+			userId:       1,
+			partyId:      1,
+			posterId:     1,
+			location:     &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:     sqlmock.NewRows(zoneColumns).AddRow(4, "junction", int32(pb.ZoneEnforcement_FLAG_PLACEMENT)),
+			posterRows:   sqlmock.NewRows(columns).AddRow(2, nil, 1.0001, 1, 11.1, placed, 250, ""),
+			wantCode:     pb.ResponseCode_OK,
+			wantWarnings: 1,
+		},
+		{
+			name:      "breaks jurisdiction rules at new location",
+			userId:    1,
+			partyId:   1,
+			posterId:  1,
+			location:  &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:  sqlmock.NewRows(zoneColumns),
+			rulesRows: sqlmock.NewRows(rulesColumns).AddRow(2, "dublin city", 30, 7, 230, true),
+			// polling day is 60 days away so a poster placed in 2024 was placed too early
+			electionRows: sqlmock.NewRows([]string{"startDate", "endDate"}).AddRow(time.Now().Add(-24*time.Hour).Unix(), time.Now().Add(60*24*time.Hour).Unix()),
+			posterRows:   sqlmock.NewRows(columns).AddRow(2, nil, 1.0001, 1, 11.1, placed, 250, ""),
+			wantCode:     pb.ResponseCode_OK,
+			wantWarnings: 3,
+		},
+		{
+			name:       "success",
+			userId:     1,
+			partyId:    1,
+			posterId:   1,
+			location:   &pb.Location{Lat: 1, Lng: 1},
+			zoneRows:   sqlmock.NewRows(zoneColumns),
+			posterRows: sqlmock.NewRows(columns).AddRow(2, nil, 1.0001, 1, 11.1, placed, 250, ""),
+			wantCode:   pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.zoneRows != nil {
+				mock.ExpectQuery("select zoneId").WithArgs(tc.partyId, tc.location.GetLng(), tc.location.GetLat()).WillReturnRows(tc.zoneRows)
+			}
+			if tc.posterRows != nil {
+				if tc.rulesRows == nil {
+					tc.rulesRows = sqlmock.NewRows(rulesColumns)
+				}
+				mock.ExpectQuery("select jurisdictionId").WithArgs(tc.location.GetLng(), tc.location.GetLat()).WillReturnRows(tc.rulesRows)
+			}
+			if tc.electionRows != nil {
+				mock.ExpectQuery("select unix_timestamp").WithArgs(tc.partyId).WillReturnRows(tc.electionRows)
+			}
+			mock.ExpectBegin()
+			if tc.posterRows != nil {
+				mock.ExpectQuery("select").WithArgs(tc.location.GetLng(), tc.location.GetLat(), tc.posterId, tc.partyId).WillReturnRows(tc.posterRows)
+			}
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			}
+			mock.ExpectExec("update fyp_schema.parties").WithArgs(tc.partyId).WillReturnResult(sqlmock.NewResult(5, 1))
+			mock.ExpectExec("update fyp_schema.posters").WithArgs(tc.location.GetLng(), tc.location.GetLat(), sqlmock.AnyArg(), 5, tc.posterId, tc.partyId).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("insert into fyp_schema.posterMoves").WillReturnResult(sqlmock.NewResult(1, 1))
+			if tc.adminRows != nil {
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_POSTER_MOVED), tc.partyId, tc.userId, int32(2), "",
+						`{"posterId":1,"location":{"lat":1,"lng":1}}`, `{"posterId":1,"location":{"lat":1,"lng":1}}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectExec("delete from fyp_schema.posterViolations").WithArgs(int64(tc.posterId)).WillReturnResult(sqlmock.NewResult(0, 0))
+			for i := 0; i < tc.wantWarnings; i++ {
+				mock.ExpectExec("insert into fyp_schema.posterViolations").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectExec("insert into fyp_schema.outboxEvents").
+				WithArgs(eventPosterChanged, tc.partyId, outboxEventArg{kind: eventPosterChanged, change: pb.PosterChangeType_POSTER_MOVED, posterId: tc.posterId}).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.partyId,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			res, err := server.MovePoster(ctx, &pb.MovePosterRequest{UserId: tc.userId, PartyId: tc.partyId, PosterId: tc.posterId, Location: tc.location, AuthKey: authKey})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.GetWarnings()) != tc.wantWarnings {
+				t.Fatalf("got warnings %v want %d", res.GetWarnings(), tc.wantWarnings)
+			}
+			if tc.wantErr {
+				return
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	defaultNearestCount    = 20
+	maxNearestCount        = 200
+	defaultNearestDistance = 2000.0
+	maxNearestDistance     = 50000.0
+	// the envelope lets the spatial index rule out far away posters before distances are worked out
+	nearestPostersQuery = `select posterID, partyId, userID, removed, st_y(location) as latitude, st_x(location) as longitude,
+							ST_Distance_Sphere(location, point(?,?)) as distance
+							from fyp_schema.posters
+							where partyId = ? and MBRContains(ST_MakeEnvelope(point(?,?), point(?,?)), location)%s
+							having distance <= ? and (distance > ? or (distance = ? and posterID > ?))
+							order by distance, posterID
+							limit ?`
+)
+
+// nearestPageToken is the last poster returned to a client, the next page starts after it.
+// The location is kept so a token can't be used to page from somewhere else.
+type nearestPageToken struct {
+	location geoService.Point
+	distance float64
+	posterId int32
+}
+
+func (t nearestPageToken) String() string {
+	raw := strings.Join([]string{
+		strconv.FormatFloat(t.location.Lat, 'g', -1, 64),
+		strconv.FormatFloat(t.location.Lng, 'g', -1, 64),
+		strconv.FormatFloat(t.distance, 'g', -1, 64),
+		strconv.FormatInt(int64(t.posterId), 10),
+	}, ":")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseNearestPageToken(token string) (nearestPageToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nearestPageToken{}, fmt.Errorf("invalid page token")
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 4 {
+		return nearestPageToken{}, fmt.Errorf("invalid page token")
+	}
+	var values [3]float64
+	for i := range values {
+		if values[i], err = strconv.ParseFloat(parts[i], 64); err != nil {
+			return nearestPageToken{}, fmt.Errorf("invalid page token")
+		}
+	}
+	posterId, err := strconv.ParseInt(parts[3], 10, 32)
+	if err != nil {
+		return nearestPageToken{}, fmt.Errorf("invalid page token")
+	}
+	return nearestPageToken{location: geoService.Point{Lat: values[0], Lng: values[1]}, distance: values[2], posterId: int32(posterId)}, nil
+}
+
+// NearestPosters returns the posters of a party closest to a location, e.g. for a removal crew working outwards from where they are standing.
+func (s *server) NearestPosters(ctx context.Context, in *pb.NearestPostersRequest) (*pb.NearestPostersResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetLocation() == nil {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("location not set")
+	}
+	origin := geoService.Point{Lat: in.GetLocation().GetLat(), Lng: in.GetLocation().GetLng()}
+	if !origin.Valid() {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("location is not a valid coordinate")
+	}
+	count := int(in.GetCount())
+	if count < 0 || count > maxNearestCount {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("count must be between 1 and %d", maxNearestCount)
+	}
+	if count == 0 {
+		count = defaultNearestCount
+	}
+	maxDistance := in.GetMaxDistance()
+	if maxDistance < 0 || maxDistance > maxNearestDistance {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("maxDistance must be between 1 and %v metres", maxNearestDistance)
+	}
+	if maxDistance == 0 {
+		maxDistance = defaultNearestDistance
+	}
+	// the first page starts before the closest possible poster
+	after := nearestPageToken{location: origin, distance: -1}
+	if in.GetPageToken() != "" {
+		token, err := parseNearestPageToken(in.GetPageToken())
+		if err != nil {
+			return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+		if token.location != origin {
+			return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("page token is for a different location")
+		}
+		after = token
+	}
+
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	sw, ne := geoService.Envelope(origin, maxDistance)
+	// ask for one more poster than the count so we know if there is another page
+	rows, err := s.DB.Query(fmt.Sprintf(nearestPostersQuery, posterStatusClause(in.GetStatus())),
+		origin.Lng, origin.Lat, in.GetPartyId(), sw.Lng, sw.Lat, ne.Lng, ne.Lat,
+		maxDistance, after.distance, after.distance, after.posterId, count+1)
+	if err != nil {
+		return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query nearest posters: %v", err)
+	}
+	defer rows.Close()
+
+	var posters []*pb.NearbyPoster
+	nextPageToken := ""
+	for rows.Next() {
+		if len(posters) == count {
+			last := posters[len(posters)-1]
+			nextPageToken = nearestPageToken{location: origin, distance: last.Distance, posterId: last.Poster.Posterid}.String()
+			break
+		}
+		var poster PosterUpdate
+		var distance float64
+		removed := []uint8{}
+		err = rows.Scan(&poster.PosterId, &poster.PartyId, &poster.UserID, &removed, &poster.location.Lat, &poster.location.Lng, &distance)
+		if err != nil {
+			return &pb.NearestPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read posters from sql result: %v", err)
+		}
+		posters = append(posters, &pb.NearbyPoster{
+			Poster: &pb.Poster{
+				PlacedBy: poster.UserID,
+				Party:    poster.PartyId,
+				Posterid: poster.PosterId,
+				Location: &pb.Location{Lat: poster.location.Lat, Lng: poster.location.Lng},
+				Removed:  removed != nil,
+			},
+			Distance: distance,
+			Bearing:  geoService.Bearing(origin, geoService.Point{Lat: poster.location.Lat, Lng: poster.location.Lng}),
+		})
+	}
+	return &pb.NearestPostersResponse{Code: pb.ResponseCode_OK, Posters: posters, NextPageToken: nextPageToken}, nil
+}
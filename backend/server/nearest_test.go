@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestNearestPosters(t *testing.T) {
+	location := &pb.Location{Lat: 53.35, Lng: -6.25}
+	columns := []string{"posterID", "partyId", "userID", "removed", "latitude", "longitude", "distance"}
+	pageToken := nearestPageToken{location: geoService.Point{Lat: 53.35, Lng: -6.25}, distance: 120.5, posterId: 7}
+	tests := []struct {
+		name          string
+		userId        int32
+		partyId       int32
+		location      *pb.Location
+		count         int32
+		pageToken     string
+		returnRows    *sqlmock.Rows
+		wantAfter     nearestPageToken
+		wantLimit     int
+		wantErr       bool
+		wantCode      pb.ResponseCode
+		wantPosters   []int32
+		wantNextToken bool
+	}{
+		{
+			name:       "userId not set",
+			partyId:    1,
+			location:   location,
+			returnRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "location not set",
+			userId:     1,
+			partyId:    1,
+			returnRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "count too large",
+			userId:     1,
+			partyId:    1,
+			location:   location,
+			count:      int32(maxNearestCount + 1),
+			returnRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "page token for another location",
+			userId:     1,
+			partyId:    1,
+			location:   &pb.Location{Lat: 53.4, Lng: -6.25},
+			pageToken:  pageToken.String(),
+			returnRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "invalid page token",
+			userId:     1,
+			partyId:    1,
+			location:   location,
+			pageToken:  "not a token",
+			returnRows: sqlmock.NewRows(columns),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "first page",
+			userId:   1,
+			partyId:  1,
+			location: location,
+			count:    2,
+			returnRows: sqlmock.NewRows(columns).
+				AddRow(3, 1, 1, nil, 53.351, -6.25, 111.2).
+				AddRow(7, 1, 2, nil, 53.35, -6.248, 133.4).
+				AddRow(2, 1, 1, nil, 53.34, -6.25, 1112.0),
+			wantAfter:     nearestPageToken{distance: -1},
+			wantLimit:     3,
+			wantCode:      pb.ResponseCode_OK,
+			wantPosters:   []int32{3, 7},
+			wantNextToken: true,
+		},
+		{
+			name:      "last page",
+			userId:    1,
+			partyId:   1,
+			location:  location,
+			pageToken: pageToken.String(),
+			returnRows: sqlmock.NewRows(columns).
+				AddRow(2, 1, 1, nil, 53.34, -6.25, 1112.0),
+			wantAfter:   pageToken,
+			wantLimit:   defaultNearestCount + 1,
+			wantCode:    pb.ResponseCode_OK,
+			wantPosters: []int32{2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.location.GetLng(), tc.location.GetLat(), tc.partyId,
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+				defaultNearestDistance, tc.wantAfter.distance, tc.wantAfter.distance, tc.wantAfter.posterId, tc.wantLimit).WillReturnRows(tc.returnRows)
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.partyId,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			res, err := server.NearestPosters(ctx, &pb.NearestPostersRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey,
+				Location: tc.location, Count: tc.count, PageToken: tc.pageToken})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Posters) != len(tc.wantPosters) {
+				t.Fatalf("got posters %v want posters %v", res.Posters, tc.wantPosters)
+			}
+			for i, poster := range res.Posters {
+				if poster.Poster.Posterid != tc.wantPosters[i] {
+					t.Fatalf("got posters %v want posters %v", res.Posters, tc.wantPosters)
+				}
+			}
+			if (res.NextPageToken != "") != tc.wantNextToken {
+				t.Fatalf("got next page token %q want token: %v", res.NextPageToken, tc.wantNextToken)
+			}
+			if tc.wantNextToken {
+				token, err := parseNearestPageToken(res.NextPageToken)
+				if err != nil || token.posterId != 7 || token.distance != 133.4 {
+					t.Fatalf("got next page token %v err %v", token, err)
+				}
+			}
+			// poster 7 is due east of the location
+			if len(res.Posters) > 1 && (res.Posters[1].Bearing < 89 || res.Posters[1].Bearing > 91) {
+				t.Fatalf("got bearing %v want 90", res.Posters[1].Bearing)
+			}
+		})
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// how long a notification has to reach every channel of its recipient
+	notificationTimeout        = 30 * time.Second
+	maxNotificationAddress     = 4096
+	maxNotificationErrorLength = 1024
+	defaultNotificationHistory = int32(50)
+	maxNotificationHistory     = int32(500)
+	notificationContextQuery   = "select l1.username, l2.partyName, l2.admin from fyp_schema.users as l1, fyp_schema.parties as l2 where l1.userID = ? and l2.partyID = ?"
+	// channels of a user that has not muted the event
+	notificationChannelsQuery = `select l1.channel, l1.address from fyp_schema.notificationChannels as l1
+							where l1.userId = ? and not exists (select 1 from fyp_schema.notificationMutes as l2 where l2.userId = l1.userId and l2.event = ?)`
+	logNotificationQuery       = "insert into fyp_schema.notificationLog (userId, event, channel, address, subject, body, delivered, error) values (?,?,?,?,?,?,?,?)"
+	userNotificationChannels   = "select channel, address from fyp_schema.notificationChannels where userId = ? order by channel"
+	userNotificationMutes      = "select event from fyp_schema.notificationMutes where userId = ? order by event"
+	clearNotificationChannels  = "delete from fyp_schema.notificationChannels where userId = ?"
+	clearNotificationMutes     = "delete from fyp_schema.notificationMutes where userId = ?"
+	insertNotificationChannel  = "insert into fyp_schema.notificationChannels (userId, channel, address) values (?,?,?)"
+	insertNotificationMute     = "insert into fyp_schema.notificationMutes (userId, event) values (?,?)"
+	notificationHistoryQuery   = "select notificationId, event, channel, address, subject, delivered, error, unix_timestamp(created) from fyp_schema.notificationLog where userId = ? order by notificationId desc limit ?"
+	notificationDeadlineLayout = "Mon 2 Jan 15:04"
+)
+
+// notificationTemplates are rendered with notificationData, the subject is also used as the push title.
+var notificationTemplates = map[pb.NotificationEvent]struct{ subject, body *template.Template }{
+	pb.NotificationEvent_NOTIFY_JOIN_REQUESTED: notificationTemplate(
+		"{{.Username}} wants to join {{.Party}}",
+		"{{.Username}} has asked to join {{.Party}}. Open the app to approve or deny the request."),
+	pb.NotificationEvent_NOTIFY_JOIN_APPROVED: notificationTemplate(
+		"You have joined {{.Party}}",
+		"Your request to join {{.Party}} was approved. Your posters now belong to the party."),
+	pb.NotificationEvent_NOTIFY_JOIN_DENIED: notificationTemplate(
+		"Your request to join {{.Party}} was denied",
+		"An admin of {{.Party}} denied your request to join."),
+	pb.NotificationEvent_NOTIFY_POSTER_DUE_SOON: notificationTemplate(
+		"Poster {{.PosterId}} is due for removal",
+		"Poster {{.PosterId}} must be taken down by {{.Deadline}}."),
+	pb.NotificationEvent_NOTIFY_POSTER_OVERDUE: notificationTemplate(
+		"Poster {{.PosterId}} is overdue",
+		"Poster {{.PosterId}} should have been taken down by {{.Deadline}}. Please remove it as soon as possible."),
+	pb.NotificationEvent_NOTIFY_POSTER_ESCALATED: notificationTemplate(
+		"Poster {{.PosterId}} is still up",
+		"Poster {{.PosterId}} placed for {{.Party}} is still up after its removal deadline of {{.Deadline}}. This is reminder {{.Level}}."),
+}
+
+func notificationTemplate(subject, body string) struct{ subject, body *template.Template } {
+	return struct{ subject, body *template.Template }{
+		subject: template.Must(template.New("subject").Parse(subject)),
+		body:    template.Must(template.New("body").Parse(body)),
+	}
+}
+
+// notification is something that happened that a user should hear about.
+type notification struct {
+	event pb.NotificationEvent
+	// recipient, ignored if toAdmin is set
+	userId  int32
+	toAdmin bool
+	partyId int32
+	// the user the notification is about, defaults to the recipient
+	aboutUserId int32
+	posterId    int32
+	deadline    time.Time
+	level       int32
+}
+
+// notificationData is what notification templates are rendered with.
+type notificationData struct {
+	Username string
+	Party    string
+	PosterId int32
+	Deadline string
+	Level    int32
+}
+
+// notificationMessage is a rendered notification.
+type notificationMessage struct {
+	event   pb.NotificationEvent
+	subject string
+	body    string
+}
+
+// notifier delivers messages over one channel.
+type notifier interface {
+	send(ctx context.Context, address string, msg notificationMessage) error
+}
+
+// notificationService renders notifications and delivers them over the channels each user has set up.
+type notificationService struct {
+	db       *sql.DB
+	channels map[pb.NotificationChannel]notifier
+}
+
+// notify renders the notification and delivers it to every channel of the recipient, logging each attempt.
+// Delivery failures are only logged, an error is returned if the database could not be used.
+func (n *notificationService) notify(ctx context.Context, note notification) error {
+	tmpl, ok := notificationTemplates[note.event]
+	if !ok {
+		return fmt.Errorf("no template for %v", note.event)
+	}
+	about := note.aboutUserId
+	if about == 0 {
+		about = note.userId
+	}
+	var data notificationData
+	var admin int32
+	err := n.db.QueryRowContext(ctx, notificationContextQuery, about, note.partyId).Scan(&data.Username, &data.Party, &admin)
+	if err != nil {
+		return fmt.Errorf("failed to look up user %d and party %d: %v", about, note.partyId, err)
+	}
+	data.PosterId = note.posterId
+	data.Level = note.level
+	if !note.deadline.IsZero() {
+		data.Deadline = note.deadline.Format(notificationDeadlineLayout)
+	}
+	recipient := note.userId
+	if note.toAdmin {
+		recipient = admin
+	}
+	msg := notificationMessage{event: note.event}
+	var subject, body strings.Builder
+	if err = tmpl.subject.Execute(&subject, data); err != nil {
+		return fmt.Errorf("failed to render %v: %v", note.event, err)
+	}
+	if err = tmpl.body.Execute(&body, data); err != nil {
+		return fmt.Errorf("failed to render %v: %v", note.event, err)
+	}
+	msg.subject, msg.body = subject.String(), body.String()
+
+	rows, err := n.db.QueryContext(ctx, notificationChannelsQuery, recipient, int32(note.event))
+	if err != nil {
+		return fmt.Errorf("failed to query notification channels: %v", err)
+	}
+	var addresses []*pb.NotificationAddress
+	for rows.Next() {
+		var address pb.NotificationAddress
+		var channel int32
+		if err = rows.Scan(&channel, &address.Address); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to read notification channels: %v", err)
+		}
+		address.Channel = pb.NotificationChannel(channel)
+		addresses = append(addresses, &address)
+	}
+	_ = rows.Close()
+
+	for _, address := range addresses {
+		deliveryErr := fmt.Errorf("%v is not enabled on this server", address.GetChannel())
+		if channel, ok := n.channels[address.GetChannel()]; ok {
+			deliveryErr = channel.send(ctx, address.GetAddress(), msg)
+		}
+		errMsg := ""
+		if deliveryErr != nil {
+			errMsg = deliveryErr.Error()
+			if len(errMsg) > maxNotificationErrorLength {
+				errMsg = errMsg[:maxNotificationErrorLength]
+			}
+		}
+		_, err = n.db.ExecContext(ctx, logNotificationQuery, recipient, int32(note.event), int32(address.GetChannel()), address.GetAddress(),
+			msg.subject, msg.body, deliveryErr == nil, errMsg)
+		if err != nil {
+			return fmt.Errorf("failed to log notification: %v", err)
+		}
+	}
+	return nil
+}
+
+// smtpNotifier sends notifications by email.
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+	// sendMail, replaced in tests
+	sendMail func(ctx context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// sendMail is smtp.SendMail that gives up when ctx is done, so a stalled mail server can't hold up the caller.
+func sendMail(ctx context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(a); err != nil {
+				return err
+			}
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (n *smtpNotifier) send(ctx context.Context, address string, msg notificationMessage) error {
+	to, err := mail.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("invalid email address: %v", err)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", "").Replace(msg.subject))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(msg.body)
+	buf.WriteString("\r\n")
+	send := n.sendMail
+	if send == nil {
+		send = sendMail
+	}
+	return send(ctx, n.addr, n.auth, n.from, []string{to.Address}, buf.Bytes())
+}
+
+// webhookNotifier posts notifications as JSON to a url chosen by the user.
+type webhookNotifier struct {
+	client *http.Client
+}
+
+type webhookNotification struct {
+	Event   string `json:"event"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+func (n *webhookNotifier) send(ctx context.Context, address string, msg notificationMessage) error {
+	body, err := json.Marshal(webhookNotification{Event: msg.event.String(), Subject: msg.subject, Body: msg.body})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, n.client, address, nil, body, nil)
+}
+
+// pushNotifier sends push notifications through an FCM compatible endpoint.
+type pushNotifier struct {
+	endpoint  string
+	serverKey string
+	client    *http.Client
+}
+
+type pushRequest struct {
+	To           string            `json:"to"`
+	Notification pushContent       `json:"notification"`
+	Data         map[string]string `json:"data"`
+}
+
+type pushContent struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type pushResponse struct {
+	Failure int `json:"failure"`
+	Results []struct {
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+func (n *pushNotifier) send(ctx context.Context, address string, msg notificationMessage) error {
+	body, err := json.Marshal(pushRequest{
+		To:           address,
+		Notification: pushContent{Title: msg.subject, Body: msg.body},
+		Data:         map[string]string{"event": msg.event.String()},
+	})
+	if err != nil {
+		return err
+	}
+	var res pushResponse
+	if err = postJSON(ctx, n.client, n.endpoint, map[string]string{"Authorization": "key=" + n.serverKey}, body, &res); err != nil {
+		return err
+	}
+	// the endpoint accepts the request even if the device token is no longer valid
+	if res.Failure > 0 {
+		if len(res.Results) > 0 && res.Results[0].Error != "" {
+			return fmt.Errorf("push rejected: %s", res.Results[0].Error)
+		}
+		return fmt.Errorf("push rejected")
+	}
+	return nil
+}
+
+// postJSON posts body to target and decodes the response into out if it is not nil.
+func postJSON(ctx context.Context, client *http.Client, target string, headers map[string]string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, res.Status)
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to read response from %s: %v", req.URL.Host, err)
+	}
+	return nil
+}
+
+// validateNotificationAddress checks an address can be used with its channel.
+func validateNotificationAddress(ctx context.Context, address *pb.NotificationAddress) error {
+	if address.GetAddress() == "" {
+		return fmt.Errorf("address not set for %v", address.GetChannel())
+	}
+	if len(address.GetAddress()) > maxNotificationAddress {
+		return fmt.Errorf("address for %v is too long", address.GetChannel())
+	}
+	switch address.GetChannel() {
+	case pb.NotificationChannel_NOTIFICATION_EMAIL:
+		if _, err := mail.ParseAddress(address.GetAddress()); err != nil {
+			return fmt.Errorf("invalid email address: %v", err)
+		}
+	case pb.NotificationChannel_NOTIFICATION_WEBHOOK:
+		if err := checkWebhookAddress(ctx, address.GetAddress()); err != nil {
+			return err
+		}
+	case pb.NotificationChannel_NOTIFICATION_PUSH:
+	default:
+		return fmt.Errorf("unknown notification channel %v", address.GetChannel())
+	}
+	return nil
+}
+
+// publicAddress is false for addresses on the server's own network, which webhooks must not be able to reach.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified())
+}
+
+// checkWebhookAddress checks target is an http or https url whose host only resolves to public addresses.
+func checkWebhookAddress(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("webhook must be an http or https url")
+	}
+	host := u.Hostname()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve webhook host %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr.IP) {
+			return fmt.Errorf("webhook host %s is not a public address", host)
+		}
+	}
+	return nil
+}
+
+// dialPublicOnly is the dialer control of webhook clients. It checks the address actually being connected to, so a
+// host that was public when it was saved can't be pointed at the server's own network afterwards or through a redirect.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("webhooks can not be sent to %s", host)
+	}
+	return nil
+}
+
+// newWebhookClient returns a client for urls chosen by users, which can only connect to public addresses.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialPublicOnly}
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout}}
+}
+
+// GetNotificationPreferences returns where the user is notified and which events they have muted.
+func (s *server) GetNotificationPreferences(ctx context.Context, in *pb.NotificationPreferencesRequest) (*pb.NotificationPreferencesResponse, error) {
+	if in.GetUserId() == 0 {
+		return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetAuthKey() == "" {
+		return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil || userClaims.UserID != in.GetUserId() {
+		return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	var preferences pb.NotificationPreferences
+	rows, err := s.DB.Query(userNotificationChannels, in.GetUserId())
+	if err != nil {
+		return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query notification channels: %v", err)
+	}
+	for rows.Next() {
+		var address pb.NotificationAddress
+		var channel int32
+		if err = rows.Scan(&channel, &address.Address); err != nil {
+			_ = rows.Close()
+			return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read notification channels: %v", err)
+		}
+		address.Channel = pb.NotificationChannel(channel)
+		preferences.Addresses = append(preferences.Addresses, &address)
+	}
+	_ = rows.Close()
+	rows, err = s.DB.Query(userNotificationMutes, in.GetUserId())
+	if err != nil {
+		return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query muted notifications: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event int32
+		if err = rows.Scan(&event); err != nil {
+			return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read muted notifications: %v", err)
+		}
+		preferences.MutedEvents = append(preferences.MutedEvents, pb.NotificationEvent(event))
+	}
+	return &pb.NotificationPreferencesResponse{Code: pb.ResponseCode_OK, Preferences: &preferences}, nil
+}
+
+// UpdateNotificationPreferences replaces where the user is notified and which events they have muted.
+func (s *server) UpdateNotificationPreferences(ctx context.Context, in *pb.UpdateNotificationPreferencesRequest) (*pb.UpdateNotificationPreferencesResponse, error) {
+	if in.GetUserId() == 0 {
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetAuthKey() == "" {
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil || userClaims.UserID != in.GetUserId() {
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	channels := make(map[pb.NotificationChannel]bool)
+	for _, address := range in.GetPreferences().GetAddresses() {
+		if err := validateNotificationAddress(ctx, address); err != nil {
+			return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+		if channels[address.GetChannel()] {
+			return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only one address can be set for %v", address.GetChannel())
+		}
+		channels[address.GetChannel()] = true
+	}
+	muted := make(map[pb.NotificationEvent]bool)
+	for _, event := range in.GetPreferences().GetMutedEvents() {
+		if _, ok := notificationTemplates[event]; !ok {
+			return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("unknown notification event %v", event)
+		}
+		muted[event] = true
+	}
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	if _, err = tx.Exec(clearNotificationChannels, in.GetUserId()); err != nil {
+		_ = tx.Rollback()
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to clear notification channels: %v", err)
+	}
+	if _, err = tx.Exec(clearNotificationMutes, in.GetUserId()); err != nil {
+		_ = tx.Rollback()
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to clear muted notifications: %v", err)
+	}
+	for _, address := range in.GetPreferences().GetAddresses() {
+		if _, err = tx.Exec(insertNotificationChannel, in.GetUserId(), int32(address.GetChannel()), address.GetAddress()); err != nil {
+			_ = tx.Rollback()
+			return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save notification channel: %v", err)
+		}
+	}
+	for event := range muted {
+		if _, err = tx.Exec(insertNotificationMute, in.GetUserId(), int32(event)); err != nil {
+			_ = tx.Rollback()
+			return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to mute notification: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save notification preferences: %v", err)
+	}
+	return &pb.UpdateNotificationPreferencesResponse{Code: pb.ResponseCode_OK}, nil
+}
+
+// NotificationHistory returns the latest attempts to notify the user, newest first.
+func (s *server) NotificationHistory(ctx context.Context, in *pb.NotificationHistoryRequest) (*pb.NotificationHistoryResponse, error) {
+	if in.GetUserId() == 0 {
+		return &pb.NotificationHistoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetAuthKey() == "" {
+		return &pb.NotificationHistoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil || userClaims.UserID != in.GetUserId() {
+		return &pb.NotificationHistoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	limit := in.GetLimit()
+	if limit <= 0 {
+		limit = defaultNotificationHistory
+	}
+	if limit > maxNotificationHistory {
+		limit = maxNotificationHistory
+	}
+	rows, err := s.DB.Query(notificationHistoryQuery, in.GetUserId(), limit)
+	if err != nil {
+		return &pb.NotificationHistoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query notifications: %v", err)
+	}
+	defer rows.Close()
+	var deliveries []*pb.NotificationDelivery
+	for rows.Next() {
+		var delivery pb.NotificationDelivery
+		var event, channel int32
+		var created int64
+		err = rows.Scan(&delivery.NotificationId, &event, &channel, &delivery.Address, &delivery.Subject, &delivery.Delivered, &delivery.Error, &created)
+		if err != nil {
+			return &pb.NotificationHistoryResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read notifications: %v", err)
+		}
+		delivery.Event = pb.NotificationEvent(event)
+		delivery.Channel = pb.NotificationChannel(channel)
+		delivery.Created = timestamppb.New(time.Unix(created, 0))
+		deliveries = append(deliveries, &delivery)
+	}
+	return &pb.NotificationHistoryResponse{Code: pb.ResponseCode_OK, Deliveries: deliveries}, nil
+}
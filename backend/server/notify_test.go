@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+// fakeNotifier records what it was asked to send instead of contacting anyone.
+type fakeNotifier struct {
+	sent []notificationMessage
+	to   []string
+	err  error
+}
+
+func (f *fakeNotifier) send(_ context.Context, address string, msg notificationMessage) error {
+	f.sent = append(f.sent, msg)
+	f.to = append(f.to, address)
+	return f.err
+}
+
+func TestNotify(t *testing.T) {
+	deadline := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		note         notification
+		wantContext  []driver.Value
+		contextRow   []driver.Value
+		wantUser     int32
+		channelRows  *sqlmock.Rows
+		emailErr     error
+		wantSubject  string
+		wantBody     string
+		wantSent     int
+		wantLogged   [][]interface{}
+		wantErr      bool
+		contextFails bool
+	}{
+		{
+			name:        "join request goes to the party admin",
+			note:        notification{event: pb.NotificationEvent_NOTIFY_JOIN_REQUESTED, toAdmin: true, partyId: 2, aboutUserId: 7},
+			wantContext: []driver.Value{7, 2},
+			contextRow:  []driver.Value{"alice", "green", 3},
+			wantUser:    3,
+			channelRows: sqlmock.NewRows([]string{"channel", "address"}).AddRow(0, "admin@example.com"),
+			wantSubject: "alice wants to join green",
+			wantBody:    "alice has asked to join green. Open the app to approve or deny the request.",
+			wantSent:    1,
+			wantLogged:  [][]interface{}{{3, 0, 0, "admin@example.com", true, ""}},
+		},
+		{
+			name:        "failed and disabled channels are logged",
+			note:        notification{event: pb.NotificationEvent_NOTIFY_POSTER_OVERDUE, userId: 7, partyId: 2, posterId: 11, deadline: deadline},
+			wantContext: []driver.Value{7, 2},
+			contextRow:  []driver.Value{"alice", "green", 3},
+			wantUser:    7,
+			channelRows: sqlmock.NewRows([]string{"channel", "address"}).AddRow(0, "alice@example.com").AddRow(2, "device-token"),
+			emailErr:    fmt.Errorf("connection refused"),
+			wantSubject: "Poster 11 is overdue",
+			wantBody:    "Poster 11 should have been taken down by Mon 10 Jun 12:00. Please remove it as soon as possible.",
+			wantSent:    1,
+			wantLogged: [][]interface{}{
+				{7, 4, 0, "alice@example.com", false, "connection refused"},
+				{7, 4, 2, "device-token", false, "NOTIFICATION_PUSH is not enabled on this server"},
+			},
+		},
+		{
+			name:        "muted or no channels",
+			note:        notification{event: pb.NotificationEvent_NOTIFY_JOIN_APPROVED, userId: 7, partyId: 2},
+			wantContext: []driver.Value{7, 2},
+			contextRow:  []driver.Value{"alice", "green", 3},
+			wantUser:    7,
+			channelRows: sqlmock.NewRows([]string{"channel", "address"}),
+		},
+		{
+			name:         "unknown user",
+			note:         notification{event: pb.NotificationEvent_NOTIFY_JOIN_APPROVED, userId: 7, partyId: 2},
+			wantContext:  []driver.Value{7, 2},
+			contextFails: true,
+			wantErr:      true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			email := &fakeNotifier{err: tc.emailErr}
+			service := &notificationService{db: db, channels: map[pb.NotificationChannel]notifier{pb.NotificationChannel_NOTIFICATION_EMAIL: email}}
+			contextQuery := mock.ExpectQuery("select l1.username, l2.partyName").WithArgs(tc.wantContext...)
+			if tc.contextFails {
+				contextQuery.WillReturnRows(sqlmock.NewRows([]string{"username", "partyName", "admin"}))
+			} else {
+				contextQuery.WillReturnRows(sqlmock.NewRows([]string{"username", "partyName", "admin"}).AddRow(tc.contextRow...))
+				mock.ExpectQuery("select l1.channel, l1.address").WithArgs(tc.wantUser, int32(tc.note.event)).WillReturnRows(tc.channelRows)
+			}
+			for _, logged := range tc.wantLogged {
+				mock.ExpectExec("insert into fyp_schema.notificationLog").
+					WithArgs(logged[0], logged[1], logged[2], logged[3], tc.wantSubject, tc.wantBody, logged[4], logged[5]).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			err = service.notify(context.Background(), tc.note)
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if len(email.sent) != tc.wantSent {
+				t.Fatalf("sent %d emails want %d", len(email.sent), tc.wantSent)
+			}
+			for _, msg := range email.sent {
+				if msg.subject != tc.wantSubject || msg.body != tc.wantBody {
+					t.Fatalf("got message %+v", msg)
+				}
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	for _, event := range pb.NotificationEvent_value {
+		if _, ok := notificationTemplates[pb.NotificationEvent(event)]; !ok {
+			t.Fatalf("no template for %v", pb.NotificationEvent(event))
+		}
+	}
+	for _, event := range escalationEvents {
+		if _, ok := notificationTemplates[event]; !ok {
+			t.Fatalf("no template for %v", event)
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	var gotTo []string
+	var gotMsg string
+	n := &smtpNotifier{addr: "localhost:25", from: "posters@example.com", sendMail: func(_ context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotTo = to
+		gotMsg = string(msg)
+		return nil
+	}}
+	err := n.send(context.Background(), "Alice <alice@example.com>", notificationMessage{subject: "hello\r\nBcc: x@example.com", body: "body"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gotTo) != 1 || gotTo[0] != "alice@example.com" {
+		t.Fatalf("sent to %v", gotTo)
+	}
+	// headers can't be injected through the subject
+	if !strings.Contains(gotMsg, "Subject: helloBcc: x@example.com\r\n") || !strings.HasSuffix(gotMsg, "\r\n\r\nbody\r\n") {
+		t.Fatalf("got message %q", gotMsg)
+	}
+	if err = n.send(context.Background(), "not an address", notificationMessage{}); err == nil {
+		t.Fatalf("expected error for invalid address")
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	// a mail server that accepts connections but never greets the client
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = sendMail(ctx, ln.Addr().String(), nil, "posters@example.com", []string{"alice@example.com"}, []byte("body"))
+	if err == nil {
+		t.Fatalf("expected error from stalled mail server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("gave up after %v", elapsed)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got webhookNotification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil || got.Subject == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	n := &webhookNotifier{client: ts.Client()}
+
+	err := n.send(context.Background(), ts.URL, notificationMessage{event: pb.NotificationEvent_NOTIFY_JOIN_DENIED, subject: "denied", body: "body"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Event != "NOTIFY_JOIN_DENIED" || got.Subject != "denied" || got.Body != "body" {
+		t.Fatalf("got %+v", got)
+	}
+	if err = n.send(context.Background(), ts.URL, notificationMessage{subject: "fail"}); err == nil {
+		t.Fatalf("expected error when the webhook fails")
+	}
+	// the test server is on loopback, which the client used outside of tests refuses to connect to
+	n = &webhookNotifier{client: newWebhookClient(time.Second)}
+	if err = n.send(context.Background(), ts.URL, notificationMessage{subject: "denied"}); err == nil {
+		t.Fatalf("expected error when the webhook is on the server's network")
+	}
+}
+
+func TestCheckWebhookAddress(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "https://203.0.113.10/hook"},
+		{target: "https://[2001:db8::1]:8443/hook"},
+		{target: "ftp://203.0.113.10/hook", wantErr: true},
+		{target: "http://127.0.0.1:8080/hook", wantErr: true},
+		{target: "http://[::1]/hook", wantErr: true},
+		{target: "http://10.1.2.3/hook", wantErr: true},
+		{target: "http://192.168.0.194:50051/hook", wantErr: true},
+		{target: "http://169.254.169.254/latest/meta-data", wantErr: true},
+		{target: "http://0.0.0.0/hook", wantErr: true},
+		{target: "http://[fe80::1]/hook", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.target, func(t *testing.T) {
+			if err := checkWebhookAddress(context.Background(), tc.target); (err != nil) != tc.wantErr {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPushNotifier(t *testing.T) {
+	var got pushRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "key=secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		if got.To == "stale-token" {
+			_, _ = w.Write([]byte(`{"success":0,"failure":1,"results":[{"error":"NotRegistered"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"success":1,"failure":0,"results":[{"message_id":"1"}]}`))
+	}))
+	defer ts.Close()
+	n := &pushNotifier{endpoint: ts.URL, serverKey: "secret", client: ts.Client()}
+
+	err := n.send(context.Background(), "device-token", notificationMessage{event: pb.NotificationEvent_NOTIFY_POSTER_DUE_SOON, subject: "title", body: "body"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.To != "device-token" || got.Notification.Title != "title" || got.Data["event"] != "NOTIFY_POSTER_DUE_SOON" {
+		t.Fatalf("got %+v", got)
+	}
+	if err = n.send(context.Background(), "stale-token", notificationMessage{}); err == nil || !strings.Contains(err.Error(), "NotRegistered") {
+		t.Fatalf("expected rejected push, got %v", err)
+	}
+	n.serverKey = "wrong"
+	if err = n.send(context.Background(), "device-token", notificationMessage{}); err == nil {
+		t.Fatalf("expected error with the wrong server key")
+	}
+}
+
+func TestUpdateNotificationPreferences(t *testing.T) {
+	tests := []struct {
+		name        string
+		authKey     string
+		userId      int32
+		preferences *pb.NotificationPreferences
+		wantSaved   bool
+		wantErr     bool
+		wantCode    pb.ResponseCode
+	}{
+		{
+			name:     "token for another user",
+			authKey:  testAuthKey(t, 2, 1),
+			userId:   1,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "invalid email",
+			authKey: testAuthKey(t, 1, 1),
+			userId:  1,
+			preferences: &pb.NotificationPreferences{Addresses: []*pb.NotificationAddress{
+				{Channel: pb.NotificationChannel_NOTIFICATION_EMAIL, Address: "alice"},
+			}},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "webhook is not a url",
+			authKey: testAuthKey(t, 1, 1),
+			userId:  1,
+			preferences: &pb.NotificationPreferences{Addresses: []*pb.NotificationAddress{
+				{Channel: pb.NotificationChannel_NOTIFICATION_WEBHOOK, Address: "ftp://example.com"},
+			}},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "webhook on the server's network",
+			authKey: testAuthKey(t, 1, 1),
+			userId:  1,
+			preferences: &pb.NotificationPreferences{Addresses: []*pb.NotificationAddress{
+				{Channel: pb.NotificationChannel_NOTIFICATION_WEBHOOK, Address: "http://169.254.169.254/latest/meta-data"},
+			}},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "two addresses for one channel",
+			authKey: testAuthKey(t, 1, 1),
+			userId:  1,
+			preferences: &pb.NotificationPreferences{Addresses: []*pb.NotificationAddress{
+				{Channel: pb.NotificationChannel_NOTIFICATION_PUSH, Address: "a"},
+				{Channel: pb.NotificationChannel_NOTIFICATION_PUSH, Address: "b"},
+			}},
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "success",
+			authKey: testAuthKey(t, 1, 1),
+			userId:  1,
+			preferences: &pb.NotificationPreferences{
+				Addresses: []*pb.NotificationAddress{
+					{Channel: pb.NotificationChannel_NOTIFICATION_EMAIL, Address: "alice@example.com"},
+					{Channel: pb.NotificationChannel_NOTIFICATION_WEBHOOK, Address: "https://203.0.113.10/hook"},
+				},
+				MutedEvents: []pb.NotificationEvent{pb.NotificationEvent_NOTIFY_POSTER_DUE_SOON},
+			},
+			wantSaved: true,
+			wantCode:  pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db}
+			if tc.wantSaved {
+				mock.ExpectBegin()
+				mock.ExpectExec("delete from fyp_schema.notificationChannels").WithArgs(tc.userId).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("delete from fyp_schema.notificationMutes").WithArgs(tc.userId).WillReturnResult(sqlmock.NewResult(0, 1))
+				for _, address := range tc.preferences.GetAddresses() {
+					mock.ExpectExec("insert into fyp_schema.notificationChannels").
+						WithArgs(tc.userId, int32(address.GetChannel()), address.GetAddress()).WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				for _, event := range tc.preferences.GetMutedEvents() {
+					mock.ExpectExec("insert into fyp_schema.notificationMutes").WithArgs(tc.userId, int32(event)).WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+				mock.ExpectCommit()
+			}
+
+			res, err := server.UpdateNotificationPreferences(ctx, &pb.UpdateNotificationPreferencesRequest{AuthKey: tc.authKey, UserId: tc.userId, Preferences: tc.preferences})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestNotificationHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	columns := []string{"notificationId", "event", "channel", "address", "subject", "delivered", "error", "created"}
+	mock.ExpectQuery("select notificationId").WithArgs(int32(1), maxNotificationHistory).WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(2, 4, 0, "alice@example.com", "Poster 11 is overdue", false, "connection refused", 1718000000).
+		AddRow(1, 1, 1, "https://example.com/hook", "You have joined green", true, "", 1717000000))
+
+	res, err := server.NotificationHistory(context.Background(), &pb.NotificationHistoryRequest{AuthKey: testAuthKey(t, 1, 1), UserId: 1, Limit: 10000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Deliveries) != 2 || res.Deliveries[0].Delivered || res.Deliveries[0].Event != pb.NotificationEvent_NOTIFY_POSTER_OVERDUE || !res.Deliveries[1].Delivered {
+		t.Fatalf("got deliveries %v", res.Deliveries)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
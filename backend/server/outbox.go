@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var (
+	// an event that keeps failing is given up on after this many attempts
+	maxOutboxAttempts    = 10
+	outboxBatchSize      = 100
+	outboxPollInterval   = 5 * time.Second
+	insertOutboxQuery    = "insert into fyp_schema.outboxEvents (kind, partyId, payload) values (?,?,?)"
+	pendingOutboxQuery   = "select eventId, payload, attempts, handled from fyp_schema.outboxEvents where dispatched is null order by eventId limit ?"
+	outboxDispatchQuery  = "update fyp_schema.outboxEvents set dispatched = now(), attempts = attempts + 1, lastError = ?, handled = ? where eventId = ?"
+	outboxFailedQuery    = "update fyp_schema.outboxEvents set attempts = attempts + 1, lastError = ?, handled = ? where eventId = ?"
+	maxOutboxErrorLength = 1024
+)
+
+const (
+	eventPosterChanged  = "poster.changed"
+	eventJoinRequested  = "join.requested"
+	eventMemberApproved = "member.approved"
+	eventMemberDenied   = "member.denied"
+)
+
+// domainEvent is a change that other parts of the server react to. It is written to the outbox in the same
+// transaction as the change so it is published if and only if the change is committed.
+type domainEvent struct {
+	Kind     string    `json:"kind"`
+	PartyId  int32     `json:"partyId"`
+	Occurred time.Time `json:"occurred"`
+	// poster changes
+	Change pb.PosterChangeType `json:"change,omitempty"`
+	Seq    int64               `json:"seq,omitempty"`
+	// protojson encoded pb.Poster
+	Poster json.RawMessage `json:"poster,omitempty"`
+	// join requests and their review
+	Member *webhookMember `json:"member,omitempty"`
+}
+
+// posterChangedEvent is published when a poster is placed, removed or moved. seq is the change's position in the
+// party's change feed.
+func posterChangedEvent(change pb.PosterChangeType, poster *pb.Poster, seq int64) (domainEvent, error) {
+	encoded, err := protojson.Marshal(poster)
+	if err != nil {
+		return domainEvent{}, err
+	}
+	return domainEvent{Kind: eventPosterChanged, PartyId: poster.GetParty(), Change: change, Seq: seq, Poster: encoded}, nil
+}
+
+func memberEvent(kind string, partyId int32, member *pb.Member) domainEvent {
+	return domainEvent{
+		Kind:    kind,
+		PartyId: partyId,
+		Member:  &webhookMember{UserId: member.GetUserId(), FirstName: member.GetFirstName(), LastName: member.GetLastName()},
+	}
+}
+
+func (e domainEvent) poster() (*pb.Poster, error) {
+	var poster pb.Poster
+	if err := protojson.Unmarshal(e.Poster, &poster); err != nil {
+		return nil, fmt.Errorf("invalid poster in %s event: %v", e.Kind, err)
+	}
+	return &poster, nil
+}
+
+// writeOutbox records the event as part of tx.
+func writeOutbox(tx *sql.Tx, event domainEvent) error {
+	if event.Occurred.IsZero() {
+		event.Occurred = time.Now().UTC()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertOutboxQuery, event.Kind, event.PartyId, string(payload))
+	return err
+}
+
+// outboxSubscriber reacts to a committed event. Events are delivered at least once, a subscriber that failed is
+// given the event again but the subscribers that handled it are not.
+type outboxSubscriber func(ctx context.Context, event domainEvent) error
+
+// outboxDispatcher publishes events from the outbox to every subscriber in the order they were committed. An event a
+// subscriber fails on is retried after the events behind it.
+type outboxDispatcher struct {
+	db          *sql.DB
+	subscribers []outboxSubscriber
+	// wakes the dispatcher when events are committed
+	wake chan struct{}
+}
+
+// newOutboxDispatcher creates a dispatcher for the subscribers. Which subscribers handled an event is recorded by
+// their position, so new subscribers go at the end.
+func newOutboxDispatcher(db *sql.DB, subscribers ...outboxSubscriber) *outboxDispatcher {
+	return &outboxDispatcher{db: db, subscribers: subscribers, wake: make(chan struct{}, 1)}
+}
+
+// poke tells the dispatcher new events were committed.
+func (o *outboxDispatcher) poke() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outboxDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := o.dispatchPending(ctx)
+			if err != nil {
+				log.Printf("failed to dispatch events: %v", err)
+			}
+			// keep going while there is a backlog
+			if err != nil || n < outboxBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// dispatchPending publishes pending events and returns how many were dispatched. Events a subscriber fails on are
+// left pending and the first of their errors is returned once the rest of the batch is published.
+func (o *outboxDispatcher) dispatchPending(ctx context.Context) (int, error) {
+	rows, err := o.db.QueryContext(ctx, pendingOutboxQuery, outboxBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query outbox: %v", err)
+	}
+	type pending struct {
+		eventId  int64
+		payload  string
+		attempts int
+		handled  int64
+	}
+	var events []pending
+	for rows.Next() {
+		var p pending
+		if err = rows.Scan(&p.eventId, &p.payload, &p.attempts, &p.handled); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to read outbox: %v", err)
+		}
+		events = append(events, p)
+	}
+	_ = rows.Close()
+
+	dispatched := 0
+	var firstErr error
+	for _, p := range events {
+		var event domainEvent
+		handled := p.handled
+		dispatchErr := json.Unmarshal([]byte(p.payload), &event)
+		if dispatchErr == nil {
+			handled, dispatchErr = o.publish(ctx, event, p.handled)
+		}
+		if dispatchErr == nil {
+			if _, err = o.db.ExecContext(ctx, outboxDispatchQuery, "", handled, p.eventId); err != nil {
+				return dispatched, fmt.Errorf("failed to mark event %d dispatched: %v", p.eventId, err)
+			}
+			dispatched++
+			continue
+		}
+		errMsg := dispatchErr.Error()
+		if len(errMsg) > maxOutboxErrorLength {
+			errMsg = errMsg[:maxOutboxErrorLength]
+		}
+		if p.attempts+1 >= maxOutboxAttempts {
+			log.Printf("giving up on event %d after %d attempts: %v", p.eventId, p.attempts+1, dispatchErr)
+			if _, err = o.db.ExecContext(ctx, outboxDispatchQuery, errMsg, handled, p.eventId); err != nil {
+				return dispatched, fmt.Errorf("failed to mark event %d dispatched: %v", p.eventId, err)
+			}
+			dispatched++
+			continue
+		}
+		if _, err = o.db.ExecContext(ctx, outboxFailedQuery, errMsg, handled, p.eventId); err != nil {
+			return dispatched, fmt.Errorf("failed to record event %d failure: %v", p.eventId, err)
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("failed to dispatch event %d: %v", p.eventId, dispatchErr)
+		}
+	}
+	return dispatched, firstErr
+}
+
+// publish gives the event to every subscriber that hasn't handled it yet, returning the updated handled bits and
+// the first error.
+func (o *outboxDispatcher) publish(ctx context.Context, event domainEvent, handled int64) (int64, error) {
+	var firstErr error
+	for i, subscriber := range o.subscribers {
+		if handled&(1<<i) != 0 {
+			continue
+		}
+		if err := subscriber(ctx, event); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		handled |= 1 << i
+	}
+	return handled, firstErr
+}
+
+// handleEvent streams poster changes to clients watching the party.
+func (h *posterHub) handleEvent(_ context.Context, event domainEvent) error {
+	if event.Kind != eventPosterChanged {
+		return nil
+	}
+	poster, err := event.poster()
+	if err != nil {
+		return err
+	}
+	h.publish(event.Change, poster, changeCursor{partyId: event.PartyId, seq: event.Seq, posterId: poster.GetPosterid()})
+	return nil
+}
+
+// handleEvent notifies users about join requests and their review.
+func (n *notificationService) handleEvent(ctx context.Context, event domainEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+	switch event.Kind {
+	case eventJoinRequested:
+		return n.notify(ctx, notification{event: pb.NotificationEvent_NOTIFY_JOIN_REQUESTED, toAdmin: true, partyId: event.PartyId, aboutUserId: event.Member.UserId})
+	case eventMemberApproved:
+		return n.notify(ctx, notification{event: pb.NotificationEvent_NOTIFY_JOIN_APPROVED, userId: event.Member.UserId, partyId: event.PartyId})
+	case eventMemberDenied:
+		return n.notify(ctx, notification{event: pb.NotificationEvent_NOTIFY_JOIN_DENIED, userId: event.Member.UserId, partyId: event.PartyId})
+	}
+	return nil
+}
+
+// handleEvent queues party events for the party's webhooks.
+func (w *webhookDispatcher) handleEvent(ctx context.Context, event domainEvent) error {
+	switch event.Kind {
+	case eventPosterChanged:
+		webhookEvent, ok := posterWebhookEvents[event.Change]
+		if !ok {
+			return nil
+		}
+		poster, err := event.poster()
+		if err != nil {
+			return err
+		}
+		payload := posterWebhookPayload(poster)
+		payload.Occurred = event.Occurred
+		return w.enqueue(ctx, webhookEvent, payload)
+	case eventMemberApproved:
+		return w.enqueue(ctx, pb.WebhookEvent_WEBHOOK_MEMBER_JOINED, webhookPayload{PartyId: event.PartyId, Occurred: event.Occurred, Member: event.Member})
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+// outboxEventArg matches the payload of an event written to the outbox.
+type outboxEventArg struct {
+	kind     string
+	change   pb.PosterChangeType
+	posterId int32
+	userId   int32
+}
+
+func (a outboxEventArg) Match(v driver.Value) bool {
+	payload, ok := v.(string)
+	if !ok {
+		return false
+	}
+	var event domainEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil || event.Kind != a.kind || event.Occurred.IsZero() {
+		return false
+	}
+	if a.userId != 0 && (event.Member == nil || event.Member.UserId != a.userId) {
+		return false
+	}
+	if a.kind != eventPosterChanged {
+		return true
+	}
+	poster, err := event.poster()
+	if err != nil || event.Change != a.change {
+		return false
+	}
+	return a.posterId == 0 || poster.GetPosterid() == a.posterId
+}
+
+func testOutboxPayload(t *testing.T, change pb.PosterChangeType, poster *pb.Poster, seq int64) string {
+	event, err := posterChangedEvent(change, poster, seq)
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+	event.Occurred = time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to encode event: %v", err)
+	}
+	return string(payload)
+}
+
+func TestOutboxDispatchPending(t *testing.T) {
+	placed := testOutboxPayload(t, pb.PosterChangeType_POSTER_PLACED, &pb.Poster{PlacedBy: 2, Party: 1, Posterid: 11, Location: &pb.Location{Lat: 53.3, Lng: -6.2}}, 7)
+	removed := testOutboxPayload(t, pb.PosterChangeType_POSTER_REMOVED, &pb.Poster{Party: 1, Posterid: 11, Removed: true}, 8)
+	columns := []string{"eventId", "payload", "attempts", "handled"}
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+		// the second subscriber fails on the event with this seq
+		failSeq int64
+		expect  func(mock sqlmock.Sqlmock)
+		wantN   int
+		wantErr bool
+		// subscriber/seq of each event given to a subscriber
+		wantReceived []string
+	}{
+		{
+			name: "events are published in order",
+			rows: sqlmock.NewRows(columns).AddRow(1, placed, 0, 0).AddRow(2, removed, 0, 0),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("update fyp_schema.outboxEvents set dispatched").WithArgs("", int64(3), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("update fyp_schema.outboxEvents set dispatched").WithArgs("", int64(3), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantN:        2,
+			wantReceived: []string{"0/7", "1/7", "0/8", "1/8"},
+		},
+		{
+			name:    "later events are published past a failing event",
+			rows:    sqlmock.NewRows(columns).AddRow(1, placed, 3, 0).AddRow(2, removed, 0, 0),
+			failSeq: 7,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("update fyp_schema.outboxEvents set attempts").WithArgs("subscriber failed", int64(1), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("update fyp_schema.outboxEvents set dispatched").WithArgs("", int64(3), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantN:        1,
+			wantErr:      true,
+			wantReceived: []string{"0/7", "1/7", "0/8", "1/8"},
+		},
+		{
+			name: "subscribers that handled an event are not given it again",
+			rows: sqlmock.NewRows(columns).AddRow(1, placed, 1, 1),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("update fyp_schema.outboxEvents set dispatched").WithArgs("", int64(3), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantN:        1,
+			wantReceived: []string{"1/7"},
+		},
+		{
+			name:    "events are given up on after too many attempts",
+			rows:    sqlmock.NewRows(columns).AddRow(1, placed, maxOutboxAttempts-1, 1),
+			failSeq: 7,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("update fyp_schema.outboxEvents set dispatched").WithArgs("subscriber failed", int64(1), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantN:        1,
+			wantReceived: []string{"1/7"},
+		},
+		{
+			name: "unreadable events are retried",
+			rows: sqlmock.NewRows(columns).AddRow(1, "{", 0, 0),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("update fyp_schema.outboxEvents set attempts").WithArgs(sqlmock.AnyArg(), int64(0), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			var received []string
+			subscriber := func(i int) outboxSubscriber {
+				return func(_ context.Context, event domainEvent) error {
+					received = append(received, fmt.Sprintf("%d/%d", i, event.Seq))
+					if i == 1 && event.Seq == tc.failSeq {
+						return fmt.Errorf("subscriber failed")
+					}
+					return nil
+				}
+			}
+			o := newOutboxDispatcher(db, subscriber(0), subscriber(1))
+			mock.ExpectQuery("select eventId, payload, attempts, handled").WithArgs(outboxBatchSize).WillReturnRows(tc.rows)
+			tc.expect(mock)
+
+			n, err := o.dispatchPending(context.Background())
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if n != tc.wantN {
+				t.Fatalf("dispatched %d events want %d", n, tc.wantN)
+			}
+			if fmt.Sprint(received) != fmt.Sprint(tc.wantReceived) {
+				t.Fatalf("subscribers received %v want %v", received, tc.wantReceived)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestHubHandleEvent(t *testing.T) {
+	hub := newPosterHub()
+	sub := hub.subscribe(1)
+	var event domainEvent
+	payload := testOutboxPayload(t, pb.PosterChangeType_POSTER_MOVED, &pb.Poster{PlacedBy: 2, Party: 1, Posterid: 11, Location: &pb.Location{Lat: 53.3, Lng: -6.2}}, 9)
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		t.Fatalf("failed to decode event: %v", err)
+	}
+	if err := hub.handleEvent(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := hub.handleEvent(context.Background(), domainEvent{Kind: eventJoinRequested, PartyId: 1, Member: &webhookMember{UserId: 3}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sub.events) != 1 {
+		t.Fatalf("got %d events want 1", len(sub.events))
+	}
+	got := <-sub.events
+	if got.event.Type != pb.PosterChangeType_POSTER_MOVED || got.position != (changeCursor{partyId: 1, seq: 9, posterId: 11}) ||
+		got.event.Poster.GetLocation().GetLat() != 53.3 || got.event.Poster.GetPlacedBy() != 2 {
+		t.Fatalf("got event %v at %v", got.event, got.position)
+	}
+}
+
+func TestWebhookHandleEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	w := newWebhookDispatcher(db, nil)
+	moved, err := posterChangedEvent(pb.PosterChangeType_POSTER_MOVED, &pb.Poster{Party: 1, Posterid: 11}, 9)
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+	occurred := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	approved := memberEvent(eventMemberApproved, 1, &pb.Member{UserId: 3, FirstName: "john", LastName: "murphy"})
+	approved.Occurred = occurred
+	// moves are not sent to webhooks, approvals are sent as member.joined
+	mock.ExpectExec("insert into fyp_schema.webhookDeliveries").
+		WithArgs(int32(pb.WebhookEvent_WEBHOOK_MEMBER_JOINED),
+			`{"event":"member.joined","partyId":1,"occurred":"2024-06-10T12:00:00Z","member":{"userId":3,"firstName":"john","lastName":"murphy"}}`,
+			int32(1), int32(pb.WebhookEvent_WEBHOOK_MEMBER_JOINED)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, event := range []domainEvent{moved, approved} {
+		if err = w.handleEvent(context.Background(), event); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
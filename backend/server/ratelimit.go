@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// number of clients remembered. Old entries are swept out once it is reached, and it is never exceeded.
+var maxRateLimitKeys = 10000
+
+// rateLimiter allows each key a number of requests in a sliding window of time.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+	now    func() time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time), now: time.Now}
+}
+
+// recent drops the hits that are outside the window.
+func (l *rateLimiter) recent(hits []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= l.window {
+		i++
+	}
+	return hits[i:]
+}
+
+// allow records a request for key and reports whether it is within the limit. A nil limiter allows everything.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if len(l.hits) >= maxRateLimitKeys {
+		for k, hits := range l.hits {
+			if hits = l.recent(hits, now); len(hits) == 0 {
+				delete(l.hits, k)
+			} else {
+				l.hits[k] = hits
+			}
+		}
+		// if every client is still active, the one seen longest ago is forgotten to make room for a new one
+		if _, known := l.hits[key]; !known && len(l.hits) >= maxRateLimitKeys {
+			// the sweep left only keys with hits in the window, so none of them are empty
+			var oldest string
+			var oldestAt time.Time
+			for k, hits := range l.hits {
+				if last := hits[len(hits)-1]; oldestAt.IsZero() || last.Before(oldestAt) {
+					oldest, oldestAt = k, last
+				}
+			}
+			delete(l.hits, oldest)
+		}
+	}
+	hits := l.recent(l.hits[key], now)
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false
+	}
+	l.hits[key] = append(hits, now)
+	return true
+}
+
+// clientAddress returns the IP address a request came from, used to rate limit unauthenticated RPCs.
+func clientAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
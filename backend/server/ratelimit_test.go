@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	if !limiter.allow("a") || !limiter.allow("a") {
+		t.Fatalf("first two requests should be allowed")
+	}
+	if limiter.allow("a") {
+		t.Fatalf("third request in the window should not be allowed")
+	}
+	if !limiter.allow("b") {
+		t.Fatalf("other clients should not be limited")
+	}
+	now = now.Add(time.Minute)
+	if !limiter.allow("a") {
+		t.Fatalf("requests should be allowed once the window has passed")
+	}
+
+	var nilLimiter *rateLimiter
+	if !nilLimiter.allow("a") {
+		t.Fatalf("nil limiter should allow everything")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	defer func(n int) { maxRateLimitKeys = n }(maxRateLimitKeys)
+	maxRateLimitKeys = 2
+
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(1, time.Minute)
+	limiter.now = func() time.Time { return now }
+	limiter.allow("a")
+	limiter.allow("b")
+	now = now.Add(time.Minute)
+	limiter.allow("c")
+	if len(limiter.hits) != 1 {
+		t.Fatalf("expired clients should be swept out, got %v", limiter.hits)
+	}
+}
+
+func TestRateLimiterCap(t *testing.T) {
+	defer func(n int) { maxRateLimitKeys = n }(maxRateLimitKeys)
+	maxRateLimitKeys = 2
+
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(1, time.Minute)
+	limiter.now = func() time.Time { return now }
+	limiter.allow("a")
+	now = now.Add(time.Second)
+	limiter.allow("b")
+	now = now.Add(time.Second)
+	// nothing has expired so the sweep frees nothing
+	if !limiter.allow("c") {
+		t.Fatalf("new clients should be allowed when the limiter is full")
+	}
+	if len(limiter.hits) != 2 {
+		t.Fatalf("limiter should not remember more than %d clients, got %v", maxRateLimitKeys, limiter.hits)
+	}
+	if _, ok := limiter.hits["a"]; ok {
+		t.Fatalf("the client seen longest ago should be forgotten, got %v", limiter.hits)
+	}
+	// known clients are still limited when the limiter is full
+	if limiter.allow("b") {
+		t.Fatalf("b should still be limited")
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 51234}})
+	if got := clientAddress(ctx); got != "10.0.0.7" {
+		t.Fatalf("got address %q", got)
+	}
+	if got := clientAddress(context.Background()); got != "" {
+		t.Fatalf("got address %q for context without a peer", got)
+	}
+}
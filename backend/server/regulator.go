@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	defaultRegulatorLimit = 500
+	maxRegulatorLimit     = 5000
+	regulatorLoginQuery   = `select l1.regulatorId, l1.pwhash, l2.name from fyp_schema.regulators as l1
+							join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							where l1.username = ?`
+	insertRegulatorQuery = "insert into fyp_schema.regulators (username, pwhash, jurisdictionId) values (?,?,?)"
+	// posters anywhere inside the regulators area are included, even if a smaller jurisdiction inside it has its own rules.
+	// only the party name is selected so nothing about members is shared
+	regulatorPostersQuery = fmt.Sprintf(`select l1.posterID, l4.partyName, st_y(l1.location), st_x(l1.location), unix_timestamp(l1.created), l1.removed is not null,
+							unix_timestamp(%[1]s), coalesce(%[2]s, false) as overdue
+							from fyp_schema.regulators as r
+							join fyp_schema.jurisdictions as area on r.jurisdictionId = area.jurisdictionId
+							join fyp_schema.posters as l1 on ST_Contains(area.area, l1.location)
+							join fyp_schema.parties as l4 on l1.partyId = l4.partyID
+							left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+							left join fyp_schema.elections as l3 on l1.partyId = l3.partyId and l3.closed is null
+							where r.regulatorId = ?%%s
+							order by overdue desc, %[1]s is null, %[1]s, l1.posterID
+							limit ?`, posterDeadlineExpression, posterOverdueCondition)
+)
+
+// verifyRegulatorClaims checks that a token belongs to the regulator it is being used for.
+// party members have no regulatorId so their tokens never match.
+func verifyRegulatorClaims(claims *tokenService.UserClaims, regulatorId int32) bool {
+	return claims.RegulatorId != 0 && claims.RegulatorId == regulatorId
+}
+
+// createRegulator is used by site operators to give a local authority officer an account.
+func createRegulator(db *sql.DB, username, password string, jurisdictionId int) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("username and password must be set")
+	}
+	pwhash, err := hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(insertRegulatorQuery, username, pwhash, jurisdictionId)
+	return err
+}
+
+// RegulatorLogin logs in a local authority officer. The token it returns can only be used with the Regulator RPCs.
+func (s *server) RegulatorLogin(ctx context.Context, in *pb.RegulatorLoginRequest) (*pb.RegulatorLoginResponse, error) {
+	if in.GetUsername() == "" {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("username not supplied")
+	}
+	if in.GetPassword() == "" {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("password not supplied")
+	}
+	rows, err := s.DB.Query(regulatorLoginQuery, in.GetUsername())
+	if err != nil {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query database for username %v. err: %v", in.GetUsername(), err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to login")
+	}
+	var regulatorId int32
+	var pwhash, jurisdiction string
+	if err = rows.Scan(&regulatorId, &pwhash, &jurisdiction); err != nil {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to scan sql result: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(pwhash), []byte(in.GetPassword())); err != nil {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to login")
+	}
+
+	claims := tokenService.UserClaims{
+		Username:    in.GetUsername(),
+		RegulatorId: regulatorId,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+		},
+	}
+	accessToken, err := tokenService.NewAccessToken(claims)
+	if err != nil {
+		return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create access token %v", err)
+	}
+	return &pb.RegulatorLoginResponse{Code: pb.ResponseCode_OK, AuthKey: accessToken, RegulatorId: regulatorId, Jurisdiction: jurisdiction}, nil
+}
+
+// RegulatorPosters returns the posters of every party inside a regulators jurisdiction with their removal deadlines.
+func (s *server) RegulatorPosters(ctx context.Context, in *pb.RegulatorPostersRequest) (*pb.RegulatorPostersResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetRegulatorId() == 0 {
+		return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("regulatorId not set")
+	}
+	limit := int(in.GetLimit())
+	if limit < 0 || limit > maxRegulatorLimit {
+		return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("limit must be between 1 and %d", maxRegulatorLimit)
+	}
+	if limit == 0 {
+		limit = defaultRegulatorLimit
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyRegulatorClaims(userClaims, in.GetRegulatorId()) {
+		return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	filters := posterStatusClause(in.GetStatus())
+	if in.GetOverdueOnly() {
+		filters += " and " + posterOverdueCondition
+	}
+	// ask for one more poster than the limit so we know if the result was truncated
+	rows, err := s.DB.Query(fmt.Sprintf(regulatorPostersQuery, filters), in.GetRegulatorId(), limit+1)
+	if err != nil {
+		return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query posters: %v", err)
+	}
+	defer rows.Close()
+
+	var posters []*pb.RegulatedPoster
+	truncated := false
+	for rows.Next() {
+		if len(posters) == limit {
+			truncated = true
+			break
+		}
+		poster := &pb.RegulatedPoster{Location: &pb.Location{}}
+		var placed int64
+		var deadline sql.NullInt64
+		err = rows.Scan(&poster.PosterId, &poster.Party, &poster.Location.Lat, &poster.Location.Lng, &placed, &poster.Removed, &deadline, &poster.Overdue)
+		if err != nil {
+			return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read posters from sql result: %v", err)
+		}
+		poster.Placed = timestamppb.New(time.Unix(placed, 0))
+		if deadline.Valid {
+			poster.RemovalDeadline = timestamppb.New(time.Unix(deadline.Int64, 0))
+		}
+		posters = append(posters, poster)
+	}
+	return &pb.RegulatorPostersResponse{Code: pb.ResponseCode_OK, Posters: posters, Truncated: truncated}, nil
+}
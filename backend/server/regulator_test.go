@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+	"golang.org/x/crypto/bcrypt"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func regulatorAuthKey(t *testing.T, regulatorId int32) string {
+	authKey, err := tokenService.NewAccessToken(tokenService.UserClaims{
+		Username:    "regulator",
+		RegulatorId: regulatorId,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create jwt: %v", err)
+	}
+	return authKey
+}
+
+func TestRegulatorLogin(t *testing.T) {
+	pwhash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	tests := []struct {
+		name      string
+		username  string
+		password  string
+		loginRows *sqlmock.Rows
+		wantErr   bool
+		wantCode  pb.ResponseCode
+	}{
+		{
+			name:     "password not set",
+			username: "council",
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "username does not exist",
+			username:  "council",
+			password:  "password",
+			loginRows: sqlmock.NewRows([]string{"regulatorId", "pwhash", "name"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "wrong password",
+			username:  "council",
+			password:  "wrong",
+			loginRows: sqlmock.NewRows([]string{"regulatorId", "pwhash", "name"}).AddRow(3, string(pwhash), "dublin city"),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "success",
+			username:  "council",
+			password:  "password",
+			loginRows: sqlmock.NewRows([]string{"regulatorId", "pwhash", "name"}).AddRow(3, string(pwhash), "dublin city"),
+			wantCode:  pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.loginRows != nil {
+				mock.ExpectQuery("select l1.regulatorId").WithArgs(tc.username).WillReturnRows(tc.loginRows)
+			}
+
+			res, err := server.RegulatorLogin(ctx, &pb.RegulatorLoginRequest{Username: tc.username, Password: tc.password})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if tc.wantErr {
+				return
+			}
+			claims := tokenService.ParseAccessToken(res.AuthKey)
+			// the token must not work for any party
+			if claims == nil || claims.RegulatorId != 3 || claims.UserID != 0 || claims.PartyId != 0 || res.Jurisdiction != "dublin city" {
+				t.Fatalf("got claims %v and response %v", claims, res)
+			}
+		})
+	}
+}
+
+func TestRegulatorPosters(t *testing.T) {
+	columns := []string{"posterID", "partyName", "latitude", "longitude", "created", "removed", "deadline", "overdue"}
+	tests := []struct {
+		name          string
+		authKey       string
+		regulatorId   int32
+		limit         int32
+		posterRows    *sqlmock.Rows
+		wantErr       bool
+		wantCode      pb.ResponseCode
+		wantPosters   int
+		wantTruncated bool
+	}{
+		{
+			name:        "party member token",
+			authKey:     testAuthKey(t, 1, 1),
+			regulatorId: 1,
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "other regulators id",
+			authKey:     regulatorAuthKey(t, 2),
+			regulatorId: 1,
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "limit too high",
+			authKey:     regulatorAuthKey(t, 1),
+			regulatorId: 1,
+			limit:       5001,
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "success",
+			authKey:     regulatorAuthKey(t, 1),
+			regulatorId: 1,
+			posterRows: sqlmock.NewRows(columns).
+				AddRow(4, "party a", 53.35, -6.26, 1700000000, false, 1700500000, true).
+				AddRow(9, "party b", 53.36, -6.25, 1700000000, false, nil, false),
+			wantCode:    pb.ResponseCode_OK,
+			wantPosters: 2,
+		},
+		{
+			name:        "truncated",
+			authKey:     regulatorAuthKey(t, 1),
+			regulatorId: 1,
+			limit:       1,
+			posterRows: sqlmock.NewRows(columns).
+				AddRow(4, "party a", 53.35, -6.26, 1700000000, false, 1700500000, true).
+				AddRow(9, "party b", 53.36, -6.25, 1700000000, false, nil, false),
+			wantCode:      pb.ResponseCode_OK,
+			wantPosters:   1,
+			wantTruncated: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.posterRows != nil {
+				mock.ExpectQuery("select l1.posterID, l4.partyName").WithArgs(tc.regulatorId, sqlmock.AnyArg()).WillReturnRows(tc.posterRows)
+			}
+
+			res, err := server.RegulatorPosters(ctx, &pb.RegulatorPostersRequest{AuthKey: tc.authKey, RegulatorId: tc.regulatorId, Limit: tc.limit})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Posters) != tc.wantPosters || res.Truncated != tc.wantTruncated {
+				t.Fatalf("got %d posters truncated %v", len(res.Posters), res.Truncated)
+			}
+			if tc.wantPosters == 2 {
+				if !res.Posters[0].Overdue || res.Posters[0].RemovalDeadline.AsTime().Unix() != 1700500000 || res.Posters[0].Party != "party a" {
+					t.Fatalf("got poster %v", res.Posters[0])
+				}
+				if res.Posters[1].RemovalDeadline != nil {
+					t.Fatalf("poster of a party without an election should have no deadline: %v", res.Posters[1])
+				}
+			}
+		})
+	}
+}
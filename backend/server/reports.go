@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// each address can send this many reports in reportWindow
+	reportsPerWindow = 5
+	reportWindow     = 10 * time.Minute
+	// reports further than this from every poster are kept but not given to a party
+	reportMatchDistance  = 50.0
+	maxReportPhotoSize   = 2 << 20
+	maxReportDescription = 2000
+	reportPhotoTypes     = map[string]bool{"image/jpeg": true, "image/png": true}
+
+	nearestUnremovedPosterQuery = `select posterID, partyId, ST_Distance_Sphere(location, point(?,?)) as distance
+									from fyp_schema.posters
+									where removed is null and MBRContains(ST_MakeEnvelope(point(?,?), point(?,?)), location)
+									having distance <= ?
+									order by distance
+									limit 1`
+	insertReportQuery = `insert into fyp_schema.posterReports (statusTokenHash, location, description, photo, photoType, posterId, partyId, distance)
+						values (?,point(?,?),?,?,?,?,?,?)`
+	lookupReportQuery = `select unix_timestamp(l1.reported), l1.posterId, unix_timestamp(l1.dismissed), unix_timestamp(l2.removed)
+						from fyp_schema.posterReports as l1
+						left join fyp_schema.posters as l2 on l1.posterId = l2.posterID
+						where l1.statusTokenHash = ?`
+	partyReportsQuery = `select l1.reportId, l1.posterId, st_y(l1.location), st_x(l1.location), l1.description, l1.photo is not null,
+						unix_timestamp(l1.reported), l1.distance, unix_timestamp(l1.dismissed), unix_timestamp(l2.removed)
+						from fyp_schema.posterReports as l1
+						join fyp_schema.posters as l2 on l1.posterId = l2.posterID
+						where l1.partyId = ?%s
+						order by l1.reported, l1.reportId`
+	openReportsClause  = " and l1.dismissed is null and l2.removed is null"
+	reportPhotoQuery   = "select photo, photoType from fyp_schema.posterReports where reportId = ? and partyId = ? and photo is not null"
+	dismissReportQuery = "update fyp_schema.posterReports set dismissed = now(), dismissedBy = ?, dismissReason = ? where reportId = ? and partyId = ? and dismissed is null"
+)
+
+// reportStatus works out where a report is up to. resolved is when the poster was removed or the report dismissed.
+func reportStatus(posterId sql.NullInt32, dismissed, removed sql.NullInt64) (status pb.ReportStatus, resolved sql.NullInt64) {
+	switch {
+	case dismissed.Valid:
+		return pb.ReportStatus_REPORT_DISMISSED, dismissed
+	case removed.Valid:
+		return pb.ReportStatus_REPORT_POSTER_REMOVED, removed
+	case !posterId.Valid:
+		return pb.ReportStatus_REPORT_UNMATCHED, sql.NullInt64{}
+	}
+	return pb.ReportStatus_REPORT_OPEN, sql.NullInt64{}
+}
+
+func hashStatusToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newStatusToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ReportPoster lets members of the public report a poster that should not be up. The report is given to the party
+// whose poster is closest to the reported location.
+func (s *server) ReportPoster(ctx context.Context, in *pb.ReportPosterRequest) (*pb.ReportPosterResponse, error) {
+	if in.GetLocation() == nil {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("location not set")
+	}
+	location := geoService.Point{Lat: in.GetLocation().GetLat(), Lng: in.GetLocation().GetLng()}
+	if !location.Valid() {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("location is not a valid coordinate")
+	}
+	if in.GetDescription() == "" {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("description not set")
+	}
+	if len(in.GetDescription()) > maxReportDescription {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("description can not be longer than %d characters", maxReportDescription)
+	}
+	// left nil rather than an empty []byte so reports without a photo store null
+	var photo interface{}
+	var photoType string
+	if len(in.GetPhoto()) > 0 {
+		if len(in.GetPhoto()) > maxReportPhotoSize {
+			return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("photo can not be bigger than %dMB", maxReportPhotoSize>>20)
+		}
+		photo, photoType = in.GetPhoto(), http.DetectContentType(in.GetPhoto())
+		if !reportPhotoTypes[photoType] {
+			return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("photo must be a jpeg or png")
+		}
+	}
+	if !s.reportLimiter.allow(clientAddress(ctx)) {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("too many reports, please try again later")
+	}
+
+	sw, ne := geoService.Envelope(location, reportMatchDistance)
+	rows, err := s.DB.Query(nearestUnremovedPosterQuery, location.Lng, location.Lat, sw.Lng, sw.Lat, ne.Lng, ne.Lat, reportMatchDistance)
+	if err != nil {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to find reported poster: %v", err)
+	}
+	var posterId, partyId sql.NullInt32
+	var distance sql.NullFloat64
+	if rows.Next() {
+		if err = rows.Scan(&posterId, &partyId, &distance); err != nil {
+			_ = rows.Close()
+			return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read reported poster: %v", err)
+		}
+	}
+	_ = rows.Close()
+
+	token, err := newStatusToken()
+	if err != nil {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create status token: %v", err)
+	}
+	_, err = s.DB.Exec(insertReportQuery, hashStatusToken(token), location.Lng, location.Lat, in.GetDescription(), photo, photoType, posterId, partyId, distance)
+	if err != nil {
+		return &pb.ReportPosterResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save report: %v", err)
+	}
+	status, _ := reportStatus(posterId, sql.NullInt64{}, sql.NullInt64{})
+	return &pb.ReportPosterResponse{Code: pb.ResponseCode_OK, StatusToken: token, Status: status}, nil
+}
+
+// LookupReport lets a reporter see whether their report has been dealt with.
+func (s *server) LookupReport(ctx context.Context, in *pb.LookupReportRequest) (*pb.LookupReportResponse, error) {
+	if in.GetStatusToken() == "" {
+		return &pb.LookupReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("statusToken not set")
+	}
+	rows, err := s.DB.Query(lookupReportQuery, hashStatusToken(in.GetStatusToken()))
+	if err != nil {
+		return &pb.LookupReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query report: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return &pb.LookupReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("report does not exist")
+	}
+	var reported int64
+	var posterId sql.NullInt32
+	var dismissed, removed sql.NullInt64
+	if err = rows.Scan(&reported, &posterId, &dismissed, &removed); err != nil {
+		return &pb.LookupReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read report: %v", err)
+	}
+	status, resolved := reportStatus(posterId, dismissed, removed)
+	res := &pb.LookupReportResponse{Code: pb.ResponseCode_OK, Status: status, Reported: timestamppb.New(time.Unix(reported, 0))}
+	if resolved.Valid {
+		res.Resolved = timestamppb.New(time.Unix(resolved.Int64, 0))
+	}
+	return res, nil
+}
+
+// PosterReports returns the public reports about a party's posters, the party's queue of posters to deal with.
+func (s *server) PosterReports(ctx context.Context, in *pb.PosterReportsRequest) (*pb.PosterReportsResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	filter := openReportsClause
+	if in.GetIncludeResolved() {
+		filter = ""
+	}
+	rows, err := s.DB.Query(fmt.Sprintf(partyReportsQuery, filter), in.GetPartyId())
+	if err != nil {
+		return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query reports: %v", err)
+	}
+	defer rows.Close()
+	var reports []*pb.PosterReport
+	for rows.Next() {
+		report := &pb.PosterReport{Location: &pb.Location{}}
+		var posterId sql.NullInt32
+		var reported int64
+		var dismissed, removed sql.NullInt64
+		err = rows.Scan(&report.ReportId, &posterId, &report.Location.Lat, &report.Location.Lng, &report.Description, &report.HasPhoto,
+			&reported, &report.Distance, &dismissed, &removed)
+		if err != nil {
+			return &pb.PosterReportsResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read reports: %v", err)
+		}
+		report.PosterId = posterId.Int32
+		report.Reported = timestamppb.New(time.Unix(reported, 0))
+		report.Status, _ = reportStatus(posterId, dismissed, removed)
+		reports = append(reports, report)
+	}
+	return &pb.PosterReportsResponse{Code: pb.ResponseCode_OK, Reports: reports}, nil
+}
+
+// ReportPhoto returns the photo sent with a report.
+func (s *server) ReportPhoto(ctx context.Context, in *pb.ReportPhotoRequest) (*pb.ReportPhotoResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetReportId() == 0 {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("reportId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+	rows, err := s.DB.Query(reportPhotoQuery, in.GetReportId(), in.GetPartyId())
+	if err != nil {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query report photo: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("report does not have a photo")
+	}
+	res := &pb.ReportPhotoResponse{Code: pb.ResponseCode_OK}
+	if err = rows.Scan(&res.Photo, &res.ContentType); err != nil {
+		return &pb.ReportPhotoResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read report photo: %v", err)
+	}
+	return res, nil
+}
+
+// DismissReport closes a report without removing the poster, e.g. when the poster is allowed to be there.
+func (s *server) DismissReport(ctx context.Context, in *pb.DismissReportRequest) (*pb.DismissReportResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetReportId() == 0 {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("reportId not set")
+	}
+	if in.GetReason() == "" {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("reason not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can dismiss reports")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	res, err := tx.Exec(dismissReportQuery, in.GetUserId(), in.GetReason(), in.GetReportId(), in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to dismiss report: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("report does not exist or was already dismissed")
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_REPORT_DISMISSED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		before:  reportAudit{ReportId: in.GetReportId()},
+		after:   reportAudit{ReportId: in.GetReportId(), DismissReason: in.GetReason()},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record dismissing report: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.DismissReportResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to dismiss report: %v", err)
+	}
+	return &pb.DismissReportResponse{Code: pb.ResponseCode_OK}, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/peer"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestReportStatus(t *testing.T) {
+	poster := sql.NullInt32{Int32: 4, Valid: true}
+	at := sql.NullInt64{Int64: 1700000000, Valid: true}
+	tests := []struct {
+		name         string
+		posterId     sql.NullInt32
+		dismissed    sql.NullInt64
+		removed      sql.NullInt64
+		wantStatus   pb.ReportStatus
+		wantResolved sql.NullInt64
+	}{
+		{name: "open", posterId: poster, wantStatus: pb.ReportStatus_REPORT_OPEN},
+		{name: "no poster nearby", wantStatus: pb.ReportStatus_REPORT_UNMATCHED},
+		{name: "poster removed", posterId: poster, removed: at, wantStatus: pb.ReportStatus_REPORT_POSTER_REMOVED, wantResolved: at},
+		{name: "dismissed", posterId: poster, dismissed: at, removed: sql.NullInt64{Int64: 1800000000, Valid: true}, wantStatus: pb.ReportStatus_REPORT_DISMISSED, wantResolved: at},
+	}
+
+	for _, tc := range tests {
+		status, resolved := reportStatus(tc.posterId, tc.dismissed, tc.removed)
+		if status != tc.wantStatus || resolved != tc.wantResolved {
+			t.Fatalf("%s: got status %v resolved %v", tc.name, status, resolved)
+		}
+	}
+}
+
+func TestReportPoster(t *testing.T) {
+	location := &pb.Location{Lat: 53.35, Lng: -6.26}
+	png := append([]byte("\x89PNG\x0d\x0a\x1a\x0a"), make([]byte, 16)...)
+	tests := []struct {
+		name        string
+		location    *pb.Location
+		description string
+		photo       []byte
+		rateLimited bool
+		posterRows  *sqlmock.Rows
+		wantPhoto   interface{}
+		wantErr     bool
+		wantCode    pb.ResponseCode
+		wantStatus  pb.ReportStatus
+	}{
+		{
+			name:        "location not set",
+			description: "left up after the election",
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "description not set",
+			location: location,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "photo is not an image",
+			location:    location,
+			description: "left up after the election",
+			photo:       []byte("not an image"),
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "too many reports",
+			location:    location,
+			description: "left up after the election",
+			rateLimited: true,
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "matched to poster",
+			location:    location,
+			description: "left up after the election",
+			photo:       png,
+			posterRows:  sqlmock.NewRows([]string{"posterID", "partyId", "distance"}).AddRow(4, 2, 12.5),
+			wantPhoto:   png,
+			wantCode:    pb.ResponseCode_OK,
+			wantStatus:  pb.ReportStatus_REPORT_OPEN,
+		},
+		{
+			name:        "no poster nearby",
+			location:    location,
+			description: "left up after the election",
+			posterRows:  sqlmock.NewRows([]string{"posterID", "partyId", "distance"}),
+			wantCode:    pb.ResponseCode_OK,
+			wantStatus:  pb.ReportStatus_REPORT_UNMATCHED,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 51234}})
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db, reportLimiter: newRateLimiter(1, time.Minute)}
+			if tc.rateLimited {
+				server.reportLimiter.allow("10.0.0.7")
+			}
+			if tc.posterRows != nil {
+				mock.ExpectQuery("select posterID, partyId").WithArgs(-6.26, 53.35, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), reportMatchDistance).
+					WillReturnRows(tc.posterRows)
+				photoType := ""
+				if tc.wantPhoto != nil {
+					photoType = "image/png"
+				}
+				mock.ExpectExec("insert into fyp_schema.posterReports").
+					WithArgs(sqlmock.AnyArg(), -6.26, 53.35, tc.description, tc.wantPhoto, photoType, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			res, err := server.ReportPoster(ctx, &pb.ReportPosterRequest{Location: tc.location, Description: tc.description, Photo: tc.photo})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if res.Status != tc.wantStatus {
+				t.Fatalf("got status %v want %v", res.Status, tc.wantStatus)
+			}
+			if !tc.wantErr && res.StatusToken == "" {
+				t.Fatalf("status token not returned")
+			}
+			if !tc.wantErr {
+				if err = mock.ExpectationsWereMet(); err != nil {
+					t.Fatalf("report was not saved: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupReport(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	// only the hash of the token is stored
+	mock.ExpectQuery("select unix_timestamp").WithArgs(hashStatusToken("token")).
+		WillReturnRows(sqlmock.NewRows([]string{"reported", "posterId", "dismissed", "removed"}).AddRow(1700000000, 4, nil, 1700090000))
+
+	res, err := server.LookupReport(context.Background(), &pb.LookupReportRequest{StatusToken: "token"})
+	if err != nil {
+		t.Fatalf("failed to look up report: %v", err)
+	}
+	if res.Status != pb.ReportStatus_REPORT_POSTER_REMOVED || res.Resolved.AsTime().Unix() != 1700090000 || res.Reported.AsTime().Unix() != 1700000000 {
+		t.Fatalf("got response %v", res)
+	}
+
+	mock.ExpectQuery("select unix_timestamp").WithArgs(hashStatusToken("unknown")).
+		WillReturnRows(sqlmock.NewRows([]string{"reported", "posterId", "dismissed", "removed"}))
+	if _, err = server.LookupReport(context.Background(), &pb.LookupReportRequest{StatusToken: "unknown"}); err == nil {
+		t.Fatalf("expected error for unknown token")
+	}
+}
+
+func TestPosterReports(t *testing.T) {
+	columns := []string{"reportId", "posterId", "latitude", "longitude", "description", "hasPhoto", "reported", "distance", "dismissed", "removed"}
+	tests := []struct {
+		name            string
+		userId          int32
+		partyId         int32
+		includeResolved bool
+		reportRows      *sqlmock.Rows
+		wantErr         bool
+		wantStatuses    []pb.ReportStatus
+	}{
+		{
+			name:    "partyId not set",
+			userId:  1,
+			wantErr: true,
+		},
+		{
+			name:         "open reports",
+			userId:       1,
+			partyId:      1,
+			reportRows:   sqlmock.NewRows(columns).AddRow(1, 4, 53.35, -6.26, "left up", true, 1700000000, 12.5, nil, nil),
+			wantStatuses: []pb.ReportStatus{pb.ReportStatus_REPORT_OPEN},
+		},
+		{
+			name:            "include resolved",
+			userId:          1,
+			partyId:         1,
+			includeResolved: true,
+			reportRows: sqlmock.NewRows(columns).
+				AddRow(1, 4, 53.35, -6.26, "left up", true, 1700000000, 12.5, nil, nil).
+				AddRow(2, 5, 53.35, -6.26, "blocking the footpath", false, 1700000000, 3, 1700050000, nil),
+			wantStatuses: []pb.ReportStatus{pb.ReportStatus_REPORT_OPEN, pb.ReportStatus_REPORT_DISMISSED},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.reportRows != nil {
+				mock.ExpectQuery("select l1.reportId").WithArgs(tc.partyId).WillReturnRows(tc.reportRows)
+			}
+
+			res, err := server.PosterReports(context.Background(), &pb.PosterReportsRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: testAuthKey(t, tc.userId, tc.partyId),
+				IncludeResolved: tc.includeResolved})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if len(res.Reports) != len(tc.wantStatuses) {
+				t.Fatalf("got reports %v", res.Reports)
+			}
+			for i, status := range tc.wantStatuses {
+				if res.Reports[i].Status != status {
+					t.Fatalf("got report %v want status %v", res.Reports[i], status)
+				}
+			}
+		})
+	}
+}
+
+func TestDismissReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		reason    string
+		adminRows *sqlmock.Rows
+		affected  int64
+		wantErr   bool
+		wantCode  pb.ResponseCode
+	}{
+		{
+			name:      "reason not set",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "user is not admin of party",
+			reason:    "poster has a permit",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "already dismissed",
+			reason:    "poster has a permit",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "success",
+			reason:    "poster has a permit",
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			affected:  1,
+			wantCode:  pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(int32(1), int32(1)).WillReturnRows(tc.adminRows)
+			mock.ExpectBegin()
+			mock.ExpectExec("update fyp_schema.posterReports").WithArgs(int32(1), tc.reason, int32(3), int32(1)).WillReturnResult(sqlmock.NewResult(0, tc.affected))
+			if tc.affected == 0 {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_REPORT_DISMISSED), int32(1), int32(1), int32(0), "", `{"reportId":3}`, `{"reportId":3,"dismissReason":"poster has a permit"}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			res, err := server.DismissReport(context.Background(), &pb.DismissReportRequest{UserId: 1, PartyId: 1, AuthKey: testAuthKey(t, 1, 1), ReportId: 3, Reason: tc.reason})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	// planning a route takes time proportional to the square of the number of posters
+	maxRouteStops = 500
+	// in metres per second
+	defaultRouteSpeed = 1.4
+	// time it takes to take down a poster once the crew gets to it
+	routeStopDuration = 2 * time.Minute
+	routePostersQuery = `select posterID, partyId, userID, st_y(location) as latitude, st_x(location) as longitude
+						from fyp_schema.posters
+						where partyId = ? and removed is null%s
+						order by posterID
+						limit ?`
+)
+
+// posterIdsClause returns a condition that limits a query to the given posters and the arguments it needs.
+func posterIdsClause(posterIds []int32) (string, []interface{}) {
+	if len(posterIds) == 0 {
+		return "", nil
+	}
+	args := make([]interface{}, len(posterIds))
+	for i, id := range posterIds {
+		args[i] = id
+	}
+	return " and posterID in (?" + strings.Repeat(",?", len(posterIds)-1) + ")", args
+}
+
+// PlanRemovalRoute orders a partys outstanding posters into a route for a removal crew to follow.
+func (s *server) PlanRemovalRoute(ctx context.Context, in *pb.RemovalRouteRequest) (*pb.RemovalRouteResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetStart() == nil {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("start location not set")
+	}
+	start := geoService.Point{Lat: in.GetStart().GetLat(), Lng: in.GetStart().GetLng()}
+	if !start.Valid() {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("start location is not a valid coordinate")
+	}
+	if len(in.GetPosterIds()) > maxRouteStops {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("a route can have at most %d posters", maxRouteStops)
+	}
+	if in.GetMaxDistance() < 0 {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("maxDistance can not be negative")
+	}
+	speed := in.GetSpeed()
+	if speed < 0 {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("speed can not be negative")
+	}
+	if speed == 0 {
+		speed = defaultRouteSpeed
+	}
+
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	clause, idArgs := posterIdsClause(in.GetPosterIds())
+	args := append([]interface{}{in.GetPartyId()}, idArgs...)
+	args = append(args, maxRouteStops+1)
+	rows, err := s.DB.Query(fmt.Sprintf(routePostersQuery, clause), args...)
+	if err != nil {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query outstanding posters: %v", err)
+	}
+	defer rows.Close()
+	var posters []*pb.Poster
+	var stops []geoService.Point
+	for rows.Next() {
+		if len(posters) == maxRouteStops {
+			return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("party has more than %d outstanding posters, choose which posters to visit", maxRouteStops)
+		}
+		poster := &pb.Poster{Location: &pb.Location{}}
+		err = rows.Scan(&poster.Posterid, &poster.Party, &poster.PlacedBy, &poster.Location.Lat, &poster.Location.Lng)
+		if err != nil {
+			return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read posters from sql result: %v", err)
+		}
+		posters = append(posters, poster)
+		stops = append(stops, geoService.Point{Lat: poster.Location.Lat, Lng: poster.Location.Lng})
+	}
+	rows.Close()
+
+	res := &pb.RemovalRouteResponse{Code: pb.ResponseCode_OK}
+	waypoints := []geoService.Waypoint{{Point: start, Name: "start"}}
+	previous := start
+	full := false
+	for _, i := range geoService.Route(start, stops) {
+		leg := geoService.Distance(previous, stops[i])
+		// the route is cut off at the first poster that is too far so the rest of it stays in order for another crew
+		if full || (in.GetMaxDistance() > 0 && res.TotalDistance+leg > in.GetMaxDistance()) {
+			full = true
+			res.UnvisitedPosterIds = append(res.UnvisitedPosterIds, posters[i].Posterid)
+			continue
+		}
+		res.TotalDistance += leg
+		res.Stops = append(res.Stops, &pb.RouteStop{Poster: posters[i], LegDistance: leg, Distance: res.TotalDistance})
+		waypoints = append(waypoints, geoService.Waypoint{Point: stops[i], Name: fmt.Sprintf("poster %d", posters[i].Posterid)})
+		previous = stops[i]
+	}
+	estimate := time.Duration(res.TotalDistance/speed*float64(time.Second)) + time.Duration(len(res.Stops))*routeStopDuration
+	res.EstimatedSeconds = int64(estimate.Seconds())
+
+	gpx, err := geoService.GPX("removal route", waypoints)
+	if err != nil {
+		return &pb.RemovalRouteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create gpx: %v", err)
+	}
+	res.Gpx = string(gpx)
+	return res, nil
+}
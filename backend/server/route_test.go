@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestPlanRemovalRoute(t *testing.T) {
+	start := &pb.Location{Lat: 0, Lng: 0}
+	columns := []string{"posterID", "partyId", "userID", "latitude", "longitude"}
+	// posters along the equator about 1.1km apart
+	posterRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow(1, 1, 1, 0, 0.03).
+			AddRow(2, 1, 1, 0, 0.01).
+			AddRow(3, 1, 2, 0, 0.02)
+	}
+	tests := []struct {
+		name          string
+		userId        int32
+		partyId       int32
+		start         *pb.Location
+		posterIds     []int32
+		maxDistance   float64
+		returnRows    *sqlmock.Rows
+		wantArgs      []interface{}
+		wantErr       bool
+		wantCode      pb.ResponseCode
+		wantStops     []int32
+		wantUnvisited []int32
+	}{
+		{
+			name:       "userId not set",
+			partyId:    1,
+			start:      start,
+			returnRows: posterRows(),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "start not set",
+			userId:     1,
+			partyId:    1,
+			returnRows: posterRows(),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "too many posters",
+			userId:     1,
+			partyId:    1,
+			start:      start,
+			posterIds:  make([]int32, maxRouteStops+1),
+			returnRows: posterRows(),
+			wantErr:    true,
+			wantCode:   pb.ResponseCode_FAILED,
+		},
+		{
+			name:       "all outstanding posters",
+			userId:     1,
+			partyId:    1,
+			start:      start,
+			returnRows: posterRows(),
+			wantArgs:   []interface{}{int32(1), maxRouteStops + 1},
+			wantCode:   pb.ResponseCode_OK,
+			wantStops:  []int32{2, 3, 1},
+		},
+		{
+			name:       "subset of posters",
+			userId:     1,
+			partyId:    1,
+			start:      start,
+			posterIds:  []int32{1, 3},
+			returnRows: sqlmock.NewRows(columns).AddRow(1, 1, 1, 0, 0.03).AddRow(3, 1, 2, 0, 0.02),
+			wantArgs:   []interface{}{int32(1), int32(1), int32(3), maxRouteStops + 1},
+			wantCode:   pb.ResponseCode_OK,
+			wantStops:  []int32{3, 1},
+		},
+		{
+			name:          "route longer than max distance",
+			userId:        1,
+			partyId:       1,
+			start:         start,
+			maxDistance:   2500,
+			returnRows:    posterRows(),
+			wantArgs:      []interface{}{int32(1), maxRouteStops + 1},
+			wantCode:      pb.ResponseCode_OK,
+			wantStops:     []int32{2, 3},
+			wantUnvisited: []int32{1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			var args []driver.Value
+			for _, arg := range tc.wantArgs {
+				args = append(args, arg)
+			}
+			mock.ExpectQuery("select").WithArgs(args...).WillReturnRows(tc.returnRows)
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.partyId,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			res, err := server.PlanRemovalRoute(ctx, &pb.RemovalRouteRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey,
+				Start: tc.start, PosterIds: tc.posterIds, MaxDistance: tc.maxDistance})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			var stops []int32
+			for _, stop := range res.Stops {
+				stops = append(stops, stop.Poster.Posterid)
+			}
+			if !reflect.DeepEqual(stops, tc.wantStops) {
+				t.Fatalf("got stops %v want stops %v", stops, tc.wantStops)
+			}
+			if !reflect.DeepEqual(res.UnvisitedPosterIds, tc.wantUnvisited) {
+				t.Fatalf("got unvisited posters %v want %v", res.UnvisitedPosterIds, tc.wantUnvisited)
+			}
+			if tc.wantErr {
+				return
+			}
+			last := res.Stops[len(res.Stops)-1]
+			if res.TotalDistance != last.Distance {
+				t.Fatalf("got total distance %v want %v", res.TotalDistance, last.Distance)
+			}
+			// walking time plus two minutes for each poster
+			wantSeconds := int64(res.TotalDistance/defaultRouteSpeed) + int64(len(res.Stops))*120
+			if res.EstimatedSeconds < wantSeconds-1 || res.EstimatedSeconds > wantSeconds+1 {
+				t.Fatalf("got estimated time %ds want %ds", res.EstimatedSeconds, wantSeconds)
+			}
+			if strings.Count(res.Gpx, "<rtept") != len(res.Stops)+1 {
+				t.Fatalf("got gpx %s", res.Gpx)
+			}
+		})
+	}
+}
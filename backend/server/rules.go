@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/michaelc445/fyp/geoService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	// when jurisdictions overlap the smallest one is the most specific
+	jurisdictionAtLocationQuery = `select jurisdictionId, name, placementDaysBefore, removalDaysAfter, maxHeightCm, permitRequired
+									from fyp_schema.jurisdictions where ST_Contains(area, point(?,?))
+									order by ST_Area(area) limit 1`
+	insertJurisdictionQuery = `insert into fyp_schema.jurisdictions (name, area, placementDaysBefore, removalDaysAfter, maxHeightCm, permitRequired)
+								values (?,ST_GeomFromText(?),?,?,?,?)`
+	electionDatesQuery = "select unix_timestamp(startDate), unix_timestamp(endDate) from fyp_schema.elections where partyId = ? and closed is null"
+)
+
+// ruleSet is the poster law of a local authority. Rules that are not set do not apply.
+type ruleSet struct {
+	jurisdictionId int32
+	name           string
+	// posters can only be placed this many days before polling day
+	placementDaysBefore sql.NullInt32
+	// posters must be removed this many days after polling day
+	removalDaysAfter sql.NullInt32
+	maxHeightCm      sql.NullInt32
+	permitRequired   bool
+}
+
+// placement is the information about a poster that rules are checked against.
+type placement struct {
+	placed       time.Time
+	heightCm     int32
+	permitNumber string
+}
+
+func days(n int32) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// removalDeadline returns the time by which posters in the jurisdiction must be removed after an election.
+// ok is false if the jurisdiction has no removal rule.
+func (r *ruleSet) removalDeadline(pollingDay time.Time) (deadline time.Time, ok bool) {
+	if r == nil || !r.removalDaysAfter.Valid {
+		return time.Time{}, false
+	}
+	return pollingDay.Add(days(r.removalDaysAfter.Int32)), true
+}
+
+// check returns every rule a placement breaks. pollingDay is zero if the party has no election.
+func (r *ruleSet) check(p placement, pollingDay time.Time) []posterViolation {
+	if r == nil {
+		return nil
+	}
+	var violations []posterViolation
+	violation := func(format string, args ...interface{}) {
+		violations = append(violations, posterViolation{
+			source:   "jurisdiction",
+			sourceId: r.jurisdictionId,
+			detail:   r.name + ": " + fmt.Sprintf(format, args...),
+		})
+	}
+	if r.placementDaysBefore.Valid && !pollingDay.IsZero() {
+		earliest := pollingDay.Add(-days(r.placementDaysBefore.Int32))
+		if p.placed.Before(earliest) {
+			violation("posters can not be placed before %s", earliest.Format("2 Jan 2006"))
+		}
+	}
+	if r.maxHeightCm.Valid && p.heightCm > r.maxHeightCm.Int32 {
+		violation("posters can not be higher than %dcm", r.maxHeightCm.Int32)
+	}
+	if r.permitRequired && p.permitNumber == "" {
+		violation("a permit is required to place posters")
+	}
+	return violations
+}
+
+// jurisdictionAt returns the rules that apply at a location, or nil if the location is not in any jurisdiction.
+func (s *server) jurisdictionAt(location *pb.Location) (*ruleSet, error) {
+	rows, err := s.DB.Query(jurisdictionAtLocationQuery, location.GetLng(), location.GetLat())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	var rules ruleSet
+	err = rows.Scan(&rules.jurisdictionId, &rules.name, &rules.placementDaysBefore, &rules.removalDaysAfter, &rules.maxHeightCm, &rules.permitRequired)
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// electionDates returns the start date and polling day of a party's election. ok is false if the party has no election.
+func (s *server) electionDates(partyId int32) (startDate time.Time, pollingDay time.Time, ok bool, err error) {
+	rows, err := s.DB.Query(electionDatesQuery, partyId)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	var start, end int64
+	if err = rows.Scan(&start, &end); err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+	return time.Unix(start, 0), time.Unix(end, 0), true, nil
+}
+
+func nullInt32Property(properties map[string]interface{}, key string) (sql.NullInt32, error) {
+	value, ok := properties[key]
+	if !ok || value == nil {
+		return sql.NullInt32{}, nil
+	}
+	n, ok := value.(float64)
+	if !ok || n < 0 || n != float64(int32(n)) {
+		return sql.NullInt32{}, fmt.Errorf("%s must be a whole number", key)
+	}
+	return sql.NullInt32{Int32: int32(n), Valid: true}, nil
+}
+
+// importJurisdictions is used by site operators to load local authority boundaries and their poster rules.
+// Each feature can have placementDaysBefore, removalDaysAfter, maxHeightCm and permitRequired properties.
+func importJurisdictions(db *sql.DB, path string) (int, error) {
+	geojson, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	areas, err := geoService.ParseAreas(geojson)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	for _, area := range areas {
+		var rules ruleSet
+		for key, dest := range map[string]*sql.NullInt32{
+			"placementDaysBefore": &rules.placementDaysBefore,
+			"removalDaysAfter":    &rules.removalDaysAfter,
+			"maxHeightCm":         &rules.maxHeightCm,
+		} {
+			if *dest, err = nullInt32Property(area.Properties, key); err != nil {
+				_ = tx.Rollback()
+				return 0, fmt.Errorf("jurisdiction %s: %v", area.Name, err)
+			}
+		}
+		rules.permitRequired, _ = area.Properties["permitRequired"].(bool)
+		_, err = tx.Exec(insertJurisdictionQuery, area.Name, area.WKT(), rules.placementDaysBefore, rules.removalDaysAfter, rules.maxHeightCm, rules.permitRequired)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to add jurisdiction %s: %v", area.Name, err)
+		}
+	}
+	return len(areas), tx.Commit()
+}
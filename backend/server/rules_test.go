@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestRuleSetCheck(t *testing.T) {
+	pollingDay := time.Date(2026, 11, 27, 0, 0, 0, 0, time.UTC)
+	rules := &ruleSet{
+		jurisdictionId:      1,
+		name:                "dublin city",
+		placementDaysBefore: sql.NullInt32{Int32: 30, Valid: true},
+		removalDaysAfter:    sql.NullInt32{Int32: 7, Valid: true},
+		maxHeightCm:         sql.NullInt32{Int32: 230, Valid: true},
+		permitRequired:      true,
+	}
+	tests := []struct {
+		name           string
+		rules          *ruleSet
+		placement      placement
+		pollingDay     time.Time
+		wantViolations int
+	}{
+		{
+			name:       "no jurisdiction",
+			placement:  placement{placed: pollingDay.Add(-days(60))},
+			pollingDay: pollingDay,
+		},
+		{
+			name:       "follows rules",
+			rules:      rules,
+			placement:  placement{placed: pollingDay.Add(-days(10)), heightCm: 200, permitNumber: "DCC-1"},
+			pollingDay: pollingDay,
+		},
+		{
+			name:           "placed too early",
+			rules:          rules,
+			placement:      placement{placed: pollingDay.Add(-days(31)), heightCm: 200, permitNumber: "DCC-1"},
+			pollingDay:     pollingDay,
+			wantViolations: 1,
+		},
+		{
+			name:      "no election",
+			rules:     rules,
+			placement: placement{placed: pollingDay.Add(-days(31)), heightCm: 200, permitNumber: "DCC-1"},
+		},
+		{
+			name:           "too high without permit",
+			rules:          rules,
+			placement:      placement{placed: pollingDay.Add(-days(10)), heightCm: 300},
+			pollingDay:     pollingDay,
+			wantViolations: 2,
+		},
+		{
+			name:       "rules not set",
+			rules:      &ruleSet{jurisdictionId: 2, name: "cork"},
+			placement:  placement{placed: pollingDay.Add(-days(60)), heightCm: 300},
+			pollingDay: pollingDay,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			violations := tc.rules.check(tc.placement, tc.pollingDay)
+			if len(violations) != tc.wantViolations {
+				t.Fatalf("got violations %v want %d violations", violations, tc.wantViolations)
+			}
+		})
+	}
+}
+
+func TestRuleSetRemovalDeadline(t *testing.T) {
+	pollingDay := time.Date(2026, 11, 27, 0, 0, 0, 0, time.UTC)
+	var noJurisdiction *ruleSet
+	if _, ok := noJurisdiction.removalDeadline(pollingDay); ok {
+		t.Fatalf("expected no deadline without a jurisdiction")
+	}
+	if _, ok := (&ruleSet{name: "cork"}).removalDeadline(pollingDay); ok {
+		t.Fatalf("expected no deadline without a removal rule")
+	}
+	deadline, ok := (&ruleSet{removalDaysAfter: sql.NullInt32{Int32: 7, Valid: true}}).removalDeadline(pollingDay)
+	if !ok || !deadline.Equal(time.Date(2026, 12, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("got deadline %v want 2026-12-04", deadline)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	// a poster placed this close to a site the volunteer claimed counts towards the site
+	plannedSiteLinkDistance = 25
+	insertPlannedSiteQuery  = "insert into fyp_schema.plannedSites (partyId, location, quantity, candidate, createdBy) values (?,point(?,?),?,?,?)"
+	claimSiteQuery          = "update fyp_schema.plannedSites set claimedBy = ?, claimed = now() where siteId = ? and partyId = ? and claimedBy is null"
+	releaseSiteQuery        = "update fyp_schema.plannedSites set claimedBy = null, claimed = null where siteId = ? and partyId = ? and claimedBy = ?"
+	// sites that still need posters are preferred over the closest site
+	claimedSiteNearQuery = `select siteId, ST_Distance_Sphere(location, point(?,?)) as distance
+							from fyp_schema.plannedSites as l1
+							where partyId = ? and claimedBy = ?
+							having distance <= ?
+							order by (select count(*) from fyp_schema.posters where plannedSiteId = l1.siteId) >= l1.quantity, distance
+							limit 1`
+	siteCoverageQuery = `select l1.siteId, st_y(l1.location), st_x(l1.location), l1.quantity, l1.candidate, l1.claimedBy, count(l2.posterID)
+							from fyp_schema.plannedSites as l1
+							left join fyp_schema.posters as l2 on l2.plannedSiteId = l1.siteId
+							where l1.partyId = ?
+							group by l1.siteId
+							order by l1.siteId`
+)
+
+// claimedSiteNear returns the planned site a poster placed by a user at a location counts towards.
+func (s *server) claimedSiteNear(partyId, userId int32, location *pb.Location) (sql.NullInt32, error) {
+	rows, err := s.DB.Query(claimedSiteNearQuery, location.GetLng(), location.GetLat(), partyId, userId, plannedSiteLinkDistance)
+	if err != nil {
+		return sql.NullInt32{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return sql.NullInt32{}, nil
+	}
+	var siteId int32
+	var distance float64
+	if err = rows.Scan(&siteId, &distance); err != nil {
+		return sql.NullInt32{}, err
+	}
+	return sql.NullInt32{Int32: siteId, Valid: true}, nil
+}
+
+// sitesFromGeoJSON reads planned sites from GeoJSON Point features with quantity and candidate properties.
+func sitesFromGeoJSON(geojson []byte) ([]*pb.PlannedSite, error) {
+	points, err := geoService.ParsePoints(geojson)
+	if err != nil {
+		return nil, err
+	}
+	var sites []*pb.PlannedSite
+	for i, point := range points {
+		quantity, err := nullInt32Property(point.Properties, "quantity")
+		if err != nil {
+			return nil, fmt.Errorf("feature %d: %v", i, err)
+		}
+		candidate, _ := point.Properties["candidate"].(string)
+		sites = append(sites, &pb.PlannedSite{
+			Location:  &pb.Location{Lat: point.Lat, Lng: point.Lng},
+			Quantity:  quantity.Int32,
+			Candidate: candidate,
+		})
+	}
+	return sites, nil
+}
+
+// CreatePlannedSites allows a party admin to plan where posters should be put up.
+func (s *server) CreatePlannedSites(ctx context.Context, in *pb.CreateSitesRequest) (*pb.CreateSitesResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	sites := in.GetSites()
+	if in.GetGeojson() != "" {
+		imported, err := sitesFromGeoJSON([]byte(in.GetGeojson()))
+		if err != nil {
+			return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, err
+		}
+		sites = append(sites, imported...)
+	}
+	if len(sites) == 0 {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("sites or geojson must be set")
+	}
+	for i, site := range sites {
+		if site.GetLocation() == nil {
+			return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("site %d location not set", i)
+		}
+		if !(geoService.Point{Lat: site.GetLocation().GetLat(), Lng: site.GetLocation().GetLng()}).Valid() {
+			return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("site %d location is not a valid coordinate", i)
+		}
+		if site.GetQuantity() < 0 {
+			return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("site %d quantity can not be negative", i)
+		}
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can plan sites")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	var siteIds []int32
+	for _, site := range sites {
+		quantity := site.GetQuantity()
+		if quantity == 0 {
+			quantity = 1
+		}
+		res, err := tx.Exec(insertPlannedSiteQuery, in.GetPartyId(), site.GetLocation().GetLng(), site.GetLocation().GetLat(), quantity, site.GetCandidate(), in.GetUserId())
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to add planned site: %v", err)
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			_ = tx.Rollback()
+			return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to get siteId from query: %v", err)
+		}
+		siteIds = append(siteIds, int32(id))
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_SITES_PLANNED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   sitesAudit{SiteIds: siteIds},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record planned sites: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.CreateSitesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit planned sites: %v", err)
+	}
+	return &pb.CreateSitesResponse{Code: pb.ResponseCode_OK, SiteIds: siteIds}, nil
+}
+
+// ClaimPlannedSite lets a volunteer say they will put up the posters at a site, or give the site up again.
+func (s *server) ClaimPlannedSite(ctx context.Context, in *pb.ClaimSiteRequest) (*pb.ClaimSiteResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetSiteId() == 0 {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("siteId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	var res sql.Result
+	var err error
+	if in.GetRelease() {
+		res, err = s.DB.Exec(releaseSiteQuery, in.GetSiteId(), in.GetPartyId(), in.GetUserId())
+	} else {
+		res, err = s.DB.Exec(claimSiteQuery, in.GetUserId(), in.GetSiteId(), in.GetPartyId())
+	}
+	if err != nil {
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to update planned site: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if in.GetRelease() {
+			return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("site does not exist or is not claimed by user")
+		}
+		return &pb.ClaimSiteResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("site does not exist or is already claimed")
+	}
+	return &pb.ClaimSiteResponse{Code: pb.ResponseCode_OK}, nil
+}
+
+// PlacementCoverage compares the posters a party planned to put up with the posters placed at each site.
+func (s *server) PlacementCoverage(ctx context.Context, in *pb.CoverageRequest) (*pb.CoverageResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	rows, err := s.DB.Query(siteCoverageQuery, in.GetPartyId())
+	if err != nil {
+		return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query planned sites: %v", err)
+	}
+	defer rows.Close()
+	res := &pb.CoverageResponse{Code: pb.ResponseCode_OK}
+	candidates := make(map[string]*pb.CandidateCoverage)
+	for rows.Next() {
+		site := &pb.PlannedSite{Location: &pb.Location{}}
+		var claimedBy sql.NullInt32
+		var placed int32
+		err = rows.Scan(&site.SiteId, &site.Location.Lat, &site.Location.Lng, &site.Quantity, &site.Candidate, &claimedBy, &placed)
+		if err != nil {
+			return &pb.CoverageResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read planned sites from sql result: %v", err)
+		}
+		site.ClaimedBy = claimedBy.Int32
+		res.Sites = append(res.Sites, &pb.SiteCoverage{Site: site, Placed: placed})
+		res.Planned += site.Quantity
+		res.Placed += placed
+
+		candidate, ok := candidates[site.Candidate]
+		if !ok {
+			candidate = &pb.CandidateCoverage{Candidate: site.Candidate}
+			candidates[site.Candidate] = candidate
+			res.Candidates = append(res.Candidates, candidate)
+		}
+		candidate.Planned += site.Quantity
+		candidate.Placed += placed
+	}
+	sort.Slice(res.Candidates, func(i, j int) bool {
+		return res.Candidates[i].Candidate < res.Candidates[j].Candidate
+	})
+	return res, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestCreatePlannedSites(t *testing.T) {
+	tests := []struct {
+		name        string
+		userId      int32
+		partyId     int32
+		sites       []*pb.PlannedSite
+		geojson     string
+		adminRows   *sqlmock.Rows
+		wantInserts [][]interface{}
+		wantErr     bool
+		wantCode    pb.ResponseCode
+		wantSiteIds []int32
+	}{
+		{
+			name:      "nothing to create",
+			userId:    1,
+			partyId:   1,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "location not set",
+			userId:    1,
+			partyId:   1,
+			sites:     []*pb.PlannedSite{{Quantity: 2}},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "invalid geojson",
+			userId:    1,
+			partyId:   1,
+			geojson:   `{"type":"Feature","properties":{"quantity":"two"},"geometry":{"type":"Point","coordinates":[-6.25,53.3]}}`,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "user is not admin of party",
+			userId:    1,
+			partyId:   1,
+			sites:     []*pb.PlannedSite{{Location: &pb.Location{Lat: 53.3, Lng: -6.25}, Quantity: 2}},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "sites and import",
+			userId:    1,
+			partyId:   1,
+			sites:     []*pb.PlannedSite{{Location: &pb.Location{Lat: 53.3, Lng: -6.25}, Quantity: 2, Candidate: "smith"}},
+			geojson:   `{"type":"Feature","properties":{"candidate":"jones"},"geometry":{"type":"Point","coordinates":[-6.24,53.31]}}`,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantInserts: [][]interface{}{
+				{int32(1), -6.25, 53.3, int32(2), "smith", int32(1)},
+				{int32(1), -6.24, 53.31, int32(1), "jones", int32(1)},
+			},
+			wantCode:    pb.ResponseCode_OK,
+			wantSiteIds: []int32{1, 2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			mock.ExpectBegin()
+			for i, args := range tc.wantInserts {
+				var values []driver.Value
+				for _, arg := range args {
+					values = append(values, arg)
+				}
+				mock.ExpectExec("insert into fyp_schema.plannedSites").WithArgs(values...).WillReturnResult(sqlmock.NewResult(int64(i+1), 1))
+			}
+			if tc.wantInserts != nil {
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_SITES_PLANNED), tc.partyId, tc.userId, int32(0), "", nil, `{"siteIds":[1,2]}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			mock.ExpectCommit()
+
+			res, err := server.CreatePlannedSites(ctx, &pb.CreateSitesRequest{UserId: tc.userId, PartyId: tc.partyId,
+				AuthKey: testAuthKey(t, tc.userId, tc.partyId), Sites: tc.sites, Geojson: tc.geojson})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if !reflect.DeepEqual(res.SiteIds, tc.wantSiteIds) {
+				t.Fatalf("got sites %v want sites %v", res.SiteIds, tc.wantSiteIds)
+			}
+			if tc.wantInserts != nil {
+				if err = mock.ExpectationsWereMet(); err != nil {
+					t.Fatalf("unfulfilled expectations: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimPlannedSite(t *testing.T) {
+	tests := []struct {
+		name         string
+		userId       int32
+		partyId      int32
+		siteId       int32
+		release      bool
+		rowsAffected int64
+		wantErr      bool
+		wantCode     pb.ResponseCode
+	}{
+		{
+			name:     "siteId not set",
+			userId:   2,
+			partyId:  1,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "already claimed",
+			userId:   2,
+			partyId:  1,
+			siteId:   4,
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "claim",
+			userId:       2,
+			partyId:      1,
+			siteId:       4,
+			rowsAffected: 1,
+			wantCode:     pb.ResponseCode_OK,
+		},
+		{
+			name:         "release",
+			userId:       2,
+			partyId:      1,
+			siteId:       4,
+			release:      true,
+			rowsAffected: 1,
+			wantCode:     pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			if tc.release {
+				mock.ExpectExec("update fyp_schema.plannedSites set claimedBy = null").WithArgs(tc.siteId, tc.partyId, tc.userId).
+					WillReturnResult(sqlmock.NewResult(0, tc.rowsAffected))
+			} else {
+				mock.ExpectExec("update fyp_schema.plannedSites set claimedBy = \\?").WithArgs(tc.userId, tc.siteId, tc.partyId).
+					WillReturnResult(sqlmock.NewResult(0, tc.rowsAffected))
+			}
+
+			res, err := server.ClaimPlannedSite(ctx, &pb.ClaimSiteRequest{UserId: tc.userId, PartyId: tc.partyId,
+				AuthKey: testAuthKey(t, tc.userId, tc.partyId), SiteId: tc.siteId, Release: tc.release})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestPlacementCoverage(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	mock.ExpectQuery("select").WithArgs(int32(1)).WillReturnRows(
+		sqlmock.NewRows([]string{"siteId", "latitude", "longitude", "quantity", "candidate", "claimedBy", "placed"}).
+			AddRow(1, 53.3, -6.25, 2, "smith", 2, 2).
+			AddRow(2, 53.31, -6.24, 3, "jones", nil, 0).
+			AddRow(3, 53.32, -6.23, 1, "smith", 3, 1))
+
+	res, err := server.PlacementCoverage(ctx, &pb.CoverageRequest{UserId: 1, PartyId: 1, AuthKey: testAuthKey(t, 1, 1)})
+	if err != nil {
+		t.Fatalf("failed to get coverage: %v", err)
+	}
+	if res.Planned != 6 || res.Placed != 3 || len(res.Sites) != 3 {
+		t.Fatalf("got coverage %v", res)
+	}
+	if res.Sites[1].Site.ClaimedBy != 0 || res.Sites[0].Site.ClaimedBy != 2 {
+		t.Fatalf("got sites %v", res.Sites)
+	}
+	want := []*pb.CandidateCoverage{{Candidate: "jones", Planned: 3}, {Candidate: "smith", Planned: 3, Placed: 3}}
+	for i, candidate := range res.Candidates {
+		if candidate.Candidate != want[i].Candidate || candidate.Planned != want[i].Planned || candidate.Placed != want[i].Placed {
+			t.Fatalf("got candidates %v want %v", res.Candidates, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+)
+
+var (
+	maxTilePosters = 10000
+	// the election end date is part of the tile version because it decides which posters are overdue
+	tileVersionQuery = `select l1.changeSeq, coalesce(unix_timestamp(l2.endDate), 0)
+						from fyp_schema.parties as l1
+						left join fyp_schema.elections as l2 on l1.partyID = l2.partyId and l2.closed is null
+						where l1.partyID = ?`
+	tilePostersQuery = fmt.Sprintf(`select l1.posterID, st_y(l1.location), st_x(l1.location), l1.userID, l4.username, unix_timestamp(l1.created),
+						case when l1.removed is not null then 'removed' when %s then 'overdue' else 'up' end
+						from fyp_schema.posters as l1
+						join fyp_schema.users as l4 on l1.userID = l4.userID
+						left join fyp_schema.jurisdictions as l2 on l1.jurisdictionId = l2.jurisdictionId
+						left join fyp_schema.elections as l3 on l1.partyId = l3.partyId and l3.closed is null
+						where l1.partyId = ? and MBRContains(ST_MakeEnvelope(point(?,?), point(?,?)), l1.location)
+						order by l1.posterID
+						limit ?`, posterOverdueCondition)
+)
+
+// parseTilePath reads the party and tile from a /tiles/{partyId}/{z}/{x}/{y}.mvt path.
+func parseTilePath(path string) (partyId int32, z, x, y int, err error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/tiles/"), "/")
+	if len(parts) != 4 || !strings.HasSuffix(parts[3], ".mvt") {
+		return 0, 0, 0, 0, fmt.Errorf("tile paths look like /tiles/{partyId}/{z}/{x}/{y}.mvt")
+	}
+	parts[3] = strings.TrimSuffix(parts[3], ".mvt")
+	var numbers [4]int
+	for i, part := range parts {
+		if numbers[i], err = strconv.Atoi(part); err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("tile paths look like /tiles/{partyId}/{z}/{x}/{y}.mvt")
+		}
+	}
+	if numbers[0] <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("partyId must be set")
+	}
+	if numbers[1] > maxZoom {
+		return 0, 0, 0, 0, fmt.Errorf("zoom must be between 0 and %d", maxZoom)
+	}
+	if err = geoService.ValidTile(numbers[1], numbers[2], numbers[3]); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return int32(numbers[0]), numbers[1], numbers[2], numbers[3], nil
+}
+
+// tileETag is the version of a partys tiles. it changes whenever a poster is placed, moved or removed,
+// when the election changes and at midnight so poster ages and overdue posters stay current.
+func (s *server) tileETag(partyId int32, now time.Time) (string, error) {
+	rows, err := s.DB.Query(tileVersionQuery, partyId)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", sql.ErrNoRows
+	}
+	var changeSeq, endDate int64
+	if err = rows.Scan(&changeSeq, &endDate); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%d-%d-%s"`, changeSeq, endDate, now.UTC().Format("20060102")), nil
+}
+
+// serveTile serves Mapbox vector tiles of a partys posters. Requests are authenticated with the same
+// access token as PosterApp, sent as "Authorization: Bearer <authKey>".
+func (s *server) serveTile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	partyId, z, x, y, err := parseTilePath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	authKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if authKey == "" {
+		http.Error(w, "authKey not set", http.StatusUnauthorized)
+		return
+	}
+	userClaims := tokenService.ParseAccessToken(authKey)
+	if userClaims == nil || userClaims.Valid() != nil {
+		http.Error(w, "authKey is invalid. please login again", http.StatusUnauthorized)
+		return
+	}
+	if !verifyClaims(userClaims, userClaims.UserID, partyId) {
+		http.Error(w, "authkey does not match supplied data", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	etag, err := s.tileETag(partyId, now)
+	if err != nil {
+		log.Printf("failed to get tile version for party %d: %v", partyId, err)
+		http.Error(w, "failed to get tile version", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	// clients have to check the tile is current before using a cached copy
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	sw, ne := geoService.TileBounds(z, x, y)
+	rows, err := s.DB.Query(tilePostersQuery, partyId, sw.Lng, sw.Lat, ne.Lng, ne.Lat, maxTilePosters)
+	if err != nil {
+		log.Printf("failed to query posters for tile %d/%d/%d: %v", z, x, y, err)
+		http.Error(w, "failed to query posters", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var features []geoService.TileFeature
+	for rows.Next() {
+		var posterId, userId int32
+		var location geoService.Point
+		var username, status string
+		var created int64
+		if err = rows.Scan(&posterId, &location.Lat, &location.Lng, &userId, &username, &created, &status); err != nil {
+			log.Printf("failed to read posters for tile %d/%d/%d: %v", z, x, y, err)
+			http.Error(w, "failed to read posters", http.StatusInternalServerError)
+			return
+		}
+		features = append(features, geoService.TileFeature{
+			Id:    uint64(posterId),
+			Point: location,
+			Attributes: map[string]interface{}{
+				"status":   status,
+				"placedBy": userId,
+				"username": username,
+				"placed":   created,
+				"ageDays":  int64(now.Sub(time.Unix(created, 0)) / (24 * time.Hour)),
+			},
+		})
+	}
+	tile, err := geoService.MVT("posters", z, x, y, features)
+	if err != nil {
+		log.Printf("failed to encode tile %d/%d/%d: %v", z, x, y, err)
+		http.Error(w, "failed to encode tile", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Content-Length", strconv.Itoa(len(tile)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(tile)
+}
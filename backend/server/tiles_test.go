@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseTilePath(t *testing.T) {
+	tests := []struct {
+		path        string
+		wantPartyId int32
+		wantZ       int
+		wantX       int
+		wantY       int
+		wantErr     bool
+	}{
+		{path: "/tiles/1/12/2020/1352.mvt", wantPartyId: 1, wantZ: 12, wantX: 2020, wantY: 1352},
+		{path: "/tiles/1/12/2020/1352.png", wantErr: true},
+		{path: "/tiles/1/12/2020", wantErr: true},
+		{path: "/tiles/a/12/2020/1352.mvt", wantErr: true},
+		{path: "/tiles/1/1/2/0.mvt", wantErr: true},
+		// regulator tokens have no party
+		{path: "/tiles/0/12/2020/1352.mvt", wantErr: true},
+		{path: "/tiles/1/23/0/0.mvt", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		partyId, z, x, y, err := parseTilePath(tc.path)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s expected error: %v but got err: %v", tc.path, tc.wantErr, err)
+		}
+		if partyId != tc.wantPartyId || z != tc.wantZ || x != tc.wantX || y != tc.wantY {
+			t.Fatalf("%s got %d %d/%d/%d", tc.path, partyId, z, x, y)
+		}
+	}
+}
+
+func TestServeTile(t *testing.T) {
+	etag := `"12-1700000000-` + time.Now().UTC().Format("20060102") + `"`
+	posterColumns := []string{"posterID", "latitude", "longitude", "userID", "username", "created", "status"}
+	tests := []struct {
+		name        string
+		path        string
+		authKey     string
+		ifNoneMatch string
+		posterRows  *sqlmock.Rows
+		wantStatus  int
+	}{
+		{
+			name:       "invalid path",
+			path:       "/tiles/1/12/2020.mvt",
+			authKey:    testAuthKey(t, 1, 1),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "authKey not set",
+			path:       "/tiles/1/12/2020/1352.mvt",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "authKey invalid",
+			path:       "/tiles/1/12/2020/1352.mvt",
+			authKey:    "not a token",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "other partys tiles",
+			path:       "/tiles/2/12/2020/1352.mvt",
+			authKey:    testAuthKey(t, 1, 1),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:        "tile has not changed",
+			path:        "/tiles/1/12/2020/1352.mvt",
+			authKey:     testAuthKey(t, 1, 1),
+			ifNoneMatch: etag,
+			wantStatus:  http.StatusNotModified,
+		},
+		{
+			name:        "posters changed since tile was cached",
+			path:        "/tiles/1/12/2020/1352.mvt",
+			authKey:     testAuthKey(t, 1, 1),
+			ifNoneMatch: `"11-1700000000-` + time.Now().UTC().Format("20060102") + `"`,
+			posterRows:  sqlmock.NewRows(posterColumns).AddRow(1, 53.35, -6.26, 1, "michael1234", time.Now().Add(-50*time.Hour).Unix(), "up"),
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:       "success",
+			path:       "/tiles/1/12/2020/1352.mvt",
+			authKey:    testAuthKey(t, 1, 1),
+			posterRows: sqlmock.NewRows(posterColumns).AddRow(1, 53.35, -6.26, 1, "michael1234", time.Now().Add(-50*time.Hour).Unix(), "overdue"),
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select l1.changeSeq").WithArgs(int32(1)).WillReturnRows(sqlmock.NewRows([]string{"changeSeq", "endDate"}).AddRow(12, 1700000000))
+			if tc.posterRows != nil {
+				mock.ExpectQuery("select l1.posterID").WithArgs(int32(1), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), maxTilePosters).
+					WillReturnRows(tc.posterRows)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.authKey != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.authKey)
+			}
+			if tc.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			server.serveTile(rec, req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("got status %d want %d: %s", rec.Code, tc.wantStatus, rec.Body.String())
+			}
+			if tc.wantStatus == http.StatusOK {
+				if rec.Header().Get("ETag") != etag || rec.Header().Get("Content-Type") != "application/vnd.mapbox-vector-tile" || rec.Body.Len() == 0 {
+					t.Fatalf("got headers %v and %d bytes", rec.Header(), rec.Body.Len())
+				}
+			}
+		})
+	}
+}
@@ -11,6 +11,8 @@ type UserClaims struct {
 	UserID   int32  `json:"userid"`
 	Username string `json:"username"`
 	PartyId  int32  `json:"partyid"`
+	// only set for regulators, who have no user or party
+	RegulatorId int32 `json:"regulatorid,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// number of events buffered for each client before it is considered too slow and disconnected
+	watchBufferSize = 64
+)
+
+// posterHub fans out poster changes to every client watching a party.
+type posterHub struct {
+	mu          sync.Mutex
+	subscribers map[int32]map[*posterSubscriber]struct{}
+}
+
+type hubEvent struct {
+	position changeCursor
+	event    *pb.PosterEvent
+}
+
+type posterSubscriber struct {
+	// closed by the hub if the subscriber falls behind
+	events chan hubEvent
+}
+
+func newPosterHub() *posterHub {
+	return &posterHub{subscribers: make(map[int32]map[*posterSubscriber]struct{})}
+}
+
+// publish sends a committed poster change to everyone watching the posters party.
+// position is where the change is in the party's change feed.
+func (h *posterHub) publish(changeType pb.PosterChangeType, poster *pb.Poster, position changeCursor) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event := hubEvent{
+		position: position,
+		event:    &pb.PosterEvent{Type: changeType, Poster: poster, Cursor: position.String(), Occurred: timestamppb.Now()},
+	}
+	partyId := poster.GetParty()
+	for sub := range h.subscribers[partyId] {
+		select {
+		case sub.events <- event:
+		default:
+			// client is not keeping up, disconnect it and let it resume from its last cursor
+			close(sub.events)
+			delete(h.subscribers[partyId], sub)
+		}
+	}
+}
+
+// subscribe registers a new watcher for a party.
+func (h *posterHub) subscribe(partyId int32) *posterSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := &posterSubscriber{events: make(chan hubEvent, watchBufferSize)}
+	if h.subscribers[partyId] == nil {
+		h.subscribers[partyId] = make(map[*posterSubscriber]struct{})
+	}
+	h.subscribers[partyId][sub] = struct{}{}
+	return sub
+}
+
+func (h *posterHub) unsubscribe(partyId int32, sub *posterSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[partyId], sub)
+}
+
+// WatchPosters streams poster placements and removals made by members of the users party as they happen.
+// Clients reconnecting with the cursor of the last event they received are first sent the changes they missed.
+func (s *server) WatchPosters(in *pb.WatchPostersRequest, stream pb.PosterApp_WatchPostersServer) error {
+	if in.GetAuthKey() == "" {
+		return fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return fmt.Errorf("partyId not set")
+	}
+	// verify authkey
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return fmt.Errorf("authkey does not match supplied data")
+	}
+	if s.hub == nil {
+		return fmt.Errorf("live updates are not available")
+	}
+
+	// subscribe before looking up missed changes so nothing committed in between is lost
+	sub := s.hub.subscribe(in.GetPartyId())
+	defer s.hub.unsubscribe(in.GetPartyId(), sub)
+
+	var lastSent changeCursor
+	if in.GetCursor() != "" {
+		cursor, err := parseChangeCursor(in.GetCursor())
+		if err != nil {
+			return err
+		}
+		resync, err := s.needsResync(cursor, in.GetPartyId())
+		if err != nil {
+			return fmt.Errorf("failed to check cursor: %v", err)
+		}
+		if resync {
+			return fmt.Errorf("cursor is too old, call RetrieveUpdates to resync")
+		}
+		posters, positions, err := s.postersChangedSince(cursor, maxUpdatesPageSize+1)
+		if err != nil {
+			return err
+		}
+		if len(posters) > maxUpdatesPageSize {
+			return fmt.Errorf("too many changes missed, call RetrieveUpdates with the cursor to catch up")
+		}
+		lastSent = cursor
+		for i, poster := range posters {
+			changeType := pb.PosterChangeType_POSTER_PLACED
+			if poster.GetRemoved() {
+				changeType = pb.PosterChangeType_POSTER_REMOVED
+			}
+			if err := stream.Send(&pb.PosterEvent{Type: changeType, Poster: poster, Cursor: positions[i].String()}); err != nil {
+				return err
+			}
+			lastSent = positions[i]
+		}
+	}
+
+	// stop streaming once the authkey expires
+	var expired <-chan time.Time
+	if userClaims.ExpiresAt != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(userClaims.ExpiresAt, 0)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-expired:
+			return fmt.Errorf("authKey has expired. please login again")
+		case event, ok := <-sub.events:
+			if !ok {
+				return fmt.Errorf("client fell behind, reconnect using the cursor of the last event received")
+			}
+			// already sent while catching up or redelivered by the outbox
+			if !event.position.after(lastSent) {
+				continue
+			}
+			if err := stream.Send(event.event); err != nil {
+				return err
+			}
+			lastSent = event.position
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+	"google.golang.org/grpc"
+
+	pb "github.com/michaelc445/proto"
+)
+
+type fakeWatchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events []*pb.PosterEvent
+	// called after each event is sent
+	onSend func()
+}
+
+func (f *fakeWatchStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeWatchStream) Send(event *pb.PosterEvent) error {
+	f.events = append(f.events, event)
+	if f.onSend != nil {
+		f.onSend()
+	}
+	return nil
+}
+
+func TestPosterHub(t *testing.T) {
+	hub := newPosterHub()
+	sub := hub.subscribe(1)
+	hub.publish(pb.PosterChangeType_POSTER_PLACED, &pb.Poster{Party: 1, Posterid: 1}, changeCursor{partyId: 1, seq: 1, posterId: 1})
+	hub.publish(pb.PosterChangeType_POSTER_PLACED, &pb.Poster{Party: 2, Posterid: 2}, changeCursor{partyId: 2, seq: 1, posterId: 2})
+	hub.publish(pb.PosterChangeType_POSTER_REMOVED, &pb.Poster{Party: 1, Posterid: 1, Removed: true}, changeCursor{partyId: 1, seq: 2, posterId: 1})
+
+	first := <-sub.events
+	second := <-sub.events
+	if first.event.GetPoster().GetPosterid() != 1 || second.event.GetType() != pb.PosterChangeType_POSTER_REMOVED {
+		t.Fatalf("got events %v %v", first.event, second.event)
+	}
+	if second.event.GetCursor() != (changeCursor{partyId: 1, seq: 2, posterId: 1}).String() {
+		t.Fatalf("got cursor %v", second.event.GetCursor())
+	}
+	if len(sub.events) != 0 {
+		t.Fatalf("received event from another party")
+	}
+}
+
+func TestPosterHubSlowSubscriber(t *testing.T) {
+	hub := newPosterHub()
+	sub := hub.subscribe(1)
+	for i := 0; i <= watchBufferSize; i++ {
+		hub.publish(pb.PosterChangeType_POSTER_PLACED, &pb.Poster{Party: 1, Posterid: int32(i)}, changeCursor{partyId: 1, seq: int64(i + 1), posterId: int32(i)})
+	}
+	for range sub.events {
+	}
+	if _, ok := hub.subscribers[1][sub]; ok {
+		t.Fatalf("slow subscriber was not removed")
+	}
+}
+
+func TestWatchPosters(t *testing.T) {
+	columns := []string{"posterID", "partyId", "userID", "removed", "latitude", "longitude", "changeSeq"}
+	tests := []struct {
+		name       string
+		userId     int32
+		partyId    int32
+		claimParty int32
+		cursor     string
+		seqRows    *sqlmock.Rows
+		missedRows *sqlmock.Rows
+		redeliver  bool
+		wantErr    bool
+		wantEvents int
+	}{
+		{
+			name:       "userId not set",
+			partyId:    1,
+			claimParty: 1,
+			wantErr:    true,
+		},
+		{
+			name:       "partyId not set",
+			userId:     1,
+			claimParty: 1,
+			wantErr:    true,
+		},
+		{
+			name:       "party does not match authkey",
+			userId:     1,
+			partyId:    2,
+			claimParty: 1,
+			wantErr:    true,
+		},
+		{
+			name:       "cursor too old",
+			userId:     1,
+			partyId:    1,
+			claimParty: 1,
+			cursor:     changeCursor{partyId: 1, seq: 1, posterId: 1}.String(),
+			seqRows:    sqlmock.NewRows([]string{"changeSeq", "resyncSeq"}).AddRow(5, 3),
+			wantErr:    true,
+		},
+		{
+			name:       "success",
+			userId:     1,
+			partyId:    1,
+			claimParty: 1,
+			wantEvents: 2,
+		},
+		{
+			name:       "resume from cursor",
+			userId:     1,
+			partyId:    1,
+			claimParty: 1,
+			cursor:     changeCursor{partyId: 1, seq: 1, posterId: 1}.String(),
+			seqRows:    sqlmock.NewRows([]string{"changeSeq", "resyncSeq"}).AddRow(2, 0),
+			missedRows: sqlmock.NewRows(columns).AddRow(2, 1, 1, nil, 1, 1, 2),
+			// the missed poster and the live removal, the live placement of the missed poster is skipped
+			wantEvents: 2,
+		},
+		{
+			name:       "outbox redelivers events",
+			userId:     1,
+			partyId:    1,
+			claimParty: 1,
+			redeliver:  true,
+			// the placement is only sent once, the removal that follows its redelivery ends the stream
+			wantEvents: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			hub := newPosterHub()
+			server := &server{DB: db, hub: hub}
+			if tc.seqRows != nil {
+				mock.ExpectQuery("select changeSeq").WithArgs(tc.partyId).WillReturnRows(tc.seqRows)
+			}
+			if tc.missedRows != nil {
+				mock.ExpectQuery("select posterID").WillReturnRows(tc.missedRows)
+			}
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.claimParty,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			stream := &fakeWatchStream{ctx: ctx}
+			stream.onSend = func() {
+				if len(stream.events) == tc.wantEvents {
+					cancel()
+				}
+			}
+			published := make(chan struct{})
+			go func() {
+				defer close(published)
+				// wait for the stream to subscribe
+				for {
+					hub.mu.Lock()
+					n := len(hub.subscribers[1])
+					hub.mu.Unlock()
+					if n > 0 || ctx.Err() != nil {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				hub.publish(pb.PosterChangeType_POSTER_PLACED, &pb.Poster{Party: 1, Posterid: 2}, changeCursor{partyId: 1, seq: 2, posterId: 2})
+				if tc.redeliver {
+					hub.publish(pb.PosterChangeType_POSTER_PLACED, &pb.Poster{Party: 1, Posterid: 2}, changeCursor{partyId: 1, seq: 2, posterId: 2})
+				}
+				hub.publish(pb.PosterChangeType_POSTER_REMOVED, &pb.Poster{Party: 1, Posterid: 1, Removed: true}, changeCursor{partyId: 1, seq: 3, posterId: 1})
+			}()
+
+			err = server.WatchPosters(&pb.WatchPostersRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey, Cursor: tc.cursor}, stream)
+			// streams that fail never subscribe, so stop the publisher waiting for them
+			cancel()
+			<-published
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if len(stream.events) != tc.wantEvents {
+				t.Fatalf("got %d events want %d", len(stream.events), tc.wantEvents)
+			}
+			if tc.redeliver && !stream.events[1].GetPoster().GetRemoved() {
+				t.Fatalf("got events %v want the placement then the removal", stream.events)
+			}
+		})
+	}
+}
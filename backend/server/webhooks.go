@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	maxWebhooksPerParty = 10
+	maxWebhookURL       = 2048
+	// deliveries are retried with exponential backoff until they have been tried this many times
+	maxWebhookRetries   = 8
+	webhookBackoff      = 30 * time.Second
+	maxWebhookBackoff   = 6 * time.Hour
+	webhookPollInterval = time.Minute
+	webhookBatchSize    = 100
+	webhookTimeout      = 10 * time.Second
+	// webhooks whose deliveries are attempted at the same time
+	maxConcurrentWebhooks = 8
+	defaultDeliveries     = int32(50)
+	maxDeliveries         = int32(500)
+	// queues a delivery for every webhook of the party that wants the event
+	enqueueWebhookQuery = `insert into fyp_schema.webhookDeliveries (webhookId, partyId, event, payload, nextAttempt)
+							select l1.webhookId, l1.partyId, ?, ?, now() from fyp_schema.partyWebhooks as l1
+							join fyp_schema.partyWebhookEvents as l2 on l1.webhookId = l2.webhookId
+							where l1.partyId = ? and l2.event = ?`
+	dueWebhooksQuery = `select l1.deliveryId, l1.webhookId, l1.event, l1.payload, l1.retries, l2.url, l2.secret
+							from fyp_schema.webhookDeliveries as l1
+							join fyp_schema.partyWebhooks as l2 on l1.webhookId = l2.webhookId
+							where l1.nextAttempt <= from_unixtime(?) order by l1.nextAttempt limit ?`
+	logWebhookAttemptQuery   = "insert into fyp_schema.webhookAttempts (deliveryId, statusCode, error, durationMs) values (?,?,?,?)"
+	webhookDeliveredQuery    = "update fyp_schema.webhookDeliveries set delivered = from_unixtime(?), nextAttempt = null, retries = retries + 1, lastError = '' where deliveryId = ?"
+	webhookFailedQuery       = "update fyp_schema.webhookDeliveries set nextAttempt = from_unixtime(?), retries = retries + 1, lastError = ? where deliveryId = ?"
+	redeliverWebhookQuery    = "update fyp_schema.webhookDeliveries set nextAttempt = now(), retries = 0, delivered = null where deliveryId = ? and partyId = ?"
+	countPartyWebhooksQuery  = "select count(*) from fyp_schema.partyWebhooks where partyId = ?"
+	insertWebhookQuery       = "insert into fyp_schema.partyWebhooks (partyId, url, secret, createdBy) values (?,?,?,?)"
+	insertWebhookEventQuery  = "insert into fyp_schema.partyWebhookEvents (webhookId, event) values (?,?)"
+	partyWebhooksQuery       = "select webhookId, url, unix_timestamp(created) from fyp_schema.partyWebhooks where partyId = ? order by webhookId"
+	partyWebhookEventsQuery  = "select l1.webhookId, l1.event from fyp_schema.partyWebhookEvents as l1 join fyp_schema.partyWebhooks as l2 on l1.webhookId = l2.webhookId where l2.partyId = ? order by l1.event"
+	deleteWebhookQuery       = "delete from fyp_schema.partyWebhooks where webhookId = ? and partyId = ?"
+	deleteWebhookEventsQuery = "delete from fyp_schema.partyWebhookEvents where webhookId = ?"
+	webhookDeliveriesQuery   = `select deliveryId, webhookId, event, unix_timestamp(created), delivered is not null, retries, unix_timestamp(nextAttempt), lastError
+							from fyp_schema.webhookDeliveries where partyId = ?%s order by deliveryId desc limit ?`
+	webhookAttemptsQuery = `select l1.deliveryId, unix_timestamp(l1.attempted), l1.statusCode, l1.error, l1.durationMs
+							from fyp_schema.webhookAttempts as l1 join fyp_schema.webhookDeliveries as l2 on l1.deliveryId = l2.deliveryId
+							where l2.partyId = ? and l1.deliveryId >= ? order by l1.attemptId`
+)
+
+// webhookEventNames are the event names used in payloads and the X-Webhook-Event header.
+var webhookEventNames = map[pb.WebhookEvent]string{
+	pb.WebhookEvent_WEBHOOK_MEMBER_JOINED:  "member.joined",
+	pb.WebhookEvent_WEBHOOK_POSTER_PLACED:  "poster.placed",
+	pb.WebhookEvent_WEBHOOK_POSTER_REMOVED: "poster.removed",
+}
+
+// posterWebhookEvents are the webhook events sent for poster changes.
+var posterWebhookEvents = map[pb.PosterChangeType]pb.WebhookEvent{
+	pb.PosterChangeType_POSTER_PLACED:  pb.WebhookEvent_WEBHOOK_POSTER_PLACED,
+	pb.PosterChangeType_POSTER_REMOVED: pb.WebhookEvent_WEBHOOK_POSTER_REMOVED,
+}
+
+// webhookPayload is the JSON body sent to webhooks.
+type webhookPayload struct {
+	Event    string         `json:"event"`
+	PartyId  int32          `json:"partyId"`
+	Occurred time.Time      `json:"occurred"`
+	Member   *webhookMember `json:"member,omitempty"`
+	Poster   *webhookPoster `json:"poster,omitempty"`
+}
+
+type webhookMember struct {
+	UserId    int32  `json:"userId"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+type webhookPoster struct {
+	PosterId  int32    `json:"posterId"`
+	PlacedBy  int32    `json:"placedBy,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// posterWebhookPayload describes a poster change the same way it is sent to clients watching the party.
+func posterWebhookPayload(poster *pb.Poster) webhookPayload {
+	payload := webhookPayload{PartyId: poster.GetParty(), Poster: &webhookPoster{PosterId: poster.GetPosterid(), PlacedBy: poster.GetPlacedBy()}}
+	if poster.GetLocation() != nil {
+		lat, lng := poster.GetLocation().GetLat(), poster.GetLocation().GetLng()
+		payload.Poster.Latitude, payload.Poster.Longitude = &lat, &lng
+	}
+	return payload
+}
+
+// webhookSignature signs the timestamp and body so receivers can check the payload came from us and is not replayed.
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay is how long to wait before trying a delivery again after it has failed retries times.
+func webhookRetryDelay(retries int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < retries; i++ {
+		delay *= 2
+		if delay >= maxWebhookBackoff {
+			return maxWebhookBackoff
+		}
+	}
+	return delay
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookDispatcher delivers queued webhook events, retrying failed deliveries with exponential backoff.
+// Deliveries are stored before they are attempted so nothing is lost if the server restarts.
+type webhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	// wakes the dispatcher when new deliveries are queued
+	wake chan struct{}
+	now  func() time.Time
+}
+
+func newWebhookDispatcher(db *sql.DB, client *http.Client) *webhookDispatcher {
+	return &webhookDispatcher{db: db, client: client, wake: make(chan struct{}, 1), now: time.Now}
+}
+
+// enqueue queues the event for every webhook of the party that wants it.
+func (w *webhookDispatcher) enqueue(ctx context.Context, event pb.WebhookEvent, payload webhookPayload) error {
+	payload.Event = webhookEventNames[event]
+	if payload.Occurred.IsZero() {
+		payload.Occurred = time.Now().UTC()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	res, err := w.db.ExecContext(ctx, enqueueWebhookQuery, int32(event), string(body), payload.PartyId, int32(event))
+	if err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		w.poke()
+	}
+	return nil
+}
+
+func (w *webhookDispatcher) poke() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *webhookDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := w.deliverDue(ctx)
+			if err != nil {
+				log.Printf("failed to deliver webhooks: %v", err)
+			}
+			// keep going while there is a backlog
+			if err != nil || n < webhookBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+type webhookDelivery struct {
+	deliveryId int64
+	webhookId  int32
+	event      pb.WebhookEvent
+	payload    string
+	retries    int
+	url        string
+	secret     string
+}
+
+// deliverDue attempts every delivery that is due and returns how many were attempted. The deliveries of each webhook
+// are attempted in order, up to maxConcurrentWebhooks webhooks at a time, and stop at the first that fails so a slow
+// url only holds up its own deliveries.
+func (w *webhookDispatcher) deliverDue(ctx context.Context) (int, error) {
+	rows, err := w.db.QueryContext(ctx, dueWebhooksQuery, w.now().Unix(), webhookBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query due webhooks: %v", err)
+	}
+	var webhookIds []int32
+	byWebhook := make(map[int32][]webhookDelivery)
+	for rows.Next() {
+		var d webhookDelivery
+		var event int32
+		if err = rows.Scan(&d.deliveryId, &d.webhookId, &event, &d.payload, &d.retries, &d.url, &d.secret); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to read due webhooks: %v", err)
+		}
+		d.event = pb.WebhookEvent(event)
+		if _, ok := byWebhook[d.webhookId]; !ok {
+			webhookIds = append(webhookIds, d.webhookId)
+		}
+		byWebhook[d.webhookId] = append(byWebhook[d.webhookId], d)
+	}
+	_ = rows.Close()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		attempted int
+		firstErr  error
+	)
+	running := make(chan struct{}, maxConcurrentWebhooks)
+	for _, webhookId := range webhookIds {
+		deliveries := byWebhook[webhookId]
+		running <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-running }()
+			for _, d := range deliveries {
+				delivered, err := w.attempt(ctx, d)
+				mu.Lock()
+				attempted++
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				// the rest are tried again on the next poll
+				if err != nil || !delivered {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return attempted, firstErr
+}
+
+// attempt posts the delivery once, records the outcome and returns whether it was delivered.
+func (w *webhookDispatcher) attempt(ctx context.Context, d webhookDelivery) (bool, error) {
+	started := w.now()
+	status, sendErr := w.post(ctx, d, started)
+	finished := w.now()
+	duration := finished.Sub(started).Milliseconds()
+	errMsg := ""
+	if sendErr != nil {
+		errMsg = sendErr.Error()
+		if len(errMsg) > maxNotificationErrorLength {
+			errMsg = errMsg[:maxNotificationErrorLength]
+		}
+	}
+	if _, err := w.db.ExecContext(ctx, logWebhookAttemptQuery, d.deliveryId, status, errMsg, duration); err != nil {
+		return false, fmt.Errorf("failed to log webhook attempt: %v", err)
+	}
+	if sendErr == nil {
+		if _, err := w.db.ExecContext(ctx, webhookDeliveredQuery, finished.Unix(), d.deliveryId); err != nil {
+			return false, fmt.Errorf("failed to mark webhook delivered: %v", err)
+		}
+		return true, nil
+	}
+	// give up once retries run out, the delivery can still be redelivered by an admin
+	var next interface{}
+	if d.retries+1 < maxWebhookRetries {
+		next = finished.Add(webhookRetryDelay(d.retries + 1)).Unix()
+	}
+	if _, err := w.db.ExecContext(ctx, webhookFailedQuery, next, errMsg, d.deliveryId); err != nil {
+		return false, fmt.Errorf("failed to schedule webhook retry: %v", err)
+	}
+	return false, nil
+}
+
+// post sends the signed payload and returns the response status, 0 if there was no response.
+func (w *webhookDispatcher) post(ctx context.Context, d webhookDelivery, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	body := []byte(d.payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", webhookEventNames[d.event])
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.deliveryId, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-Webhook-Signature", webhookSignature(d.secret, now.Unix(), body))
+	client := w.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// checkWebhookAdmin checks the request was made by the admin of the party.
+func (s *server) checkWebhookAdmin(authKey string, userId, partyId int32) error {
+	if authKey == "" {
+		return fmt.Errorf("authKey not set")
+	}
+	if userId == 0 {
+		return fmt.Errorf("userId not set")
+	}
+	if partyId == 0 {
+		return fmt.Errorf("partyId not set")
+	}
+	userClaims := tokenService.ParseAccessToken(authKey)
+	if userClaims == nil || userClaims.Valid() != nil {
+		return fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, userId, partyId) {
+		return fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", partyId, userId)
+	if err != nil {
+		return fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		_ = rows.Close()
+		return fmt.Errorf("only party admin can manage webhooks")
+	}
+	_ = rows.Close()
+	return nil
+}
+
+// RegisterWebhook registers a url that is sent the chosen party events. The returned secret signs every payload.
+func (s *server) RegisterWebhook(ctx context.Context, in *pb.RegisterWebhookRequest) (*pb.RegisterWebhookResponse, error) {
+	if len(in.GetUrl()) > maxWebhookURL {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("webhook url is too long")
+	}
+	if len(in.GetEvents()) == 0 {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("events not set")
+	}
+	events := make(map[pb.WebhookEvent]bool)
+	for _, event := range in.GetEvents() {
+		if _, ok := webhookEventNames[event]; !ok {
+			return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("unknown webhook event %v", event)
+		}
+		events[event] = true
+	}
+	if err := s.checkWebhookAdmin(in.GetAuthKey(), in.GetUserId(), in.GetPartyId()); err != nil {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	// the host is only resolved for admins
+	if err := checkWebhookAddress(ctx, in.GetUrl()); err != nil {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to create webhook secret: %v", err)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	var count int
+	if err = tx.QueryRow(countPartyWebhooksQuery, in.GetPartyId()).Scan(&count); err != nil {
+		_ = tx.Rollback()
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to count webhooks: %v", err)
+	}
+	if count >= maxWebhooksPerParty {
+		_ = tx.Rollback()
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("a party can have at most %d webhooks", maxWebhooksPerParty)
+	}
+	res, err := tx.Exec(insertWebhookQuery, in.GetPartyId(), in.GetUrl(), secret, in.GetUserId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save webhook: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save webhook: %v", err)
+	}
+	for event := range events {
+		if _, err = tx.Exec(insertWebhookEventQuery, id, int32(event)); err != nil {
+			_ = tx.Rollback()
+			return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save webhook events: %v", err)
+		}
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_WEBHOOK_REGISTERED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   webhookAudit{WebhookId: int32(id), Url: in.GetUrl(), Events: in.GetEvents()},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record webhook: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to save webhook: %v", err)
+	}
+	return &pb.RegisterWebhookResponse{Code: pb.ResponseCode_OK, WebhookId: int32(id), Secret: secret}, nil
+}
+
+// ListWebhooks returns the webhooks registered for a party, without their secrets.
+func (s *server) ListWebhooks(ctx context.Context, in *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+	if err := s.checkWebhookAdmin(in.GetAuthKey(), in.GetUserId(), in.GetPartyId()); err != nil {
+		return &pb.ListWebhooksResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	rows, err := s.DB.Query(partyWebhooksQuery, in.GetPartyId())
+	if err != nil {
+		return &pb.ListWebhooksResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query webhooks: %v", err)
+	}
+	var webhooks []*pb.PartyWebhook
+	byId := make(map[int32]*pb.PartyWebhook)
+	for rows.Next() {
+		var webhook pb.PartyWebhook
+		var created int64
+		if err = rows.Scan(&webhook.WebhookId, &webhook.Url, &created); err != nil {
+			_ = rows.Close()
+			return &pb.ListWebhooksResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read webhooks: %v", err)
+		}
+		webhook.Created = timestamppb.New(time.Unix(created, 0))
+		webhooks = append(webhooks, &webhook)
+		byId[webhook.WebhookId] = &webhook
+	}
+	_ = rows.Close()
+	rows, err = s.DB.Query(partyWebhookEventsQuery, in.GetPartyId())
+	if err != nil {
+		return &pb.ListWebhooksResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query webhook events: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var webhookId, event int32
+		if err = rows.Scan(&webhookId, &event); err != nil {
+			return &pb.ListWebhooksResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read webhook events: %v", err)
+		}
+		if webhook, ok := byId[webhookId]; ok {
+			webhook.Events = append(webhook.Events, pb.WebhookEvent(event))
+		}
+	}
+	return &pb.ListWebhooksResponse{Code: pb.ResponseCode_OK, Webhooks: webhooks}, nil
+}
+
+// DeleteWebhook stops events being sent to a webhook. Its delivery log is kept.
+func (s *server) DeleteWebhook(ctx context.Context, in *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+	if in.GetWebhookId() == 0 {
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("webhookId not set")
+	}
+	if err := s.checkWebhookAdmin(in.GetAuthKey(), in.GetUserId(), in.GetPartyId()); err != nil {
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	res, err := tx.Exec(deleteWebhookQuery, in.GetWebhookId(), in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to delete webhook: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("webhook %d not found", in.GetWebhookId())
+	}
+	if _, err = tx.Exec(deleteWebhookEventsQuery, in.GetWebhookId()); err != nil {
+		_ = tx.Rollback()
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to delete webhook events: %v", err)
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_WEBHOOK_DELETED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		before:  webhookAudit{WebhookId: in.GetWebhookId()},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record deleting webhook: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to delete webhook: %v", err)
+	}
+	return &pb.DeleteWebhookResponse{Code: pb.ResponseCode_OK}, nil
+}
+
+// WebhookDeliveries returns a party's latest webhook deliveries with every attempt made to deliver them.
+func (s *server) WebhookDeliveries(ctx context.Context, in *pb.WebhookDeliveriesRequest) (*pb.WebhookDeliveriesResponse, error) {
+	if err := s.checkWebhookAdmin(in.GetAuthKey(), in.GetUserId(), in.GetPartyId()); err != nil {
+		return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	limit := in.GetLimit()
+	if limit <= 0 {
+		limit = defaultDeliveries
+	}
+	if limit > maxDeliveries {
+		limit = maxDeliveries
+	}
+	filters := ""
+	args := []interface{}{in.GetPartyId()}
+	if in.GetWebhookId() != 0 {
+		filters = " and webhookId = ?"
+		args = append(args, in.GetWebhookId())
+	}
+	args = append(args, limit)
+	rows, err := s.DB.Query(fmt.Sprintf(webhookDeliveriesQuery, filters), args...)
+	if err != nil {
+		return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query webhook deliveries: %v", err)
+	}
+	var deliveries []*pb.WebhookDelivery
+	byId := make(map[int64]*pb.WebhookDelivery)
+	for rows.Next() {
+		var delivery pb.WebhookDelivery
+		var event int32
+		var created int64
+		var next sql.NullInt64
+		err = rows.Scan(&delivery.DeliveryId, &delivery.WebhookId, &event, &created, &delivery.Delivered, &delivery.Retries, &next, &delivery.LastError)
+		if err != nil {
+			_ = rows.Close()
+			return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read webhook deliveries: %v", err)
+		}
+		delivery.Event = pb.WebhookEvent(event)
+		delivery.Created = timestamppb.New(time.Unix(created, 0))
+		if next.Valid {
+			delivery.NextAttempt = timestamppb.New(time.Unix(next.Int64, 0))
+		}
+		deliveries = append(deliveries, &delivery)
+		byId[delivery.DeliveryId] = &delivery
+	}
+	_ = rows.Close()
+	if len(deliveries) == 0 {
+		return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_OK}, nil
+	}
+	// deliveries are newest first, so the last one is the oldest
+	rows, err = s.DB.Query(webhookAttemptsQuery, in.GetPartyId(), deliveries[len(deliveries)-1].DeliveryId)
+	if err != nil {
+		return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query webhook attempts: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attempt pb.WebhookAttempt
+		var deliveryId, attempted int64
+		if err = rows.Scan(&deliveryId, &attempted, &attempt.StatusCode, &attempt.Error, &attempt.DurationMs); err != nil {
+			return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read webhook attempts: %v", err)
+		}
+		attempt.Attempted = timestamppb.New(time.Unix(attempted, 0))
+		if delivery, ok := byId[deliveryId]; ok {
+			delivery.Attempts = append(delivery.Attempts, &attempt)
+		}
+	}
+	return &pb.WebhookDeliveriesResponse{Code: pb.ResponseCode_OK, Deliveries: deliveries}, nil
+}
+
+// RedeliverWebhook queues a delivery to be sent again with a fresh set of retries.
+func (s *server) RedeliverWebhook(ctx context.Context, in *pb.RedeliverWebhookRequest) (*pb.RedeliverWebhookResponse, error) {
+	if in.GetDeliveryId() == 0 {
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("deliveryId not set")
+	}
+	if err := s.checkWebhookAdmin(in.GetAuthKey(), in.GetUserId(), in.GetPartyId()); err != nil {
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	res, err := tx.Exec(redeliverWebhookQuery, in.GetDeliveryId(), in.GetPartyId())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to queue delivery: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		_ = tx.Rollback()
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("delivery %d not found", in.GetDeliveryId())
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_WEBHOOK_REDELIVERED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   deliveryAudit{DeliveryId: in.GetDeliveryId()},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record redelivery: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to queue delivery: %v", err)
+	}
+	if s.webhooks != nil {
+		s.webhooks.poke()
+	}
+	return &pb.RedeliverWebhookResponse{Code: pb.ResponseCode_OK}, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"event":"poster.placed"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1718000000." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := webhookSignature("secret", 1718000000, body); got != want {
+		t.Fatalf("got signature %s want %s", got, want)
+	}
+	// a replayed payload with a new timestamp does not match
+	if webhookSignature("secret", 1718000001, body) == want {
+		t.Fatalf("signature does not cover the timestamp")
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{retries: 1, want: webhookBackoff},
+		{retries: 2, want: 2 * webhookBackoff},
+		{retries: 4, want: 8 * webhookBackoff},
+		{retries: 30, want: maxWebhookBackoff},
+	}
+	for _, tc := range tests {
+		if got := webhookRetryDelay(tc.retries); got != tc.want {
+			t.Fatalf("retry %d: got delay %v want %v", tc.retries, got, tc.want)
+		}
+	}
+}
+
+func TestWebhookEnqueue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	w := newWebhookDispatcher(db, nil)
+	occurred := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	payload := posterWebhookPayload(&pb.Poster{PlacedBy: 3, Party: 2, Posterid: 11, Location: &pb.Location{Lat: 53.3, Lng: -6.2}})
+	payload.Occurred = occurred
+	want := `{"event":"poster.placed","partyId":2,"occurred":"2024-06-10T12:00:00Z","poster":{"posterId":11,"placedBy":3,"latitude":53.3,"longitude":-6.2}}`
+	mock.ExpectExec("insert into fyp_schema.webhookDeliveries").
+		WithArgs(int32(pb.WebhookEvent_WEBHOOK_POSTER_PLACED), want, int32(2), int32(pb.WebhookEvent_WEBHOOK_POSTER_PLACED)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err = w.enqueue(context.Background(), pb.WebhookEvent_WEBHOOK_POSTER_PLACED, payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-w.wake:
+	default:
+		t.Fatalf("dispatcher was not woken for the new delivery")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
+
+// unixAfter matches unix times later than it.
+type unixAfter int64
+
+func (a unixAfter) Match(v driver.Value) bool {
+	n, ok := v.(int64)
+	return ok && n > int64(a)
+}
+
+func TestWebhookDeliverDue(t *testing.T) {
+	start := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	payload := `{"event":"member.joined","partyId":2}`
+	var mu sync.Mutex
+	var gotHeaders http.Header
+	var gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mu.Lock()
+		gotHeaders, gotBody = r.Header, string(body)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	// webhooks are attempted at the same time, so their queries can come in any order
+	mock.MatchExpectationsInOrder(false)
+	w := newWebhookDispatcher(db, ts.Client())
+	// every reading of the clock is a minute after the last, so each attempt is signed and recorded with its own time
+	var clockMu sync.Mutex
+	now := start
+	w.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	}
+	columns := []string{"deliveryId", "webhookId", "event", "payload", "retries", "url", "secret"}
+	mock.ExpectQuery("select l1.deliveryId, l1.webhookId, l1.event, l1.payload").WithArgs(start.Add(time.Minute).Unix(), webhookBatchSize).WillReturnRows(sqlmock.NewRows(columns).
+		AddRow(1, 1, 0, payload, 0, ts.URL+"/ok", "secret").
+		AddRow(2, 2, 0, payload, 2, ts.URL+"/fail", "secret").
+		AddRow(3, 3, 0, payload, maxWebhookRetries-1, ts.URL+"/fail", "secret").
+		// held back until the delivery before it to the same webhook succeeds
+		AddRow(4, 2, 0, payload, 0, ts.URL+"/fail", "secret"))
+	// delivered
+	mock.ExpectExec("insert into fyp_schema.webhookAttempts").WithArgs(1, 200, "", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("update fyp_schema.webhookDeliveries set delivered").WithArgs(unixAfter(start.Add(time.Minute).Unix()), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	// failed, retried with backoff
+	mock.ExpectExec("insert into fyp_schema.webhookAttempts").WithArgs(2, 503, "webhook returned 503 Service Unavailable", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("update fyp_schema.webhookDeliveries set nextAttempt").
+		WithArgs(unixAfter(start.Add(time.Minute+webhookRetryDelay(3)).Unix()), "webhook returned 503 Service Unavailable", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	// failed with no retries left
+	mock.ExpectExec("insert into fyp_schema.webhookAttempts").WithArgs(3, 503, "webhook returned 503 Service Unavailable", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("update fyp_schema.webhookDeliveries set nextAttempt").
+		WithArgs(nil, "webhook returned 503 Service Unavailable", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := w.deliverDue(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("attempted %d deliveries want 3", n)
+	}
+	if gotBody != payload || gotHeaders.Get("X-Webhook-Event") != "member.joined" || gotHeaders.Get("X-Webhook-Delivery") != "1" {
+		t.Fatalf("got body %s and headers %v", gotBody, gotHeaders)
+	}
+	signed, err := strconv.ParseInt(gotHeaders.Get("X-Webhook-Timestamp"), 10, 64)
+	if err != nil || signed <= start.Add(time.Minute).Unix() {
+		t.Fatalf("signed at %s, not when the attempt was made", gotHeaders.Get("X-Webhook-Timestamp"))
+	}
+	if gotHeaders.Get("X-Webhook-Signature") != webhookSignature("secret", signed, []byte(payload)) {
+		t.Fatalf("got signature %s", gotHeaders.Get("X-Webhook-Signature"))
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestRegisterWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		authKey   string
+		url       string
+		events    []pb.WebhookEvent
+		adminRows *sqlmock.Rows
+		count     int
+		wantSaved bool
+		wantErr   bool
+		wantCode  pb.ResponseCode
+	}{
+		{
+			name:      "not a url",
+			authKey:   testAuthKey(t, 1, 1),
+			url:       "crm.example.com",
+			events:    []pb.WebhookEvent{pb.WebhookEvent_WEBHOOK_POSTER_PLACED},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "url on the server's network",
+			authKey:   testAuthKey(t, 1, 1),
+			url:       "http://127.0.0.1:8080/hook",
+			events:    []pb.WebhookEvent{pb.WebhookEvent_WEBHOOK_POSTER_PLACED},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "no events",
+			authKey:  testAuthKey(t, 1, 1),
+			url:      "https://203.0.113.10/hook",
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "not admin",
+			authKey:   testAuthKey(t, 1, 1),
+			url:       "https://203.0.113.10/hook",
+			events:    []pb.WebhookEvent{pb.WebhookEvent_WEBHOOK_POSTER_PLACED},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "too many webhooks",
+			authKey:   testAuthKey(t, 1, 1),
+			url:       "https://203.0.113.10/hook",
+			events:    []pb.WebhookEvent{pb.WebhookEvent_WEBHOOK_POSTER_PLACED},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			count:     maxWebhooksPerParty,
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "success",
+			authKey:   testAuthKey(t, 1, 1),
+			url:       "https://203.0.113.10/hook",
+			events:    []pb.WebhookEvent{pb.WebhookEvent_WEBHOOK_MEMBER_JOINED},
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantSaved: true,
+			wantCode:  pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db}
+			if tc.adminRows != nil {
+				mock.ExpectQuery("select \\* from fyp_schema.parties").WithArgs(1, 1).WillReturnRows(tc.adminRows)
+			}
+			if tc.count > 0 || tc.wantSaved {
+				mock.ExpectBegin()
+				mock.ExpectQuery("select count").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tc.count))
+			}
+			if tc.count > 0 {
+				mock.ExpectRollback()
+			}
+			if tc.wantSaved {
+				mock.ExpectExec("insert into fyp_schema.partyWebhooks").WithArgs(1, tc.url, sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(4, 1))
+				mock.ExpectExec("insert into fyp_schema.partyWebhookEvents").WithArgs(4, int32(tc.events[0])).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_WEBHOOK_REGISTERED), int32(1), int32(1), int32(0), "", nil,
+						fmt.Sprintf(`{"webhookId":4,"url":%q,"events":[%d]}`, tc.url, tc.events[0])).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			}
+
+			res, err := server.RegisterWebhook(ctx, &pb.RegisterWebhookRequest{AuthKey: tc.authKey, UserId: 1, PartyId: 1, Url: tc.url, Events: tc.events})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if tc.wantSaved && (res.WebhookId != 4 || len(res.Secret) != 64) {
+				t.Fatalf("got response %v", res)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	mock.ExpectQuery("select \\* from fyp_schema.parties").WithArgs(1, 1).WillReturnRows(sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1))
+	mock.ExpectBegin()
+	mock.ExpectExec("delete from fyp_schema.partyWebhooks").WithArgs(int32(4), int32(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("delete from fyp_schema.partyWebhookEvents").WithArgs(int32(4)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("insert into fyp_schema.auditLog").
+		WithArgs(int32(pb.AuditAction_AUDIT_WEBHOOK_DELETED), int32(1), int32(1), int32(0), "", `{"webhookId":4}`, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	res, err := server.DeleteWebhook(context.Background(), &pb.DeleteWebhookRequest{AuthKey: testAuthKey(t, 1, 1), UserId: 1, PartyId: 1, WebhookId: 4})
+
+	if err != nil || res.GetCode() != pb.ResponseCode_OK {
+		t.Fatalf("got code %v err %v", res.GetCode(), err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	defer db.Close()
+	if err != nil {
+		t.Fatalf("an error occured while creating fake sql database %v", err)
+	}
+	server := &server{DB: db}
+	mock.ExpectQuery("select \\* from fyp_schema.parties").WithArgs(1, 1).WillReturnRows(sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1))
+	mock.ExpectQuery("select deliveryId, webhookId").WithArgs(int32(1), int32(4), defaultDeliveries).WillReturnRows(
+		sqlmock.NewRows([]string{"deliveryId", "webhookId", "event", "created", "delivered", "retries", "nextAttempt", "lastError"}).
+			AddRow(9, 4, 1, 1718000000, false, 2, 1718000600, "webhook returned 500 Internal Server Error").
+			AddRow(7, 4, 0, 1717000000, true, 1, nil, ""))
+	mock.ExpectQuery("select l1.deliveryId, unix_timestamp").WithArgs(int32(1), int64(7)).WillReturnRows(
+		sqlmock.NewRows([]string{"deliveryId", "attempted", "statusCode", "error", "durationMs"}).
+			AddRow(7, 1717000000, 200, "", 40).
+			AddRow(9, 1718000000, 500, "webhook returned 500 Internal Server Error", 35).
+			AddRow(9, 1718000030, 500, "webhook returned 500 Internal Server Error", 31))
+
+	res, err := server.WebhookDeliveries(context.Background(), &pb.WebhookDeliveriesRequest{AuthKey: testAuthKey(t, 1, 1), UserId: 1, PartyId: 1, WebhookId: 4})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Deliveries) != 2 || len(res.Deliveries[0].Attempts) != 2 || len(res.Deliveries[1].Attempts) != 1 {
+		t.Fatalf("got deliveries %v", res.Deliveries)
+	}
+	if res.Deliveries[0].NextAttempt == nil || res.Deliveries[1].NextAttempt != nil || !res.Deliveries[1].Delivered {
+		t.Fatalf("got deliveries %v", res.Deliveries)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestRedeliverWebhook(t *testing.T) {
+	tests := []struct {
+		name         string
+		deliveryId   int64
+		rowsAffected int64
+		wantErr      bool
+		wantCode     pb.ResponseCode
+	}{
+		{
+			name:     "deliveryId not set",
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "delivery of another party",
+			deliveryId:   9,
+			rowsAffected: 0,
+			wantErr:      true,
+			wantCode:     pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "success",
+			deliveryId:   9,
+			rowsAffected: 1,
+			wantCode:     pb.ResponseCode_OK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+			}
+			server := &server{DB: db, webhooks: newWebhookDispatcher(db, nil)}
+			if tc.deliveryId != 0 {
+				mock.ExpectQuery("select \\* from fyp_schema.parties").WithArgs(1, 1).WillReturnRows(sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1))
+				mock.ExpectBegin()
+				mock.ExpectExec("update fyp_schema.webhookDeliveries set nextAttempt = now").WithArgs(tc.deliveryId, 1).WillReturnResult(sqlmock.NewResult(0, tc.rowsAffected))
+			}
+			if tc.rowsAffected > 0 {
+				mock.ExpectExec("insert into fyp_schema.auditLog").
+					WithArgs(int32(pb.AuditAction_AUDIT_WEBHOOK_REDELIVERED), int32(1), int32(1), int32(0), "", nil, fmt.Sprintf(`{"deliveryId":%d}`, tc.deliveryId)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			} else if tc.deliveryId != 0 {
+				mock.ExpectRollback()
+			}
+
+			res, err := server.RedeliverWebhook(context.Background(), &pb.RedeliverWebhookRequest{AuthKey: testAuthKey(t, 1, 1), UserId: 1, PartyId: 1, DeliveryId: tc.deliveryId})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Fatalf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
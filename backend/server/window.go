@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pb "github.com/michaelc445/proto"
+)
+
+// electionWindow checks that a poster placed at the given time is inside the party's election window,
+// which runs from the start of the election to polling day. hasElection is false if the party has no election.
+func electionWindow(placed, startDate, pollingDay time.Time, hasElection bool) (pb.ResponseCode, error) {
+	if !hasElection {
+		return pb.ResponseCode_NO_ELECTION, fmt.Errorf("party admin must create an election before posters can be placed")
+	}
+	if placed.Before(startDate) {
+		return pb.ResponseCode_OUTSIDE_ELECTION_WINDOW, fmt.Errorf("posters can not be placed before the election starts on %s", startDate.Format("2 Jan 2006"))
+	}
+	if placed.After(pollingDay) {
+		return pb.ResponseCode_OUTSIDE_ELECTION_WINDOW, fmt.Errorf("posters can not be placed after polling day %s", pollingDay.Format("2 Jan 2006"))
+	}
+	return pb.ResponseCode_OK, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/michaelc445/fyp/geoService"
+	"github.com/michaelc445/fyp/tokenService"
+	pb "github.com/michaelc445/proto"
+)
+
+var (
+	zonesAtLocationQuery = `select zoneId, name, enforcement from fyp_schema.exclusionZones
+							where (partyId is null or partyId = ?) and ST_Contains(area, point(?,?))
+							order by enforcement, zoneId`
+	zonesInBoundsQuery = `select zoneId, name, enforcement, ST_AsGeoJSON(area), partyId is null from fyp_schema.exclusionZones
+							where (partyId is null or partyId = ?) and MBRIntersects(area, ST_MakeEnvelope(point(?,?), point(?,?)))`
+	insertZoneQuery      = "insert into fyp_schema.exclusionZones (partyId, name, enforcement, area, createdBy) values (?,?,?,ST_GeomFromText(?),?)"
+	recordViolationQuery = "insert into fyp_schema.posterViolations (posterId, source, sourceId, detail) values (?,?,?,?)"
+)
+
+type exclusionZone struct {
+	zoneId      int32
+	name        string
+	enforcement pb.ZoneEnforcement
+}
+
+// posterViolation is a problem with a placement that is recorded against the poster rather than stopping it being placed.
+type posterViolation struct {
+	source   string
+	sourceId int32
+	detail   string
+}
+
+// zonesAt returns the exclusion zones that apply to a party at a location.
+func (s *server) zonesAt(partyId int32, location *pb.Location) ([]exclusionZone, error) {
+	rows, err := s.DB.Query(zonesAtLocationQuery, partyId, location.GetLng(), location.GetLat())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var zones []exclusionZone
+	for rows.Next() {
+		var zone exclusionZone
+		if err = rows.Scan(&zone.zoneId, &zone.name, &zone.enforcement); err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+func recordViolations(tx *sql.Tx, posterId int64, violations []posterViolation) error {
+	for _, violation := range violations {
+		_, err := tx.Exec(recordViolationQuery, posterId, violation.source, violation.sourceId, violation.detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importZones adds every area in a GeoJSON file as an exclusion zone. Zones with no party apply to every party.
+func importZones(tx *sql.Tx, partyId sql.NullInt32, createdBy sql.NullInt32, geojson []byte, enforcement pb.ZoneEnforcement) (int, error) {
+	if _, ok := pb.ZoneEnforcement_name[int32(enforcement)]; !ok {
+		return 0, fmt.Errorf("unknown zone enforcement %v", enforcement)
+	}
+	areas, err := geoService.ParseAreas(geojson)
+	if err != nil {
+		return 0, err
+	}
+	for _, area := range areas {
+		_, err = tx.Exec(insertZoneQuery, partyId, area.Name, int32(enforcement), area.WKT(), createdBy)
+		if err != nil {
+			return 0, fmt.Errorf("failed to add zone %s: %v", area.Name, err)
+		}
+	}
+	return len(areas), nil
+}
+
+// importSiteZones is used by site operators to add exclusion zones that apply to every party.
+func importSiteZones(db *sql.DB, path string, enforcement pb.ZoneEnforcement) (int, error) {
+	geojson, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	n, err := importZones(tx, sql.NullInt32{}, sql.NullInt32{}, geojson, enforcement)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// ImportExclusionZones allows a party admin to add exclusion zones for their party from a GeoJSON file.
+func (s *server) ImportExclusionZones(ctx context.Context, in *pb.ImportZonesRequest) (*pb.ImportZonesResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetGeojson() == "" {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("geojson not set")
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey does not match supplied id's. Please login again")
+	}
+	// check the user is admin
+	rows, err := s.DB.Query("select * from fyp_schema.parties where partyID = ? and admin = ?", in.GetPartyId(), in.GetUserId())
+	if err != nil {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to check permissions: %v", err)
+	}
+	if !rows.Next() {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("only party admin can import exclusion zones")
+	}
+	_ = rows.Close()
+
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to start transaction %v", err)
+	}
+	n, err := importZones(tx,
+		sql.NullInt32{Int32: in.GetPartyId(), Valid: true},
+		sql.NullInt32{Int32: in.GetUserId(), Valid: true},
+		[]byte(in.GetGeojson()), in.GetEnforcement())
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	err = writeAudit(ctx, tx, auditEntry{
+		action:  pb.AuditAction_AUDIT_ZONES_IMPORTED,
+		partyId: in.GetPartyId(),
+		actorId: in.GetUserId(),
+		after:   zoneImportAudit{Enforcement: in.GetEnforcement(), Imported: int32(n)},
+	})
+	if err != nil {
+		_ = tx.Rollback()
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to record import: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return &pb.ImportZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to commit exclusion zones: %v", err)
+	}
+	return &pb.ImportZonesResponse{Code: pb.ResponseCode_OK, Imported: int32(n)}, nil
+}
+
+// ListExclusionZones returns the exclusion zones that apply to the users party inside a bounding box.
+func (s *server) ListExclusionZones(ctx context.Context, in *pb.ZonesRequest) (*pb.ZonesResponse, error) {
+	if in.GetAuthKey() == "" {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey not set")
+	}
+	if in.GetUserId() == 0 {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("userId not set")
+	}
+	if in.GetPartyId() == 0 {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("partyId not set")
+	}
+	if in.GetBounds() == nil {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("bounding box not set")
+	}
+	if err := validBoundingBox(in.GetBounds()); err != nil {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, err
+	}
+	userClaims := tokenService.ParseAccessToken(in.GetAuthKey())
+	if userClaims == nil || userClaims.Valid() != nil {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authKey is invalid. please login again")
+	}
+	if !verifyClaims(userClaims, in.GetUserId(), in.GetPartyId()) {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("authkey does not match supplied data")
+	}
+
+	sw, ne := in.GetBounds().GetSouthWest(), in.GetBounds().GetNorthEast()
+	rows, err := s.DB.Query(zonesInBoundsQuery, in.GetPartyId(), sw.GetLng(), sw.GetLat(), ne.GetLng(), ne.GetLat())
+	if err != nil {
+		return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to query exclusion zones: %v", err)
+	}
+	defer rows.Close()
+	var zones []*pb.ExclusionZone
+	for rows.Next() {
+		zone := pb.ExclusionZone{}
+		err = rows.Scan(&zone.ZoneId, &zone.Name, &zone.Enforcement, &zone.Geometry, &zone.SiteWide)
+		if err != nil {
+			return &pb.ZonesResponse{Code: pb.ResponseCode_FAILED}, fmt.Errorf("failed to read exclusion zones: %v", err)
+		}
+		zones = append(zones, &zone)
+	}
+	return &pb.ZonesResponse{Code: pb.ResponseCode_OK, Zones: zones}, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/michaelc445/fyp/tokenService"
+
+	pb "github.com/michaelc445/proto"
+)
+
+func TestImportExclusionZones(t *testing.T) {
+	geojson := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"name":"school"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}},
+		{"type":"Feature","properties":{"name":"church"},"geometry":{"type":"Polygon","coordinates":[[[2,2],[3,2],[3,3],[2,2]]]}}
+	]}`
+	tests := []struct {
+		name         string
+		userId       int32
+		partyId      int32
+		geojson      string
+		enforcement  pb.ZoneEnforcement
+		adminRows    *sqlmock.Rows
+		wantErr      bool
+		wantCode     pb.ResponseCode
+		wantImported int32
+	}{
+		{
+			name:      "userId not set",
+			partyId:   1,
+			geojson:   geojson,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "geojson not set",
+			userId:    1,
+			partyId:   1,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "user is not admin of party",
+			userId:    1,
+			partyId:   1,
+			geojson:   geojson,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:      "invalid geojson",
+			userId:    1,
+			partyId:   1,
+			geojson:   `{"type":"Feature","properties":{},"geometry":null}`,
+			adminRows: sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:   true,
+			wantCode:  pb.ResponseCode_FAILED,
+		},
+		{
+			name:        "unknown enforcement",
+			userId:      1,
+			partyId:     1,
+			geojson:     geojson,
+			enforcement: pb.ZoneEnforcement(7),
+			adminRows:   sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantErr:     true,
+			wantCode:    pb.ResponseCode_FAILED,
+		},
+		{
+			name:         "success",
+			userId:       1,
+			partyId:      1,
+			geojson:      geojson,
+			adminRows:    sqlmock.NewRows([]string{"partyId", "partyName", "admin"}).AddRow(1, "fake_party", 1),
+			wantCode:     pb.ResponseCode_OK,
+			wantImported: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, tc.userId).WillReturnRows(tc.adminRows)
+			mock.ExpectBegin()
+			mock.ExpectExec("insert").WithArgs(tc.partyId, "school", int32(tc.enforcement), "POLYGON((0 0, 1 0, 1 1, 0 0))", tc.userId).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("insert").WithArgs(tc.partyId, "church", int32(tc.enforcement), "POLYGON((2 2, 3 2, 3 3, 2 2))", tc.userId).WillReturnResult(sqlmock.NewResult(2, 1))
+			mock.ExpectExec("insert into fyp_schema.auditLog").
+				WithArgs(int32(pb.AuditAction_AUDIT_ZONES_IMPORTED), tc.partyId, tc.userId, int32(0), "", nil, fmt.Sprintf(`{"enforcement":%d,"imported":2}`, tc.enforcement)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.partyId,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			res, err := server.ImportExclusionZones(ctx, &pb.ImportZonesRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey, Geojson: tc.geojson,
+				Enforcement: tc.enforcement})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if res.Imported != tc.wantImported {
+				t.Fatalf("got %d zones imported want %d", res.Imported, tc.wantImported)
+			}
+		})
+	}
+}
+
+func TestListExclusionZones(t *testing.T) {
+	bounds := &pb.BoundingBox{SouthWest: &pb.Location{Lat: 0, Lng: 0}, NorthEast: &pb.Location{Lat: 1, Lng: 1}}
+	columns := []string{"zoneId", "name", "enforcement", "area", "siteWide"}
+	tests := []struct {
+		name      string
+		userId    int32
+		partyId   int32
+		bounds    *pb.BoundingBox
+		zoneRows  *sqlmock.Rows
+		wantErr   bool
+		wantCode  pb.ResponseCode
+		wantZones int
+	}{
+		{
+			name:     "partyId not set",
+			userId:   1,
+			bounds:   bounds,
+			zoneRows: sqlmock.NewRows(columns),
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:     "bounds not set",
+			userId:   1,
+			partyId:  1,
+			zoneRows: sqlmock.NewRows(columns),
+			wantErr:  true,
+			wantCode: pb.ResponseCode_FAILED,
+		},
+		{
+			name:    "success",
+			userId:  1,
+			partyId: 1,
+			bounds:  bounds,
+			zoneRows: sqlmock.NewRows(columns).
+				AddRow(1, "school", 0, `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`, false).
+				AddRow(2, "junction", 1, `{"type":"Polygon","coordinates":[[[0,0],[0.5,0],[0.5,0.5],[0,0]]]}`, true),
+			wantCode:  pb.ResponseCode_OK,
+			wantZones: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, mock, err := sqlmock.New()
+			defer db.Close()
+			if err != nil {
+				t.Fatalf("an error occured while creating fake sql database %v", err)
+
+			}
+			server := &server{DB: db}
+			mock.ExpectQuery("select").WithArgs(tc.partyId, 0.0, 0.0, 1.0, 1.0).WillReturnRows(tc.zoneRows)
+
+			userClaims := tokenService.UserClaims{
+				UserID:   tc.userId,
+				Username: "test",
+				PartyId:  tc.partyId,
+				StandardClaims: jwt.StandardClaims{
+					IssuedAt:  time.Now().Unix(),
+					ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+				},
+			}
+			authKey, err := tokenService.NewAccessToken(userClaims)
+			if err != nil {
+				t.Fatalf("failed to create jwt: %v", err)
+			}
+
+			res, err := server.ListExclusionZones(ctx, &pb.ZonesRequest{UserId: tc.userId, PartyId: tc.partyId, AuthKey: authKey, Bounds: tc.bounds})
+
+			if (!tc.wantErr && err != nil) || (tc.wantErr && err == nil) {
+				t.Fatalf("expected error: %v but got err: %v", tc.wantErr, err)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("got code %v want code %v", res.Code, tc.wantCode)
+			}
+			if len(res.Zones) != tc.wantZones {
+				t.Fatalf("got %d zones want %d", len(res.Zones), tc.wantZones)
+			}
+			if tc.wantZones > 0 && (res.Zones[1].Enforcement != pb.ZoneEnforcement_FLAG_PLACEMENT || !res.Zones[1].SiteWide) {
+				t.Fatalf("got zone %v", res.Zones[1])
+			}
+		})
+	}
+}